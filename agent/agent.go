@@ -4,12 +4,17 @@ import (
 	"context"
 	"crypto/tls"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 
 	v1 "github.com/erikmagkekse/btrfs-nfs-csi/agent/api/v1"
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/replication"
 	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
 	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/nfs"
 	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
 
 	"github.com/labstack/echo/v5"
 	"github.com/rs/zerolog/log"
@@ -42,6 +47,33 @@ func (a *Agent) Start(ctx context.Context) {
 	if a.cfg.NFSReconcileInterval > 0 {
 		features["nfs_reconcile"] = a.cfg.NFSReconcileInterval.String()
 	}
+	if a.cfg.SnapshotScheduleInterval > 0 {
+		features["snapshot_schedules"] = a.cfg.SnapshotScheduleInterval.String()
+	}
+	if a.cfg.ConsistencyInterval > 0 {
+		features["consistency_check"] = a.cfg.ConsistencyInterval.String()
+	}
+	if a.cfg.ReplicationInterval > 0 && a.cfg.ReplicationPeerURL != "" {
+		features["replication"] = a.cfg.ReplicationInterval.String()
+	}
+	if a.cfg.ScrubSchedule != "" {
+		if !utils.IsSchedulePeriod(a.cfg.ScrubSchedule) {
+			log.Fatal().Str("schedule", a.cfg.ScrubSchedule).Msg("invalid AGENT_SCRUB_SCHEDULE, must be one of: " + strings.Join(utils.SchedulePeriods, ", "))
+		}
+		features["scrub_schedule"] = a.cfg.ScrubSchedule
+	}
+	if a.cfg.AutoBalanceThreshold > 0 {
+		if a.cfg.AutoBalanceUsage < 0 || a.cfg.AutoBalanceUsage > 100 {
+			log.Fatal().Int("usage", a.cfg.AutoBalanceUsage).Msg("invalid AGENT_AUTO_BALANCE_USAGE, must be between 0 and 100")
+		}
+		features["auto_balance"] = strconv.FormatUint(a.cfg.AutoBalanceThreshold, 10)
+	}
+	if a.cfg.RecompressOnChange {
+		features["recompress_on_change"] = "enabled"
+	}
+	if a.cfg.CorruptionScanInterval > 0 {
+		features["corruption_scan"] = a.cfg.CorruptionScanInterval.String()
+	}
 
 	startMetricsServer(a.cfg.MetricsAddr)
 
@@ -52,50 +84,132 @@ func (a *Agent) Start(ctx context.Context) {
 		exp = nfs.NewKernelExporter(a.cfg.ExportfsBin, a.cfg.KernelExportOptions)
 	}
 
-	// parse tenants
-	tenants := parseTenants(a.cfg.Tenants)
-	tenantNames := make([]string, 0, len(tenants))
-	for _, name := range tenants {
-		tenantNames = append(tenantNames, name)
+	// AGENT_TENANTS and AGENT_TENANTS_FILE seed the tenant store
+	tenants := a.cfg.Tenants
+	if a.cfg.TenantsFile != "" {
+		data, err := os.ReadFile(a.cfg.TenantsFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", a.cfg.TenantsFile).Msg("failed to read AGENT_TENANTS_FILE")
+		}
+		tenants += "\n" + string(data)
 	}
 
 	// storage layer + handler
 	store := storage.New(
-		a.cfg.BasePath, a.cfg.QuotaEnabled, exp, tenantNames,
-		a.cfg.DefaultDirMode, a.cfg.DefaultDataMode, a.cfg.BtrfsBin,
+		a.cfg.BasePath, a.cfg.QuotaEnabled, a.cfg.QuotaMode, exp, seedTenants(tenants),
+		a.cfg.DefaultDirMode, a.cfg.DefaultDataMode, a.cfg.BtrfsBin, a.cfg.BtrfsBackend,
 	)
+	if len(store.Tenants()) == 0 && a.cfg.AdminToken == "" {
+		log.Fatal().Msg("no tenants configured, set AGENT_TENANTS or AGENT_ADMIN_TOKEN to create tenants through the admin API")
+	}
+	store.SetRecompressOnChange(a.cfg.RecompressOnChange)
+	store.SetDedupeRateLimit(a.cfg.DedupeRateLimit)
+	store.SetTrashRetention(a.cfg.TrashRetention)
 	h := &v1.Handler{Store: store}
+	if mode := store.QuotaMode(); mode != "" {
+		features["quota_mode"] = string(mode)
+	}
+	features["btrfs_backend"] = string(store.Backend())
 
 	// unauthenticated endpoints
 	e.GET("/healthz", v1.Healthz(a.version, a.commit, features, store))
 
-	// v1 API with auth
-	api := e.Group("/v1", v1.AuthMiddleware(tenants))
+	// v1 API with auth, every route requires a scope of the token
+	api := e.Group("/v1", v1.AuthMiddleware(store))
+	read := v1.RequireScope(storage.ScopeVolumesRead)
+	write := v1.RequireScope(storage.ScopeVolumesWrite)
+	snapWrite := v1.RequireScope(storage.ScopeSnapshotsWrite)
+	snapSend := v1.RequireScope(storage.ScopeSnapshotsSend)
+	exportWrite := v1.RequireScope(storage.ScopeExportsWrite)
+	tenantAdmin := v1.RequireScope(storage.ScopeTenantAdmin)
+
+	api.POST("/volumes", h.CreateVolume, write)
+	api.GET("/volumes", h.ListVolumes, read)
+	api.GET("/volumes/:name", h.GetVolume, read)
+	api.PATCH("/volumes/:name", h.UpdateVolume, write)
+	api.DELETE("/volumes/:name", h.DeleteVolume, write)
+	api.POST("/volumes/:name/receive", h.ReceiveVolume, write)
+	api.POST("/volumes/:name/rollback", h.RollbackVolume, write)
+	api.POST("/volumes/:name/defragment", h.StartDefragment, write)
+	api.GET("/volumes/:name/defragment", h.DefragmentStatus, read)
+	api.DELETE("/volumes/:name/defragment", h.CancelDefragment, write)
+	api.GET("/volumes/:name/corruption", h.GetVolumeCorruption, read)
+	api.DELETE("/volumes/:name/corruption", h.ClearVolumeCorruption, write)
 
-	api.POST("/volumes", h.CreateVolume)
-	api.GET("/volumes", h.ListVolumes)
-	api.GET("/volumes/:name", h.GetVolume)
-	api.PATCH("/volumes/:name", h.UpdateVolume)
-	api.DELETE("/volumes/:name", h.DeleteVolume)
+	api.GET("/volumes/:name/snapshots", h.ListVolumeSnapshots, read)
+	api.POST("/volumes/:name/export", h.ExportVolume, exportWrite)
+	api.DELETE("/volumes/:name/export", h.UnexportVolume, exportWrite)
+	api.GET("/exports", h.ListExports, read)
+	api.GET("/dashboard", v1.ServeDashboard(a.cfg.DashboardRefresh), read)
 
-	api.GET("/volumes/:name/snapshots", h.ListVolumeSnapshots)
-	api.POST("/volumes/:name/export", h.ExportVolume)
-	api.DELETE("/volumes/:name/export", h.UnexportVolume)
-	api.GET("/exports", h.ListExports)
-	api.GET("/dashboard", v1.ServeDashboard(a.cfg.DashboardRefresh))
+	api.GET("/stats", h.Stats, read)
+	api.GET("/consistency", h.CheckConsistency, read)
+	api.POST("/consistency", h.RepairConsistency, tenantAdmin)
+	api.POST("/dedupe", h.StartDedupe, tenantAdmin)
+	api.GET("/dedupe", h.DedupeStatus, read)
+	api.DELETE("/dedupe", h.CancelDedupe, tenantAdmin)
+	api.GET("/trash", h.ListTrash, read)
+	api.POST("/trash/:id/restore", h.RestoreTrash, write)
+	api.DELETE("/trash/:id", h.PurgeTrash, tenantAdmin)
+	api.POST("/snapshots", h.CreateSnapshot, snapWrite)
+	api.GET("/snapshots", h.ListSnapshots, read)
+	api.GET("/snapshots/:name", h.GetSnapshot, read)
+	api.GET("/snapshots/:name/send", h.SendSnapshot, snapSend)
+	api.DELETE("/snapshots/:name", h.DeleteSnapshot, snapWrite)
 
-	api.GET("/stats", h.Stats)
-	api.POST("/snapshots", h.CreateSnapshot)
-	api.GET("/snapshots", h.ListSnapshots)
-	api.GET("/snapshots/:name", h.GetSnapshot)
-	api.DELETE("/snapshots/:name", h.DeleteSnapshot)
+	api.POST("/clones", h.CreateClone, write)
 
-	api.POST("/clones", h.CreateClone)
+	// admin API, acts on the whole filesystem
+	if a.cfg.AdminToken != "" {
+		admin := e.Group("/v1", v1.AdminMiddleware(a.cfg.AdminToken))
+
+		admin.GET("/scrub", h.ScrubStatus)
+		admin.POST("/scrub", h.StartScrub)
+		admin.DELETE("/scrub", h.CancelScrub)
+		admin.GET("/balance", h.BalanceStatus)
+		admin.POST("/balance", h.StartBalance)
+		admin.DELETE("/balance", h.CancelBalance)
+		admin.GET("/admin/consistency", h.CheckFilesystemConsistency)
+		admin.POST("/admin/consistency", h.RepairFilesystemConsistency)
+
+		admin.GET("/admin/tenants", h.ListTenants)
+		admin.POST("/admin/tenants", h.CreateTenant)
+		admin.DELETE("/admin/tenants/:name", h.DeleteTenant)
+		admin.POST("/admin/tenants/:name/tokens", h.CreateTenantToken)
+		admin.DELETE("/admin/tenants/:name/tokens/:id", h.DeleteTenantToken)
+		admin.POST("/admin/tenants/:name/volumes/:volume/adopt", h.AdoptVolume)
+	} else {
+		log.Info().Msg("AGENT_ADMIN_TOKEN not set, admin API disabled")
+	}
 
 	a.echo = e
 	a.ready = true
 
-	store.StartWorkers(ctx, a.cfg.UsageInterval, a.cfg.NFSReconcileInterval, a.cfg.DeviceIOInterval, a.cfg.DeviceStatsInterval)
+	store.StartWorkers(ctx, storage.WorkerConfig{
+		UsageInterval:             a.cfg.UsageInterval,
+		ReconcileInterval:         a.cfg.NFSReconcileInterval,
+		DeviceIOInterval:          a.cfg.DeviceIOInterval,
+		DeviceStatsInterval:       a.cfg.DeviceStatsInterval,
+		ScheduleInterval:          a.cfg.SnapshotScheduleInterval,
+		ConsistencyInterval:       a.cfg.ConsistencyInterval,
+		CorruptionScanInterval:    a.cfg.CorruptionScanInterval,
+		ScrubSchedule:             a.cfg.ScrubSchedule,
+		AutoBalanceMinUnallocated: a.cfg.AutoBalanceThreshold,
+		AutoBalanceUsage:          a.cfg.AutoBalanceUsage,
+	})
+
+	// replication to the peer agent, one client per tenant with a peer token
+	if a.cfg.ReplicationInterval > 0 && a.cfg.ReplicationPeerURL != "" {
+		peers := make(map[string]replication.Peer)
+		for token, name := range parseTenants(a.cfg.ReplicationPeerTokens) {
+			peers[name] = v1.NewClient(a.cfg.ReplicationPeerURL, token)
+		}
+		if len(peers) == 0 {
+			log.Warn().Msg("AGENT_REPLICATION_PEER_URL is set but AGENT_REPLICATION_PEER_TOKENS is empty, replication disabled")
+		} else {
+			replication.New(store, peers).Start(ctx, a.cfg.ReplicationInterval)
+		}
+	}
 
 	go func() {
 		var err error
@@ -123,16 +237,36 @@ func (a *Agent) IsReady() bool {
 	return a.ready
 }
 
-// parseTenants parses "name:token,name:token" into map[token]name.
-// Returns nil if input is empty.
+// tenantEntries splits AGENT_TENANTS or the content of AGENT_TENANTS_FILE
+// into entries, separated by commas or newlines. Blank lines and lines
+// starting with # are skipped.
+func tenantEntries(s string) []string {
+	var entries []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// parseTenants parses "name:token,name:token" into map[token]name. The token
+// may be a hash from storage.HashToken. An optional third field is the tenant
+// limit, see parseTenantLimits. Returns nil if input is empty.
 func parseTenants(s string) map[string]string {
 	if s == "" {
 		return nil
 	}
 	m := make(map[string]string)
-	for _, entry := range strings.Split(s, ",") {
-		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
-		if len(parts) == 2 {
+	for _, entry := range tenantEntries(s) {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) >= 2 {
 			name := strings.TrimSpace(parts[0])
 			token := strings.TrimSpace(parts[1])
 			m[token] = name
@@ -143,3 +277,47 @@ func parseTenants(s string) map[string]string {
 	}
 	return m
 }
+
+// seedTenants builds the tenants of AGENT_TENANTS, sorted by name. They are
+// added to the tenant store on start unless it already knows them.
+func seedTenants(s string) []storage.Tenant {
+	limits := parseTenantLimits(s)
+	byName := make(map[string]*storage.Tenant)
+	for token, name := range parseTenants(s) {
+		tok, err := storage.NewTenantToken(token)
+		if err != nil {
+			log.Fatal().Err(err).Str("tenant", name).Msg("failed to hash tenant token")
+		}
+		t, ok := byName[name]
+		if !ok {
+			t = &storage.Tenant{Name: name, LimitBytes: limits[name], CreatedAt: tok.CreatedAt}
+			byName[name] = t
+		}
+		t.Tokens = append(t.Tokens, tok)
+	}
+	seed := make([]storage.Tenant, 0, len(byName))
+	for _, t := range byName {
+		seed = append(seed, *t)
+	}
+	slices.SortFunc(seed, func(a, b storage.Tenant) int { return strings.Compare(a.Name, b.Name) })
+	return seed
+}
+
+// parseTenantLimits parses the capacity limits in bytes of
+// "name:token:limit" entries into map[name]limit.
+func parseTenantLimits(s string) map[string]uint64 {
+	limits := make(map[string]uint64)
+	for _, entry := range tenantEntries(s) {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		limit, err := strconv.ParseUint(strings.TrimSpace(parts[2]), 10, 64)
+		if err != nil {
+			log.Fatal().Str("tenant", name).Msg("invalid tenant limit in AGENT_TENANTS, must be bytes")
+		}
+		limits[name] = limit
+	}
+	return limits
+}
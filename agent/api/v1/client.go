@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -14,6 +16,9 @@ type Client struct {
 	url   string
 	token string
 	http  *http.Client
+	// stream is used for send/receive, which run as long as the data takes
+	// to transfer and are bounded by the caller's context only.
+	stream *http.Client
 }
 
 func NewClient(url, token string) *Client {
@@ -23,6 +28,7 @@ func NewClient(url, token string) *Client {
 		http: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		stream: &http.Client{},
 	}
 }
 
@@ -49,6 +55,49 @@ func (c *Client) UpdateVolume(ctx context.Context, name string, req VolumeUpdate
 	return &resp, nil
 }
 
+// RollbackVolume replaces the data of volume name with the given snapshot.
+func (c *Client) RollbackVolume(ctx context.Context, name string, req VolumeRollbackRequest) (*VolumeRollbackResponse, error) {
+	var resp VolumeRollbackResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/volumes/"+name+"/rollback", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AdoptVolume turns the subvolume or directory at req.Path into volume name of tenant. Requires the admin token.
+func (c *Client) AdoptVolume(ctx context.Context, tenant, name string, req VolumeAdoptRequest) (*VolumeDetailResponse, error) {
+	var resp VolumeDetailResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/admin/tenants/"+tenant+"/volumes/"+name+"/adopt", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReceiveVolume uploads the btrfs send stream read from r into volume name.
+func (c *Client) ReceiveVolume(ctx context.Context, name string, req VolumeReceiveRequest, r io.Reader) (*VolumeDetailResponse, error) {
+	q := url.Values{}
+	q.Set("snapshot", req.Snapshot)
+	if req.SizeBytes > 0 {
+		q.Set("size_bytes", strconv.FormatUint(req.SizeBytes, 10))
+	}
+	if req.NoCOW {
+		q.Set("nocow", "true")
+	}
+	if req.Compression != "" {
+		q.Set("compression", req.Compression)
+	}
+
+	var buf bytes.Buffer
+	if err := c.doStream(ctx, http.MethodPost, "/v1/volumes/"+name+"/receive?"+q.Encode(), r, &buf); err != nil {
+		return nil, err
+	}
+	var resp VolumeDetailResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+	return &resp, nil
+}
+
 func (c *Client) CreateSnapshot(ctx context.Context, req SnapshotCreateRequest) (*SnapshotDetailResponse, error) {
 	var resp SnapshotDetailResponse
 	if err := c.do(ctx, http.MethodPost, "/v1/snapshots", req, &resp); err != nil {
@@ -61,6 +110,18 @@ func (c *Client) DeleteSnapshot(ctx context.Context, name string) error {
 	return c.do(ctx, http.MethodDelete, "/v1/snapshots/"+name, nil, nil)
 }
 
+// SendSnapshot writes a btrfs send stream of the snapshot to w.
+// If parent is set, an incremental stream relative to parent is requested.
+func (c *Client) SendSnapshot(ctx context.Context, name, parent string, w io.Writer) error {
+	path := "/v1/snapshots/" + name + "/send"
+	if parent != "" {
+		path += "?parent=" + url.QueryEscape(parent)
+	}
+	return c.doStream(ctx, http.MethodGet, path, nil, w)
+}
+
+// CreateClone creates a volume from a snapshot or volume. The returned
+// CloneResponse is the VolumeDetailResponse of the new volume.
 func (c *Client) CreateClone(ctx context.Context, req CloneCreateRequest) (*CloneResponse, error) {
 	var resp CloneResponse
 	if err := c.do(ctx, http.MethodPost, "/v1/clones", req, &resp); err != nil {
@@ -76,6 +137,48 @@ func (c *Client) ExportVolume(ctx context.Context, name string, cl string) error
 	return c.do(ctx, http.MethodPost, "/v1/volumes/"+name+"/export", ExportRequest{Client: cl}, nil)
 }
 
+// StartDefragment rewrites the data of volume name with the given or the
+// volume's compression in the background.
+func (c *Client) StartDefragment(ctx context.Context, name string, req DefragmentRequest) (*DefragmentJobResponse, error) {
+	var resp DefragmentJobResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/volumes/"+name+"/defragment", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DefragmentStatus returns the current or last defragment of volume name.
+func (c *Client) DefragmentStatus(ctx context.Context, name string) (*DefragmentJobResponse, error) {
+	var resp DefragmentJobResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/volumes/"+name+"/defragment", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelDefragment stops the running defragment of volume name.
+func (c *Client) CancelDefragment(ctx context.Context, name string) (*DefragmentJobResponse, error) {
+	var resp DefragmentJobResponse
+	if err := c.do(ctx, http.MethodDelete, "/v1/volumes/"+name+"/defragment", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetVolumeCorruption lists the files of volume name and its snapshots with checksum errors.
+func (c *Client) GetVolumeCorruption(ctx context.Context, name string) (*CorruptionResponse, error) {
+	var resp CorruptionResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/volumes/"+name+"/corruption", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ClearVolumeCorruption forgets the corrupted files of volume name.
+func (c *Client) ClearVolumeCorruption(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/volumes/"+name+"/corruption", nil, nil)
+}
+
 func (c *Client) UnexportVolume(ctx context.Context, name string, cl string) error {
 	return c.do(ctx, http.MethodDelete, "/v1/volumes/"+name+"/export", ExportRequest{Client: cl}, nil)
 }
@@ -128,6 +231,184 @@ func (c *Client) Stats(ctx context.Context) (*StatsResponse, error) {
 	return &resp, nil
 }
 
+// CheckConsistency reports inconsistencies between volumes, snapshots,
+// their metadata and btrfs without changing anything.
+func (c *Client) CheckConsistency(ctx context.Context) (*ConsistencyReport, error) {
+	var resp ConsistencyReport
+	if err := c.do(ctx, http.MethodGet, "/v1/consistency", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RepairConsistency runs the consistency check and fixes the safe cases.
+func (c *Client) RepairConsistency(ctx context.Context) (*ConsistencyReport, error) {
+	var resp ConsistencyReport
+	if err := c.do(ctx, http.MethodPost, "/v1/consistency", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListTrash returns the deleted volumes of the tenant that can still be restored.
+func (c *Client) ListTrash(ctx context.Context) (*TrashListResponse, error) {
+	var resp TrashListResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/trash", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RestoreTrash restores a deleted volume, under its old name unless req.Name is set.
+func (c *Client) RestoreTrash(ctx context.Context, id string, req TrashRestoreRequest) (*VolumeDetailResponse, error) {
+	var resp VolumeDetailResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/trash/"+id+"/restore", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// PurgeTrash deletes a trash entry before its retention ends.
+func (c *Client) PurgeTrash(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/trash/"+id, nil, nil)
+}
+
+// StartDedupe starts deduplicating identical data across the tenant's volumes.
+func (c *Client) StartDedupe(ctx context.Context) (*DedupeJob, error) {
+	var resp DedupeJob
+	if err := c.do(ctx, http.MethodPost, "/v1/dedupe", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DedupeStatus returns the current or last dedupe of the tenant.
+func (c *Client) DedupeStatus(ctx context.Context) (*DedupeJob, error) {
+	var resp DedupeJob
+	if err := c.do(ctx, http.MethodGet, "/v1/dedupe", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelDedupe stops the running dedupe, the next run resumes it.
+func (c *Client) CancelDedupe(ctx context.Context) (*DedupeJob, error) {
+	var resp DedupeJob
+	if err := c.do(ctx, http.MethodDelete, "/v1/dedupe", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ScrubStatus returns the state of the current or last scrub. Requires the admin token.
+func (c *Client) ScrubStatus(ctx context.Context) (*ScrubStatusResponse, error) {
+	var resp ScrubStatusResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/scrub", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// StartScrub starts a scrub of the agent's filesystem. Requires the admin token.
+func (c *Client) StartScrub(ctx context.Context) (*ScrubStatusResponse, error) {
+	var resp ScrubStatusResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/scrub", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelScrub cancels the running scrub. Requires the admin token.
+func (c *Client) CancelScrub(ctx context.Context) (*ScrubStatusResponse, error) {
+	var resp ScrubStatusResponse
+	if err := c.do(ctx, http.MethodDelete, "/v1/scrub", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// BalanceStatus returns the state of the balance. Requires the admin token.
+func (c *Client) BalanceStatus(ctx context.Context) (*BalanceStatusResponse, error) {
+	var resp BalanceStatusResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/balance", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// StartBalance starts a usage-filtered balance. Requires the admin token.
+func (c *Client) StartBalance(ctx context.Context, req BalanceRequest) (*BalanceStatusResponse, error) {
+	var resp BalanceStatusResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/balance", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelBalance cancels the running or paused balance. Requires the admin token.
+func (c *Client) CancelBalance(ctx context.Context) (*BalanceStatusResponse, error) {
+	var resp BalanceStatusResponse
+	if err := c.do(ctx, http.MethodDelete, "/v1/balance", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CheckFilesystemConsistency reports qgroups without a subvolume. Requires the admin token.
+func (c *Client) CheckFilesystemConsistency(ctx context.Context) (*ConsistencyReport, error) {
+	var resp ConsistencyReport
+	if err := c.do(ctx, http.MethodGet, "/v1/admin/consistency", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RepairFilesystemConsistency destroys qgroups without a subvolume. Requires the admin token.
+func (c *Client) RepairFilesystemConsistency(ctx context.Context) (*ConsistencyReport, error) {
+	var resp ConsistencyReport
+	if err := c.do(ctx, http.MethodPost, "/v1/admin/consistency", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListTenants returns all tenants without their token secrets. Requires the admin token.
+func (c *Client) ListTenants(ctx context.Context) (*TenantListResponse, error) {
+	var resp TenantListResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/admin/tenants", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateTenant creates a tenant, the response holds its only copy of the token. Requires the admin token.
+func (c *Client) CreateTenant(ctx context.Context, req TenantCreateRequest) (*Tenant, error) {
+	var resp Tenant
+	if err := c.do(ctx, http.MethodPost, "/v1/admin/tenants", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteTenant deletes a tenant without volumes, snapshots or trash entries. Requires the admin token.
+func (c *Client) DeleteTenant(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/admin/tenants/"+name, nil, nil)
+}
+
+// CreateTenantToken adds a token to a tenant, e.g. to rotate it. Requires the admin token.
+func (c *Client) CreateTenantToken(ctx context.Context, name string, req TenantTokenCreateRequest) (*TenantToken, error) {
+	var resp TenantToken
+	if err := c.do(ctx, http.MethodPost, "/v1/admin/tenants/"+name+"/tokens", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteTenantToken revokes a token of a tenant. Requires the admin token.
+func (c *Client) DeleteTenantToken(ctx context.Context, name, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/admin/tenants/"+name+"/tokens/"+id, nil, nil)
+}
+
 func (c *Client) Healthz(ctx context.Context) (*HealthResponse, error) {
 	var resp HealthResponse
 	if err := c.do(ctx, http.MethodGet, "/healthz", nil, &resp); err != nil {
@@ -172,18 +453,7 @@ func (c *Client) do(ctx context.Context, method, path string, body any, result a
 		if resp.StatusCode == http.StatusConflict && result != nil && len(respBody) > 0 {
 			_ = json.Unmarshal(respBody, result)
 		}
-		var errResp ErrorResponse
-		if json.Unmarshal(respBody, &errResp) == nil && errResp.Error != "" {
-			return &AgentError{
-				StatusCode: resp.StatusCode,
-				Code:       errResp.Code,
-				Message:    errResp.Error,
-			}
-		}
-		return &AgentError{
-			StatusCode: resp.StatusCode,
-			Message:    string(respBody),
-		}
+		return agentError(resp.StatusCode, respBody)
 	}
 
 	if result != nil && len(respBody) > 0 {
@@ -195,6 +465,57 @@ func (c *Client) do(ctx context.Context, method, path string, body any, result a
 	return nil
 }
 
+// doStream sends body as a raw octet stream and copies the response body to out.
+// Either may be nil.
+func (c *Client) doStream(ctx context.Context, method, path string, body io.Reader, out io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, body)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return fmt.Errorf("request %s %s: %w", method, path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 400 {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("read response: %w", err)
+		}
+		return agentError(resp.StatusCode, respBody)
+	}
+
+	if out == nil {
+		out = io.Discard
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("read stream %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+func agentError(statusCode int, body []byte) error {
+	var errResp ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
+		return &AgentError{
+			StatusCode: statusCode,
+			Code:       errResp.Code,
+			Message:    errResp.Error,
+		}
+	}
+	return &AgentError{
+		StatusCode: statusCode,
+		Message:    string(body),
+	}
+}
+
 type AgentError struct {
 	StatusCode int
 	Code       string
@@ -225,3 +546,17 @@ func IsLocked(err error) bool {
 	}
 	return false
 }
+
+func IsForbidden(err error) bool {
+	if ae, ok := err.(*AgentError); ok {
+		return ae.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+func IsQuotaExceeded(err error) bool {
+	if ae, ok := err.(*AgentError); ok {
+		return ae.StatusCode == http.StatusInsufficientStorage
+	}
+	return false
+}
@@ -2,10 +2,13 @@ package v1
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
 
 	"github.com/labstack/echo/v5"
+	"github.com/rs/zerolog/log"
 )
 
 type Handler struct {
@@ -65,20 +68,31 @@ func volumeDetailResponseFrom(meta *storage.VolumeMetadata) VolumeDetailResponse
 		clients = []string{}
 	}
 	return VolumeDetailResponse{
-		Name:         meta.Name,
-		Path:         meta.Path,
-		SizeBytes:    meta.SizeBytes,
-		NoCOW:        meta.NoCOW,
-		Compression:  meta.Compression,
-		QuotaBytes:   meta.QuotaBytes,
-		UsedBytes:    meta.UsedBytes,
-		UID:          meta.UID,
-		GID:          meta.GID,
-		Mode:         meta.Mode,
-		Clients:      clients,
-		CreatedAt:    meta.CreatedAt,
-		UpdatedAt:    meta.UpdatedAt,
-		LastAttachAt: meta.LastAttachAt,
+		Name:              meta.Name,
+		Path:              meta.Path,
+		SizeBytes:         meta.SizeBytes,
+		NoCOW:             meta.NoCOW,
+		Compression:       meta.Compression,
+		QuotaBytes:        meta.QuotaBytes,
+		UsedBytes:         meta.UsedBytes,
+		UID:               meta.UID,
+		GID:               meta.GID,
+		Mode:              meta.Mode,
+		Clients:           clients,
+		SourceSnapshot:    meta.SourceSnapshot,
+		SourceVolume:      meta.SourceVolume,
+		ReceivedSnapshot:  meta.ReceivedSnapshot,
+		Replicate:         meta.Replicate,
+		Replication:       meta.Replication,
+		SnapshotSchedule:  meta.SnapshotSchedule,
+		CreatedAt:         meta.CreatedAt,
+		UpdatedAt:         meta.UpdatedAt,
+		LastAttachAt:      meta.LastAttachAt,
+		CorruptedFiles:    len(meta.CorruptedFiles),
+		DedupedBytes:      meta.DedupedBytes,
+		AdoptedFrom:       meta.AdoptedFrom,
+		IncludeSnapshots:  meta.GroupQgroup != "",
+		CombinedUsedBytes: meta.CombinedUsedBytes,
 	}
 }
 
@@ -120,6 +134,124 @@ func (h *Handler) DeleteVolume(c *echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+func (h *Handler) ReceiveVolume(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	var req storage.VolumeReceiveRequest
+	if err := echo.BindQueryParams(c, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid query parameters", Code: "BAD_REQUEST"})
+	}
+
+	// the stream is read for as long as the sender takes to produce it
+	_ = http.NewResponseController(c.Response()).SetReadDeadline(time.Time{})
+
+	meta, err := h.Store.ReceiveVolume(c.Request().Context(), tenant, c.Param("name"), req, c.Request().Body)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, volumeDetailResponseFrom(meta))
+}
+
+func (h *Handler) RollbackVolume(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	var req storage.VolumeRollbackRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body", Code: "BAD_REQUEST"})
+	}
+
+	meta, safety, err := h.Store.RollbackVolume(c.Request().Context(), tenant, c.Param("name"), req)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, VolumeRollbackResponse{
+		VolumeDetailResponse: volumeDetailResponseFrom(meta),
+		SafetySnapshot:       safety.Name,
+	})
+}
+
+// AdoptVolume reads data from anywhere on the filesystem and is therefore an
+// admin route, the tenant is a path parameter.
+func (h *Handler) AdoptVolume(c *echo.Context) error {
+	var req storage.VolumeAdoptRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body", Code: "BAD_REQUEST"})
+	}
+
+	meta, err := h.Store.AdoptVolume(c.Request().Context(), c.Param("name"), c.Param("volume"), req)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, volumeDetailResponseFrom(meta))
+}
+
+func defragmentJobResponseFrom(job *storage.DefragmentJob) DefragmentJobResponse {
+	return DefragmentJobResponse{DefragmentJob: *job, Progress: job.Progress()}
+}
+
+func (h *Handler) StartDefragment(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	var req storage.DefragmentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body", Code: "BAD_REQUEST"})
+	}
+
+	job, err := h.Store.StartDefragment(tenant, c.Param("name"), req)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusAccepted, defragmentJobResponseFrom(job))
+}
+
+func (h *Handler) DefragmentStatus(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	job, err := h.Store.DefragmentStatus(tenant, c.Param("name"))
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, defragmentJobResponseFrom(job))
+}
+
+func (h *Handler) CancelDefragment(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	job, err := h.Store.CancelDefragment(tenant, c.Param("name"))
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, defragmentJobResponseFrom(job))
+}
+
+func (h *Handler) GetVolumeCorruption(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+	name := c.Param("name")
+
+	files, err := h.Store.VolumeCorruption(tenant, name)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, CorruptionResponse{Volume: name, Files: files, Total: len(files)})
+}
+
+func (h *Handler) ClearVolumeCorruption(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	if err := h.Store.ClearVolumeCorruption(tenant, c.Param("name")); err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 func (h *Handler) ExportVolume(c *echo.Context) error {
 	tenant := c.Get("tenant").(string)
 	name := c.Param("name")
@@ -180,6 +312,12 @@ func (h *Handler) Stats(c *echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error(), Code: "INTERNAL_ERROR"})
 	}
 
+	// tenant usage is optional, it must not hide the filesystem stats
+	tu, err := h.Store.TenantUsage(c.Request().Context(), tenant)
+	if err != nil {
+		log.Warn().Err(err).Str("tenant", tenant).Msg("failed to read tenant usage")
+	}
+
 	devices := make([]DeviceStatsResponse, len(ds.Devices))
 	for i, d := range ds.Devices {
 		devices[i] = DeviceStatsResponse{
@@ -224,10 +362,285 @@ func (h *Handler) Stats(c *echo.Context) error {
 			MetadataTotalBytes: ds.Filesystem.MetadataTotalBytes,
 			DataRatio:          ds.Filesystem.DataRatio,
 			Devices:            devices,
+			Scrub:              scrubStatusResponseFrom(&ds.Scrub),
+			Balance:            balanceStatusResponseFrom(&ds.Balance),
+		},
+		Trash: TrashStatsResponse{
+			Volumes:   fs.TrashVolumes,
+			UsedBytes: fs.TrashUsedBytes,
 		},
+		Tenant: tu,
 	})
 }
 
+// --- Scrub ---
+
+func scrubStatusResponseFrom(st *btrfs.ScrubStatus) ScrubStatusResponse {
+	resp := ScrubStatusResponse{
+		Status:              st.Status,
+		Running:             st.Running(),
+		Progress:            st.Progress(),
+		TotalBytes:          st.TotalBytes,
+		ScrubbedBytes:       st.ScrubbedBytes,
+		DurationSeconds:     int64(st.Duration.Seconds()),
+		ErrorsFound:         st.ErrorsFound,
+		CorrectedErrors:     st.CorrectedErrors,
+		UncorrectableErrors: st.UncorrectableErrors,
+	}
+	if !st.StartedAt.IsZero() {
+		started := st.StartedAt.UTC()
+		resp.StartedAt = &started
+	}
+	if t := st.CompletedAt(); !t.IsZero() {
+		completed := t.UTC()
+		resp.CompletedAt = &completed
+	}
+	return resp
+}
+
+func (h *Handler) ScrubStatus(c *echo.Context) error {
+	st, err := h.Store.ScrubStatus(c.Request().Context())
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, scrubStatusResponseFrom(st))
+}
+
+func (h *Handler) StartScrub(c *echo.Context) error {
+	st, err := h.Store.StartScrub(c.Request().Context())
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusAccepted, scrubStatusResponseFrom(st))
+}
+
+func (h *Handler) CancelScrub(c *echo.Context) error {
+	st, err := h.Store.CancelScrub(c.Request().Context())
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, scrubStatusResponseFrom(st))
+}
+
+// --- Balance ---
+
+func balanceStatusResponseFrom(st *btrfs.BalanceStatus) BalanceStatusResponse {
+	status := st.Status
+	if status == "" {
+		status = btrfs.BalanceIdle
+	}
+	return BalanceStatusResponse{
+		Status:           status,
+		Running:          st.Running(),
+		Progress:         st.Progress(),
+		TotalChunks:      st.TotalChunks,
+		BalancedChunks:   st.BalancedChunks,
+		ConsideredChunks: st.ConsideredChunks,
+	}
+}
+
+func (h *Handler) BalanceStatus(c *echo.Context) error {
+	st, err := h.Store.BalanceStatus(c.Request().Context())
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, balanceStatusResponseFrom(st))
+}
+
+func (h *Handler) StartBalance(c *echo.Context) error {
+	var req storage.BalanceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body", Code: "BAD_REQUEST"})
+	}
+
+	st, err := h.Store.StartBalance(c.Request().Context(), req)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusAccepted, balanceStatusResponseFrom(st))
+}
+
+func (h *Handler) CancelBalance(c *echo.Context) error {
+	st, err := h.Store.CancelBalance(c.Request().Context())
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, balanceStatusResponseFrom(st))
+}
+
+// --- Tenants ---
+
+func (h *Handler) ListTenants(c *echo.Context) error {
+	tenants := h.Store.ListTenants()
+	return c.JSON(http.StatusOK, TenantListResponse{Tenants: tenants, Total: len(tenants)})
+}
+
+func (h *Handler) CreateTenant(c *echo.Context) error {
+	var req TenantCreateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body", Code: "BAD_REQUEST"})
+	}
+
+	tenant, err := h.Store.CreateTenant(c.Request().Context(), req)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, tenant)
+}
+
+func (h *Handler) DeleteTenant(c *echo.Context) error {
+	if err := h.Store.DeleteTenant(c.Request().Context(), c.Param("name")); err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *Handler) CreateTenantToken(c *echo.Context) error {
+	var req TenantTokenCreateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body", Code: "BAD_REQUEST"})
+	}
+
+	tok, err := h.Store.CreateTenantToken(c.Param("name"), req)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, tok)
+}
+
+func (h *Handler) DeleteTenantToken(c *echo.Context) error {
+	if err := h.Store.DeleteTenantToken(c.Param("name"), c.Param("id")); err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// --- Consistency ---
+
+func (h *Handler) CheckConsistency(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	report, err := h.Store.CheckConsistency(c.Request().Context(), tenant, false)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) RepairConsistency(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	report, err := h.Store.CheckConsistency(c.Request().Context(), tenant, true)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) CheckFilesystemConsistency(c *echo.Context) error {
+	report, err := h.Store.CheckFilesystemConsistency(c.Request().Context(), false)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) RepairFilesystemConsistency(c *echo.Context) error {
+	report, err := h.Store.CheckFilesystemConsistency(c.Request().Context(), true)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// --- Trash ---
+
+func (h *Handler) ListTrash(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	entries, err := h.Store.ListTrash(tenant)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, TrashListResponse{Entries: entries, Total: len(entries)})
+}
+
+func (h *Handler) RestoreTrash(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	var req storage.TrashRestoreRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body", Code: "BAD_REQUEST"})
+	}
+
+	meta, err := h.Store.RestoreTrash(tenant, c.Param("id"), req)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, volumeDetailResponseFrom(meta))
+}
+
+func (h *Handler) PurgeTrash(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	if err := h.Store.PurgeTrash(c.Request().Context(), tenant, c.Param("id")); err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// --- Dedupe ---
+
+func (h *Handler) StartDedupe(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	job, err := h.Store.StartDedupe(tenant)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func (h *Handler) DedupeStatus(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	job, err := h.Store.DedupeStatus(tenant)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+func (h *Handler) CancelDedupe(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	job, err := h.Store.CancelDedupe(tenant)
+	if err != nil {
+		return StorageError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
 // --- Snapshots ---
 
 func snapshotResponseFrom(meta *storage.SnapshotMetadata) SnapshotResponse {
@@ -297,6 +710,7 @@ func snapshotDetailResponseFrom(meta *storage.SnapshotMetadata) SnapshotDetailRe
 		UsedBytes:      meta.UsedBytes,
 		ExclusiveBytes: meta.ExclusiveBytes,
 		ReadOnly:       meta.ReadOnly,
+		Schedule:       meta.Schedule,
 		CreatedAt:      meta.CreatedAt,
 		UpdatedAt:      meta.UpdatedAt,
 	}
@@ -323,6 +737,43 @@ func (h *Handler) DeleteSnapshot(c *echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+// streamWriter defers the 200 response header until the first byte is written,
+// so errors raised before any output can still be returned as JSON.
+type streamWriter struct {
+	c       *echo.Context
+	started bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+		w.c.Response().WriteHeader(http.StatusOK)
+	}
+	return w.c.Response().Write(p)
+}
+
+func (h *Handler) SendSnapshot(c *echo.Context) error {
+	tenant := c.Get("tenant").(string)
+
+	// sends of large snapshots easily outlive the server write timeout
+	_ = http.NewResponseController(c.Response()).SetWriteDeadline(time.Time{})
+
+	w := &streamWriter{c: c}
+	if err := h.Store.SendSnapshot(c.Request().Context(), tenant, c.Param("name"), c.QueryParam("parent"), w); err != nil {
+		if !w.started {
+			return StorageError(c, err)
+		}
+		// the status line is already out, abort the connection so the client
+		// sees a truncated stream instead of a cleanly terminated one
+		panic(http.ErrAbortHandler)
+	}
+	if !w.started {
+		return c.NoContent(http.StatusOK)
+	}
+	return nil
+}
+
 // --- Clones ---
 
 func (h *Handler) CreateClone(c *echo.Context) error {
@@ -336,20 +787,10 @@ func (h *Handler) CreateClone(c *echo.Context) error {
 	meta, err := h.Store.CreateClone(c.Request().Context(), tenant, req)
 	if err != nil {
 		if meta != nil {
-			return c.JSON(http.StatusConflict, CloneResponse{
-				Name:           meta.Name,
-				SourceSnapshot: meta.SourceSnapshot,
-				Path:           meta.Path,
-				CreatedAt:      meta.CreatedAt,
-			})
+			return c.JSON(http.StatusConflict, volumeDetailResponseFrom(meta))
 		}
 		return StorageError(c, err)
 	}
 
-	return c.JSON(http.StatusCreated, CloneResponse{
-		Name:           meta.Name,
-		SourceSnapshot: meta.SourceSnapshot,
-		Path:           meta.Path,
-		CreatedAt:      meta.CreatedAt,
-	})
+	return c.JSON(http.StatusCreated, volumeDetailResponseFrom(meta))
 }
@@ -1,60 +1,129 @@
 package v1
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
+
 	"github.com/labstack/echo/v5"
 )
 
-// AuthMiddleware validates Bearer or Basic auth and resolves the token to a tenant name.
-func AuthMiddleware(tenants map[string]string) echo.MiddlewareFunc {
+// TenantResolver resolves an API token to its tenant and the scopes of the
+// token. Tokens may change at runtime, every request is resolved again.
+type TenantResolver interface {
+	TenantByToken(token string) (string, []string, bool)
+}
+
+// AuthMiddleware validates Bearer or Basic auth and resolves the token to a
+// tenant name and its scopes, checked by RequireScope.
+func AuthMiddleware(tenants TenantResolver) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c *echo.Context) error {
-			auth := c.Request().Header.Get("Authorization")
-			if auth == "" {
-				c.Response().Header().Set("WWW-Authenticate", `Basic realm="agent"`)
-				return c.JSON(http.StatusUnauthorized, ErrorResponse{
-					Error: "missing authorization header",
-					Code:  "UNAUTHORIZED",
-				})
+			providedToken, err := authToken(c)
+			if providedToken == "" {
+				return err
 			}
 
-			parts := strings.SplitN(auth, " ", 2)
-			if len(parts) != 2 {
+			tenant, scopes, ok := tenants.TenantByToken(providedToken)
+			if !ok {
 				return unauthorized(c)
 			}
+			c.Set("tenant", tenant)
+			c.Set("scopes", scopes)
 
-			var providedToken string
-			switch parts[0] {
-			case "Bearer":
-				providedToken = parts[1]
-			case "Basic":
-				decoded, err := base64.StdEncoding.DecodeString(parts[1])
-				if err != nil {
-					return unauthorized(c)
-				}
-				_, pass, ok := strings.Cut(string(decoded), ":")
-				if !ok {
-					return unauthorized(c)
-				}
-				providedToken = pass
-			default:
-				return unauthorized(c)
+			return next(c)
+		}
+	}
+}
+
+// RequireScope rejects tokens without scope with FORBIDDEN, see
+// storage.HasScope. Runs after AuthMiddleware.
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			scopes, _ := c.Get("scopes").([]string)
+			if !storage.HasScope(scopes, scope) {
+				return StorageError(c, &storage.StorageError{Code: storage.ErrForbidden, Message: fmt.Sprintf("token lacks the %s scope", scope)})
 			}
 
-			tenant, ok := tenants[providedToken]
-			if !ok {
+			return next(c)
+		}
+	}
+}
+
+// AdminMiddleware only admits the admin token, which may be a hash from
+// storage.HashToken. Admin routes act on the whole agent, not on a tenant,
+// so no tenant is set.
+func AdminMiddleware(adminToken string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			providedToken, err := authToken(c)
+			if providedToken == "" {
+				return err
+			}
+
+			if !adminTokenValid(adminToken, providedToken) {
 				return unauthorized(c)
 			}
-			c.Set("tenant", tenant)
 
 			return next(c)
 		}
 	}
 }
 
+func adminTokenValid(adminToken, providedToken string) bool {
+	if adminToken == "" {
+		return false
+	}
+	if storage.IsTokenHash(adminToken) {
+		return storage.VerifyToken(adminToken, providedToken)
+	}
+	return subtle.ConstantTimeCompare([]byte(providedToken), []byte(adminToken)) == 1
+}
+
+// authToken extracts the token from a Bearer or Basic (password) Authorization
+// header. If no token is found, the 401 response has already been written and
+// its error is returned.
+func authToken(c *echo.Context) (string, error) {
+	auth := c.Request().Header.Get("Authorization")
+	if auth == "" {
+		c.Response().Header().Set("WWW-Authenticate", `Basic realm="agent"`)
+		return "", c.JSON(http.StatusUnauthorized, ErrorResponse{
+			Error: "missing authorization header",
+			Code:  "UNAUTHORIZED",
+		})
+	}
+
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 {
+		return "", unauthorized(c)
+	}
+
+	switch parts[0] {
+	case "Bearer":
+		if parts[1] == "" {
+			return "", unauthorized(c)
+		}
+		return parts[1], nil
+	case "Basic":
+		decoded, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", unauthorized(c)
+		}
+		_, pass, ok := strings.Cut(string(decoded), ":")
+		if !ok || pass == "" {
+			return "", unauthorized(c)
+		}
+		return pass, nil
+	default:
+		return "", unauthorized(c)
+	}
+}
+
 func unauthorized(c *echo.Context) error {
 	c.Response().Header().Set("WWW-Authenticate", `Basic realm="agent"`)
 	return c.JSON(http.StatusUnauthorized, ErrorResponse{
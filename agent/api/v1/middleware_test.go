@@ -0,0 +1,79 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
+	"github.com/labstack/echo/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver map[string][]string
+
+func (f fakeResolver) TenantByToken(token string) (string, []string, bool) {
+	scopes, ok := f[token]
+	if !ok {
+		return "", nil, false
+	}
+	return "test", scopes, true
+}
+
+func TestScopes(t *testing.T) {
+	e := echo.New()
+	api := e.Group("/v1", AuthMiddleware(fakeResolver{
+		"full":         nil,
+		"reader":       {storage.ScopeVolumesRead},
+		"sender":       {storage.ScopeSnapshotsSend},
+		"tenant_admin": {storage.ScopeTenantAdmin},
+	}))
+	ok := func(c *echo.Context) error { return c.NoContent(http.StatusNoContent) }
+	api.GET("/volumes", ok, RequireScope(storage.ScopeVolumesRead))
+	api.DELETE("/volumes/:name", ok, RequireScope(storage.ScopeVolumesWrite))
+	api.GET("/snapshots/:name/send", ok, RequireScope(storage.ScopeSnapshotsSend))
+
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "full_read", token: "full", method: http.MethodGet, wantStatus: http.StatusNoContent},
+		{name: "full_write", token: "full", method: http.MethodDelete, wantStatus: http.StatusNoContent},
+		{name: "reader_read", token: "reader", method: http.MethodGet, wantStatus: http.StatusNoContent},
+		{name: "reader_write", token: "reader", method: http.MethodDelete, wantStatus: http.StatusForbidden, wantCode: "FORBIDDEN"},
+		{name: "tenant_admin_write", token: "tenant_admin", method: http.MethodDelete, wantStatus: http.StatusNoContent},
+		{name: "full_send", token: "full", method: http.MethodGet, path: "/v1/snapshots/snap1/send", wantStatus: http.StatusNoContent},
+		{name: "reader_send", token: "reader", method: http.MethodGet, path: "/v1/snapshots/snap1/send", wantStatus: http.StatusForbidden, wantCode: "FORBIDDEN"},
+		{name: "sender_send", token: "sender", method: http.MethodGet, path: "/v1/snapshots/snap1/send", wantStatus: http.StatusNoContent},
+		{name: "unknown_token", token: "nope", method: http.MethodGet, wantStatus: http.StatusUnauthorized, wantCode: "UNAUTHORIZED"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = "/v1/volumes"
+				if tt.method == http.MethodDelete {
+					path += "/vol1"
+				}
+			}
+			req := httptest.NewRequest(tt.method, path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantCode != "" {
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+				assert.Equal(t, tt.wantCode, resp.Code)
+			}
+		})
+	}
+}
@@ -11,12 +11,31 @@ import (
 type (
 	VolumeCreateRequest   = storage.VolumeCreateRequest
 	VolumeUpdateRequest   = storage.VolumeUpdateRequest
+	VolumeReceiveRequest  = storage.VolumeReceiveRequest
+	VolumeRollbackRequest = storage.VolumeRollbackRequest
+	VolumeAdoptRequest    = storage.VolumeAdoptRequest
 	SnapshotCreateRequest = storage.SnapshotCreateRequest
 	CloneCreateRequest    = storage.CloneCreateRequest
 	VolumeMetadata        = storage.VolumeMetadata
 	SnapshotMetadata      = storage.SnapshotMetadata
-	CloneMetadata         = storage.CloneMetadata
-	ExportEntry           = storage.ExportEntry
+	// Deprecated: use VolumeMetadata.
+	CloneMetadata            = storage.CloneMetadata
+	ReplicationState         = storage.ReplicationState
+	ExportEntry              = storage.ExportEntry
+	ConsistencyReport        = storage.ConsistencyReport
+	ConsistencyIssue         = storage.ConsistencyIssue
+	CorruptedFile            = storage.CorruptedFile
+	BalanceRequest           = storage.BalanceRequest
+	DefragmentRequest        = storage.DefragmentRequest
+	DefragmentJob            = storage.DefragmentJob
+	DedupeJob                = storage.DedupeJob
+	TrashEntry               = storage.TrashEntry
+	TrashRestoreRequest      = storage.TrashRestoreRequest
+	TenantUsage              = storage.TenantUsage
+	Tenant                   = storage.Tenant
+	TenantToken              = storage.TenantToken
+	TenantCreateRequest      = storage.TenantCreateRequest
+	TenantTokenCreateRequest = storage.TenantTokenCreateRequest
 )
 
 const (
@@ -40,21 +59,59 @@ type VolumeResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// CloneResponse was the response of POST /v1/clones before clones became
+// volumes.
+//
+// Deprecated: clones are volumes, use VolumeDetailResponse. It will be
+// removed in the next release.
+type CloneResponse = VolumeDetailResponse
+
 type VolumeDetailResponse struct {
-	Name         string     `json:"name"`
-	Path         string     `json:"path"`
-	SizeBytes    uint64     `json:"size_bytes"`
-	NoCOW        bool       `json:"nocow"`
-	Compression  string     `json:"compression"`
-	QuotaBytes   uint64     `json:"quota_bytes"`
-	UsedBytes    uint64     `json:"used_bytes"`
-	UID          int        `json:"uid"`
-	GID          int        `json:"gid"`
-	Mode         string     `json:"mode"`
-	Clients      []string   `json:"clients"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
-	LastAttachAt *time.Time `json:"last_attach_at,omitempty"`
+	Name             string            `json:"name"`
+	Path             string            `json:"path"`
+	SizeBytes        uint64            `json:"size_bytes"`
+	NoCOW            bool              `json:"nocow"`
+	Compression      string            `json:"compression"`
+	QuotaBytes       uint64            `json:"quota_bytes"`
+	UsedBytes        uint64            `json:"used_bytes"`
+	UID              int               `json:"uid"`
+	GID              int               `json:"gid"`
+	Mode             string            `json:"mode"`
+	Clients          []string          `json:"clients"`
+	SourceSnapshot   string            `json:"source_snapshot,omitempty"`
+	SourceVolume     string            `json:"source_volume,omitempty"`
+	ReceivedSnapshot string            `json:"received_snapshot,omitempty"`
+	Replicate        bool              `json:"replicate"`
+	Replication      *ReplicationState `json:"replication,omitempty"`
+	SnapshotSchedule string            `json:"snapshot_schedule,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at"`
+	LastAttachAt     *time.Time        `json:"last_attach_at,omitempty"`
+	// CorruptedFiles is the number of files with checksum errors, see CorruptionResponse.
+	CorruptedFiles int `json:"corrupted_files,omitempty"`
+	// DedupedBytes is shared with identical data as of the last dedupe.
+	DedupedBytes     uint64 `json:"deduped_bytes,omitempty"`
+	AdoptedFrom      string `json:"adopted_from,omitempty"`
+	IncludeSnapshots bool   `json:"include_snapshots"`
+	// CombinedUsedBytes is the usage of the volume and its snapshots, only
+	// set with IncludeSnapshots.
+	CombinedUsedBytes uint64 `json:"combined_used_bytes,omitempty"`
+}
+
+type VolumeRollbackResponse struct {
+	VolumeDetailResponse
+	SafetySnapshot string `json:"safety_snapshot"`
+}
+
+type DefragmentJobResponse struct {
+	DefragmentJob
+	Progress float64 `json:"progress"`
+}
+
+type CorruptionResponse struct {
+	Volume string          `json:"volume"`
+	Files  []CorruptedFile `json:"files"`
+	Total  int             `json:"total"`
 }
 
 type VolumeListResponse struct {
@@ -78,6 +135,7 @@ type SnapshotDetailResponse struct {
 	UsedBytes      uint64    `json:"used_bytes"`
 	ExclusiveBytes uint64    `json:"exclusive_bytes"`
 	ReadOnly       bool      `json:"readonly"`
+	Schedule       string    `json:"schedule,omitempty"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
 }
@@ -87,20 +145,33 @@ type SnapshotListResponse struct {
 	Total     int                `json:"total"`
 }
 
-type CloneResponse struct {
-	Name           string    `json:"name"`
-	SourceSnapshot string    `json:"source_snapshot"`
-	Path           string    `json:"path"`
-	CreatedAt      time.Time `json:"created_at"`
-}
-
 type ExportListResponse struct {
 	Exports []ExportEntry `json:"exports"`
 }
 
+type TrashListResponse struct {
+	Entries []TrashEntry `json:"entries"`
+	Total   int          `json:"total"`
+}
+
+type TenantListResponse struct {
+	Tenants []Tenant `json:"tenants"`
+	Total   int      `json:"total"`
+}
+
 type StatsResponse struct {
 	Statfs StatfsResponse          `json:"statfs"`
 	Btrfs  FilesystemStatsResponse `json:"btrfs"`
+	Trash  TrashStatsResponse      `json:"trash"`
+	// Tenant is the usage of the tenant qgroup, omitted without quota.
+	Tenant *TenantUsage `json:"tenant,omitempty"`
+}
+
+// TrashStatsResponse counts the deleted volumes of the tenant in the trash,
+// their space is still in use until they are purged.
+type TrashStatsResponse struct {
+	Volumes   int    `json:"volumes"`
+	UsedBytes uint64 `json:"used_bytes"`
 }
 
 type StatfsResponse struct {
@@ -156,6 +227,31 @@ type FilesystemStatsResponse struct {
 	MetadataTotalBytes uint64                `json:"metadata_total_bytes"`
 	DataRatio          float64               `json:"data_ratio"`
 	Devices            []DeviceStatsResponse `json:"devices"`
+	Scrub              ScrubStatusResponse   `json:"scrub"`
+	Balance            BalanceStatusResponse `json:"balance"`
+}
+
+type ScrubStatusResponse struct {
+	Status              string     `json:"status"`
+	Running             bool       `json:"running"`
+	Progress            float64    `json:"progress"`
+	TotalBytes          uint64     `json:"total_bytes"`
+	ScrubbedBytes       uint64     `json:"scrubbed_bytes"`
+	DurationSeconds     int64      `json:"duration_seconds"`
+	ErrorsFound         uint64     `json:"errors_found"`
+	CorrectedErrors     uint64     `json:"corrected_errors"`
+	UncorrectableErrors uint64     `json:"uncorrectable_errors"`
+	StartedAt           *time.Time `json:"started_at,omitempty"`
+	CompletedAt         *time.Time `json:"completed_at,omitempty"`
+}
+
+type BalanceStatusResponse struct {
+	Status           string  `json:"status"`
+	Running          bool    `json:"running"`
+	Progress         float64 `json:"progress"`
+	TotalChunks      uint64  `json:"total_chunks"`
+	BalancedChunks   uint64  `json:"balanced_chunks"`
+	ConsideredChunks uint64  `json:"considered_chunks"`
 }
 
 type ErrorResponse struct {
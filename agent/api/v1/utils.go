@@ -1,6 +1,7 @@
 package v1
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
@@ -13,10 +14,15 @@ var codeStatus = map[string]int{
 	storage.ErrNotFound:      http.StatusNotFound,
 	storage.ErrAlreadyExists: http.StatusConflict,
 	storage.ErrBusy:          http.StatusLocked,
+	storage.ErrQuotaExceeded: http.StatusInsufficientStorage,
+	storage.ErrForbidden:     http.StatusForbidden,
 }
 
+// StorageError writes err as JSON. A *storage.StorageError anywhere in the
+// chain of err sets the status and code, anything else is a 500.
 func StorageError(c *echo.Context, err error) error {
-	if se, ok := err.(*storage.StorageError); ok {
+	var se *storage.StorageError
+	if errors.As(err, &se) {
 		status, found := codeStatus[se.Code]
 		if !found {
 			status = http.StatusInternalServerError
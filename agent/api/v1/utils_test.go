@@ -39,12 +39,24 @@ func TestStorageError(t *testing.T) {
 			wantStatus: http.StatusConflict,
 			wantCode:   "ALREADY_EXISTS",
 		},
+		{
+			name:       "ErrForbidden_maps_to_403",
+			err:        &storage.StorageError{Code: storage.ErrForbidden, Message: "missing scope"},
+			wantStatus: http.StatusForbidden,
+			wantCode:   "FORBIDDEN",
+		},
 		{
 			name:       "unknown_code_maps_to_500",
 			err:        &storage.StorageError{Code: "CUSTOM", Message: "custom error"},
 			wantStatus: http.StatusInternalServerError,
 			wantCode:   "CUSTOM",
 		},
+		{
+			name:       "wrapped_StorageError_keeps_its_code",
+			err:        fmt.Errorf("safety snapshot failed: %w", &storage.StorageError{Code: storage.ErrAlreadyExists, Message: "exists"}),
+			wantStatus: http.StatusConflict,
+			wantCode:   "ALREADY_EXISTS",
+		},
 		{
 			name:       "non_StorageError_maps_to_500",
 			err:        fmt.Errorf("boom"),
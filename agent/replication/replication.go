@@ -0,0 +1,192 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	v1 "github.com/erikmagkekse/btrfs-nfs-csi/agent/api/v1"
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
+
+	"github.com/rs/zerolog/log"
+)
+
+// snapshotPrefix prefixes the timestamp in replication snapshot names.
+const snapshotPrefix = "repl-"
+
+// Store is the subset of storage.Storage used by the replicator.
+type Store interface {
+	ListVolumes(tenant string) ([]storage.VolumeMetadata, error)
+	CreateSnapshot(ctx context.Context, tenant string, req storage.SnapshotCreateRequest) (*storage.SnapshotMetadata, error)
+	SendSnapshot(ctx context.Context, tenant, name, parent string, w io.Writer) error
+	DeleteSnapshot(ctx context.Context, tenant, name string) error
+	SetReplicationState(tenant, name string, state *storage.ReplicationState) error
+}
+
+// Peer is the receiving agent, implemented by v1.Client.
+type Peer interface {
+	ReceiveVolume(ctx context.Context, name string, req v1.VolumeReceiveRequest, r io.Reader) (*v1.VolumeDetailResponse, error)
+	DeleteSnapshot(ctx context.Context, name string) error
+}
+
+// Replicator pushes volumes flagged with Replicate to a peer agent.
+// Each run takes a read-only snapshot and sends it incrementally against the
+// previously replicated one, which is then dropped on both sides.
+type Replicator struct {
+	store Store
+	peers map[string]Peer // local tenant -> peer client authenticated for it
+	now   func() time.Time
+}
+
+func New(store Store, peers map[string]Peer) *Replicator {
+	return &Replicator{store: store, peers: peers, now: time.Now}
+}
+
+// Start runs a replication pass every interval until ctx is cancelled.
+func (r *Replicator) Start(ctx context.Context, interval time.Duration) {
+	log.Info().Dur("interval", interval).Int("tenants", len(r.peers)).Msg("replication started")
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.RunOnce(ctx)
+			}
+		}
+	}()
+}
+
+// RunOnce replicates every flagged volume of every tenant with a peer once.
+func (r *Replicator) RunOnce(ctx context.Context) {
+	for tenant, peer := range r.peers {
+		vols, err := r.store.ListVolumes(tenant)
+		if err != nil {
+			log.Error().Err(err).Str("tenant", tenant).Msg("replication: failed to list volumes")
+			continue
+		}
+
+		var ok, failed int
+		for i := range vols {
+			vol := &vols[i]
+			if !vol.Replicate {
+				storage.ReplicationLagSeconds.DeleteLabelValues(tenant, vol.Name)
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err := r.replicate(ctx, tenant, peer, vol); err != nil {
+				log.Error().Err(err).Str("tenant", tenant).Str("volume", vol.Name).Msg("replication failed")
+				storage.ReplicationFailuresTotal.WithLabelValues(tenant, vol.Name).Inc()
+				failed++
+			} else {
+				ok++
+			}
+			r.updateLag(tenant, vol)
+		}
+		log.Debug().Str("tenant", tenant).Int("replicated", ok).Int("failed", failed).Msg("replication: pass done")
+	}
+}
+
+func (r *Replicator) replicate(ctx context.Context, tenant string, peer Peer, vol *storage.VolumeMetadata) error {
+	now := r.now().UTC()
+	name := storage.SnapshotName(vol.Name, snapshotPrefix+now.Format("20060102150405"))
+
+	if _, err := r.store.CreateSnapshot(ctx, tenant, storage.SnapshotCreateRequest{Volume: vol.Name, Name: name}); err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+
+	var parent string
+	if vol.Replication != nil {
+		parent = vol.Replication.LastSnapshot
+	}
+
+	err := r.push(ctx, tenant, peer, vol, name, parent)
+	if err != nil && parent != "" && isNotFound(err) {
+		// one side lost the common base, start over with a full stream
+		log.Warn().Err(err).Str("tenant", tenant).Str("volume", vol.Name).Str("parent", parent).Msg("replication: parent missing, sending full stream")
+		err = r.push(ctx, tenant, peer, vol, name, "")
+	}
+	if err != nil {
+		if delErr := r.store.DeleteSnapshot(ctx, tenant, name); delErr != nil {
+			log.Warn().Err(delErr).Str("snapshot", name).Msg("replication: failed to delete unsent snapshot")
+		}
+		return err
+	}
+
+	state := &storage.ReplicationState{LastSnapshot: name, LastSyncAt: now}
+	if err := r.store.SetReplicationState(tenant, vol.Name, state); err != nil {
+		return fmt.Errorf("record replication state: %w", err)
+	}
+	vol.Replication = state
+
+	if parent != "" {
+		if err := r.store.DeleteSnapshot(ctx, tenant, parent); err != nil && !isNotFound(err) {
+			log.Warn().Err(err).Str("snapshot", parent).Msg("replication: failed to delete previous snapshot")
+		}
+		if err := peer.DeleteSnapshot(ctx, parent); err != nil && !isNotFound(err) {
+			log.Warn().Err(err).Str("snapshot", parent).Msg("replication: failed to delete previous snapshot on peer")
+		}
+	}
+
+	log.Info().Str("tenant", tenant).Str("volume", vol.Name).Str("snapshot", name).Bool("incremental", parent != "").Msg("volume replicated")
+	return nil
+}
+
+// push pipes the local send stream of name straight into the peer's receive.
+func (r *Replicator) push(ctx context.Context, tenant string, peer Peer, vol *storage.VolumeMetadata, name, parent string) error {
+	pr, pw := io.Pipe()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := r.store.SendSnapshot(ctx, tenant, name, parent, pw)
+		_ = pw.CloseWithError(err)
+		sendErr <- err
+	}()
+
+	_, recvErr := peer.ReceiveVolume(ctx, vol.Name, v1.VolumeReceiveRequest{
+		Snapshot:    name,
+		SizeBytes:   vol.SizeBytes,
+		NoCOW:       vol.NoCOW,
+		Compression: vol.Compression,
+	}, pr)
+	// unblock the sender if the peer stopped reading early
+	_ = pr.Close()
+
+	sErr := <-sendErr
+	var ae *v1.AgentError
+	switch {
+	case errors.As(recvErr, &ae):
+		// the peer rejected the stream, a send error is only the consequence
+		return fmt.Errorf("receive on peer: %w", recvErr)
+	case sErr != nil:
+		return fmt.Errorf("send: %w", sErr)
+	case recvErr != nil:
+		return fmt.Errorf("receive on peer: %w", recvErr)
+	}
+	return nil
+}
+
+func (r *Replicator) updateLag(tenant string, vol *storage.VolumeMetadata) {
+	since := vol.CreatedAt
+	if vol.Replication != nil {
+		since = vol.Replication.LastSyncAt
+	}
+	storage.ReplicationLagSeconds.WithLabelValues(tenant, vol.Name).Set(r.now().Sub(since).Seconds())
+}
+
+func isNotFound(err error) bool {
+	var se *storage.StorageError
+	if errors.As(err, &se) {
+		return se.Code == storage.ErrNotFound
+	}
+	var ae *v1.AgentError
+	if errors.As(err, &ae) {
+		return v1.IsNotFound(ae)
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	v1 "github.com/erikmagkekse/btrfs-nfs-csi/agent/api/v1"
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// --- fakes ---
+
+type fakeStore struct {
+	vols      []storage.VolumeMetadata
+	snapshots map[string]bool
+	sends     [][2]string // name, parent
+	deleted   []string
+	state     map[string]*storage.ReplicationState
+	sendErr   func(name, parent string) error
+}
+
+func newFakeStore(vols ...storage.VolumeMetadata) *fakeStore {
+	return &fakeStore{vols: vols, snapshots: map[string]bool{}, state: map[string]*storage.ReplicationState{}}
+}
+
+func (f *fakeStore) ListVolumes(string) ([]storage.VolumeMetadata, error) {
+	out := make([]storage.VolumeMetadata, len(f.vols))
+	copy(out, f.vols)
+	for i := range out {
+		if st, ok := f.state[out[i].Name]; ok {
+			out[i].Replication = st
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeStore) CreateSnapshot(_ context.Context, _ string, req storage.SnapshotCreateRequest) (*storage.SnapshotMetadata, error) {
+	f.snapshots[req.Name] = true
+	return &storage.SnapshotMetadata{Name: req.Name, Volume: req.Volume, ReadOnly: true}, nil
+}
+
+func (f *fakeStore) SendSnapshot(_ context.Context, _, name, parent string, w io.Writer) error {
+	f.sends = append(f.sends, [2]string{name, parent})
+	if f.sendErr != nil {
+		if err := f.sendErr(name, parent); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "stream:"+name)
+	return err
+}
+
+func (f *fakeStore) DeleteSnapshot(_ context.Context, _, name string) error {
+	if !f.snapshots[name] {
+		return &storage.StorageError{Code: storage.ErrNotFound, Message: "not found"}
+	}
+	delete(f.snapshots, name)
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func (f *fakeStore) SetReplicationState(_, name string, state *storage.ReplicationState) error {
+	f.state[name] = state
+	return nil
+}
+
+type fakePeer struct {
+	received []v1.VolumeReceiveRequest
+	payloads []string
+	deleted  []string
+	recvErr  error
+}
+
+func (p *fakePeer) ReceiveVolume(_ context.Context, name string, req v1.VolumeReceiveRequest, r io.Reader) (*v1.VolumeDetailResponse, error) {
+	if p.recvErr != nil {
+		err := p.recvErr
+		p.recvErr = nil
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p.received = append(p.received, req)
+	p.payloads = append(p.payloads, string(data))
+	return &v1.VolumeDetailResponse{Name: name, ReceivedSnapshot: req.Snapshot}, nil
+}
+
+func (p *fakePeer) DeleteSnapshot(_ context.Context, name string) error {
+	p.deleted = append(p.deleted, name)
+	return nil
+}
+
+func newTestReplicator(store Store, peer Peer, now time.Time) *Replicator {
+	r := New(store, map[string]Peer{"test": peer})
+	r.now = func() time.Time { return now }
+	return r
+}
+
+// --- Tests ---
+
+func TestRunOnce(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("full_then_incremental", func(t *testing.T) {
+		store := newFakeStore(storage.VolumeMetadata{Name: "vol1", SizeBytes: 1024, Compression: "zstd", Replicate: true})
+		peer := &fakePeer{}
+		t.Cleanup(func() { storage.ReplicationLagSeconds.DeleteLabelValues("test", "vol1") })
+
+		newTestReplicator(store, peer, t0).RunOnce(ctx)
+
+		first := "vol1-repl-20260102030405"
+		require.Len(t, peer.received, 1)
+		assert.Equal(t, v1.VolumeReceiveRequest{Snapshot: first, SizeBytes: 1024, Compression: "zstd"}, peer.received[0])
+		assert.Equal(t, "stream:"+first, peer.payloads[0])
+		assert.Equal(t, [2]string{first, ""}, store.sends[0], "first run sends a full stream")
+		assert.Equal(t, first, store.state["vol1"].LastSnapshot)
+		assert.Equal(t, float64(0), testutil.ToFloat64(storage.ReplicationLagSeconds.WithLabelValues("test", "vol1")))
+
+		newTestReplicator(store, peer, t0.Add(time.Minute)).RunOnce(ctx)
+
+		second := "vol1-repl-20260102030505"
+		assert.Equal(t, [2]string{second, first}, store.sends[1], "second run is incremental")
+		assert.Equal(t, second, store.state["vol1"].LastSnapshot)
+		assert.Equal(t, []string{first}, store.deleted, "previous base is deleted locally")
+		assert.Equal(t, []string{first}, peer.deleted, "previous base is deleted on the peer")
+		assert.True(t, store.snapshots[second])
+	})
+
+	t.Run("skips_unflagged", func(t *testing.T) {
+		store := newFakeStore(storage.VolumeMetadata{Name: "vol1"})
+		peer := &fakePeer{}
+
+		newTestReplicator(store, peer, t0).RunOnce(ctx)
+
+		assert.Empty(t, store.snapshots)
+		assert.Empty(t, peer.received)
+	})
+
+	t.Run("peer_failure_keeps_state", func(t *testing.T) {
+		store := newFakeStore(storage.VolumeMetadata{Name: "vol2", Replicate: true, CreatedAt: t0.Add(-time.Hour)})
+		peer := &fakePeer{recvErr: fmt.Errorf("connection refused")}
+		t.Cleanup(func() {
+			storage.ReplicationLagSeconds.DeleteLabelValues("test", "vol2")
+			storage.ReplicationFailuresTotal.DeleteLabelValues("test", "vol2")
+		})
+
+		newTestReplicator(store, peer, t0).RunOnce(ctx)
+
+		assert.Empty(t, store.state)
+		assert.Empty(t, store.snapshots, "unsent snapshot is deleted")
+		assert.Equal(t, float64(1), testutil.ToFloat64(storage.ReplicationFailuresTotal.WithLabelValues("test", "vol2")))
+		assert.Equal(t, float64(3600), testutil.ToFloat64(storage.ReplicationLagSeconds.WithLabelValues("test", "vol2")), "lag counts from creation until the first sync")
+	})
+
+	t.Run("peer_missing_parent_falls_back_to_full", func(t *testing.T) {
+		store := newFakeStore(storage.VolumeMetadata{Name: "vol3", Replicate: true})
+		store.state["vol3"] = &storage.ReplicationState{LastSnapshot: "old", LastSyncAt: t0.Add(-time.Minute)}
+		store.snapshots["old"] = true
+		peer := &fakePeer{recvErr: &v1.AgentError{StatusCode: http.StatusNotFound, Code: storage.ErrNotFound}}
+		t.Cleanup(func() { storage.ReplicationLagSeconds.DeleteLabelValues("test", "vol3") })
+
+		newTestReplicator(store, peer, t0).RunOnce(ctx)
+
+		name := "vol3-repl-20260102030405"
+		require.Len(t, peer.received, 1)
+		assert.Equal(t, [2]string{name, ""}, store.sends[len(store.sends)-1])
+		assert.Equal(t, name, store.state["vol3"].LastSnapshot)
+		assert.Equal(t, []string{"old"}, store.deleted)
+	})
+
+	t.Run("local_missing_parent_falls_back_to_full", func(t *testing.T) {
+		store := newFakeStore(storage.VolumeMetadata{Name: "vol4", Replicate: true})
+		store.state["vol4"] = &storage.ReplicationState{LastSnapshot: "gone"}
+		store.sendErr = func(_, parent string) error {
+			if parent != "" {
+				return &storage.StorageError{Code: storage.ErrNotFound, Message: "snapshot \"gone\" not found"}
+			}
+			return nil
+		}
+		peer := &fakePeer{}
+		t.Cleanup(func() { storage.ReplicationLagSeconds.DeleteLabelValues("test", "vol4") })
+
+		newTestReplicator(store, peer, t0).RunOnce(ctx)
+
+		name := "vol4-repl-20260102030405"
+		assert.Equal(t, []string{"stream:" + name}, peer.payloads)
+		assert.Equal(t, name, store.state["vol4"].LastSnapshot)
+	})
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AdoptVolume turns existing data below the btrfs mount point into a volume
+// without copying it. A subvolume is moved into place as the data
+// subvolume; a plain directory is reflink-copied into a new subvolume and
+// only removed afterwards if req.RemoveSource is set.
+func (s *Storage) AdoptVolume(ctx context.Context, tenant, name string, req VolumeAdoptRequest) (*VolumeMetadata, error) {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	// validation
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if req.SizeBytes == 0 {
+		return nil, &StorageError{Code: ErrInvalid, Message: "size_bytes is required"}
+	}
+	schedule, err := utils.ParseSnapshotSchedule(req.SnapshotSchedule)
+	if err != nil {
+		return nil, &StorageError{Code: ErrInvalid, Message: err.Error()}
+	}
+	src, err := s.validateAdoptPath(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	volDir := filepath.Join(bp, name)
+	dataDir := filepath.Join(volDir, config.DataDir)
+	if _, err := os.Stat(volDir); err == nil {
+		return nil, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("volume %q already exists", name)}
+	}
+
+	isSubvol := s.btrfs.SubvolumeExists(ctx, src)
+	if isSubvol {
+		ro, err := s.btrfs.GetProperty(ctx, src, "ro")
+		if err != nil {
+			return nil, fmt.Errorf("get ro property: %w", err)
+		}
+		if ro == "true" {
+			return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("%s is a read-only subvolume, adopt a writable snapshot of it", src)}
+		}
+	}
+
+	used, err := s.dataUsage(ctx, src, isSubvol)
+	if err != nil {
+		return nil, err
+	}
+	if used > req.SizeBytes {
+		return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("size_bytes %d is smaller than the %d bytes in use", req.SizeBytes, used)}
+	}
+
+	// operations
+	if err := os.MkdirAll(volDir, s.defaultDirMode); err != nil {
+		log.Error().Err(err).Str("path", volDir).Msg("failed to create volume directory")
+		return nil, fmt.Errorf("create volume directory: %w", err)
+	}
+
+	// restore restores the source of a moved subvolume, a copied directory
+	// is still in place and only the new subvolume is deleted
+	restore := func() {
+		if isSubvol {
+			if err := os.Rename(dataDir, src); err != nil {
+				log.Error().Err(err).Str("path", dataDir).Str("source", src).Msg("cleanup: failed to move subvolume back")
+				return
+			}
+		} else if err := s.btrfs.SubvolumeDelete(ctx, dataDir); err != nil {
+			log.Warn().Err(err).Str("path", dataDir).Msg("cleanup: failed to delete subvolume")
+		}
+		if err := os.RemoveAll(volDir); err != nil {
+			log.Warn().Err(err).Str("path", volDir).Msg("cleanup: failed to remove directory")
+		}
+	}
+
+	if isSubvol {
+		if err := os.Rename(src, dataDir); err != nil {
+			_ = os.RemoveAll(volDir)
+			log.Error().Err(err).Str("source", src).Str("path", dataDir).Msg("failed to move subvolume")
+			return nil, fmt.Errorf("move subvolume: %w", err)
+		}
+	} else {
+		if err := s.btrfs.SubvolumeCreate(ctx, dataDir, s.tenantInherit(tenant)...); err != nil {
+			_ = os.RemoveAll(volDir)
+			log.Error().Err(err).Str("path", dataDir).Msg("failed to create subvolume")
+			return nil, fmt.Errorf("btrfs subvolume create failed: %w", err)
+		}
+		if err := s.btrfs.ReflinkCopy(ctx, src, dataDir); err != nil {
+			log.Error().Err(err).Str("source", src).Str("path", dataDir).Msg("failed to reflink copy directory")
+			restore()
+			return nil, fmt.Errorf("reflink copy failed: %w", err)
+		}
+	}
+
+	if s.quotaEnabled {
+		if err := s.btrfs.QgroupLimit(ctx, dataDir, req.SizeBytes); err != nil {
+			log.Error().Err(err).Str("path", dataDir).Uint64("bytes", req.SizeBytes).Msg("failed to set qgroup limit")
+			restore()
+			return nil, fmt.Errorf("qgroup limit failed: %w", err)
+		}
+		// an adopted subvolume already exists, a copy joined on creation
+		if isSubvol {
+			if err := s.assignTenantQgroup(ctx, tenant, dataDir); err != nil {
+				log.Error().Err(err).Str("path", dataDir).Msg("failed to assign tenant qgroup")
+				restore()
+				return nil, fmt.Errorf("qgroup assign failed: %w", err)
+			}
+		}
+		// a new subvolume is only accounted once the copy is committed
+		if err := s.btrfs.FilesystemSync(ctx, s.mountPoint); err != nil {
+			log.Warn().Err(err).Msg("filesystem sync failed, usage is updated by the usage updater")
+		}
+	}
+
+	meta, err := s.volumeMetadataFromSubvolume(ctx, volDir, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("path", dataDir).Msg("failed to read adopted subvolume")
+		restore()
+		return nil, fmt.Errorf("read adopted subvolume: %w", err)
+	}
+	meta.SizeBytes = req.SizeBytes
+	meta.QuotaBytes = req.SizeBytes
+	if !s.quotaEnabled {
+		meta.UsedBytes = used
+	}
+	meta.Replicate = req.Replicate
+	meta.SnapshotSchedule = schedule.String()
+	meta.AdoptedFrom = src
+
+	if err := writeMetadataAtomic(filepath.Join(volDir, config.MetadataFile), meta); err != nil {
+		log.Error().Err(err).Msg("failed to write metadata")
+		restore()
+		return nil, fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	// the volume is complete, a leftover source only costs metadata space
+	if !isSubvol && req.RemoveSource {
+		if err := os.RemoveAll(src); err != nil {
+			log.Warn().Err(err).Str("path", src).Msg("adopt: failed to remove source directory, remove it manually")
+		}
+	}
+
+	log.Info().Str("tenant", tenant).Str("name", name).Str("source", src).Bool("subvolume", isSubvol).Uint64("used", meta.UsedBytes).Msg("volume adopted")
+	return &meta, nil
+}
+
+// validateAdoptPath checks that path is a directory below the btrfs mount
+// point outside of all tenant directories and returns it with all symlinks
+// resolved, so neither a symlink nor a relative base path hides a tenant
+// directory.
+func (s *Storage) validateAdoptPath(path string) (string, error) {
+	if path == "" || !filepath.IsAbs(path) {
+		return "", &StorageError{Code: ErrInvalid, Message: "path must be an absolute path"}
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return "", &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("path %s not found", path)}
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", path, err)
+	}
+	mountPoint, basePath := resolvePath(s.mountPoint), resolvePath(s.basePath)
+	if resolved == mountPoint || !isWithin(resolved, mountPoint) {
+		return "", &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("path must be below the btrfs mount point %s", s.mountPoint)}
+	}
+	if isWithin(basePath, resolved) {
+		return "", &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("path must not contain the base path %s", s.basePath)}
+	}
+	for _, t := range s.Tenants() {
+		if isWithin(resolved, filepath.Join(basePath, t)) {
+			return "", &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("path %s is managed by tenant %q", path, t)}
+		}
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("stat %s: %w", resolved, err)
+	}
+	if !info.IsDir() {
+		return "", &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("path %s is not a directory", path)}
+	}
+	return resolved, nil
+}
+
+// resolvePath returns path absolute with all symlinks resolved, or only
+// absolute if it cannot be resolved.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// dataUsage returns the bytes the data at src uses: the referenced bytes of
+// a subvolume with quota, otherwise the size of all files.
+func (s *Storage) dataUsage(ctx context.Context, src string, isSubvol bool) (uint64, error) {
+	if isSubvol && s.quotaEnabled {
+		used, err := s.btrfs.QgroupUsage(ctx, src)
+		if err != nil {
+			return 0, fmt.Errorf("qgroup usage failed: %w", err)
+		}
+		return used, nil
+	}
+	_, size, err := countFiles(src)
+	if err != nil {
+		return 0, fmt.Errorf("measure %s: %w", src, err)
+	}
+	return size, nil
+}
+
+// isWithin reports whether path is dir or below it. Both must be clean.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adoptRunFn fakes the btrfs and cp calls of AdoptVolume. subvols are the
+// paths that are subvolume roots; subvolume create and cp act on the disk.
+func adoptRunFn(subvols map[string]bool, ro string) func([]string) (string, error) {
+	return func(args []string) (string, error) {
+		switch {
+		case args[0] == "subvolume" && args[1] == "show":
+			if subvols[args[2]] {
+				return "Subvolume ID:\t\t\t256\n", nil
+			}
+			return "", errors.New("not a subvolume")
+		case args[0] == "subvolume" && args[1] == "create":
+			return "", os.Mkdir(args[2], 0o755)
+		case args[0] == "property" && args[1] == "get":
+			if args[3] == "ro" {
+				return "ro=" + ro + "\n", nil
+			}
+			return "", nil
+		case args[0] == "-a": // cp -a --reflink=always src/. dst
+			return "", os.CopyFS(args[3], os.DirFS(strings.TrimSuffix(args[2], "/.")))
+		}
+		return "", nil
+	}
+}
+
+func TestAdoptVolume(t *testing.T) {
+	ctx := context.Background()
+
+	// setup creates <base>/legacy/pvc-1 with a 4 KiB file
+	setup := func(t *testing.T) (*Storage, string, *utils.MockRunner, string) {
+		s, bp, runner, _ := newTestStorage(t)
+		src := filepath.Join(s.basePath, "legacy", "pvc-1")
+		require.NoError(t, os.MkdirAll(src, 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(src, "file"), make([]byte, 4096), 0o644))
+		return s, bp, runner, src
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		s, bp, _, src := setup(t)
+		setupUsageVol(t, bp, "existing", VolumeMetadata{Name: "existing"})
+		require.NoError(t, os.WriteFile(filepath.Join(s.basePath, "legacy", "file"), nil, 0o644))
+
+		tests := []struct {
+			name string
+			vol  string
+			req  VolumeAdoptRequest
+			code string
+		}{
+			{"invalid_name", "bad name!", VolumeAdoptRequest{Path: src, SizeBytes: 1 << 20}, ErrInvalid},
+			{"no_size", "vol", VolumeAdoptRequest{Path: src}, ErrInvalid},
+			{"relative", "vol", VolumeAdoptRequest{Path: "legacy/pvc-1", SizeBytes: 1 << 20}, ErrInvalid},
+			{"outside_mount", "vol", VolumeAdoptRequest{Path: os.TempDir(), SizeBytes: 1 << 20}, ErrInvalid},
+			{"mount_point", "vol", VolumeAdoptRequest{Path: s.mountPoint, SizeBytes: 1 << 20}, ErrInvalid},
+			{"tenant_dir", "vol", VolumeAdoptRequest{Path: filepath.Join(bp, "existing", config.DataDir), SizeBytes: 1 << 20}, ErrInvalid},
+			{"not_found", "vol", VolumeAdoptRequest{Path: filepath.Join(s.basePath, "legacy", "missing"), SizeBytes: 1 << 20}, ErrNotFound},
+			{"not_a_directory", "vol", VolumeAdoptRequest{Path: filepath.Join(s.basePath, "legacy", "file"), SizeBytes: 1 << 20}, ErrInvalid},
+			{"exists", "existing", VolumeAdoptRequest{Path: src, SizeBytes: 1 << 20}, ErrAlreadyExists},
+			{"too_small", "vol", VolumeAdoptRequest{Path: src, SizeBytes: 1024}, ErrInvalid},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := s.AdoptVolume(ctx, "test", tt.vol, tt.req)
+				requireStorageError(t, err, tt.code)
+				assert.DirExists(t, src)
+			})
+		}
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		s, bp, mock, src := setup(t)
+		mock.RunFn = adoptRunFn(nil, "false")
+
+		meta, err := s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: src + "/", SizeBytes: 1 << 20, SnapshotSchedule: "daily=7"})
+		require.NoError(t, err)
+
+		dataDir := filepath.Join(bp, "vol", config.DataDir)
+		assert.True(t, containsCall(mock.Calls, "subvolume", "create", dataDir))
+		assert.True(t, containsCall(mock.Calls, "-a", "--reflink=always", src+"/.", dataDir))
+		assert.FileExists(t, filepath.Join(dataDir, "file"))
+		assert.FileExists(t, filepath.Join(src, "file"), "source is only removed on request")
+
+		assert.Equal(t, uint64(1<<20), meta.SizeBytes)
+		assert.Equal(t, uint64(4096), meta.UsedBytes)
+		assert.Equal(t, src, meta.AdoptedFrom)
+		assert.Equal(t, "daily=7", meta.SnapshotSchedule)
+		assert.Equal(t, *meta, readVolumeMeta(t, filepath.Join(bp, "vol")))
+	})
+
+	t.Run("remove_source", func(t *testing.T) {
+		s, bp, mock, src := setup(t)
+		mock.RunFn = adoptRunFn(nil, "false")
+
+		_, err := s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: src, SizeBytes: 1 << 20, RemoveSource: true})
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(bp, "vol", config.DataDir, "file"))
+		assert.NoDirExists(t, src)
+	})
+
+	t.Run("symlink_to_tenant_dir", func(t *testing.T) {
+		s, bp, _, _ := setup(t)
+		volDir := setupUsageVol(t, bp, "existing", VolumeMetadata{Name: "existing"})
+		link := filepath.Join(s.basePath, "legacy", "link")
+		require.NoError(t, os.Symlink(filepath.Join(volDir, config.DataDir), link))
+
+		_, err := s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: link, SizeBytes: 1 << 20})
+		requireStorageError(t, err, ErrInvalid)
+		assert.DirExists(t, filepath.Join(volDir, config.DataDir))
+	})
+
+	t.Run("relative_base_path", func(t *testing.T) {
+		s, bp, _, _ := setup(t)
+		volDir := setupUsageVol(t, bp, "existing", VolumeMetadata{Name: "existing"})
+		wd, err := os.Getwd()
+		require.NoError(t, err)
+		rel, err := filepath.Rel(wd, s.basePath)
+		require.NoError(t, err)
+		s.basePath = rel
+
+		_, err = s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: filepath.Join(volDir, config.DataDir), SizeBytes: 1 << 20})
+		requireStorageError(t, err, ErrInvalid)
+		assert.DirExists(t, filepath.Join(volDir, config.DataDir))
+	})
+
+	t.Run("subvolume", func(t *testing.T) {
+		s, bp, mock, src := setup(t)
+		s.quotaEnabled = true
+		qgroup := qgroupRunFn(8192, 8192)
+		adopt := adoptRunFn(map[string]bool{src: true}, "false")
+		mock.RunFn = func(args []string) (string, error) {
+			if args[0] == "qgroup" || (args[0] == "subvolume" && args[1] == "show" && !strings.HasPrefix(args[2], src)) {
+				return qgroup(args)
+			}
+			return adopt(args)
+		}
+
+		meta, err := s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: src, SizeBytes: 1 << 20})
+		require.NoError(t, err)
+
+		dataDir := filepath.Join(bp, "vol", config.DataDir)
+		assert.FileExists(t, filepath.Join(dataDir, "file"))
+		assert.NoDirExists(t, src)
+		assert.False(t, containsCall(mock.Calls, "subvolume", "create", dataDir))
+		assert.True(t, containsCall(mock.Calls, "qgroup", "limit", "1048576", dataDir))
+		assert.Equal(t, uint64(8192), meta.UsedBytes)
+		assert.Equal(t, "750", meta.Mode)
+	})
+
+	t.Run("subvolume_over_size", func(t *testing.T) {
+		s, _, mock, src := setup(t)
+		s.quotaEnabled = true
+		adopt := adoptRunFn(map[string]bool{src: true}, "false")
+		mock.RunFn = func(args []string) (string, error) {
+			if args[0] == "qgroup" {
+				return qgroupRunFn(2<<20, 2<<20)(args)
+			}
+			return adopt(args)
+		}
+
+		_, err := s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: src, SizeBytes: 1 << 20})
+		requireStorageError(t, err, ErrInvalid)
+		assert.Contains(t, err.Error(), "2097152 bytes in use")
+		assert.DirExists(t, src)
+	})
+
+	t.Run("readonly_subvolume", func(t *testing.T) {
+		s, _, mock, src := setup(t)
+		mock.RunFn = adoptRunFn(map[string]bool{src: true}, "true")
+
+		_, err := s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: src, SizeBytes: 1 << 20})
+		requireStorageError(t, err, ErrInvalid)
+		assert.DirExists(t, src)
+	})
+
+	t.Run("copy_failure", func(t *testing.T) {
+		s, bp, mock, src := setup(t)
+		adopt := adoptRunFn(nil, "false")
+		mock.RunFn = func(args []string) (string, error) {
+			if args[0] == "-a" {
+				return "", errors.New("cp: failed to clone: Invalid cross-device link")
+			}
+			return adopt(args)
+		}
+
+		_, err := s.AdoptVolume(ctx, "test", "vol", VolumeAdoptRequest{Path: src, SizeBytes: 1 << 20})
+		require.Error(t, err)
+		assert.True(t, containsCall(mock.Calls, "subvolume", "delete", filepath.Join(bp, "vol", config.DataDir)))
+		assert.NoDirExists(t, filepath.Join(bp, "vol"))
+		assert.FileExists(t, filepath.Join(src, "file"))
+	})
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// balanceCheckInterval is how often the auto balancer checks unallocated space.
+	balanceCheckInterval = 10 * time.Minute
+	// autoBalanceCooldown is the minimum time between two automatic balances,
+	// so a balance that could not free enough space is not restarted right away.
+	autoBalanceCooldown = time.Hour
+)
+
+// BalanceStatus returns the state of the balance. Like a scrub, a balance
+// always covers the whole filesystem.
+func (s *Storage) BalanceStatus(ctx context.Context) (*btrfs.BalanceStatus, error) {
+	st, err := s.btrfs.BalanceStatus(ctx, s.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("balance status: %w", err)
+	}
+	s.setBalanceStatus(st)
+	return &st, nil
+}
+
+// StartBalance starts a usage-filtered balance in the background. It
+// relocates chunks filled up to the given percentage into fewer chunks and
+// returns the freed ones to unallocated space.
+func (s *Storage) StartBalance(ctx context.Context, req BalanceRequest) (*btrfs.BalanceStatus, error) {
+	if req.DataUsage == nil && req.MetadataUsage == nil {
+		return nil, &StorageError{Code: ErrInvalid, Message: "data_usage or metadata_usage is required, full balance is not supported"}
+	}
+	for _, u := range []*int{req.DataUsage, req.MetadataUsage} {
+		if u != nil && (*u < 0 || *u > 100) {
+			return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("usage filter must be between 0 and 100, got %d", *u)}
+		}
+	}
+
+	st, err := s.BalanceStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if st.Active() {
+		return nil, &StorageError{Code: ErrBusy, Message: fmt.Sprintf("balance is already %s", st.Status)}
+	}
+	if err := s.btrfs.BalanceStart(ctx, s.mountPoint, btrfs.BalanceFilters{DataUsage: req.DataUsage, MetadataUsage: req.MetadataUsage}); err != nil {
+		return nil, fmt.Errorf("balance start: %w", err)
+	}
+	log.Info().Str("path", s.mountPoint).Interface("data_usage", req.DataUsage).Interface("metadata_usage", req.MetadataUsage).Msg("balance started")
+	return s.BalanceStatus(ctx)
+}
+
+// CancelBalance cancels the running or paused balance. Chunks relocated so
+// far stay relocated.
+func (s *Storage) CancelBalance(ctx context.Context) (*btrfs.BalanceStatus, error) {
+	st, err := s.BalanceStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Active() {
+		return nil, &StorageError{Code: ErrInvalid, Message: "no balance is running"}
+	}
+	if err := s.btrfs.BalanceCancel(ctx, s.mountPoint); err != nil {
+		return nil, fmt.Errorf("balance cancel: %w", err)
+	}
+	log.Info().Str("path", s.mountPoint).Msg("balance cancelled")
+	return s.BalanceStatus(ctx)
+}
+
+// StartAutoBalancer starts a balance of data chunks filled up to usage percent
+// whenever unallocated space drops below minUnallocated bytes. Without
+// unallocated space btrfs cannot allocate new metadata chunks and writes fail
+// with ENOSPC although data chunks still have free space.
+func (s *Storage) StartAutoBalancer(ctx context.Context, minUnallocated uint64, usage int) {
+	go func() {
+		s.runAutoBalance(ctx, minUnallocated, usage, time.Now())
+		ticker := time.NewTicker(balanceCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.runAutoBalance(ctx, minUnallocated, usage, now)
+			}
+		}
+	}()
+}
+
+func (s *Storage) runAutoBalance(ctx context.Context, minUnallocated uint64, usage int, now time.Time) {
+	if !s.lastAutoBalance.IsZero() && now.Sub(s.lastAutoBalance) < autoBalanceCooldown {
+		return
+	}
+	fu, err := s.btrfs.FilesystemUsage(ctx, s.mountPoint)
+	if err != nil {
+		log.Warn().Err(err).Msg("auto balancer: failed to get filesystem usage")
+		return
+	}
+	if fu.UnallocatedBytes >= minUnallocated {
+		return
+	}
+
+	st, err := s.BalanceStatus(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("auto balancer: failed to get balance status")
+		return
+	}
+	if st.Active() {
+		return
+	}
+	if _, err := s.StartBalance(ctx, BalanceRequest{DataUsage: &usage}); err != nil {
+		log.Error().Err(err).Msg("auto balancer: failed to start balance")
+		return
+	}
+	s.lastAutoBalance = now
+	AutoBalanceTotal.WithLabelValues(s.basePath).Inc()
+	log.Warn().Uint64("unallocated", fu.UnallocatedBytes).Uint64("threshold", minUnallocated).Int("data_usage", usage).Msg("auto balancer: unallocated space low, balance started")
+}
+
+// setBalanceStatus caches st for DeviceStats and updates the balance metrics.
+func (s *Storage) setBalanceStatus(st btrfs.BalanceStatus) {
+	s.cachedBalance.Store(&st)
+
+	running := 0.0
+	if st.Running() {
+		running = 1
+	}
+	BalanceRunningGauge.WithLabelValues(s.basePath).Set(running)
+	BalanceProgressRatio.WithLabelValues(s.basePath).Set(st.Progress())
+}
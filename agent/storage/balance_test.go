@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	balanceIdleOut    = "No balance found on '/mnt'\n"
+	balanceRunningOut = "Balance on '/mnt' is running\n5 out of about 10 chunks balanced (6 considered),  50% left\n"
+)
+
+// balanceRunner fakes `btrfs balance status` and `btrfs filesystem usage`
+// with the given output and unallocated bytes.
+func balanceRunner(status string, unallocated uint64) func(args []string) (string, error) {
+	return func(args []string) (string, error) {
+		switch {
+		case args[0] == "balance" && args[1] == "status":
+			return status, nil
+		case args[0] == "filesystem" && args[1] == "usage":
+			return fmt.Sprintf("Overall:\n    Device size:\t\t10737418240\n    Device unallocated:\t\t%d\n", unallocated), nil
+		}
+		return "", nil
+	}
+}
+
+func TestStartBalance(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("starts", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceIdleOut, 0)
+
+		_, err := s.StartBalance(ctx, BalanceRequest{DataUsage: ptrInt(10)})
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "balance", "start", "--bg", "-dusage=10", s.mountPoint))
+	})
+
+	t.Run("no_filter", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceIdleOut, 0)
+
+		_, err := s.StartBalance(ctx, BalanceRequest{})
+		requireStorageError(t, err, ErrInvalid)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("usage_out_of_range", func(t *testing.T) {
+		s, _, _, _ := newTestStorage(t)
+
+		_, err := s.StartBalance(ctx, BalanceRequest{MetadataUsage: ptrInt(101)})
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("already_running", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceRunningOut, 0)
+
+		_, err := s.StartBalance(ctx, BalanceRequest{DataUsage: ptrInt(10)})
+		requireStorageError(t, err, ErrBusy)
+		assert.Equal(t, 1.0, testutil.ToFloat64(BalanceRunningGauge.WithLabelValues(s.basePath)))
+		assert.Equal(t, 0.5, testutil.ToFloat64(BalanceProgressRatio.WithLabelValues(s.basePath)))
+	})
+
+	t.Run("cancel_not_running", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceIdleOut, 0)
+
+		_, err := s.CancelBalance(ctx)
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceRunningOut, 0)
+
+		_, err := s.CancelBalance(ctx)
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "balance", "cancel", s.mountPoint))
+	})
+}
+
+func TestRunAutoBalance(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 15, 13, 45, 0, 0, time.UTC)
+	const gib = 1 << 30
+
+	t.Run("enough_unallocated", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceIdleOut, 5*gib)
+
+		s.runAutoBalance(ctx, 2*gib, 20, now)
+		assert.False(t, containsCall(runner.Calls, "balance", "start", "--bg", "-dusage=20", s.mountPoint))
+	})
+
+	t.Run("low_unallocated", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceIdleOut, gib)
+		before := testutil.ToFloat64(AutoBalanceTotal.WithLabelValues(s.basePath))
+
+		s.runAutoBalance(ctx, 2*gib, 20, now)
+		assert.True(t, containsCall(runner.Calls, "balance", "start", "--bg", "-dusage=20", s.mountPoint))
+		assert.Equal(t, before+1, testutil.ToFloat64(AutoBalanceTotal.WithLabelValues(s.basePath)))
+
+		// cooldown
+		runner.Calls = nil
+		s.runAutoBalance(ctx, 2*gib, 20, now.Add(30*time.Minute))
+		assert.Empty(t, runner.Calls)
+
+		s.runAutoBalance(ctx, 2*gib, 20, now.Add(autoBalanceCooldown))
+		assert.True(t, containsCall(runner.Calls, "balance", "start", "--bg", "-dusage=20", s.mountPoint))
+	})
+
+	t.Run("already_running", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = balanceRunner(balanceRunningOut, gib)
+
+		s.runAutoBalance(ctx, 2*gib, 20, now)
+		assert.False(t, containsCall(runner.Calls, "balance", "start", "--bg", "-dusage=20", s.mountPoint))
+		assert.True(t, s.lastAutoBalance.IsZero())
+	})
+}
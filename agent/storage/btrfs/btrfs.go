@@ -2,42 +2,113 @@ package btrfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+
+	"github.com/rs/zerolog/log"
 )
 
-// TODO: Maybe better scraping? JSON support got added in 6.1 btrfs-progs!
-// TODO: Add functionality for squota
+const defaultSysfsRoot = "/sys/fs/btrfs"
 
 type Manager struct {
-	bin string
-	cmd utils.Runner
+	bin       string
+	cmd       utils.Runner
+	sysfs     string
+	quotaMode QuotaMode
+	backend   Backend
+	json      bool // btrfs-progs supports --format json
 }
 
+// NewManager returns a Manager for the btrfs binary bin. The btrfs-progs
+// version is checked once here; 6.1 and newer are parsed via JSON output.
 func NewManager(bin string) *Manager {
-	return &Manager{bin: bin, cmd: &utils.ShellRunner{}}
+	m := &Manager{bin: bin, cmd: &utils.ShellRunner{}, sysfs: defaultSysfsRoot, quotaMode: QuotaModeQgroup, backend: BackendCLI}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m.detectJSON(ctx)
+	return m
 }
 
 func NewManagerWithRunner(bin string, r utils.Runner) *Manager {
-	return &Manager{bin: bin, cmd: r}
+	return &Manager{bin: bin, cmd: r, sysfs: defaultSysfsRoot, quotaMode: QuotaModeQgroup, backend: BackendCLI}
 }
 
-func (m *Manager) SubvolumeCreate(ctx context.Context, path string) error {
-	return m.run(ctx, "subvolume", "create", path)
+// SetBackend selects the backend for subvolume and qgroup operations, see
+// ProbeIoctl before switching to BackendIoctl.
+func (m *Manager) SetBackend(b Backend) { m.backend = b }
+
+// Backend returns the backend used for subvolume and qgroup operations.
+func (m *Manager) Backend() Backend { return m.backend }
+
+// SubvolumeCreate creates the subvolume path. Its level 0 qgroup becomes a
+// member of the given higher level qgroups as part of the creation, which
+// needs no quota rescan unlike a later QgroupAssign.
+func (m *Manager) SubvolumeCreate(ctx context.Context, path string, qgroups ...string) error {
+	if m.backend == BackendIoctl {
+		return ioctlSubvolumeCreate(path, qgroups)
+	}
+	args := append([]string{"subvolume", "create"}, inheritArgs(qgroups)...)
+	return m.run(ctx, append(args, path)...)
 }
 
 func (m *Manager) SubvolumeDelete(ctx context.Context, path string) error {
+	if m.backend == BackendIoctl {
+		return ioctlSubvolumeDelete(path)
+	}
 	return m.run(ctx, "subvolume", "delete", path)
 }
 
-func (m *Manager) SubvolumeSnapshot(ctx context.Context, src, dst string, readonly bool) error {
+// SubvolumeSnapshot snapshots src to dst, joining the given higher level
+// qgroups like SubvolumeCreate. The kernel keeps the numbers exact if the
+// snapshot joins the one parent qgroup of src, otherwise it may still mark
+// the quota inconsistent.
+func (m *Manager) SubvolumeSnapshot(ctx context.Context, src, dst string, readonly bool, qgroups ...string) error {
+	if m.backend == BackendIoctl {
+		return ioctlSubvolumeSnapshot(src, dst, readonly, qgroups)
+	}
+	args := []string{"subvolume", "snapshot"}
 	if readonly {
-		return m.run(ctx, "subvolume", "snapshot", "-r", src, dst)
+		args = append(args, "-r")
 	}
-	return m.run(ctx, "subvolume", "snapshot", src, dst)
+	args = append(args, inheritArgs(qgroups)...)
+	return m.run(ctx, append(args, src, dst)...)
+}
+
+// inheritArgs returns the -i options adding a new subvolume to qgroups.
+func inheritArgs(qgroups []string) []string {
+	var args []string
+	for _, q := range qgroups {
+		args = append(args, "-i", q)
+	}
+	return args
+}
+
+// Send writes a `btrfs send` stream of the read-only subvolume at path to w.
+// If parent is set, only the delta against parent is sent (`btrfs send -p`).
+func (m *Manager) Send(ctx context.Context, path, parent string, w io.Writer) error {
+	args := []string{"send", "-q"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	args = append(args, path)
+	return m.cmd.Stream(ctx, nil, w, m.bin, args...)
+}
+
+// Receive applies a `btrfs send` stream read from r, creating the received
+// subvolume inside dir. -e stops at the end-of-stream marker instead of
+// waiting for EOF, so a trailing connection close is not required. -C
+// confines the stream to dir, the stream comes from the client.
+func (m *Manager) Receive(ctx context.Context, dir string, r io.Reader) error {
+	return m.cmd.Stream(ctx, r, nil, m.bin, "receive", "-e", "-C", dir)
 }
 
 // QuotaCheck verifies that btrfs quota is enabled on the filesystem.
@@ -45,7 +116,48 @@ func (m *Manager) QuotaCheck(ctx context.Context, path string) error {
 	return m.run(ctx, "qgroup", "show", path)
 }
 
+// DetectQuotaMode returns the quota accounting mode enabled on the filesystem
+// containing path. Kernels before 6.7 have no mode attribute in sysfs and only
+// support full qgroups.
+func (m *Manager) DetectQuotaMode(ctx context.Context, path string) (QuotaMode, error) {
+	if err := m.QuotaCheck(ctx, path); err != nil {
+		return "", fmt.Errorf("quota not enabled: %w", err)
+	}
+	out, err := m.cmd.Run(ctx, m.bin, "filesystem", "show", "--raw", path)
+	if err != nil {
+		return "", err
+	}
+	uuid, err := parseFilesystemUUID(out)
+	if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(filepath.Join(m.sysfs, uuid, "qgroups", "mode"))
+	if os.IsNotExist(err) {
+		return QuotaModeQgroup, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read quota mode: %w", err)
+	}
+	switch mode := strings.TrimSpace(string(raw)); mode {
+	case "qgroup":
+		return QuotaModeQgroup, nil
+	case "squota":
+		return QuotaModeSimple, nil
+	default:
+		return "", fmt.Errorf("unsupported quota mode %q", mode)
+	}
+}
+
+// SetQuotaMode records the accounting mode detected at startup, see QuotaMode.
+func (m *Manager) SetQuotaMode(mode QuotaMode) { m.quotaMode = mode }
+
+// QuotaMode returns the accounting mode QgroupUsageEx results are based on.
+func (m *Manager) QuotaMode() QuotaMode { return m.quotaMode }
+
 func (m *Manager) QgroupLimit(ctx context.Context, path string, bytes uint64) error {
+	if m.backend == BackendIoctl {
+		return ioctlQgroupLimit(path, bytes)
+	}
 	return m.run(ctx, "qgroup", "limit", fmt.Sprintf("%d", bytes), path)
 }
 
@@ -59,20 +171,27 @@ func (m *Manager) QgroupUsage(ctx context.Context, path string) (uint64, error)
 }
 
 // QgroupUsageEx returns both referenced and exclusive bytes for the subvolume's qgroup.
+// With simple quotas a subvolume is only charged for extents it allocated
+// itself: both values are equal, and snapshots and clones start at zero
+// since their shared extents stay charged to the source.
 func (m *Manager) QgroupUsageEx(ctx context.Context, path string) (QgroupInfo, error) {
+	if m.backend == BackendIoctl {
+		return ioctlQgroupUsage(path)
+	}
+	if m.json {
+		info, err := m.qgroupUsageJSON(ctx, path)
+		if err == nil || errors.Is(err, errQgroupNotFound) {
+			return info, err
+		}
+		log.Debug().Err(err).Str("path", path).Msg("btrfs json output failed, falling back to text")
+	}
+
 	// get subvolume ID to find the correct qgroup
 	showOut, err := m.cmd.Run(ctx, m.bin, "subvolume", "show", path)
 	if err != nil {
 		return QgroupInfo{}, err
 	}
-	var subvolID string
-	for _, line := range strings.Split(showOut, "\n") {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, "Subvolume ID:") {
-			subvolID = strings.TrimSpace(strings.TrimPrefix(trimmed, "Subvolume ID:"))
-			break
-		}
-	}
+	subvolID := parseSubvolumeID(showOut)
 	if subvolID == "" {
 		return QgroupInfo{}, fmt.Errorf("subvolume ID not found for %s", path)
 	}
@@ -83,20 +202,142 @@ func (m *Manager) QgroupUsageEx(ctx context.Context, path string) (QgroupInfo, e
 	if err != nil {
 		return QgroupInfo{}, err
 	}
-	for _, line := range strings.Split(out, "\n") {
-		fields := strings.Fields(line)
-		if len(fields) >= 3 && fields[0] == qgroupID {
-			var info QgroupInfo
-			if _, err := fmt.Sscanf(fields[1], "%d", &info.Referenced); err != nil {
-				return QgroupInfo{}, fmt.Errorf("parse referenced bytes %q: %w", fields[1], err)
+	info, found, err := parseQgroupShow(out, qgroupID)
+	if err != nil {
+		return QgroupInfo{}, err
+	}
+	if !found {
+		return QgroupInfo{}, fmt.Errorf("qgroup %s not found for %s", qgroupID, path)
+	}
+	return info, nil
+}
+
+// SubvolumeID returns the ID of the subvolume at path, which is also the
+// ID of its level 0 qgroup.
+func (m *Manager) SubvolumeID(ctx context.Context, path string) (uint64, error) {
+	if m.backend == BackendIoctl {
+		return ioctlSubvolumeID(path)
+	}
+	if m.json {
+		out, err := m.runJSON(ctx, "subvolume", "show", path)
+		if err == nil {
+			var id string
+			if id, err = parseSubvolumeIDJSON(out); err == nil {
+				return strconv.ParseUint(id, 10, 64)
 			}
-			if _, err := fmt.Sscanf(fields[2], "%d", &info.Exclusive); err != nil {
-				return QgroupInfo{}, fmt.Errorf("parse exclusive bytes %q: %w", fields[2], err)
+		}
+		log.Debug().Err(err).Str("path", path).Msg("btrfs json output failed, falling back to text")
+	}
+	out, err := m.cmd.Run(ctx, m.bin, "subvolume", "show", path)
+	if err != nil {
+		return 0, err
+	}
+	id := parseSubvolumeID(out)
+	if id == "" {
+		return 0, fmt.Errorf("subvolume ID not found for %s", path)
+	}
+	return strconv.ParseUint(id, 10, 64)
+}
+
+// QgroupCreate creates a higher level qgroup such as 1/1 on the filesystem
+// containing path. Qgroup hierarchy operations always run through btrfs-progs.
+func (m *Manager) QgroupCreate(ctx context.Context, qgroupID, path string) error {
+	return m.run(ctx, "qgroup", "create", qgroupID, path)
+}
+
+// QgroupAssign makes the level 0 qgroup of the subvolume at path a member of
+// parent. btrfs-progs rescans the quota if the assignment left it inconsistent,
+// e.g. if the subvolume shares extents with others. New subvolumes join their
+// qgroups on creation instead, see SubvolumeCreate.
+func (m *Manager) QgroupAssign(ctx context.Context, path, parent string) error {
+	id, err := m.SubvolumeID(ctx, path)
+	if err != nil {
+		return err
+	}
+	return m.run(ctx, "qgroup", "assign", fmt.Sprintf("0/%d", id), parent, path)
+}
+
+// QgroupUnassign removes the level 0 qgroup of the subvolume at path from parent.
+func (m *Manager) QgroupUnassign(ctx context.Context, path, parent string) error {
+	id, err := m.SubvolumeID(ctx, path)
+	if err != nil {
+		return err
+	}
+	return m.run(ctx, "qgroup", "remove", fmt.Sprintf("0/%d", id), parent, path)
+}
+
+// QgroupGroupDestroy removes the qgroup qgroupID, it must have no members.
+func (m *Manager) QgroupGroupDestroy(ctx context.Context, qgroupID, path string) error {
+	return m.run(ctx, "qgroup", "destroy", qgroupID, path)
+}
+
+// QgroupLimitGroup sets the referenced limit of the qgroup qgroupID, zero
+// removes it.
+func (m *Manager) QgroupLimitGroup(ctx context.Context, qgroupID string, bytes uint64, path string) error {
+	limit := "none"
+	if bytes > 0 {
+		limit = strconv.FormatUint(bytes, 10)
+	}
+	return m.run(ctx, "qgroup", "limit", limit, qgroupID, path)
+}
+
+// QgroupGroupUsage returns the usage of the qgroup qgroupID, found is false
+// if the filesystem containing path has no such qgroup.
+func (m *Manager) QgroupGroupUsage(ctx context.Context, qgroupID, path string) (QgroupInfo, bool, error) {
+	if m.json {
+		out, err := m.runJSON(ctx, "qgroup", "show", "-re", "--raw", path)
+		if err == nil {
+			var info QgroupInfo
+			var found bool
+			if info, found, err = parseQgroupShowJSON(out, qgroupID); err == nil {
+				return info, found, nil
 			}
-			return info, nil
 		}
+		log.Debug().Err(err).Str("path", path).Msg("btrfs json output failed, falling back to text")
+	}
+	out, err := m.cmd.Run(ctx, m.bin, "qgroup", "show", "-re", "--raw", path)
+	if err != nil {
+		return QgroupInfo{}, false, err
+	}
+	return parseQgroupShow(out, qgroupID)
+}
+
+// QgroupGroupIDs returns the IDs of the level 1 qgroups of the filesystem
+// containing path, e.g. 5 for 1/5.
+func (m *Manager) QgroupGroupIDs(ctx context.Context, path string) ([]uint64, error) {
+	out, err := m.cmd.Run(ctx, m.bin, "qgroup", "show", "--raw", path)
+	if err != nil {
+		return nil, err
+	}
+	return parseQgroupLevelIDs(out, 1), nil
+}
+
+var errQgroupNotFound = errors.New("qgroup not found")
+
+func (m *Manager) qgroupUsageJSON(ctx context.Context, path string) (QgroupInfo, error) {
+	showOut, err := m.runJSON(ctx, "subvolume", "show", path)
+	if err != nil {
+		return QgroupInfo{}, err
+	}
+	subvolID, err := parseSubvolumeIDJSON(showOut)
+	if err != nil {
+		return QgroupInfo{}, err
 	}
-	return QgroupInfo{}, fmt.Errorf("qgroup %s not found for %s", qgroupID, path)
+
+	qgroupID := "0/" + subvolID
+
+	out, err := m.runJSON(ctx, "qgroup", "show", "-re", "--raw", path)
+	if err != nil {
+		return QgroupInfo{}, err
+	}
+	info, found, err := parseQgroupShowJSON(out, qgroupID)
+	if err != nil {
+		return QgroupInfo{}, err
+	}
+	if !found {
+		return QgroupInfo{}, fmt.Errorf("%w: qgroup %s not found for %s", errQgroupNotFound, qgroupID, path)
+	}
+	return info, nil
 }
 
 func (m *Manager) SetNoCOW(ctx context.Context, path string) error {
@@ -111,6 +352,36 @@ func (m *Manager) SetCompression(ctx context.Context, path string, algo string)
 	return m.run(ctx, "property", "set", path, "compression", algo)
 }
 
+// Defragment recursively defragments path and rewrites its data with the
+// given compression algorithm, the level is not passed on. Empty or "none"
+// keeps the compression of each file. Every processed file is written to
+// progress as one line (-v).
+func (m *Manager) Defragment(ctx context.Context, path, compression string, progress io.Writer) error {
+	args := []string{"filesystem", "defragment", "-v", "-r"}
+	if compression != "" && compression != "none" {
+		if !utils.IsValidCompression(compression) {
+			return fmt.Errorf("invalid compression algorithm: %s", compression)
+		}
+		algo, _, _ := strings.Cut(compression, ":")
+		args = append(args, "-c"+algo)
+	}
+	return m.cmd.Stream(ctx, nil, progress, m.bin, append(args, path)...)
+}
+
+// ReflinkCopy copies the contents of the directory src into dst, sharing the
+// data extents instead of copying them. Ownership, modes and timestamps are
+// preserved, also on dst itself.
+func (m *Manager) ReflinkCopy(ctx context.Context, src, dst string) error {
+	_, err := m.cmd.Run(ctx, "cp", "-a", "--reflink=always", src+"/.", dst)
+	return err
+}
+
+// FilesystemSync commits the current transaction, qgroup numbers are only
+// updated on commit.
+func (m *Manager) FilesystemSync(ctx context.Context, path string) error {
+	return m.run(ctx, "filesystem", "sync", path)
+}
+
 // IsBtrfs checks whether the given path resides on a btrfs filesystem
 // by inspecting the filesystem magic number via statfs(2).
 func IsBtrfs(path string) bool {
@@ -132,16 +403,63 @@ func (m *Manager) run(ctx context.Context, args ...string) error {
 	return err
 }
 
-// TODO: use SubvolumeExists and SubvolumeList for a periodic consistency check
-// that compares metadata.json entries against actual btrfs subvolumes.
-// Should be fine since we anyways just list subvols for this specific path.
+// runJSON runs a btrfs command with JSON output enabled.
+func (m *Manager) runJSON(ctx context.Context, args ...string) (string, error) {
+	return m.cmd.Run(ctx, m.bin, append([]string{"--format", "json"}, args...)...)
+}
+
+// detectJSON enables JSON output if the installed btrfs-progs supports it.
+func (m *Manager) detectJSON(ctx context.Context) {
+	out, err := m.cmd.Run(ctx, m.bin, "--version")
+	if err != nil {
+		log.Debug().Err(err).Msg("btrfs version check failed, using text output")
+		return
+	}
+	m.json = supportsJSON(out)
+	log.Debug().Str("version", strings.TrimSpace(out)).Bool("json", m.json).Msg("btrfs-progs detected")
+}
+
+// SubvolumeExists reports whether path is the root of a subvolume.
 func (m *Manager) SubvolumeExists(ctx context.Context, path string) bool {
+	if m.backend == BackendIoctl {
+		return isSubvolumeRoot(path)
+	}
 	err := m.run(ctx, "subvolume", "show", path)
 	return err == nil
 }
 
+// GetProperty returns the value of the btrfs property name on path, empty if
+// it is not set. Output format: compression=zstd
+func (m *Manager) GetProperty(ctx context.Context, path, name string) (string, error) {
+	out, err := m.cmd.Run(ctx, m.bin, "property", "get", path, name)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), name+"="); ok {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// QgroupIDs returns the level 0 qgroups of the filesystem containing path.
+func (m *Manager) QgroupIDs(ctx context.Context, path string) ([]uint64, error) {
+	out, err := m.cmd.Run(ctx, m.bin, "qgroup", "show", "--raw", path)
+	if err != nil {
+		return nil, err
+	}
+	return parseQgroupIDs(out), nil
+}
+
+// QgroupDestroy removes the level 0 qgroup of subvolume id, e.g. a qgroup
+// left behind by a deleted subvolume.
+func (m *Manager) QgroupDestroy(ctx context.Context, id uint64, path string) error {
+	return m.run(ctx, "qgroup", "destroy", fmt.Sprintf("0/%d", id), path)
+}
+
 // Devices returns device info for a btrfs filesystem by parsing
-// the output of `btrfs filesystem show`. Returns kernel device paths
+// the output of `btrfs filesystem show`, which has no JSON output. Returns kernel device paths
 // (e.g. /dev/dm-0), not mapper symlinks - works inside containers.
 // Devices that are physically absent are marked as Missing.
 func (m *Manager) Devices(ctx context.Context, path string) ([]BTRFSDevice, error) {
@@ -155,6 +473,18 @@ func (m *Manager) Devices(ctx context.Context, path string) ([]BTRFSDevice, erro
 // DeviceErrors runs `btrfs device stats <path>` and parses per-device error counters.
 // Output format: [/dev/sda].write_io_errs    0
 func (m *Manager) DeviceErrors(ctx context.Context, path string) ([]DeviceErrors, error) {
+	if m.json {
+		out, err := m.runJSON(ctx, "device", "stats", path)
+		if err == nil {
+			all, perr := parseDeviceErrorsJSON(out)
+			if perr == nil {
+				return all, nil
+			}
+			err = perr
+		}
+		log.Debug().Err(err).Str("path", path).Msg("btrfs json output failed, falling back to text")
+	}
+
 	out, err := m.cmd.Run(ctx, m.bin, "device", "stats", path)
 	if err != nil {
 		return nil, err
@@ -163,6 +493,7 @@ func (m *Manager) DeviceErrors(ctx context.Context, path string) ([]DeviceErrors
 }
 
 // FilesystemUsage runs `btrfs filesystem usage -b <path>` and parses allocation info.
+// btrfs-progs has no JSON output for filesystem usage yet.
 func (m *Manager) FilesystemUsage(ctx context.Context, path string) (FilesystemUsage, error) {
 	out, err := m.cmd.Run(ctx, m.bin, "filesystem", "usage", "-b", path)
 	if err != nil {
@@ -171,8 +502,93 @@ func (m *Manager) FilesystemUsage(ctx context.Context, path string) (FilesystemU
 	return parseFilesystemUsage(out)
 }
 
+// ScrubStart starts a scrub of the filesystem containing path in the
+// background. It fails if a scrub is already running.
+func (m *Manager) ScrubStart(ctx context.Context, path string) error {
+	return m.run(ctx, "scrub", "start", path)
+}
+
+// ScrubCancel cancels the running scrub of the filesystem containing path.
+func (m *Manager) ScrubCancel(ctx context.Context, path string) error {
+	return m.run(ctx, "scrub", "cancel", path)
+}
+
+// ScrubStatus returns the state of the current or last scrub. btrfs-progs
+// keeps the result of finished scrubs in /var/lib/btrfs, the kernel only
+// knows about a running one. There is no JSON output for scrub status.
+func (m *Manager) ScrubStatus(ctx context.Context, path string) (ScrubStatus, error) {
+	out, err := m.cmd.Run(ctx, m.bin, "scrub", "status", "--raw", path)
+	if err != nil {
+		return ScrubStatus{}, err
+	}
+	return parseScrubStatus(out)
+}
+
+// BalanceStart starts a filtered balance in the background. Without any
+// filter btrfs-progs would balance every chunk, which callers must not ask for.
+func (m *Manager) BalanceStart(ctx context.Context, path string, f BalanceFilters) error {
+	args := []string{"balance", "start", "--bg"}
+	if f.DataUsage != nil {
+		args = append(args, "-dusage="+strconv.Itoa(*f.DataUsage))
+	}
+	if f.MetadataUsage != nil {
+		args = append(args, "-musage="+strconv.Itoa(*f.MetadataUsage))
+	}
+	return m.run(ctx, append(args, path)...)
+}
+
+// BalanceCancel cancels the running or paused balance of the filesystem
+// containing path. It returns once the current chunk is relocated.
+func (m *Manager) BalanceCancel(ctx context.Context, path string) error {
+	return m.run(ctx, "balance", "cancel", path)
+}
+
+// BalanceStatus returns the state of the balance. `btrfs balance status`
+// exits 1 while a balance is running, so the output decides, not the exit code.
+func (m *Manager) BalanceStatus(ctx context.Context, path string) (BalanceStatus, error) {
+	out, err := m.cmd.Run(ctx, m.bin, "balance", "status", path)
+	st, perr := parseBalanceStatus(out)
+	if perr != nil {
+		if err != nil {
+			return BalanceStatus{}, err
+		}
+		return BalanceStatus{}, perr
+	}
+	return st, nil
+}
+
+// LogicalResolve returns the files referencing the logical address, as
+// absolute paths below path (the mount point).
+func (m *Manager) LogicalResolve(ctx context.Context, logical uint64, path string) ([]string, error) {
+	out, err := m.cmd.Run(ctx, m.bin, "inspect-internal", "logical-resolve", strconv.FormatUint(logical, 10), path)
+	if err != nil {
+		return nil, err
+	}
+	return parseResolvedPaths(out), nil
+}
+
+// InodeResolve returns the paths of inode in the subvolume mounted or
+// located at path.
+func (m *Manager) InodeResolve(ctx context.Context, inode uint64, path string) ([]string, error) {
+	out, err := m.cmd.Run(ctx, m.bin, "inspect-internal", "inode-resolve", strconv.FormatUint(inode, 10), path)
+	if err != nil {
+		return nil, err
+	}
+	return parseResolvedPaths(out), nil
+}
+
+// SubvolumeList lists the subvolumes below path.
 func (m *Manager) SubvolumeList(ctx context.Context, path string) ([]SubvolumeInfo, error) {
-	out, err := m.cmd.Run(ctx, m.bin, "subvolume", "list", "-o", path)
+	return m.subvolumeList(ctx, "-o", path)
+}
+
+// SubvolumeListAll lists every subvolume of the filesystem containing path.
+func (m *Manager) SubvolumeListAll(ctx context.Context, path string) ([]SubvolumeInfo, error) {
+	return m.subvolumeList(ctx, path)
+}
+
+func (m *Manager) subvolumeList(ctx context.Context, args ...string) ([]SubvolumeInfo, error) {
+	out, err := m.cmd.Run(ctx, m.bin, append([]string{"subvolume", "list"}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -185,7 +601,11 @@ func (m *Manager) SubvolumeList(ctx context.Context, path string) ([]SubvolumeIn
 		// format: ID <id> gen <gen> top level <tl> path <path>
 		parts := strings.Fields(line)
 		if len(parts) >= 9 {
-			subs = append(subs, SubvolumeInfo{Path: parts[8]})
+			id, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parse subvolume id %q: %w", parts[1], err)
+			}
+			subs = append(subs, SubvolumeInfo{ID: id, Path: parts[8]})
 		}
 	}
 	return subs, nil
@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
 	"github.com/rs/zerolog"
@@ -76,6 +78,22 @@ func TestQgroupUsageEx(t *testing.T) {
 		require.Len(t, m.Calls, 2)
 	})
 
+	t.Run("with limit", func(t *testing.T) {
+		m := &utils.MockRunner{
+			RunFn: func(args []string) (string, error) {
+				if slices.Contains(args, "show") && !slices.Contains(args, "-re") {
+					return showOutput, nil
+				}
+				return "0/258        16384         8192         none         none\n0/259        16384         8192   1073741824         none\n", nil
+			},
+		}
+		mgr := newTestManager(m)
+
+		info, err := mgr.QgroupUsageEx(context.Background(), "/mnt/data/vol1")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1073741824), info.MaxReferenced)
+	})
+
 	t.Run("show error", func(t *testing.T) {
 		m := &utils.MockRunner{Err: fmt.Errorf("show failed")}
 		mgr := newTestManager(m)
@@ -124,6 +142,122 @@ func TestQgroupUsageEx(t *testing.T) {
 	})
 }
 
+func TestQgroupUsageExJSON(t *testing.T) {
+	// $ btrfs --format json subvolume show /mnt/data/vol1
+	showOutput := `{
+  "__header": {"version": "1"},
+  "subvolume-show": {"path": "vol1", "name": "vol1", "uuid": "abcdef-1234", "subvolume_id": 259, "generation": 42}
+}`
+	// $ btrfs --format json qgroup show -re --raw /mnt/data/vol1
+	qgroupOutput := `{
+  "__header": {"version": "1"},
+  "qgroup-show": [
+    {"qgroupid": "0/5", "referenced": 16384, "exclusive": 16384, "max_referenced": "none", "max_exclusive": "none"},
+    {"qgroupid": "0/259", "referenced": 16384, "exclusive": 8192, "max_referenced": "1073741824", "max_exclusive": "none"}
+  ]
+}`
+
+	jsonRunner := func(show, qgroup string) *utils.MockRunner {
+		return &utils.MockRunner{
+			RunFn: func(args []string) (string, error) {
+				if slices.Contains(args, "show") && !slices.Contains(args, "-re") {
+					return show, nil
+				}
+				return qgroup, nil
+			},
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		m := jsonRunner(showOutput, qgroupOutput)
+		mgr := newTestManager(m)
+		mgr.json = true
+
+		info, err := mgr.QgroupUsageEx(context.Background(), "/mnt/data/vol1")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(16384), info.Referenced)
+		assert.Equal(t, uint64(8192), info.Exclusive)
+		assert.Equal(t, uint64(1073741824), info.MaxReferenced)
+		require.Len(t, m.Calls, 2)
+		assert.Equal(t, []string{"--format", "json", "subvolume", "show", "/mnt/data/vol1"}, m.Calls[0])
+		assert.Equal(t, []string{"--format", "json", "qgroup", "show", "-re", "--raw", "/mnt/data/vol1"}, m.Calls[1])
+	})
+
+	t.Run("qgroup not found", func(t *testing.T) {
+		m := jsonRunner(showOutput, `{"qgroup-show": [{"qgroupid": "0/999", "referenced": 1, "exclusive": 1}]}`)
+		mgr := newTestManager(m)
+		mgr.json = true
+
+		_, err := mgr.QgroupUsageEx(context.Background(), "/mnt/data/vol1")
+		assert.ErrorContains(t, err, "qgroup 0/259 not found")
+		assert.Len(t, m.Calls, 2, "valid json output must not fall back to text")
+	})
+
+	t.Run("falls back to text", func(t *testing.T) {
+		m := &utils.MockRunner{
+			RunFn: func(args []string) (string, error) {
+				if args[0] == "--format" {
+					return "", fmt.Errorf("unrecognized option '--format'")
+				}
+				if slices.Contains(args, "show") && !slices.Contains(args, "-re") {
+					return "\tSubvolume ID:\t\t259\n", nil
+				}
+				return "0/259        16384         8192\n", nil
+			},
+		}
+		mgr := newTestManager(m)
+		mgr.json = true
+
+		info, err := mgr.QgroupUsageEx(context.Background(), "/mnt/data/vol1")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(16384), info.Referenced)
+		assert.Equal(t, uint64(8192), info.Exclusive)
+		assert.Len(t, m.Calls, 3)
+	})
+
+	t.Run("unexpected json falls back to text", func(t *testing.T) {
+		m := jsonRunner("\tSubvolume ID:\t\t259\n", "0/259        16384         8192\n")
+		mgr := newTestManager(m)
+		mgr.json = true
+
+		info, err := mgr.QgroupUsageEx(context.Background(), "/mnt/data/vol1")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(16384), info.Referenced)
+	})
+}
+
+func TestSubvolumeIDJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		json      string
+		jsonErr   error
+		wantCalls int
+	}{
+		{name: "json", json: `{"subvolume-show": {"subvolume_id": 259}}`, wantCalls: 1},
+		{name: "falls back to text", jsonErr: fmt.Errorf("unrecognized option '--format'"), wantCalls: 2},
+		{name: "unexpected json falls back to text", json: "\tSubvolume ID:\t\t259\n", wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &utils.MockRunner{
+				RunFn: func(args []string) (string, error) {
+					if args[0] == "--format" {
+						return tt.json, tt.jsonErr
+					}
+					return "\tSubvolume ID:\t\t259\n", nil
+				},
+			}
+			mgr := newTestManager(m)
+			mgr.json = true
+
+			id, err := mgr.SubvolumeID(context.Background(), "/mnt/data/vol1")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(259), id)
+			assert.Len(t, m.Calls, tt.wantCalls)
+		})
+	}
+}
+
 func TestQgroupUsage(t *testing.T) {
 	showOutput := "  Subvolume ID:\t\t259\n"
 	qgroupOutput := "0/259        16384         8192\n"
@@ -143,6 +277,51 @@ func TestQgroupUsage(t *testing.T) {
 	assert.Equal(t, uint64(16384), used)
 }
 
+func TestDetectQuotaMode(t *testing.T) {
+	showOut := "Label: none  uuid: abc-123\n\tTotal devices 1 FS bytes used 1024\n"
+
+	setup := func(t *testing.T, mode string) *Manager {
+		t.Helper()
+		sysfs := t.TempDir()
+		if mode != "" {
+			dir := filepath.Join(sysfs, "abc-123", "qgroups")
+			require.NoError(t, os.MkdirAll(dir, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "mode"), []byte(mode+"\n"), 0o644))
+		}
+		mgr := newTestManager(&utils.MockRunner{Out: showOut})
+		mgr.sysfs = sysfs
+		return mgr
+	}
+
+	tests := []struct {
+		name string
+		mode string
+		want QuotaMode
+	}{
+		{name: "qgroup", mode: "qgroup", want: QuotaModeQgroup},
+		{name: "squota", mode: "squota", want: QuotaModeSimple},
+		{name: "pre_6.7_kernel", mode: "", want: QuotaModeQgroup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, err := setup(t, tt.mode).DetectQuotaMode(context.Background(), "/mnt/data")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, mode)
+		})
+	}
+
+	t.Run("unknown_mode", func(t *testing.T) {
+		_, err := setup(t, "disabled").DetectQuotaMode(context.Background(), "/mnt/data")
+		assert.ErrorContains(t, err, "unsupported quota mode")
+	})
+
+	t.Run("quota_disabled", func(t *testing.T) {
+		mgr := newTestManager(&utils.MockRunner{Err: fmt.Errorf("quotas not enabled")})
+		_, err := mgr.DetectQuotaMode(context.Background(), "/mnt/data")
+		assert.ErrorContains(t, err, "quota not enabled")
+	})
+}
+
 func TestSubvolumeList(t *testing.T) {
 	// $ btrfs subvolume list -o /mnt/data
 	// ID 259 gen 12 top level 5 path vol1
@@ -165,7 +344,19 @@ func TestSubvolumeList(t *testing.T) {
 		want := []string{"vol1", "vol2", "nested/vol3"}
 		for i, s := range subs {
 			assert.Equal(t, want[i], s.Path)
+			assert.Equal(t, uint64(259+i), s.ID)
 		}
+		assert.Equal(t, []string{"subvolume", "list", "-o", "/mnt/data"}, m.Calls[0])
+	})
+
+	t.Run("all", func(t *testing.T) {
+		m := &utils.MockRunner{Out: "ID 259 gen 12 top level 5 path vol1\n"}
+		mgr := newTestManager(m)
+
+		subs, err := mgr.SubvolumeListAll(context.Background(), "/mnt/data")
+		require.NoError(t, err)
+		require.Len(t, subs, 1)
+		assert.Equal(t, []string{"subvolume", "list", "/mnt/data"}, m.Calls[0])
 	})
 
 	t.Run("empty output", func(t *testing.T) {
@@ -186,6 +377,125 @@ func TestSubvolumeList(t *testing.T) {
 	})
 }
 
+func TestGetProperty(t *testing.T) {
+	t.Run("set", func(t *testing.T) {
+		m := &utils.MockRunner{Out: "compression=zstd\n"}
+		mgr := newTestManager(m)
+
+		v, err := mgr.GetProperty(context.Background(), "/mnt/data/vol1", "compression")
+		require.NoError(t, err)
+		assert.Equal(t, "zstd", v)
+		assert.Equal(t, []string{"property", "get", "/mnt/data/vol1", "compression"}, m.Calls[0])
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		mgr := newTestManager(&utils.MockRunner{Out: ""})
+
+		v, err := mgr.GetProperty(context.Background(), "/mnt/data/vol1", "compression")
+		require.NoError(t, err)
+		assert.Empty(t, v)
+	})
+}
+
+func TestQgroupIDs(t *testing.T) {
+	// $ btrfs qgroup show --raw /mnt/data
+	out := strings.Join([]string{
+		"Qgroupid    Referenced    Exclusive   Path",
+		"--------    ----------    ---------   ----",
+		"0/5              16384        16384   <toplevel>",
+		"0/259            16384         8192   vol1",
+		"0/260                0            0   <stale>",
+		"1/100            16384        16384   <0 member qgroups>",
+	}, "\n")
+	mgr := newTestManager(&utils.MockRunner{Out: out})
+
+	ids, err := mgr.QgroupIDs(context.Background(), "/mnt/data")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{5, 259, 260}, ids)
+}
+
+func TestQgroupHierarchy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("group ids", func(t *testing.T) {
+		out := "0/5   16384   16384\n0/259   16384   8192\n1/1   32768   32768\n1/7   0   0\n2/1   0   0\n"
+		mgr := newTestManager(&utils.MockRunner{Out: out})
+
+		ids, err := mgr.QgroupGroupIDs(ctx, "/mnt/data")
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{1, 7}, ids)
+	})
+
+	t.Run("group usage", func(t *testing.T) {
+		m := &utils.MockRunner{Out: "0/259   16384   8192   none   none\n1/1   32768   16384   1073741824   none\n"}
+		mgr := newTestManager(m)
+
+		info, found, err := mgr.QgroupGroupUsage(ctx, "1/1", "/mnt/data")
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, QgroupInfo{Referenced: 32768, Exclusive: 16384, MaxReferenced: 1073741824}, info)
+		assert.Equal(t, []string{"qgroup", "show", "-re", "--raw", "/mnt/data"}, m.Calls[0])
+
+		_, found, err = mgr.QgroupGroupUsage(ctx, "1/2", "/mnt/data")
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("assign", func(t *testing.T) {
+		m := &utils.MockRunner{
+			RunFn: func(args []string) (string, error) {
+				if args[0] == "subvolume" {
+					return "\tSubvolume ID:\t\t259\n", nil
+				}
+				return "", nil
+			},
+		}
+		mgr := newTestManager(m)
+
+		require.NoError(t, mgr.QgroupAssign(ctx, "/mnt/data/vol1", "1/1"))
+		assert.Equal(t, []string{"qgroup", "assign", "0/259", "1/1", "/mnt/data/vol1"}, m.Calls[1])
+
+		require.NoError(t, mgr.QgroupUnassign(ctx, "/mnt/data/vol1", "1/1"))
+		assert.Equal(t, []string{"qgroup", "remove", "0/259", "1/1", "/mnt/data/vol1"}, m.Calls[3])
+	})
+
+	t.Run("inherit on create", func(t *testing.T) {
+		m := &utils.MockRunner{}
+		mgr := newTestManager(m)
+
+		require.NoError(t, mgr.SubvolumeCreate(ctx, "/mnt/data/vol1", "1/1"))
+		require.NoError(t, mgr.SubvolumeSnapshot(ctx, "/mnt/data/vol1", "/mnt/data/snap1", true, "1/1", "1/259"))
+		require.NoError(t, mgr.SubvolumeSnapshot(ctx, "/mnt/data/vol1", "/mnt/data/clone1", false))
+		assert.Equal(t, [][]string{
+			{"subvolume", "create", "-i", "1/1", "/mnt/data/vol1"},
+			{"subvolume", "snapshot", "-r", "-i", "1/1", "-i", "1/259", "/mnt/data/vol1", "/mnt/data/snap1"},
+			{"subvolume", "snapshot", "/mnt/data/vol1", "/mnt/data/clone1"},
+		}, m.Calls)
+	})
+
+	t.Run("assign without subvolume id", func(t *testing.T) {
+		mgr := newTestManager(&utils.MockRunner{Out: "not a subvolume"})
+
+		assert.ErrorContains(t, mgr.QgroupAssign(ctx, "/mnt/data/dir", "1/1"), "subvolume ID not found")
+	})
+
+	t.Run("create, limit and destroy", func(t *testing.T) {
+		m := &utils.MockRunner{}
+		mgr := newTestManager(m)
+
+		require.NoError(t, mgr.QgroupCreate(ctx, "1/1", "/mnt/data"))
+		require.NoError(t, mgr.QgroupLimitGroup(ctx, "1/1", 1<<30, "/mnt/data"))
+		require.NoError(t, mgr.QgroupLimitGroup(ctx, "1/1", 0, "/mnt/data"))
+		require.NoError(t, mgr.QgroupGroupDestroy(ctx, "1/1", "/mnt/data"))
+		assert.Equal(t, [][]string{
+			{"qgroup", "create", "1/1", "/mnt/data"},
+			{"qgroup", "limit", "1073741824", "1/1", "/mnt/data"},
+			{"qgroup", "limit", "none", "1/1", "/mnt/data"},
+			{"qgroup", "destroy", "1/1", "/mnt/data"},
+		}, m.Calls)
+	})
+}
+
 func TestDeviceErrors(t *testing.T) {
 	t.Run("single device", func(t *testing.T) {
 		out := strings.Join([]string{
@@ -270,6 +580,78 @@ func TestDeviceErrors(t *testing.T) {
 	})
 }
 
+func TestDeviceErrorsJSON(t *testing.T) {
+	t.Run("multi device", func(t *testing.T) {
+		// $ btrfs --format json device stats /mnt/data
+		out := `{
+  "__header": {"version": "1"},
+  "device-stats": [
+    {"device": "/dev/sda", "devid": 1, "write_io_errs": 1, "read_io_errs": 2, "flush_io_errs": 0, "corruption_errs": 0, "generation_errs": 0},
+    {"device": "/dev/sdb", "devid": 2, "write_io_errs": 0, "read_io_errs": 0, "flush_io_errs": 3, "corruption_errs": 4, "generation_errs": 5}
+  ]
+}`
+		m := &utils.MockRunner{Out: out}
+		mgr := newTestManager(m)
+		mgr.json = true
+
+		errs, err := mgr.DeviceErrors(context.Background(), "/mnt/data")
+		require.NoError(t, err)
+		require.Len(t, errs, 2)
+		assert.Equal(t, "/dev/sda", errs[0].Device)
+		assert.Equal(t, uint64(1), errs[0].WriteErrs)
+		assert.Equal(t, uint64(2), errs[0].ReadErrs)
+		assert.Equal(t, "/dev/sdb", errs[1].Device)
+		assert.Equal(t, uint64(3), errs[1].FlushErrs)
+		assert.Equal(t, uint64(4), errs[1].CorruptionErrs)
+		assert.Equal(t, uint64(5), errs[1].GenerationErrs)
+		require.Len(t, m.Calls, 1)
+		assert.Equal(t, []string{"--format", "json", "device", "stats", "/mnt/data"}, m.Calls[0])
+	})
+
+	t.Run("falls back to text", func(t *testing.T) {
+		m := &utils.MockRunner{
+			RunFn: func(args []string) (string, error) {
+				if args[0] == "--format" {
+					return "", fmt.Errorf("unrecognized option '--format'")
+				}
+				return "[/dev/sda].read_io_errs     7\n", nil
+			},
+		}
+		mgr := newTestManager(m)
+		mgr.json = true
+
+		errs, err := mgr.DeviceErrors(context.Background(), "/mnt/data")
+		require.NoError(t, err)
+		require.Len(t, errs, 1)
+		assert.Equal(t, uint64(7), errs[0].ReadErrs)
+		assert.Len(t, m.Calls, 2)
+	})
+}
+
+func TestDetectJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		err  error
+		want bool
+	}{
+		{name: "6.6", out: "btrfs-progs v6.6.3\n", want: true},
+		{name: "6.1", out: "btrfs-progs v6.1\n", want: true},
+		{name: "7.0", out: "btrfs-progs v7.0\n", want: true},
+		{name: "6.0", out: "btrfs-progs v6.0.2\n", want: false},
+		{name: "5.16", out: "btrfs-progs v5.16.2\n", want: false},
+		{name: "unparseable", out: "btrfs-progs\n", want: false},
+		{name: "error", err: fmt.Errorf("not found"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestManager(&utils.MockRunner{Out: tt.out, Err: tt.err})
+			mgr.detectJSON(context.Background())
+			assert.Equal(t, tt.want, mgr.json)
+		})
+	}
+}
+
 func TestFilesystemUsage(t *testing.T) {
 	fsUsageOutput := strings.Join([]string{
 		"Overall:",
@@ -341,6 +723,218 @@ func TestFilesystemUsage(t *testing.T) {
 	})
 }
 
+func TestScrubStatus(t *testing.T) {
+	t.Run("running", func(t *testing.T) {
+		out := strings.Join([]string{
+			"UUID:             2a8b4f1e-5c3d-4e6f-8a9b-0c1d2e3f4a5b",
+			"Scrub started:    Wed Oct  9 10:00:00 2024",
+			"Status:           running",
+			"Duration:         0:00:20",
+			"Time left:        0:06:20",
+			"ETA:              Wed Oct  9 10:06:40 2024",
+			"Total to scrub:   107374182400",
+			"Bytes scrubbed:   5368709120  (5.00%)",
+			"Rate:             268435456/s",
+			"Error summary:    no errors found",
+		}, "\n")
+		m := &utils.MockRunner{Out: out}
+		mgr := newTestManager(m)
+
+		st, err := mgr.ScrubStatus(context.Background(), "/mnt/data")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"scrub", "status", "--raw", "/mnt/data"}, m.Calls[0])
+		assert.True(t, st.Running())
+		assert.Equal(t, time.Date(2024, 10, 9, 10, 0, 0, 0, time.Local), st.StartedAt)
+		assert.Equal(t, 20*time.Second, st.Duration)
+		assert.Equal(t, uint64(107374182400), st.TotalBytes)
+		assert.Equal(t, uint64(5368709120), st.ScrubbedBytes)
+		assert.InDelta(t, 0.05, st.Progress(), 0.0001)
+		assert.Equal(t, uint64(0), st.ErrorsFound)
+		assert.True(t, st.CompletedAt().IsZero())
+	})
+
+	t.Run("finished with errors", func(t *testing.T) {
+		out := strings.Join([]string{
+			"UUID:             2a8b4f1e-5c3d-4e6f-8a9b-0c1d2e3f4a5b",
+			"Scrub started:    Wed Oct  9 10:00:00 2024",
+			"Status:           finished",
+			"Duration:         26:40:10",
+			"Total to scrub:   107374182400",
+			"Rate:             1117/s",
+			"Error summary:    read=1 csum=12",
+			"  Corrected:      10",
+			"  Uncorrectable:  3",
+			"  Unverified:     0",
+		}, "\n")
+		mgr := newTestManager(&utils.MockRunner{Out: out})
+
+		st, err := mgr.ScrubStatus(context.Background(), "/mnt/data")
+		require.NoError(t, err)
+		assert.False(t, st.Running())
+		assert.Equal(t, 1.0, st.Progress())
+		assert.Equal(t, 26*time.Hour+40*time.Minute+10*time.Second, st.Duration)
+		assert.Equal(t, uint64(13), st.ErrorsFound)
+		assert.Equal(t, uint64(10), st.CorrectedErrors)
+		assert.Equal(t, uint64(3), st.UncorrectableErrors)
+		assert.Equal(t, st.StartedAt.Add(st.Duration), st.CompletedAt())
+	})
+
+	t.Run("never scrubbed", func(t *testing.T) {
+		out := "UUID:             2a8b4f1e-5c3d-4e6f-8a9b-0c1d2e3f4a5b\n\tno stats available\n"
+		mgr := newTestManager(&utils.MockRunner{Out: out})
+
+		st, err := mgr.ScrubStatus(context.Background(), "/mnt/data")
+		require.NoError(t, err)
+		assert.Equal(t, ScrubStatus{}, st)
+	})
+
+	t.Run("invalid duration", func(t *testing.T) {
+		out := "Status:           finished\nDuration:         soon\n"
+		mgr := newTestManager(&utils.MockRunner{Out: out})
+
+		_, err := mgr.ScrubStatus(context.Background(), "/mnt/data")
+		assert.ErrorContains(t, err, "parse duration")
+	})
+
+	t.Run("command error", func(t *testing.T) {
+		mgr := newTestManager(&utils.MockRunner{Err: fmt.Errorf("scrub status failed")})
+
+		_, err := mgr.ScrubStatus(context.Background(), "/mnt/data")
+		require.Error(t, err)
+	})
+}
+
+func TestBalance(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("running", func(t *testing.T) {
+		out := "Balance on '/mnt/data' is running\n2 out of about 10 chunks balanced (3 considered),  80% left\n"
+		// balance status exits 1 while a balance is running
+		m := &utils.MockRunner{Out: out, Err: fmt.Errorf("exit status 1")}
+		mgr := newTestManager(m)
+
+		st, err := mgr.BalanceStatus(ctx, "/mnt/data")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"balance", "status", "/mnt/data"}, m.Calls[0])
+		assert.Equal(t, BalanceStatus{Status: BalanceRunning, TotalChunks: 10, BalancedChunks: 2, ConsideredChunks: 3}, st)
+		assert.True(t, st.Running())
+		assert.InDelta(t, 0.2, st.Progress(), 0.0001)
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		out := "Balance on '/mnt/data' is paused\n4 out of about 10 chunks balanced (5 considered),  60% left\n"
+		mgr := newTestManager(&utils.MockRunner{Out: out})
+
+		st, err := mgr.BalanceStatus(ctx, "/mnt/data")
+		require.NoError(t, err)
+		assert.False(t, st.Running())
+		assert.True(t, st.Active())
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		mgr := newTestManager(&utils.MockRunner{Out: "No balance found on '/mnt/data'\n"})
+
+		st, err := mgr.BalanceStatus(ctx, "/mnt/data")
+		require.NoError(t, err)
+		assert.Equal(t, BalanceStatus{Status: BalanceIdle}, st)
+		assert.False(t, st.Active())
+	})
+
+	t.Run("command error", func(t *testing.T) {
+		mgr := newTestManager(&utils.MockRunner{Out: "ERROR: not a btrfs filesystem\n", Err: fmt.Errorf("exit status 2")})
+
+		_, err := mgr.BalanceStatus(ctx, "/mnt/data")
+		assert.ErrorContains(t, err, "exit status 2")
+	})
+
+	t.Run("start with filters", func(t *testing.T) {
+		m := &utils.MockRunner{}
+		mgr := newTestManager(m)
+		data, meta := 20, 5
+
+		require.NoError(t, mgr.BalanceStart(ctx, "/mnt/data", BalanceFilters{DataUsage: &data}))
+		require.NoError(t, mgr.BalanceStart(ctx, "/mnt/data", BalanceFilters{DataUsage: &data, MetadataUsage: &meta}))
+		assert.Equal(t, []string{"balance", "start", "--bg", "-dusage=20", "/mnt/data"}, m.Calls[0])
+		assert.Equal(t, []string{"balance", "start", "--bg", "-dusage=20", "-musage=5", "/mnt/data"}, m.Calls[1])
+	})
+}
+
+func TestParseCsumError(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want CsumError
+		ok   bool
+	}{
+		{
+			name: "read",
+			msg:  "BTRFS warning (device sda): csum failed root 259 ino 257 off 8192 csum 0x98f94189 expected csum 0x00000000 mirror 1",
+			want: CsumError{Device: "sda", Root: 259, Inode: 257, Offset: 8192},
+			ok:   true,
+		},
+		{
+			name: "scrub",
+			msg:  "BTRFS warning (device dm-0): checksum error at logical 298844160 on dev /dev/dm-0, physical 298844160, root 259, inode 257, offset 0, length 4096, links 1 (path: file)",
+			want: CsumError{Device: "dm-0", Logical: 298844160, Root: 259, Inode: 257},
+			ok:   true,
+		},
+		{
+			name: "scrub without commas",
+			msg:  "BTRFS warning (device sda): checksum error at logical 298844160 on dev /dev/sda physical 298844160",
+			want: CsumError{Device: "sda", Logical: 298844160},
+			ok:   true,
+		},
+		{
+			name: "metadata",
+			msg:  "BTRFS warning (device sda): checksum error at logical 30408704 on dev /dev/sda, physical 30408704: metadata leaf (level 0) in tree 5",
+		},
+		{
+			name: "device stats",
+			msg:  "BTRFS error (device sda): bdev /dev/sda errs: wr 0, rd 0, flush 0, corrupt 1, gen 0",
+		},
+		{
+			name: "other",
+			msg:  "EXT4-fs (sdb1): mounted filesystem",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseCsumError(tt.msg)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	t.Run("logical", func(t *testing.T) {
+		m := &utils.MockRunner{Out: "/mnt/data/t/vol/data/file\n/mnt/data/t/snapshots/snap/data/file\n"}
+		mgr := newTestManager(m)
+
+		paths, err := mgr.LogicalResolve(context.Background(), 298844160, "/mnt/data")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"inspect-internal", "logical-resolve", "298844160", "/mnt/data"}, m.Calls[0])
+		assert.Equal(t, []string{"/mnt/data/t/vol/data/file", "/mnt/data/t/snapshots/snap/data/file"}, paths)
+	})
+
+	t.Run("inode", func(t *testing.T) {
+		m := &utils.MockRunner{Out: "/mnt/data/t/vol/data/dir/file\n"}
+		mgr := newTestManager(m)
+
+		paths, err := mgr.InodeResolve(context.Background(), 257, "/mnt/data/t/vol/data")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"inspect-internal", "inode-resolve", "257", "/mnt/data/t/vol/data"}, m.Calls[0])
+		assert.Equal(t, []string{"/mnt/data/t/vol/data/dir/file"}, paths)
+	})
+
+	t.Run("command error", func(t *testing.T) {
+		mgr := newTestManager(&utils.MockRunner{Err: fmt.Errorf("No such file or directory")})
+
+		_, err := mgr.LogicalResolve(context.Background(), 1, "/mnt/data")
+		require.Error(t, err)
+	})
+}
+
 func TestSetCompression(t *testing.T) {
 	t.Run("valid", func(t *testing.T) {
 		m := &utils.MockRunner{Out: ""}
@@ -361,6 +955,36 @@ func TestSetCompression(t *testing.T) {
 	})
 }
 
+func TestDefragment(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("recompress", func(t *testing.T) {
+		m := &utils.MockRunner{Out: "/mnt/data/vol1/a\n/mnt/data/vol1/b\n"}
+		mgr := newTestManager(m)
+		var progress strings.Builder
+
+		require.NoError(t, mgr.Defragment(ctx, "/mnt/data/vol1", "zstd:3", &progress))
+		assert.Equal(t, []string{"filesystem", "defragment", "-v", "-r", "-czstd", "/mnt/data/vol1"}, m.Calls[0])
+		assert.Equal(t, "/mnt/data/vol1/a\n/mnt/data/vol1/b\n", progress.String())
+	})
+
+	t.Run("keep compression", func(t *testing.T) {
+		m := &utils.MockRunner{}
+		mgr := newTestManager(m)
+
+		require.NoError(t, mgr.Defragment(ctx, "/mnt/data/vol1", "none", nil))
+		assert.Equal(t, []string{"filesystem", "defragment", "-v", "-r", "/mnt/data/vol1"}, m.Calls[0])
+	})
+
+	t.Run("invalid rejected before exec", func(t *testing.T) {
+		m := &utils.MockRunner{}
+		mgr := newTestManager(m)
+
+		require.Error(t, mgr.Defragment(ctx, "/mnt/data/vol1", "brotli", nil))
+		assert.Empty(t, m.Calls)
+	})
+}
+
 func TestDevices(t *testing.T) {
 	t.Run("single device", func(t *testing.T) {
 		out := strings.Join([]string{
@@ -0,0 +1,63 @@
+package btrfs
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CsumError is a data checksum error logged by the kernel, either on read
+// (csum failed) or by a scrub (checksum error at logical).
+type CsumError struct {
+	Device string
+	// Logical is the logical address of the bad block, 0 if not logged.
+	Logical uint64
+	// Root is the subvolume ID of the affected file, 0 if not logged.
+	Root   uint64
+	Inode  uint64
+	Offset uint64
+}
+
+var (
+	csumDeviceRe  = regexp.MustCompile(`\(device ([^)]+)\)`)
+	csumLogicalRe = regexp.MustCompile(`\blogical (\d+)`)
+	csumRootRe    = regexp.MustCompile(`\broot (\d+)`)
+	csumInodeRe   = regexp.MustCompile(`\b(?:ino|inode) (\d+)`)
+	csumOffsetRe  = regexp.MustCompile(`\b(?:off|offset) (\d+)`)
+)
+
+// ParseCsumError parses a kernel log message, ok is false for anything but
+// a data checksum error. Metadata checksum errors have no file and are skipped.
+//
+//	BTRFS warning (device sda): csum failed root 5 ino 257 off 0 csum 0x98f94189 expected csum 0x00000000 mirror 1
+//	BTRFS warning (device sda): checksum error at logical 298844160 on dev /dev/sda, physical 298844160, root 5, inode 257, offset 0, length 4096, links 1 (path: file)
+func ParseCsumError(msg string) (e CsumError, ok bool) {
+	if !strings.Contains(msg, "BTRFS") || strings.Contains(msg, "metadata") {
+		return CsumError{}, false
+	}
+	if !strings.Contains(msg, "csum failed") && !strings.Contains(msg, "checksum error at logical") {
+		return CsumError{}, false
+	}
+
+	if m := csumDeviceRe.FindStringSubmatch(msg); m != nil {
+		e.Device = m[1]
+	}
+	e.Logical = matchUint(csumLogicalRe, msg)
+	e.Root = matchUint(csumRootRe, msg)
+	e.Inode = matchUint(csumInodeRe, msg)
+	e.Offset = matchUint(csumOffsetRe, msg)
+
+	if e.Logical == 0 && (e.Root == 0 || e.Inode == 0) {
+		return CsumError{}, false
+	}
+	return e, true
+}
+
+func matchUint(re *regexp.Regexp, s string) uint64 {
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	v, _ := strconv.ParseUint(m[1], 10, 64)
+	return v
+}
@@ -251,3 +251,79 @@ func (s *BtrfsIntegrationSuite) TestConcurrentSnapshot() {
 	}
 	s.Assert().Equal(31, snapCount, "expected 31 cs-snap-* snapshots")
 }
+
+func (s *BtrfsIntegrationSuite) TestIoctlBackend() {
+	s.Require().NoError(ProbeIoctl(s.mnt), "ProbeIoctl")
+	mgr := NewManager("btrfs")
+	mgr.SetBackend(BackendIoctl)
+
+	src := filepath.Join(s.mnt, "ioctl-vol")
+	snap := filepath.Join(s.mnt, "ioctl-snap")
+	s.Require().NoError(mgr.SubvolumeCreate(s.ctx, src), "SubvolumeCreate")
+	s.Require().NoError(mgr.QgroupLimit(s.ctx, src, 10*1024*1024), "QgroupLimit")
+
+	err := os.WriteFile(filepath.Join(src, "testfile"), make([]byte, 128*1024), 0o644)
+	s.Require().NoError(err, "WriteFile")
+	_, err = s.cmd.Run(s.ctx, "sync")
+	s.Require().NoError(err, "sync")
+
+	s.Require().NoError(mgr.SubvolumeSnapshot(s.ctx, src, snap, true), "SubvolumeSnapshot(ro)")
+	s.Assert().True(s.mgr.SubvolumeExists(s.ctx, snap), "snapshot should exist")
+
+	// ioctl and CLI results must match
+	got, err := mgr.QgroupUsageEx(s.ctx, src)
+	s.Require().NoError(err, "QgroupUsageEx(ioctl)")
+	want, err := s.mgr.QgroupUsageEx(s.ctx, src)
+	s.Require().NoError(err, "QgroupUsageEx(cli)")
+	s.Assert().Equal(want, got)
+	s.Assert().NotZero(got.Referenced, "Referenced should be > 0")
+
+	s.Require().NoError(mgr.SubvolumeDelete(s.ctx, snap), "SubvolumeDelete(snapshot)")
+	s.Require().NoError(mgr.SubvolumeDelete(s.ctx, src), "SubvolumeDelete")
+	s.Assert().False(s.mgr.SubvolumeExists(s.ctx, src), "should not exist after delete")
+}
+
+func (s *BtrfsIntegrationSuite) TestDedupeRange() {
+	dir := filepath.Join(s.mnt, "dedupevol")
+	s.Require().NoError(s.mgr.SubvolumeCreate(s.ctx, dir), "SubvolumeCreate")
+
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "a"), data, 0o644))
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "b"), data, 0o644))
+	// d holds the second half of a at its start
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "d"), data[len(data)/2:], 0o644))
+	data[0]++
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "c"), data, 0o644))
+
+	open := func(name string) *os.File {
+		f, err := os.Open(filepath.Join(dir, name))
+		s.Require().NoError(err)
+		s.T().Cleanup(func() { _ = f.Close() })
+		return f
+	}
+	a, b, c, d := open("a"), open("b"), open("c"), open("d")
+
+	physical := func(f *os.File) uint64 {
+		extents, err := FileExtents(f, 0, uint64(len(data)))
+		s.Require().NoError(err, "FileExtents")
+		s.Require().NotEmpty(extents)
+		return extents[0].Physical
+	}
+	s.Require().NotEqual(physical(a), physical(b))
+
+	n, err := DedupeRange(a, 0, b, 0, uint64(len(data)))
+	s.Require().NoError(err, "DedupeRange")
+	s.Assert().Equal(uint64(len(data)), n)
+	s.Assert().Equal(physical(a), physical(b), "b should share the extents of a")
+
+	half := uint64(len(data) / 2)
+	n, err = DedupeRange(a, half, d, 0, half)
+	s.Require().NoError(err, "DedupeRange at another offset")
+	s.Assert().Equal(half, n)
+
+	_, err = DedupeRange(a, 0, c, 0, uint64(len(data)))
+	s.Assert().ErrorIs(err, ErrDedupeDiffers)
+}
@@ -0,0 +1,525 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Native btrfs ioctls, see include/uapi/linux/btrfs.h. Only the operations on
+// the volume hot path are implemented here; send/receive, properties, device
+// stats and filesystem usage always go through btrfs-progs.
+
+const (
+	ioctlMagic = 0x94
+
+	pathNameMax   = 4087 // BTRFS_PATH_NAME_MAX
+	subvolNameMax = 4039 // BTRFS_SUBVOL_NAME_MAX
+	inoLookupMax  = 4080 // BTRFS_INO_LOOKUP_PATH_MAX
+	searchArgsBuf = 4096 - int(unsafe.Sizeof(searchKey{}))
+
+	subvolRdonly        = 1 << 1 // BTRFS_SUBVOL_RDONLY
+	subvolQgroupInherit = 1 << 2 // BTRFS_SUBVOL_QGROUP_INHERIT
+
+	qgroupLimitMaxRfer = 1 << 0 // BTRFS_QGROUP_LIMIT_MAX_RFER
+
+	firstFreeObjectID   = 256 // BTRFS_FIRST_FREE_OBJECTID, root dir of a subvolume
+	quotaTreeObjectID   = 8   // BTRFS_QUOTA_TREE_OBJECTID
+	qgroupInfoKey       = 242 // BTRFS_QGROUP_INFO_KEY
+	searchHeaderSize    = 32  // struct btrfs_ioctl_search_header
+	qgroupInfoItemSize  = 40  // struct btrfs_qgroup_info_item
+	qgroupInfoRferOff   = 8
+	qgroupInfoExclOff   = 24
+	qgroupLimitKey      = 244 // BTRFS_QGROUP_LIMIT_KEY
+	qgroupLimitItemSize = 40  // struct btrfs_qgroup_limit_item
+	qgroupLimitRferOff  = 8
+
+	fsNoCOWFl = 0x00800000 // FS_NOCOW_FL
+
+	fsIocFiemap         = 0xc020660b // FS_IOC_FIEMAP, _IOWR('f', 11, struct fiemap)
+	fiemapFlagSync      = 0x1        // FIEMAP_FLAG_SYNC
+	fiemapExtentLast    = 0x1        // FIEMAP_EXTENT_LAST
+	fiemapExtentUnknown = 0x2        // FIEMAP_EXTENT_UNKNOWN
+	fiemapExtentDelay   = 0x4        // FIEMAP_EXTENT_DELALLOC
+	fiemapExtentEncoded = 0x8        // FIEMAP_EXTENT_ENCODED
+	fiemapExtentInline  = 0x200      // FIEMAP_EXTENT_DATA_INLINE
+	fiemapBatch         = 64
+)
+
+// ioctl request numbers, _IOC(dir, 0x94, nr, size).
+var (
+	iocSubvolCreate   = iocW(14, unsafe.Sizeof(volArgs{}))
+	iocTreeSearch     = iocWR(17, unsafe.Sizeof(searchArgs{}))
+	iocInoLookup      = iocWR(18, unsafe.Sizeof(inoLookupArgs{}))
+	iocSnapCreateV2   = iocW(23, unsafe.Sizeof(volArgsV2{}))
+	iocSubvolCreateV2 = iocW(24, unsafe.Sizeof(volArgsV2{}))
+	iocQgroupLimit    = iocR(43, unsafe.Sizeof(qgroupLimitArgs{}))
+	iocSnapDestroyV2  = iocW(63, unsafe.Sizeof(volArgsV2{}))
+)
+
+// struct btrfs_ioctl_vol_args
+type volArgs struct {
+	fd   int64
+	name [pathNameMax + 1]byte
+}
+
+// struct btrfs_ioctl_vol_args_v2
+type volArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	// size and qgroupInherit are read with BTRFS_SUBVOL_QGROUP_INHERIT
+	size          uint64
+	qgroupInherit unsafe.Pointer
+	unused        [2]uint64
+	name          [subvolNameMax + 1]byte
+}
+
+// struct btrfs_ioctl_qgroup_limit_args
+type qgroupLimitArgs struct {
+	qgroupid uint64
+	flags    uint64
+	maxRfer  uint64
+	maxExcl  uint64
+	rsvRfer  uint64
+	rsvExcl  uint64
+}
+
+// struct btrfs_ioctl_ino_lookup_args
+type inoLookupArgs struct {
+	treeid   uint64
+	objectid uint64
+	name     [inoLookupMax]byte
+}
+
+// struct btrfs_ioctl_search_key
+type searchKey struct {
+	treeID      uint64
+	minObjectID uint64
+	maxObjectID uint64
+	minOffset   uint64
+	maxOffset   uint64
+	minTransID  uint64
+	maxTransID  uint64
+	minType     uint32
+	maxType     uint32
+	nrItems     uint32
+	unused      uint32
+	unused1     uint64
+	unused2     uint64
+	unused3     uint64
+	unused4     uint64
+}
+
+// struct btrfs_ioctl_search_args
+type searchArgs struct {
+	key searchKey
+	buf [searchArgsBuf]byte
+}
+
+// struct fiemap with room for fiemapBatch extents
+type fiemapArgs struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extents       [fiemapBatch]fiemapExtent
+}
+
+// struct fiemap_extent
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+func iocW(nr, size uintptr) uintptr  { return ioc(1, nr, size) }
+func iocR(nr, size uintptr) uintptr  { return ioc(2, nr, size) }
+func iocWR(nr, size uintptr) uintptr { return ioc(3, nr, size) }
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | ioctlMagic<<8 | nr
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func openDir(path string) (int, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fd, nil
+}
+
+func setName(dst []byte, name string) error {
+	// dst must keep its trailing NUL
+	if len(name) >= len(dst) {
+		return unix.ENAMETOOLONG
+	}
+	copy(dst, name)
+	return nil
+}
+
+// qgroupInherit builds a struct btrfs_qgroup_inherit adding the new
+// subvolume to qgroups: flags, num_qgroups, num_ref_copies, num_excl_copies,
+// the five fields of struct btrfs_qgroup_limit and then the qgroup IDs.
+func qgroupInherit(qgroups []string) ([]uint64, error) {
+	const header = 9
+	buf := make([]uint64, header+len(qgroups))
+	buf[1] = uint64(len(qgroups))
+	for i, q := range qgroups {
+		id, err := parseQgroupID(q)
+		if err != nil {
+			return nil, err
+		}
+		buf[header+i] = id
+	}
+	return buf, nil
+}
+
+// setInherit makes args add the new subvolume to qgroups. buf must be kept
+// alive until the ioctl returned, args points into it.
+func setInherit(args *volArgsV2, qgroups []string) ([]uint64, error) {
+	if len(qgroups) == 0 {
+		return nil, nil
+	}
+	buf, err := qgroupInherit(qgroups)
+	if err != nil {
+		return nil, err
+	}
+	args.flags |= subvolQgroupInherit
+	args.size = uint64(len(buf)) * 8
+	args.qgroupInherit = unsafe.Pointer(&buf[0])
+	return buf, nil
+}
+
+func ioctlSubvolumeCreate(path string, qgroups []string) error {
+	fd, err := openDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if len(qgroups) == 0 {
+		var args volArgs
+		if err := setName(args.name[:], filepath.Base(path)); err != nil {
+			return fmt.Errorf("subvolume create %s: %w", path, err)
+		}
+		if err := ioctl(fd, iocSubvolCreate, unsafe.Pointer(&args)); err != nil {
+			return fmt.Errorf("subvolume create %s: %w", path, err)
+		}
+		return nil
+	}
+
+	var args volArgsV2
+	buf, err := setInherit(&args, qgroups)
+	if err != nil {
+		return fmt.Errorf("subvolume create %s: %w", path, err)
+	}
+	if err := setName(args.name[:], filepath.Base(path)); err != nil {
+		return fmt.Errorf("subvolume create %s: %w", path, err)
+	}
+	err = ioctl(fd, iocSubvolCreateV2, unsafe.Pointer(&args))
+	runtime.KeepAlive(buf)
+	if err != nil {
+		return fmt.Errorf("subvolume create %s: %w", path, err)
+	}
+	return nil
+}
+
+func ioctlSubvolumeSnapshot(src, dst string, readonly bool, qgroups []string) error {
+	srcFd, err := openDir(src)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(srcFd)
+	dstFd, err := openDir(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dstFd)
+
+	args := volArgsV2{fd: int64(srcFd)}
+	if readonly {
+		args.flags = subvolRdonly
+	}
+	buf, err := setInherit(&args, qgroups)
+	if err != nil {
+		return fmt.Errorf("subvolume snapshot %s: %w", dst, err)
+	}
+	if err := setName(args.name[:], filepath.Base(dst)); err != nil {
+		return fmt.Errorf("subvolume snapshot %s: %w", dst, err)
+	}
+	err = ioctl(dstFd, iocSnapCreateV2, unsafe.Pointer(&args))
+	runtime.KeepAlive(buf)
+	if err != nil {
+		return fmt.Errorf("subvolume snapshot %s -> %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+func ioctlSubvolumeDelete(path string) error {
+	fd, err := openDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var args volArgsV2
+	if err := setName(args.name[:], filepath.Base(path)); err != nil {
+		return fmt.Errorf("subvolume delete %s: %w", path, err)
+	}
+	if err := ioctl(fd, iocSnapDestroyV2, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("subvolume delete %s: %w", path, err)
+	}
+	return nil
+}
+
+func ioctlQgroupLimit(path string, bytes uint64) error {
+	fd, err := openDir(path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// qgroupid 0 is the subvolume fd belongs to
+	args := qgroupLimitArgs{flags: qgroupLimitMaxRfer, maxRfer: bytes}
+	if err := ioctl(fd, iocQgroupLimit, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("qgroup limit %s: %w", path, err)
+	}
+	return nil
+}
+
+// subvolumeID returns the ID of the subvolume containing the open directory fd.
+func subvolumeID(fd int) (uint64, error) {
+	args := inoLookupArgs{objectid: firstFreeObjectID}
+	if err := ioctl(fd, iocInoLookup, unsafe.Pointer(&args)); err != nil {
+		return 0, err
+	}
+	return args.treeid, nil
+}
+
+func ioctlSubvolumeID(path string) (uint64, error) {
+	fd, err := openDir(path)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	id, err := subvolumeID(fd)
+	if err != nil {
+		return 0, fmt.Errorf("subvolume ID lookup %s: %w", path, err)
+	}
+	return id, nil
+}
+
+// searchQgroupItem looks up the quota tree item of type keyType for qgroup
+// 0/subvolID. It returns nil if there is none.
+func searchQgroupItem(fd int, keyType uint32, subvolID uint64) ([]byte, error) {
+	args := searchArgs{key: searchKey{
+		treeID:     quotaTreeObjectID,
+		minType:    keyType,
+		maxType:    keyType,
+		minOffset:  subvolID, // level 0 qgroupid == subvolume ID
+		maxOffset:  subvolID,
+		maxTransID: math.MaxUint64,
+		nrItems:    1,
+	}}
+	if err := ioctl(fd, iocTreeSearch, unsafe.Pointer(&args)); err != nil {
+		return nil, err
+	}
+	return findSearchItem(args.buf[:], args.key.nrItems, keyType, subvolID)
+}
+
+// findSearchItem scans a TREE_SEARCH result buffer for the item with the
+// given key type and offset. Search headers are in host byte order, the
+// returned item is in on-disk (little endian) byte order.
+func findSearchItem(buf []byte, nrItems, keyType uint32, offset uint64) ([]byte, error) {
+	off := 0
+	for range nrItems {
+		if off+searchHeaderSize > len(buf) {
+			return nil, fmt.Errorf("tree search: truncated header at offset %d", off)
+		}
+		itemOffset := binary.NativeEndian.Uint64(buf[off+16:])
+		itemType := binary.NativeEndian.Uint32(buf[off+24:])
+		size := int(binary.NativeEndian.Uint32(buf[off+28:]))
+		off += searchHeaderSize
+		if off+size > len(buf) {
+			return nil, fmt.Errorf("tree search: truncated item at offset %d", off)
+		}
+		if itemType == keyType && itemOffset == offset {
+			return buf[off : off+size], nil
+		}
+		off += size
+	}
+	return nil, nil
+}
+
+func ioctlQgroupUsage(path string) (QgroupInfo, error) {
+	fd, err := openDir(path)
+	if err != nil {
+		return QgroupInfo{}, err
+	}
+	defer unix.Close(fd)
+
+	id, err := subvolumeID(fd)
+	if err != nil {
+		return QgroupInfo{}, fmt.Errorf("subvolume ID lookup %s: %w", path, err)
+	}
+	item, err := searchQgroupItem(fd, qgroupInfoKey, id)
+	if err != nil {
+		return QgroupInfo{}, fmt.Errorf("qgroup search %s: %w", path, err)
+	}
+	if len(item) < qgroupInfoItemSize {
+		return QgroupInfo{}, fmt.Errorf("qgroup 0/%d not found for %s", id, path)
+	}
+	info := QgroupInfo{
+		Referenced: binary.LittleEndian.Uint64(item[qgroupInfoRferOff:]),
+		Exclusive:  binary.LittleEndian.Uint64(item[qgroupInfoExclOff:]),
+	}
+
+	limit, err := searchQgroupItem(fd, qgroupLimitKey, id)
+	if err != nil {
+		return QgroupInfo{}, fmt.Errorf("qgroup limit search %s: %w", path, err)
+	}
+	if len(limit) >= qgroupLimitItemSize && binary.LittleEndian.Uint64(limit)&qgroupLimitMaxRfer != 0 {
+		info.MaxReferenced = binary.LittleEndian.Uint64(limit[qgroupLimitRferOff:])
+	}
+	return info, nil
+}
+
+// isSubvolumeRoot reports whether path is the root directory of a subvolume,
+// which always has inode number 256 on btrfs.
+func isSubvolumeRoot(path string) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return false
+	}
+	return st.Ino == firstFreeObjectID && st.Mode&unix.S_IFMT == unix.S_IFDIR && IsBtrfs(path)
+}
+
+// IsNoCOW reports whether the NOCOW attribute (chattr +C) is set on path.
+func IsNoCOW(path string) (bool, error) {
+	fd, err := openDir(path)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false, fmt.Errorf("get flags %s: %w", path, err)
+	}
+	return flags&fsNoCOWFl != 0, nil
+}
+
+// DedupeMaxLength is the largest range FIDEDUPERANGE handles per call, the
+// kernel silently shortens longer ranges.
+const DedupeMaxLength = 16 << 20
+
+// ErrDedupeDiffers is returned by DedupeRange if the ranges are not identical.
+var ErrDedupeDiffers = errors.New("ranges differ")
+
+// DedupeRange shares the extents of src at srcOffset with dst at dstOffset
+// for length bytes (FIDEDUPERANGE). The kernel locks and compares both ranges
+// first, nothing is changed unless they are identical. Returns the number of
+// bytes deduped.
+func DedupeRange(src *os.File, srcOffset uint64, dst *os.File, dstOffset, length uint64) (uint64, error) {
+	arg := unix.FileDedupeRange{
+		Src_offset: srcOffset,
+		Src_length: length,
+		Info:       []unix.FileDedupeRangeInfo{{Dest_fd: int64(dst.Fd()), Dest_offset: dstOffset}},
+	}
+	if err := unix.IoctlFileDedupeRange(int(src.Fd()), &arg); err != nil {
+		return 0, fmt.Errorf("FIDEDUPERANGE %s: %w", dst.Name(), err)
+	}
+	switch status := arg.Info[0].Status; {
+	case status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+		return 0, ErrDedupeDiffers
+	case status < 0:
+		return 0, fmt.Errorf("FIDEDUPERANGE %s: %w", dst.Name(), unix.Errno(-status))
+	}
+	return arg.Info[0].Bytes_deduped, nil
+}
+
+// Extent is a part of a file stored in one place on disk, see FileExtents.
+type Extent struct {
+	Logical  uint64
+	Physical uint64
+	Length   uint64
+	// Encoded extents are compressed, Physical is the start of the whole
+	// extent and not of the part at Logical.
+	Encoded bool
+	// Unmapped extents have no comparable location yet, e.g. inline or not
+	// allocated yet.
+	Unmapped bool
+}
+
+// FileExtents returns the extents of f overlapping length bytes at offset
+// (FS_IOC_FIEMAP). Dirty data is flushed first. Holes have no extent.
+func FileExtents(f *os.File, offset, length uint64) ([]Extent, error) {
+	var out []Extent
+	end := offset + length
+	for start := offset; start < end; {
+		args := fiemapArgs{start: start, length: end - start, flags: fiemapFlagSync, extentCount: fiemapBatch}
+		if err := ioctl(int(f.Fd()), fsIocFiemap, unsafe.Pointer(&args)); err != nil {
+			return nil, fmt.Errorf("FIEMAP %s: %w", f.Name(), err)
+		}
+		runtime.KeepAlive(f)
+		if args.mappedExtents == 0 {
+			break
+		}
+		for _, e := range args.extents[:args.mappedExtents] {
+			out = append(out, Extent{
+				Logical:  e.logical,
+				Physical: e.physical,
+				Length:   e.length,
+				Encoded:  e.flags&fiemapExtentEncoded != 0,
+				Unmapped: e.flags&(fiemapExtentUnknown|fiemapExtentDelay|fiemapExtentInline) != 0,
+			})
+		}
+		last := args.extents[args.mappedExtents-1]
+		if last.flags&fiemapExtentLast != 0 {
+			break
+		}
+		start = last.logical + last.length
+	}
+	return out, nil
+}
+
+// ProbeIoctl checks that the btrfs ioctls used by BackendIoctl work on the
+// filesystem containing path with the current privileges. A missing quota
+// tree is not an error, quotas may simply be disabled.
+func ProbeIoctl(path string) error {
+	fd, err := openDir(path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	id, err := subvolumeID(fd)
+	if err != nil {
+		return fmt.Errorf("BTRFS_IOC_INO_LOOKUP: %w", err)
+	}
+	if _, err := searchQgroupItem(fd, qgroupInfoKey, id); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("BTRFS_IOC_TREE_SEARCH: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIoctlABI(t *testing.T) {
+	// sizes and request numbers from include/uapi/linux/btrfs.h
+	assert.Equal(t, uintptr(4096), unsafe.Sizeof(volArgs{}))
+	assert.Equal(t, uintptr(4096), unsafe.Sizeof(volArgsV2{}))
+	assert.Equal(t, uintptr(4096), unsafe.Sizeof(inoLookupArgs{}))
+	assert.Equal(t, uintptr(4096), unsafe.Sizeof(searchArgs{}))
+	assert.Equal(t, uintptr(104), unsafe.Sizeof(searchKey{}))
+	assert.Equal(t, uintptr(48), unsafe.Sizeof(qgroupLimitArgs{}))
+	// include/uapi/linux/fiemap.h, FS_IOC_FIEMAP is sized by the header only
+	assert.Equal(t, uintptr(56), unsafe.Sizeof(fiemapExtent{}))
+	assert.Equal(t, uintptr(32), unsafe.Offsetof(fiemapArgs{}.extents))
+
+	assert.Equal(t, uintptr(0x5000940e), iocSubvolCreate)
+	assert.Equal(t, uintptr(0xd0009411), iocTreeSearch)
+	assert.Equal(t, uintptr(0xd0009412), iocInoLookup)
+	assert.Equal(t, uintptr(0x50009417), iocSnapCreateV2)
+	assert.Equal(t, uintptr(0x50009418), iocSubvolCreateV2)
+	assert.Equal(t, uintptr(0x8030942b), iocQgroupLimit)
+	assert.Equal(t, uintptr(0x5000943f), iocSnapDestroyV2)
+}
+
+func TestQgroupInherit(t *testing.T) {
+	buf, err := qgroupInherit([]string{"1/1", "1/259"})
+	require.NoError(t, err)
+	// struct btrfs_qgroup_inherit is 72 bytes followed by the qgroup IDs
+	require.Len(t, buf, 11)
+	assert.Equal(t, uint64(2), buf[1])
+	assert.Equal(t, uint64(1)<<48|1, buf[9])
+	assert.Equal(t, uint64(1)<<48|259, buf[10])
+
+	var args volArgsV2
+	_, err = setInherit(&args, []string{"1/1"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(subvolQgroupInherit), args.flags)
+	assert.Equal(t, uint64(80), args.size)
+	assert.Equal(t, uintptr(24), unsafe.Offsetof(args.size))
+	assert.Equal(t, uintptr(32), unsafe.Offsetof(args.qgroupInherit))
+
+	for _, q := range []string{"", "1", "1/", "a/1", "1/x", "70000/1"} {
+		_, err := qgroupInherit([]string{q})
+		assert.Error(t, err, q)
+	}
+}
+
+func TestFindSearchItem(t *testing.T) {
+	// appendItem appends a search header plus a btrfs_qgroup_info_item
+	appendItem := func(buf []byte, typ uint32, offset, rfer, excl uint64) []byte {
+		hdr := make([]byte, searchHeaderSize)
+		binary.NativeEndian.PutUint64(hdr[16:], offset)
+		binary.NativeEndian.PutUint32(hdr[24:], typ)
+		binary.NativeEndian.PutUint32(hdr[28:], qgroupInfoItemSize)
+		item := make([]byte, qgroupInfoItemSize)
+		binary.LittleEndian.PutUint64(item[qgroupInfoRferOff:], rfer)
+		binary.LittleEndian.PutUint64(item[qgroupInfoExclOff:], excl)
+		return append(append(buf, hdr...), item...)
+	}
+
+	t.Run("found", func(t *testing.T) {
+		buf := appendItem(nil, qgroupInfoKey, 258, 1, 1)
+		buf = appendItem(buf, qgroupInfoKey, 259, 16384, 8192)
+
+		item, err := findSearchItem(buf, 2, qgroupInfoKey, 259)
+		require.NoError(t, err)
+		require.Len(t, item, qgroupInfoItemSize)
+		assert.Equal(t, uint64(16384), binary.LittleEndian.Uint64(item[qgroupInfoRferOff:]))
+		assert.Equal(t, uint64(8192), binary.LittleEndian.Uint64(item[qgroupInfoExclOff:]))
+	})
+
+	t.Run("other key type", func(t *testing.T) {
+		buf := appendItem(nil, qgroupLimitKey, 259, 1, 1)
+
+		item, err := findSearchItem(buf, 1, qgroupInfoKey, 259)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		buf := appendItem(nil, qgroupInfoKey, 258, 1, 1)
+
+		item, err := findSearchItem(buf, 1, qgroupInfoKey, 259)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("no items", func(t *testing.T) {
+		item, err := findSearchItem(make([]byte, 64), 0, qgroupInfoKey, 259)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		buf := appendItem(nil, qgroupInfoKey, 259, 1, 1)
+
+		_, err := findSearchItem(buf[:searchHeaderSize+8], 1, qgroupInfoKey, 259)
+		assert.ErrorContains(t, err, "truncated item")
+	})
+}
@@ -0,0 +1,127 @@
+package btrfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JSON output (`btrfs --format json`) is available since btrfs-progs 6.1 for
+// subvolume show, qgroup show and device stats. filesystem show and
+// filesystem usage have no JSON output and are always parsed as text.
+
+var versionRe = regexp.MustCompile(`v(\d+)\.(\d+)`)
+
+// supportsJSON reports whether the `btrfs --version` output is 6.1 or newer.
+// Format: btrfs-progs v6.6.3
+func supportsJSON(versionOut string) bool {
+	m := versionRe.FindStringSubmatch(versionOut)
+	if m == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > 6 || (major == 6 && minor >= 1)
+}
+
+// jsonUint accepts JSON numbers as well as numeric strings, btrfs-progs
+// quotes some u64 values.
+type jsonUint uint64
+
+func (u *jsonUint) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", b, err)
+	}
+	*u = jsonUint(v)
+	return nil
+}
+
+// jsonLimit is a qgroup limit, "none" if unlimited.
+type jsonLimit uint64
+
+func (l *jsonLimit) UnmarshalJSON(b []byte) error {
+	if string(b) == `"none"` {
+		*l = 0
+		return nil
+	}
+	return (*jsonUint)(l).UnmarshalJSON(b)
+}
+
+// parseSubvolumeIDJSON extracts the subvolume ID from `btrfs --format json subvolume show`.
+// Format: {"__header": {...}, "subvolume-show": {"name": "vol1", "subvolume_id": 259, ...}}
+func parseSubvolumeIDJSON(out string) (string, error) {
+	var doc struct {
+		Show *struct {
+			ID *jsonUint `json:"subvolume_id"`
+		} `json:"subvolume-show"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		return "", fmt.Errorf("parse subvolume show json: %w", err)
+	}
+	if doc.Show == nil || doc.Show.ID == nil {
+		return "", fmt.Errorf("subvolume_id missing in subvolume show json")
+	}
+	return strconv.FormatUint(uint64(*doc.Show.ID), 10), nil
+}
+
+// parseQgroupShowJSON finds qgroupID in `btrfs --format json qgroup show -re --raw`.
+// Format: {"__header": {...}, "qgroup-show": [{"qgroupid": "0/259", "referenced": 16384, "exclusive": 8192, ...}]}
+// found is false if the output is valid but does not list qgroupID.
+func parseQgroupShowJSON(out, qgroupID string) (info QgroupInfo, found bool, err error) {
+	var doc struct {
+		Qgroups *[]struct {
+			ID         string    `json:"qgroupid"`
+			Referenced jsonUint  `json:"referenced"`
+			Exclusive  jsonUint  `json:"exclusive"`
+			MaxRfer    jsonLimit `json:"max_referenced"`
+		} `json:"qgroup-show"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		return QgroupInfo{}, false, fmt.Errorf("parse qgroup show json: %w", err)
+	}
+	if doc.Qgroups == nil {
+		return QgroupInfo{}, false, fmt.Errorf("qgroup-show missing in qgroup show json")
+	}
+	for _, q := range *doc.Qgroups {
+		if q.ID == qgroupID {
+			return QgroupInfo{Referenced: uint64(q.Referenced), Exclusive: uint64(q.Exclusive), MaxReferenced: uint64(q.MaxRfer)}, true, nil
+		}
+	}
+	return QgroupInfo{}, false, nil
+}
+
+// parseDeviceErrorsJSON parses `btrfs --format json device stats`.
+// Format: {"__header": {...}, "device-stats": [{"device": "/dev/sda", "devid": 1, "write_io_errs": 0, ...}]}
+func parseDeviceErrorsJSON(out string) ([]DeviceErrors, error) {
+	var doc struct {
+		Stats []struct {
+			Device         string   `json:"device"`
+			WriteErrs      jsonUint `json:"write_io_errs"`
+			ReadErrs       jsonUint `json:"read_io_errs"`
+			FlushErrs      jsonUint `json:"flush_io_errs"`
+			CorruptionErrs jsonUint `json:"corruption_errs"`
+			GenerationErrs jsonUint `json:"generation_errs"`
+		} `json:"device-stats"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		return nil, fmt.Errorf("parse device stats json: %w", err)
+	}
+	if len(doc.Stats) == 0 {
+		return nil, fmt.Errorf("no device found in btrfs device stats json")
+	}
+	all := make([]DeviceErrors, len(doc.Stats))
+	for i, d := range doc.Stats {
+		all[i] = DeviceErrors{
+			Device:         d.Device,
+			WriteErrs:      uint64(d.WriteErrs),
+			ReadErrs:       uint64(d.ReadErrs),
+			FlushErrs:      uint64(d.FlushErrs),
+			CorruptionErrs: uint64(d.CorruptionErrs),
+			GenerationErrs: uint64(d.GenerationErrs),
+		}
+	}
+	return all, nil
+}
@@ -1,6 +1,9 @@
 package btrfs
 
+import "time"
+
 type SubvolumeInfo struct {
+	ID   uint64
 	Path string
 }
 
@@ -36,7 +39,111 @@ type FilesystemUsage struct {
 	MetadataTotalBytes uint64
 }
 
+// QuotaMode is the quota accounting mode of a btrfs filesystem.
+type QuotaMode string
+
+const (
+	// QuotaModeQgroup is full qgroup accounting (`btrfs quota enable`).
+	QuotaModeQgroup QuotaMode = "qgroup"
+	// QuotaModeSimple is simple quota accounting (`btrfs quota enable --simple`, kernel 6.7+).
+	QuotaModeSimple QuotaMode = "simple"
+)
+
+// Backend selects how Manager talks to btrfs.
+type Backend string
+
+const (
+	// BackendCLI runs every operation through btrfs-progs.
+	BackendCLI Backend = "cli"
+	// BackendIoctl issues subvolume and qgroup operations as ioctls directly,
+	// everything else still runs through btrfs-progs.
+	BackendIoctl Backend = "ioctl"
+)
+
 type QgroupInfo struct {
 	Referenced uint64
 	Exclusive  uint64
+	// MaxReferenced is the referenced limit, 0 if unlimited.
+	MaxReferenced uint64
+}
+
+// Scrub states as reported by `btrfs scrub status`.
+const (
+	ScrubRunning     = "running"
+	ScrubFinished    = "finished"
+	ScrubAborted     = "aborted"
+	ScrubInterrupted = "interrupted"
+)
+
+// ScrubStatus is the state of the current or last scrub of a filesystem.
+type ScrubStatus struct {
+	// Status is one of the Scrub* states, empty if the filesystem was never scrubbed.
+	Status        string
+	StartedAt     time.Time
+	Duration      time.Duration
+	TotalBytes    uint64
+	ScrubbedBytes uint64
+	// ErrorsFound is the sum of all error counters of the error summary.
+	ErrorsFound         uint64
+	CorrectedErrors     uint64
+	UncorrectableErrors uint64
+}
+
+func (s ScrubStatus) Running() bool { return s.Status == ScrubRunning }
+
+// Progress returns the scrubbed fraction between 0 and 1.
+func (s ScrubStatus) Progress() float64 {
+	if s.Status == ScrubFinished {
+		return 1
+	}
+	if s.TotalBytes == 0 {
+		return 0
+	}
+	return min(float64(s.ScrubbedBytes)/float64(s.TotalBytes), 1)
+}
+
+// CompletedAt returns when a finished scrub completed, zero otherwise.
+func (s ScrubStatus) CompletedAt() time.Time {
+	if s.Status != ScrubFinished || s.StartedAt.IsZero() {
+		return time.Time{}
+	}
+	return s.StartedAt.Add(s.Duration)
+}
+
+// Balance states as reported by `btrfs balance status`.
+const (
+	BalanceIdle    = "idle"
+	BalanceRunning = "running"
+	BalancePaused  = "paused"
+)
+
+// BalanceFilters limits a balance to chunks up to the given percentage of
+// usage (-dusage / -musage), nil skips the block group type.
+type BalanceFilters struct {
+	DataUsage     *int
+	MetadataUsage *int
+}
+
+// BalanceStatus is the state of the balance of a filesystem. Chunk counts are
+// only known while a balance is running or paused.
+type BalanceStatus struct {
+	Status string
+	// TotalChunks is the kernel's estimate of chunks to relocate.
+	TotalChunks      uint64
+	BalancedChunks   uint64
+	ConsideredChunks uint64
+}
+
+func (s BalanceStatus) Running() bool { return s.Status == BalanceRunning }
+
+// Active reports whether a balance is running or paused, a paused balance
+// blocks starting a new one.
+func (s BalanceStatus) Active() bool { return s.Status != BalanceIdle }
+
+// Progress returns the balanced fraction of chunks between 0 and 1.
+func (s BalanceStatus) Progress() float64 {
+	if s.TotalChunks == 0 {
+		return 0
+	}
+	return min(float64(s.BalancedChunks)/float64(s.TotalChunks), 1)
 }
@@ -2,8 +2,10 @@ package btrfs
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // parseDevices extracts device info from `btrfs filesystem show --raw` output.
@@ -203,3 +205,223 @@ func parseProfileSizeUsed(line string) (size, used uint64) {
 	}
 	return
 }
+
+// parseFilesystemUUID extracts the filesystem UUID from `btrfs filesystem show` output.
+// Format: Label: none  uuid: 2a8b4f1e-5c3d-4e6f-8a9b-0c1d2e3f4a5b
+func parseFilesystemUUID(out string) (string, error) {
+	for _, line := range strings.Split(out, "\n") {
+		if _, uuid, ok := strings.Cut(line, "uuid:"); ok {
+			if uuid = strings.TrimSpace(uuid); uuid != "" {
+				return uuid, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("filesystem uuid not found")
+}
+
+// parseQgroupIDs extracts the level 0 qgroup IDs from `btrfs qgroup show --raw` output.
+// Format: 0/259        16384         8192
+func parseQgroupIDs(out string) []uint64 {
+	return parseQgroupLevelIDs(out, 0)
+}
+
+// parseQgroupLevelIDs extracts the IDs of the qgroups of the given level,
+// e.g. 5 for 1/5 at level 1.
+func parseQgroupLevelIDs(out string, level int) []uint64 {
+	prefix := strconv.Itoa(level) + "/"
+	var ids []uint64
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		raw, ok := strings.CutPrefix(fields[0], prefix)
+		if !ok {
+			continue
+		}
+		if id, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// parseQgroupID converts a qgroup such as 1/5 to the kernel's u64 form, the
+// level in the upper 16 bits.
+func parseQgroupID(qgroupID string) (uint64, error) {
+	rawLevel, rawID, ok := strings.Cut(qgroupID, "/")
+	level, err := strconv.ParseUint(rawLevel, 10, 16)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid qgroup %q", qgroupID)
+	}
+	id, err := strconv.ParseUint(rawID, 10, 48)
+	if err != nil {
+		return 0, fmt.Errorf("invalid qgroup %q", qgroupID)
+	}
+	return level<<48 | id, nil
+}
+
+// parseSubvolumeID extracts the subvolume ID from `btrfs subvolume show`,
+// empty if there is none. Format: Subvolume ID:		259
+func parseSubvolumeID(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if id, ok := strings.CutPrefix(strings.TrimSpace(line), "Subvolume ID:"); ok {
+			return strings.TrimSpace(id)
+		}
+	}
+	return ""
+}
+
+// parseQgroupShow finds qgroupID in `btrfs qgroup show -re --raw` output.
+// Format: 0/259        16384         8192       1073741824
+// found is false if the output does not list qgroupID.
+func parseQgroupShow(out, qgroupID string) (info QgroupInfo, found bool, err error) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != qgroupID {
+			continue
+		}
+		if _, err := fmt.Sscanf(fields[1], "%d", &info.Referenced); err != nil {
+			return QgroupInfo{}, false, fmt.Errorf("parse referenced bytes %q: %w", fields[1], err)
+		}
+		if _, err := fmt.Sscanf(fields[2], "%d", &info.Exclusive); err != nil {
+			return QgroupInfo{}, false, fmt.Errorf("parse exclusive bytes %q: %w", fields[2], err)
+		}
+		// -r adds max_rfer, "none" if unlimited
+		if len(fields) >= 4 && fields[3] != "none" {
+			if _, err := fmt.Sscanf(fields[3], "%d", &info.MaxReferenced); err != nil {
+				return QgroupInfo{}, false, fmt.Errorf("parse max referenced bytes %q: %w", fields[3], err)
+			}
+		}
+		return info, true, nil
+	}
+	return QgroupInfo{}, false, nil
+}
+
+// parseScrubStatus parses `btrfs scrub status --raw` output:
+//
+//	Scrub started:    Wed Oct 16 10:00:00 2024
+//	Status:           running
+//	Duration:         0:00:20
+//	Total to scrub:   107374182400
+//	Bytes scrubbed:   5368709120  (5.00%)
+//	Error summary:    csum=12 read=1
+//	  Corrected:      10
+//	  Uncorrectable:  3
+func parseScrubStatus(out string) (ScrubStatus, error) {
+	var st ScrubStatus
+	for _, line := range strings.Split(out, "\n") {
+		key, val, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			if strings.Contains(line, "no stats available") {
+				return ScrubStatus{}, nil
+			}
+			continue
+		}
+		val = strings.TrimSpace(val)
+		var err error
+		switch key {
+		case "Scrub started", "Scrub resumed":
+			st.StartedAt, err = time.ParseInLocation(time.ANSIC, val, time.Local)
+		case "Status":
+			st.Status = val
+		case "Duration":
+			st.Duration, err = parseScrubDuration(val)
+		case "Total to scrub":
+			st.TotalBytes, err = parseFirstUint(val)
+		case "Bytes scrubbed":
+			st.ScrubbedBytes, err = parseFirstUint(val)
+		case "Error summary":
+			if val == "no errors found" {
+				continue
+			}
+			for _, f := range strings.Fields(val) {
+				_, n, ok := strings.Cut(f, "=")
+				if !ok {
+					continue
+				}
+				v, perr := strconv.ParseUint(n, 10, 64)
+				if perr != nil {
+					return ScrubStatus{}, fmt.Errorf("parse error summary %q: %w", f, perr)
+				}
+				st.ErrorsFound += v
+			}
+		case "Corrected":
+			st.CorrectedErrors, err = parseFirstUint(val)
+		case "Uncorrectable":
+			st.UncorrectableErrors, err = parseFirstUint(val)
+		}
+		if err != nil {
+			return ScrubStatus{}, fmt.Errorf("parse %s %q: %w", strings.ToLower(key), val, err)
+		}
+	}
+	if st.Status == "" {
+		return ScrubStatus{}, fmt.Errorf("no status found in btrfs scrub status output")
+	}
+	return st, nil
+}
+
+var balanceChunksRe = regexp.MustCompile(`(\d+) out of about (\d+) chunks balanced \((\d+) considered\)`)
+
+// parseBalanceStatus parses `btrfs balance status` output:
+//
+//	No balance found on '/mnt'
+//
+//	Balance on '/mnt' is running
+//	2 out of about 10 chunks balanced (3 considered),  80% left
+func parseBalanceStatus(out string) (BalanceStatus, error) {
+	var st BalanceStatus
+	switch {
+	case strings.Contains(out, "No balance found"):
+		return BalanceStatus{Status: BalanceIdle}, nil
+	case strings.Contains(out, " is running"):
+		st.Status = BalanceRunning
+	case strings.Contains(out, " is paused"):
+		st.Status = BalancePaused
+	default:
+		return BalanceStatus{}, fmt.Errorf("no status found in btrfs balance status output")
+	}
+	if m := balanceChunksRe.FindStringSubmatch(out); m != nil {
+		st.BalancedChunks, _ = strconv.ParseUint(m[1], 10, 64)
+		st.TotalChunks, _ = strconv.ParseUint(m[2], 10, 64)
+		st.ConsideredChunks, _ = strconv.ParseUint(m[3], 10, 64)
+	}
+	return st, nil
+}
+
+// parseScrubDuration parses h:mm:ss, hours may exceed 24.
+func parseScrubDuration(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("expected h:mm:ss")
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.ParseUint(parts[i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+func parseFirstUint(s string) (uint64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty value")
+	}
+	return strconv.ParseUint(fields[0], 10, 64)
+}
+
+// parseResolvedPaths extracts the paths from `btrfs inspect-internal
+// logical-resolve` and `inode-resolve` output, one absolute path per line.
+func parseResolvedPaths(out string) []string {
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "/") {
+			paths = append(paths, line)
+		}
+	}
+	return paths
+}
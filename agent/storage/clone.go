@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/erikmagkekse/btrfs-nfs-csi/config"
@@ -12,7 +14,10 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func (s *Storage) CreateClone(ctx context.Context, tenant string, req CloneCreateRequest) (*CloneMetadata, error) {
+// CreateClone creates volume req.Name as a writable snapshot of a snapshot or
+// a live volume. The clone inherits the source volume's properties and gets
+// its own qgroup limit of req.SizeBytes, which defaults to the source size.
+func (s *Storage) CreateClone(ctx context.Context, tenant string, req CloneCreateRequest) (*VolumeMetadata, error) {
 	bp, err := s.tenantPath(tenant)
 	if err != nil {
 		return nil, err
@@ -22,23 +27,71 @@ func (s *Storage) CreateClone(ctx context.Context, tenant string, req CloneCreat
 	if err := validateName(req.Name); err != nil {
 		return nil, err
 	}
-	if err := validateName(req.Snapshot); err != nil {
-		return nil, err
+	if (req.Snapshot == "") == (req.Volume == "") {
+		return nil, &StorageError{Code: ErrInvalid, Message: "exactly one of snapshot or volume is required"}
 	}
-	snapDir := filepath.Join(bp, config.SnapshotsDir, req.Snapshot)
-	srcData := filepath.Join(snapDir, config.DataDir)
-	if _, err := os.Stat(srcData); os.IsNotExist(err) {
-		return nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("source snapshot %q not found", req.Snapshot)}
+	var srcData string
+	var src *VolumeMetadata
+	if req.Snapshot != "" {
+		if err := validateName(req.Snapshot); err != nil {
+			return nil, err
+		}
+		snapDir := filepath.Join(bp, config.SnapshotsDir, req.Snapshot)
+		srcData = filepath.Join(snapDir, config.DataDir)
+		var snap SnapshotMetadata
+		if _, err := os.Stat(srcData); os.IsNotExist(err) {
+			return nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("source snapshot %q not found", req.Snapshot)}
+		}
+		if err := ReadMetadata(filepath.Join(snapDir, config.MetadataFile), &snap); err != nil {
+			return nil, fmt.Errorf("read snapshot metadata: %w", err)
+		}
+		src, err = cloneSourceFromSnapshot(bp, &snap, srcData)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := validateName(req.Volume); err != nil {
+			return nil, err
+		}
+		// the live subvolume is snapshotted directly, no intermediate snapshot
+		srcData = filepath.Join(bp, req.Volume, config.DataDir)
+		if _, err := os.Stat(srcData); os.IsNotExist(err) {
+			return nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("source volume %q not found", req.Volume)}
+		}
+		src = &VolumeMetadata{}
+		if err := ReadMetadata(filepath.Join(bp, req.Volume, config.MetadataFile), src); err != nil {
+			return nil, fmt.Errorf("read volume metadata: %w", err)
+		}
 	}
+
 	cloneDir := filepath.Join(bp, req.Name)
 	if _, err := os.Stat(cloneDir); err == nil {
-		var existing CloneMetadata
+		var existing VolumeMetadata
 		if err := ReadMetadata(filepath.Join(cloneDir, config.MetadataFile), &existing); err != nil {
 			return nil, fmt.Errorf("clone %q exists but metadata is corrupt: %w", req.Name, err)
 		}
 		return &existing, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("clone %q already exists", req.Name)}
 	}
 
+	size := req.SizeBytes
+	if size == 0 {
+		size = src.SizeBytes
+	}
+	if size == 0 {
+		return nil, &StorageError{Code: ErrInvalid, Message: "size_bytes is required, source size is unknown"}
+	}
+	if size < src.SizeBytes {
+		return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("size %d must not be smaller than source size %d", size, src.SizeBytes)}
+	}
+	if src.Mode == "" {
+		// clones made before clones carried volume metadata
+		src.Mode = s.defaultDataMode
+	}
+	mode, err := strconv.ParseUint(src.Mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("source has invalid mode %q: %w", src.Mode, err)
+	}
+
 	// operations
 	if err := os.MkdirAll(cloneDir, s.defaultDirMode); err != nil {
 		log.Error().Err(err).Msg("failed to create clone directory")
@@ -46,29 +99,106 @@ func (s *Storage) CreateClone(ctx context.Context, tenant string, req CloneCreat
 	}
 
 	dstData := filepath.Join(cloneDir, config.DataDir)
-	if err := s.btrfs.SubvolumeSnapshot(ctx, srcData, dstData, false); err != nil {
+	cleanup := func() {
+		if err := s.btrfs.SubvolumeDelete(ctx, dstData); err != nil {
+			log.Warn().Err(err).Str("path", dstData).Msg("cleanup: failed to delete subvolume")
+		}
+		if err := os.RemoveAll(cloneDir); err != nil {
+			log.Warn().Err(err).Str("path", cloneDir).Msg("cleanup: failed to remove directory")
+		}
+	}
+
+	if err := s.btrfs.SubvolumeSnapshot(ctx, srcData, dstData, false, s.tenantInherit(tenant)...); err != nil {
 		_ = os.RemoveAll(cloneDir)
 		log.Error().Err(err).Msg("failed to create clone")
 		return nil, fmt.Errorf("btrfs snapshot failed: %w", err)
 	}
 
+	if src.NoCOW {
+		if err := s.btrfs.SetNoCOW(ctx, dstData); err != nil {
+			log.Error().Err(err).Str("path", dstData).Msg("failed to set nocow")
+			cleanup()
+			return nil, fmt.Errorf("chattr +C failed: %w", err)
+		}
+	}
+
+	if src.Compression != "" && src.Compression != "none" {
+		if err := s.btrfs.SetCompression(ctx, dstData, src.Compression); err != nil {
+			log.Error().Err(err).Str("path", dstData).Str("algo", src.Compression).Msg("failed to set compression")
+			cleanup()
+			return nil, fmt.Errorf("set compression failed: %w", err)
+		}
+	}
+
+	if s.quotaEnabled {
+		if err := s.btrfs.QgroupLimit(ctx, dstData, size); err != nil {
+			log.Error().Err(err).Str("path", dstData).Uint64("bytes", size).Msg("failed to set qgroup limit")
+			cleanup()
+			return nil, fmt.Errorf("qgroup limit failed: %w", err)
+		}
+	}
+
+	if err := os.Chmod(dstData, fileMode(mode)); err != nil {
+		log.Error().Err(err).Msg("failed to chmod")
+	}
+	if err := os.Chown(dstData, src.UID, src.GID); err != nil {
+		log.Error().Err(err).Msg("failed to chown")
+	}
+
 	now := time.Now().UTC()
-	meta := CloneMetadata{
+	meta := VolumeMetadata{
 		Name:           req.Name,
-		SourceSnapshot: req.Snapshot,
 		Path:           cloneDir,
+		SizeBytes:      size,
+		NoCOW:          src.NoCOW,
+		Compression:    src.Compression,
+		QuotaBytes:     size,
+		UID:            src.UID,
+		GID:            src.GID,
+		Mode:           src.Mode,
+		SourceSnapshot: req.Snapshot,
+		SourceVolume:   req.Volume,
 		CreatedAt:      now,
+		UpdatedAt:      now,
 	}
 
 	if err := writeMetadataAtomic(filepath.Join(cloneDir, config.MetadataFile), meta); err != nil {
 		log.Error().Err(err).Msg("failed to write clone metadata")
-		if delErr := s.btrfs.SubvolumeDelete(ctx, dstData); delErr != nil {
-			log.Warn().Err(delErr).Str("path", dstData).Msg("cleanup: failed to delete subvolume")
-		}
-		_ = os.RemoveAll(cloneDir)
+		cleanup()
 		return nil, fmt.Errorf("failed to write metadata: %w", err)
 	}
 
-	log.Info().Str("tenant", tenant).Str("name", req.Name).Str("snapshot", req.Snapshot).Msg("clone created")
+	log.Info().Str("tenant", tenant).Str("name", req.Name).Str("snapshot", req.Snapshot).Str("volume", req.Volume).Uint64("size", size).Msg("clone created")
 	return &meta, nil
 }
+
+// cloneSourceFromSnapshot returns the properties a clone of snap inherits.
+// They come from the snapshot's volume; if that volume is gone, the size is
+// taken from the snapshot and ownership and mode from its subvolume.
+func cloneSourceFromSnapshot(bp string, snap *SnapshotMetadata, snapData string) (*VolumeMetadata, error) {
+	if snap.Volume != "" {
+		var vol VolumeMetadata
+		if err := ReadMetadata(filepath.Join(bp, snap.Volume, config.MetadataFile), &vol); err == nil {
+			// the snapshot may predate a resize of its volume
+			if snap.SizeBytes > 0 {
+				vol.SizeBytes = snap.SizeBytes
+			}
+			return &vol, nil
+		}
+	}
+
+	info, err := os.Stat(snapData)
+	if err != nil {
+		return nil, fmt.Errorf("stat snapshot subvolume: %w", err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("stat snapshot subvolume: unsupported platform")
+	}
+	return &VolumeMetadata{
+		SizeBytes: snap.SizeBytes,
+		UID:       int(st.Uid),
+		GID:       int(st.Gid),
+		Mode:      fmt.Sprintf("%o", unixMode(info.Mode())),
+	}, nil
+}
@@ -25,7 +25,12 @@ func TestCreateClone(t *testing.T) {
 		snapDir := filepath.Join(bp, config.SnapshotsDir, name)
 		dataDir := filepath.Join(snapDir, config.DataDir)
 		require.NoError(t, os.MkdirAll(dataDir, 0o755))
-		writeSnapshotMetadata(t, snapDir, SnapshotMetadata{Name: name, Volume: "srcvol", ReadOnly: true})
+		writeSnapshotMetadata(t, snapDir, SnapshotMetadata{Name: name, Volume: "srcvol", SizeBytes: 1024, ReadOnly: true})
+	}
+
+	srcVol := VolumeMetadata{
+		Name: "srcvol", SizeBytes: 2048, Compression: "zstd", Mode: "750",
+		UID: os.Getuid(), GID: os.Getgid(),
 	}
 
 	t.Run("validation", func(t *testing.T) {
@@ -38,6 +43,11 @@ func TestCreateClone(t *testing.T) {
 			{name: "invalid_name", req: CloneCreateRequest{Name: "bad!", Snapshot: "snap"}, code: ErrInvalid},
 			{name: "invalid_snapshot", req: CloneCreateRequest{Name: "clone", Snapshot: "bad!"}, code: ErrInvalid},
 			{name: "snapshot_not_found", req: CloneCreateRequest{Name: "clone", Snapshot: "nonexistent"}, code: ErrNotFound},
+			{name: "no_source", req: CloneCreateRequest{Name: "clone"}, code: ErrInvalid},
+			{name: "both_sources", req: CloneCreateRequest{Name: "clone", Snapshot: "mysnap", Volume: "srcvol"}, setup: true, code: ErrInvalid},
+			{name: "invalid_volume", req: CloneCreateRequest{Name: "clone", Volume: "bad!"}, code: ErrInvalid},
+			{name: "volume_not_found", req: CloneCreateRequest{Name: "clone", Volume: "nonexistent"}, code: ErrNotFound},
+			{name: "smaller_than_source", req: CloneCreateRequest{Name: "clone", Snapshot: "mysnap", SizeBytes: 512}, setup: true, code: ErrInvalid},
 			{name: "already_exists", req: CloneCreateRequest{Name: "existing", Snapshot: "mysnap"}, setup: true, code: ErrAlreadyExists},
 		}
 		for _, tt := range tests {
@@ -51,7 +61,7 @@ func TestCreateClone(t *testing.T) {
 					require.NoError(t, os.MkdirAll(cloneDir, 0o755))
 					require.NoError(t, writeMetadataAtomic(
 						filepath.Join(cloneDir, config.MetadataFile),
-						CloneMetadata{Name: "existing", SourceSnapshot: "mysnap"},
+						VolumeMetadata{Name: "existing", SourceSnapshot: "mysnap"},
 					))
 				}
 				meta, err := s.CreateClone(ctx, "test", tt.req)
@@ -66,6 +76,8 @@ func TestCreateClone(t *testing.T) {
 
 	t.Run("success", func(t *testing.T) {
 		s, bp, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		setupUsageVol(t, bp, "srcvol", srcVol)
 		setupSrcSnap(t, bp, "mysnap")
 
 		meta, err := s.CreateClone(ctx, "test", CloneCreateRequest{
@@ -76,16 +88,76 @@ func TestCreateClone(t *testing.T) {
 		assert.Equal(t, "mysnap", meta.SourceSnapshot)
 		assert.Equal(t, filepath.Join(bp, "myclone"), meta.Path)
 		assert.False(t, meta.CreatedAt.IsZero(), "CreatedAt should be set")
+		assert.Equal(t, uint64(1024), meta.SizeBytes, "size defaults to the snapshot size")
+		assert.Equal(t, uint64(1024), meta.QuotaBytes)
+		assert.Equal(t, "zstd", meta.Compression, "compression is inherited")
+		assert.Equal(t, "750", meta.Mode, "mode is inherited")
 
-		var ondisk CloneMetadata
-		require.NoError(t, ReadMetadata(filepath.Join(bp, "myclone", config.MetadataFile), &ondisk))
+		ondisk := readVolumeMeta(t, filepath.Join(bp, "myclone"))
 		assert.Equal(t, "myclone", ondisk.Name, "on-disk metadata should match")
+		assert.Equal(t, uint64(1024), ondisk.SizeBytes)
 
 		// btrfs snapshot called WITHOUT -r flag (writable clone)
 		srcData := filepath.Join(bp, config.SnapshotsDir, "mysnap", config.DataDir)
 		dstData := filepath.Join(bp, "myclone", config.DataDir)
-		require.Len(t, runner.Calls, 1, "expected exactly 1 btrfs call")
 		assert.Equal(t, []string{"subvolume", "snapshot", srcData, dstData}, runner.Calls[0])
+		assert.True(t, containsCall(runner.Calls, "property", "set", dstData, "compression", "zstd"))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "1024", dstData))
+
+		vols, err := s.ListVolumes("test")
+		require.NoError(t, err)
+		assert.Len(t, vols, 2, "clone is listed as a volume")
+	})
+
+	t.Run("grows_beyond_source", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		setupUsageVol(t, bp, "srcvol", srcVol)
+		setupSrcSnap(t, bp, "mysnap")
+
+		meta, err := s.CreateClone(ctx, "test", CloneCreateRequest{
+			Name: "myclone", Snapshot: "mysnap", SizeBytes: 4096,
+		})
+		require.NoError(t, err, "CreateClone")
+		assert.Equal(t, uint64(4096), meta.SizeBytes)
+		assert.Equal(t, uint64(4096), meta.QuotaBytes)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "4096", filepath.Join(bp, "myclone", config.DataDir)))
+	})
+
+	t.Run("source_volume_deleted", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		setupSrcSnap(t, bp, "mysnap")
+		require.NoError(t, os.Chmod(filepath.Join(bp, config.SnapshotsDir, "mysnap", config.DataDir), 0o750))
+
+		meta, err := s.CreateClone(ctx, "test", CloneCreateRequest{
+			Name: "myclone", Snapshot: "mysnap",
+		})
+		require.NoError(t, err, "CreateClone")
+		assert.Equal(t, uint64(1024), meta.SizeBytes, "size is taken from the snapshot")
+		assert.Equal(t, "750", meta.Mode, "mode is taken from the snapshot subvolume")
+		assert.Equal(t, os.Getuid(), meta.UID)
+	})
+
+	t.Run("from_volume", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "srcvol", srcVol)
+
+		meta, err := s.CreateClone(ctx, "test", CloneCreateRequest{
+			Name: "myclone", Volume: "srcvol",
+		})
+		require.NoError(t, err, "CreateClone")
+		assert.Equal(t, "srcvol", meta.SourceVolume)
+		assert.Empty(t, meta.SourceSnapshot)
+		assert.Equal(t, uint64(2048), meta.SizeBytes, "size defaults to the volume size")
+		assert.Equal(t, "zstd", meta.Compression)
+
+		srcData := filepath.Join(bp, "srcvol", config.DataDir)
+		dstData := filepath.Join(bp, "myclone", config.DataDir)
+		assert.Equal(t, []string{"subvolume", "snapshot", srcData, dstData}, runner.Calls[0])
+
+		snaps, err := s.ListSnapshots("test", "")
+		require.NoError(t, err)
+		assert.Empty(t, snaps, "no intermediate snapshot")
 	})
 
 	t.Run("btrfs_fails_cleanup", func(t *testing.T) {
@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Consistency issue kinds
+const (
+	IssueMissingSubvolume = "missing_subvolume"
+	IssueMissingMetadata  = "missing_metadata"
+	IssueStaleTmp         = "stale_tmp"
+	IssueOrphanSnapshot   = "orphan_snapshot"
+	IssueOrphanQgroup     = "orphan_qgroup"
+	IssueLegacyClone      = "legacy_clone"
+)
+
+// issueKinds are the kinds of the tenant check, orphaned qgroups are found by
+// the filesystem check.
+var issueKinds = []string{IssueMissingSubvolume, IssueMissingMetadata, IssueStaleTmp, IssueOrphanSnapshot, IssueLegacyClone}
+
+// consistencyGrace skips entries modified more recently, a create or delete
+// may still be in progress on them.
+const consistencyGrace = 10 * time.Minute
+
+// fsTreeID is the top-level subvolume, its qgroup 0/5 has no listed subvolume.
+const fsTreeID = 5
+
+// StartConsistencyChecker periodically checks the tenant for inconsistencies
+// and reports them in logs and metrics. It never repairs anything. The
+// filesystem check is run by StartFilesystemConsistencyChecker.
+func (s *Storage) StartConsistencyChecker(ctx context.Context, interval time.Duration, tenant string) {
+	go func() {
+		s.runConsistencyCheck(ctx, tenant)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.runConsistencyCheck(ctx, tenant)
+			}
+		}
+	}()
+}
+
+func (s *Storage) runConsistencyCheck(ctx context.Context, tenant string) {
+	report, err := s.CheckConsistency(ctx, tenant, false)
+	if err != nil {
+		log.Error().Err(err).Str("tenant", tenant).Msg("consistency checker: check failed")
+		return
+	}
+	for _, issue := range report.Issues {
+		log.Warn().Str("tenant", tenant).Str("kind", issue.Kind).Str("path", issue.Path).Bool("repairable", issue.Repairable).Msg("consistency checker: " + issue.Message)
+	}
+}
+
+// CheckConsistency compares the tenant's volume and snapshot directories
+// against their metadata and btrfs subvolumes. With repair set, the safe
+// cases are fixed: stale metadata.json.tmp files and empty leftover
+// directories are removed, missing metadata is rebuilt from the subvolume
+// and clones made before clones were volumes get a size and qgroup limit.
+func (s *Storage) CheckConsistency(ctx context.Context, tenant string, repair bool) (*ConsistencyReport, error) {
+	return s.checkConsistency(ctx, tenant, repair, time.Now())
+}
+
+func (s *Storage) checkConsistency(ctx context.Context, tenant string, repair bool, now time.Time) (*ConsistencyReport, error) {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ConsistencyReport{CheckedAt: now.UTC(), Repair: repair, Issues: []ConsistencyIssue{}}
+	add := func(issue ConsistencyIssue, fix func() error) {
+		if repair && issue.Repairable {
+			if err := fix(); err != nil {
+				issue.Error = err.Error()
+			} else {
+				issue.Repaired = true
+				log.Info().Str("tenant", tenant).Str("kind", issue.Kind).Str("path", issue.Path).Msg("consistency: repaired")
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	entries, err := os.ReadDir(bp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base path: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == config.SnapshotsDir || e.Name() == config.TrashDir {
+			continue
+		}
+		volDir := filepath.Join(bp, e.Name())
+		if !s.checkEntry(ctx, volDir, false, now, add) {
+			continue
+		}
+		var meta VolumeMetadata
+		if err := ReadMetadata(filepath.Join(volDir, config.MetadataFile), &meta); err != nil || !isLegacyClone(&meta) {
+			continue
+		}
+		add(ConsistencyIssue{Kind: IssueLegacyClone, Path: volDir, Message: "clone has no size and no qgroup limit", Repairable: true}, func() error {
+			return s.backfillClone(ctx, bp, volDir, now)
+		})
+	}
+
+	snapBaseDir := filepath.Join(bp, config.SnapshotsDir)
+	snapEntries, err := os.ReadDir(snapBaseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read snapshots directory: %w", err)
+	}
+	for _, e := range snapEntries {
+		if !e.IsDir() {
+			continue
+		}
+		snapDir := filepath.Join(snapBaseDir, e.Name())
+		if !s.checkEntry(ctx, snapDir, true, now, add) {
+			continue
+		}
+		var snap SnapshotMetadata
+		if err := ReadMetadata(filepath.Join(snapDir, config.MetadataFile), &snap); err != nil || snap.Volume == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(bp, snap.Volume)); os.IsNotExist(err) {
+			add(ConsistencyIssue{Kind: IssueOrphanSnapshot, Path: snapDir, Message: fmt.Sprintf("source volume %q no longer exists", snap.Volume)}, nil)
+		}
+	}
+
+	counts := map[string]int{}
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			counts[issue.Kind]++
+		}
+	}
+	for _, kind := range issueKinds {
+		ConsistencyIssuesGauge.WithLabelValues(tenant, kind).Set(float64(counts[kind]))
+	}
+	return report, nil
+}
+
+// checkEntry checks one volume or snapshot directory. It returns true if the
+// entry has both a data subvolume and readable metadata.
+func (s *Storage) checkEntry(ctx context.Context, dir string, snapshot bool, now time.Time, add func(ConsistencyIssue, func() error)) bool {
+	metaPath := filepath.Join(dir, config.MetadataFile)
+	dataDir := filepath.Join(dir, config.DataDir)
+
+	tmp := metaPath + ".tmp"
+	if info, err := os.Stat(tmp); err == nil && now.Sub(info.ModTime()) > consistencyGrace {
+		add(ConsistencyIssue{Kind: IssueStaleTmp, Path: tmp, Message: "stale metadata temp file", Repairable: true}, func() error {
+			return os.Remove(tmp)
+		})
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil || now.Sub(info.ModTime()) <= consistencyGrace {
+		return false
+	}
+
+	_, metaErr := os.Stat(metaPath)
+	hasMeta := metaErr == nil
+
+	if _, err := os.Stat(dataDir); err != nil {
+		issue := ConsistencyIssue{Kind: IssueMissingSubvolume, Path: dir, Message: "data subvolume is missing"}
+		if hasMeta {
+			issue.Message = "metadata exists but data subvolume is missing"
+		} else {
+			// nothing but leftovers of an interrupted create
+			issue.Repairable = isEmptyLeftover(dir)
+		}
+		add(issue, func() error { return os.RemoveAll(dir) })
+		return false
+	}
+	if !s.btrfs.SubvolumeExists(ctx, dataDir) {
+		add(ConsistencyIssue{Kind: IssueMissingSubvolume, Path: dataDir, Message: "data is not a btrfs subvolume"}, nil)
+		return false
+	}
+
+	if !hasMeta {
+		add(ConsistencyIssue{Kind: IssueMissingMetadata, Path: metaPath, Message: "data subvolume has no metadata", Repairable: true}, func() error {
+			if snapshot {
+				return s.rebuildSnapshotMetadata(ctx, dir, now)
+			}
+			return s.rebuildVolumeMetadata(ctx, dir, now)
+		})
+		return false
+	}
+	return true
+}
+
+// isEmptyLeftover reports whether dir holds nothing but a metadata temp file.
+func isEmptyLeftover(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Name() != config.MetadataFile+".tmp" {
+			return false
+		}
+	}
+	return true
+}
+
+// StartFilesystemConsistencyChecker periodically checks the filesystem for
+// qgroups without a subvolume and reports them in logs and metrics.
+func (s *Storage) StartFilesystemConsistencyChecker(ctx context.Context, interval time.Duration) {
+	go func() {
+		s.runFilesystemConsistencyCheck(ctx)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.runFilesystemConsistencyCheck(ctx)
+			}
+		}
+	}()
+}
+
+func (s *Storage) runFilesystemConsistencyCheck(ctx context.Context) {
+	report, err := s.CheckFilesystemConsistency(ctx, false)
+	if err != nil {
+		log.Error().Err(err).Msg("consistency checker: filesystem check failed")
+		return
+	}
+	for _, issue := range report.Issues {
+		log.Warn().Str("kind", issue.Kind).Str("path", issue.Path).Bool("repairable", issue.Repairable).Msg("consistency checker: " + issue.Message)
+	}
+}
+
+// CheckFilesystemConsistency looks for level 0 qgroups without a subvolume,
+// left behind by subvolumes deleted outside the agent. Their subvolume is
+// gone, so they cannot be attributed to a tenant and are only checked by
+// the admin API. With repair set, they are destroyed. Level 1 qgroups of
+// tenants and volumes are never touched. Without quota the report is empty.
+func (s *Storage) CheckFilesystemConsistency(ctx context.Context, repair bool) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{CheckedAt: time.Now().UTC(), Repair: repair, Issues: []ConsistencyIssue{}}
+	if !s.quotaEnabled {
+		OrphanQgroupsGauge.Set(0)
+		return report, nil
+	}
+
+	qgroups, err := s.btrfs.QgroupIDs(ctx, s.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("list qgroups: %w", err)
+	}
+	subs, err := s.btrfs.SubvolumeListAll(ctx, s.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("list subvolumes: %w", err)
+	}
+	exists := map[uint64]bool{fsTreeID: true}
+	for _, sub := range subs {
+		exists[sub.ID] = true
+	}
+
+	var unrepaired int
+	for _, id := range qgroups {
+		if exists[id] {
+			continue
+		}
+		issue := ConsistencyIssue{Kind: IssueOrphanQgroup, Path: fmt.Sprintf("0/%d", id), Message: "qgroup has no subvolume", Repairable: true}
+		if repair {
+			if err := s.btrfs.QgroupDestroy(ctx, id, s.mountPoint); err != nil {
+				issue.Error = err.Error()
+			} else {
+				issue.Repaired = true
+				log.Info().Str("kind", issue.Kind).Str("path", issue.Path).Msg("consistency: repaired")
+			}
+		}
+		if !issue.Repaired {
+			unrepaired++
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	OrphanQgroupsGauge.Set(float64(unrepaired))
+	return report, nil
+}
+
+// rebuildVolumeMetadata writes volume metadata derived from the data
+// subvolume. Exports and schedules are not recoverable.
+func (s *Storage) rebuildVolumeMetadata(ctx context.Context, volDir string, now time.Time) error {
+	meta, err := s.volumeMetadataFromSubvolume(ctx, volDir, now)
+	if err != nil {
+		return err
+	}
+	return writeMetadataAtomic(filepath.Join(volDir, config.MetadataFile), meta)
+}
+
+// volumeMetadataFromSubvolume derives volume metadata from the data
+// subvolume: ownership and mode, NOCOW, compression and the qgroup limit as
+// size.
+func (s *Storage) volumeMetadataFromSubvolume(ctx context.Context, volDir string, now time.Time) (VolumeMetadata, error) {
+	dataDir := filepath.Join(volDir, config.DataDir)
+	info, err := os.Stat(dataDir)
+	if err != nil {
+		return VolumeMetadata{}, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return VolumeMetadata{}, fmt.Errorf("stat %s: unsupported platform", dataDir)
+	}
+
+	nocow, err := btrfs.IsNoCOW(dataDir)
+	if err != nil {
+		log.Warn().Err(err).Str("path", dataDir).Msg("consistency: failed to read nocow attribute, assuming cow")
+	}
+	compression, err := s.btrfs.GetProperty(ctx, dataDir, "compression")
+	if err != nil {
+		return VolumeMetadata{}, fmt.Errorf("get compression: %w", err)
+	}
+
+	meta := VolumeMetadata{
+		Name:        filepath.Base(volDir),
+		Path:        volDir,
+		NoCOW:       nocow,
+		Compression: compression,
+		UID:         int(st.Uid),
+		GID:         int(st.Gid),
+		Mode:        fmt.Sprintf("%o", unixMode(info.Mode())),
+		CreatedAt:   now.UTC(),
+		UpdatedAt:   now.UTC(),
+	}
+	if s.quotaEnabled {
+		q, err := s.btrfs.QgroupUsageEx(ctx, dataDir)
+		if err != nil {
+			return VolumeMetadata{}, fmt.Errorf("qgroup query: %w", err)
+		}
+		meta.SizeBytes = q.MaxReferenced
+		meta.QuotaBytes = q.MaxReferenced
+		meta.UsedBytes = q.Referenced
+	}
+	return meta, nil
+}
+
+// isLegacyClone reports whether meta was written as CloneMetadata, before
+// clones carried volume metadata.
+func isLegacyClone(meta *VolumeMetadata) bool {
+	return meta.SizeBytes == 0 && (meta.SourceSnapshot != "" || meta.SourceVolume != "")
+}
+
+// backfillClone completes the metadata of a legacy clone. Ownership, mode and
+// properties are read from the subvolume. The size is taken from the source
+// like for new clones, or the qgroup limit if the source is gone, and is
+// raised above the current usage. The qgroup limit is set to it.
+func (s *Storage) backfillClone(ctx context.Context, bp, volDir string, now time.Time) error {
+	var meta VolumeMetadata
+	metaPath := filepath.Join(volDir, config.MetadataFile)
+	if err := ReadMetadata(metaPath, &meta); err != nil {
+		return err
+	}
+	sub, err := s.volumeMetadataFromSubvolume(ctx, volDir, now)
+	if err != nil {
+		return err
+	}
+	dataDir := filepath.Join(volDir, config.DataDir)
+	used, err := s.dataUsage(ctx, dataDir, true)
+	if err != nil {
+		return err
+	}
+
+	size := legacyCloneSourceSize(bp, &meta)
+	if size == 0 {
+		size = sub.SizeBytes
+	}
+	if used >= size {
+		size = used + shrinkMargin(used)
+	}
+	if s.quotaEnabled {
+		if err := s.btrfs.QgroupLimit(ctx, dataDir, size); err != nil {
+			return fmt.Errorf("qgroup limit failed: %w", err)
+		}
+	}
+	return UpdateMetadata(metaPath, func(m *VolumeMetadata) {
+		m.SizeBytes, m.QuotaBytes, m.UsedBytes = size, size, used
+		m.NoCOW, m.Compression = sub.NoCOW, sub.Compression
+		m.UID, m.GID, m.Mode = sub.UID, sub.GID, sub.Mode
+		m.UpdatedAt = now.UTC()
+	})
+}
+
+// legacyCloneSourceSize returns the size of the source of a legacy clone,
+// zero if the source is gone.
+func legacyCloneSourceSize(bp string, meta *VolumeMetadata) uint64 {
+	if meta.SourceVolume != "" {
+		var src VolumeMetadata
+		if err := ReadMetadata(filepath.Join(bp, meta.SourceVolume, config.MetadataFile), &src); err == nil {
+			return src.SizeBytes
+		}
+		return 0
+	}
+	snapDir := filepath.Join(bp, config.SnapshotsDir, meta.SourceSnapshot)
+	var snap SnapshotMetadata
+	if err := ReadMetadata(filepath.Join(snapDir, config.MetadataFile), &snap); err != nil {
+		return 0
+	}
+	src, err := cloneSourceFromSnapshot(bp, &snap, filepath.Join(snapDir, config.DataDir))
+	if err != nil {
+		return 0
+	}
+	return src.SizeBytes
+}
+
+// rebuildSnapshotMetadata writes snapshot metadata derived from the
+// snapshot subvolume. The source volume is unknown.
+func (s *Storage) rebuildSnapshotMetadata(ctx context.Context, snapDir string, now time.Time) error {
+	ro, err := s.btrfs.GetProperty(ctx, filepath.Join(snapDir, config.DataDir), "ro")
+	if err != nil {
+		return fmt.Errorf("get ro property: %w", err)
+	}
+	meta := SnapshotMetadata{
+		Name:      filepath.Base(snapDir),
+		Path:      snapDir,
+		ReadOnly:  ro == "true",
+		CreatedAt: now.UTC(),
+		UpdatedAt: now.UTC(),
+	}
+	return writeMetadataAtomic(filepath.Join(snapDir, config.MetadataFile), meta)
+}
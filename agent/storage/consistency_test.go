@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// consistencyRunner fakes `subvolume show` (exists if the path exists),
+// `property get`, and the qgroup and subvolume listings.
+func consistencyRunner(qgroups, subvols string) func(args []string) (string, error) {
+	return func(args []string) (string, error) {
+		switch {
+		case args[0] == "subvolume" && args[1] == "show":
+			if _, err := os.Stat(args[2]); err != nil {
+				return "", fmt.Errorf("not a subvolume")
+			}
+			return "\tSubvolume ID:\t\t259\n", nil
+		case args[0] == "subvolume" && args[1] == "list":
+			return subvols, nil
+		case args[0] == "property" && args[1] == "get":
+			if args[3] == "compression" {
+				return "compression=zstd\n", nil
+			}
+			return args[3] + "=true\n", nil
+		case args[0] == "qgroup" && args[1] == "show" && args[2] == "-re":
+			return "0/259        16384         8192   1073741824         none\n", nil
+		case args[0] == "qgroup" && args[1] == "show":
+			return qgroups, nil
+		}
+		return "", nil
+	}
+}
+
+func findIssue(report *ConsistencyReport, kind string) *ConsistencyIssue {
+	for i := range report.Issues {
+		if report.Issues[i].Kind == kind {
+			return &report.Issues[i]
+		}
+	}
+	return nil
+}
+
+func TestCheckConsistency(t *testing.T) {
+	ctx := context.Background()
+	later := time.Now().Add(time.Hour)
+
+	t.Run("clean", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		runner.RunFn = consistencyRunner("", "")
+		setupUsageVol(t, bp, "vol", VolumeMetadata{Name: "vol"})
+		setupUsageSnap(t, bp, "snap", SnapshotMetadata{Name: "snap", Volume: "vol"})
+
+		report, err := s.checkConsistency(ctx, "test", false, later)
+		require.NoError(t, err)
+		assert.Empty(t, report.Issues)
+	})
+
+	t.Run("recent_entries_skipped", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		runner.RunFn = consistencyRunner("", "")
+		require.NoError(t, os.MkdirAll(filepath.Join(bp, "creating"), 0o755))
+
+		report, err := s.checkConsistency(ctx, "test", false, time.Now())
+		require.NoError(t, err)
+		assert.Empty(t, report.Issues)
+	})
+
+	t.Run("report_only", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		runner.RunFn = consistencyRunner("", "")
+		volDir := setupUsageVol(t, bp, "vol", VolumeMetadata{Name: "vol"})
+		require.NoError(t, os.WriteFile(filepath.Join(volDir, config.MetadataFile+".tmp"), nil, 0o644))
+		require.NoError(t, os.MkdirAll(filepath.Join(bp, "leftover"), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(bp, "nometa", config.DataDir), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(bp, "nodata"), 0o755))
+		writeTestMetadata(t, filepath.Join(bp, "nodata"), VolumeMetadata{Name: "nodata"})
+		setupUsageSnap(t, bp, "orphan", SnapshotMetadata{Name: "orphan", Volume: "gone"})
+
+		report, err := s.checkConsistency(ctx, "test", false, later)
+		require.NoError(t, err)
+		require.Len(t, report.Issues, 5)
+
+		byPath := map[string]ConsistencyIssue{}
+		for _, issue := range report.Issues {
+			assert.False(t, issue.Repaired)
+			byPath[issue.Path] = issue
+		}
+		assert.Equal(t, IssueStaleTmp, byPath[filepath.Join(volDir, config.MetadataFile+".tmp")].Kind)
+		assert.Equal(t, IssueMissingSubvolume, byPath[filepath.Join(bp, "leftover")].Kind)
+		assert.True(t, byPath[filepath.Join(bp, "leftover")].Repairable)
+		assert.Equal(t, IssueMissingMetadata, byPath[filepath.Join(bp, "nometa", config.MetadataFile)].Kind)
+		assert.Equal(t, IssueMissingSubvolume, byPath[filepath.Join(bp, "nodata")].Kind)
+		assert.False(t, byPath[filepath.Join(bp, "nodata")].Repairable, "volume with metadata is never removed")
+		assert.Equal(t, IssueOrphanSnapshot, byPath[filepath.Join(bp, config.SnapshotsDir, "orphan")].Kind)
+
+		assert.FileExists(t, filepath.Join(volDir, config.MetadataFile+".tmp"), "report must not change anything")
+		assert.DirExists(t, filepath.Join(bp, "leftover"))
+		assert.Equal(t, float64(1), testutil.ToFloat64(ConsistencyIssuesGauge.WithLabelValues("test", IssueOrphanSnapshot)))
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		runner.RunFn = consistencyRunner("0/5 16384 16384\n0/259 16384 8192\n0/300 0 0\n", "ID 259 gen 12 top level 5 path test/nometa/data\n")
+		volDir := setupUsageVol(t, bp, "vol", VolumeMetadata{Name: "vol"})
+		require.NoError(t, os.WriteFile(filepath.Join(volDir, config.MetadataFile+".tmp"), nil, 0o644))
+		require.NoError(t, os.MkdirAll(filepath.Join(bp, "leftover"), 0o755))
+		nometa := filepath.Join(bp, "nometa")
+		require.NoError(t, os.MkdirAll(filepath.Join(nometa, config.DataDir), 0o750))
+		require.NoError(t, os.Chmod(filepath.Join(nometa, config.DataDir), 0o750))
+		snapDir := filepath.Join(bp, config.SnapshotsDir, "nometa-snap")
+		require.NoError(t, os.MkdirAll(filepath.Join(snapDir, config.DataDir), 0o755))
+
+		report, err := s.checkConsistency(ctx, "test", true, later)
+		require.NoError(t, err)
+		require.Len(t, report.Issues, 4)
+		for _, issue := range report.Issues {
+			assert.True(t, issue.Repaired, "%s %s: %s", issue.Kind, issue.Path, issue.Error)
+		}
+
+		assert.NoFileExists(t, filepath.Join(volDir, config.MetadataFile+".tmp"))
+		assert.NoDirExists(t, filepath.Join(bp, "leftover"))
+
+		meta := readVolumeMeta(t, nometa)
+		assert.Equal(t, "nometa", meta.Name)
+		assert.Equal(t, "zstd", meta.Compression)
+		assert.Equal(t, "750", meta.Mode)
+		assert.Equal(t, uint64(1073741824), meta.SizeBytes)
+		assert.Equal(t, uint64(1073741824), meta.QuotaBytes)
+		assert.Equal(t, uint64(16384), meta.UsedBytes)
+
+		snap := readSnapMeta(t, snapDir)
+		assert.Equal(t, "nometa-snap", snap.Name)
+		assert.True(t, snap.ReadOnly)
+
+		// qgroups are filesystem-wide, a tenant never checks or destroys them
+		assert.Nil(t, findIssue(report, IssueOrphanQgroup))
+		assert.False(t, containsCall(runner.Calls, "qgroup", "destroy"))
+	})
+
+	t.Run("repair_failure_reported", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		runner.RunFn = func(args []string) (string, error) {
+			if args[0] == "property" {
+				return "", fmt.Errorf("property get failed")
+			}
+			return consistencyRunner("", "")(args)
+		}
+		require.NoError(t, os.MkdirAll(filepath.Join(bp, "nometa", config.DataDir), 0o755))
+
+		report, err := s.checkConsistency(ctx, "test", true, later)
+		require.NoError(t, err)
+		issue := findIssue(report, IssueMissingMetadata)
+		require.NotNil(t, issue)
+		assert.False(t, issue.Repaired)
+		assert.Contains(t, issue.Error, "property get failed")
+		assert.NoFileExists(t, filepath.Join(bp, "nometa", config.MetadataFile))
+	})
+
+	t.Run("legacy_clone", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		runner.RunFn = consistencyRunner("", "")
+		setupUsageVol(t, bp, "src", VolumeMetadata{Name: "src", SizeBytes: 2 << 30})
+		setupUsageSnap(t, bp, "snap", SnapshotMetadata{Name: "snap", Volume: "src"})
+		// clones written as CloneMetadata carry no size, quota or ownership
+		fromSnap := setupUsageVol(t, bp, "from-snap", VolumeMetadata{Name: "from-snap", SourceSnapshot: "snap"})
+		fromGone := setupUsageVol(t, bp, "from-gone", VolumeMetadata{Name: "from-gone", SourceVolume: "gone"})
+
+		report, err := s.checkConsistency(ctx, "test", false, later)
+		require.NoError(t, err)
+		require.Len(t, report.Issues, 2)
+		for _, issue := range report.Issues {
+			assert.Equal(t, IssueLegacyClone, issue.Kind)
+			assert.True(t, issue.Repairable)
+		}
+		assert.False(t, containsCall(runner.Calls, "qgroup", "limit"))
+
+		report, err = s.checkConsistency(ctx, "test", true, later)
+		require.NoError(t, err)
+		for _, issue := range report.Issues {
+			assert.True(t, issue.Repaired, "%s %s: %s", issue.Kind, issue.Path, issue.Error)
+		}
+
+		meta := readVolumeMeta(t, fromSnap)
+		assert.Equal(t, "snap", meta.SourceSnapshot)
+		assert.Equal(t, uint64(2<<30), meta.SizeBytes, "size of the snapshot source")
+		assert.Equal(t, uint64(2<<30), meta.QuotaBytes)
+		assert.Equal(t, uint64(16384), meta.UsedBytes)
+		assert.Equal(t, "zstd", meta.Compression)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "2147483648", filepath.Join(fromSnap, config.DataDir)))
+
+		meta = readVolumeMeta(t, fromGone)
+		assert.Equal(t, uint64(1073741824), meta.SizeBytes, "existing qgroup limit without source")
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "1073741824", filepath.Join(fromGone, config.DataDir)))
+
+		report, err = s.checkConsistency(ctx, "test", false, later)
+		require.NoError(t, err)
+		assert.Empty(t, report.Issues)
+	})
+
+	t.Run("invalid_tenant", func(t *testing.T) {
+		s, _, _, _ := newTestStorage(t)
+		_, err := s.CheckConsistency(ctx, "unknown", false)
+		require.Error(t, err)
+	})
+}
+
+func TestCheckFilesystemConsistency(t *testing.T) {
+	ctx := context.Background()
+	// level 1 tenant and volume qgroups have no subvolume by design
+	qgroups := "0/5 16384 16384\n0/259 16384 8192\n0/300 0 0\n1/1 16384 8192\n1/2 0 0\n"
+	subvols := "ID 259 gen 12 top level 5 path test/vol/data\n"
+
+	t.Run("report_only", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		runner.RunFn = consistencyRunner(qgroups, subvols)
+
+		report, err := s.CheckFilesystemConsistency(ctx, false)
+		require.NoError(t, err)
+		require.Len(t, report.Issues, 1)
+		assert.Equal(t, IssueOrphanQgroup, report.Issues[0].Kind)
+		assert.Equal(t, "0/300", report.Issues[0].Path)
+		assert.False(t, report.Issues[0].Repaired)
+		assert.False(t, containsCall(runner.Calls, "qgroup", "destroy"))
+		assert.Equal(t, float64(1), testutil.ToFloat64(OrphanQgroupsGauge))
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		runner.RunFn = consistencyRunner(qgroups, subvols)
+
+		report, err := s.CheckFilesystemConsistency(ctx, true)
+		require.NoError(t, err)
+		require.Len(t, report.Issues, 1)
+		assert.True(t, report.Issues[0].Repaired)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "destroy", "0/300", s.mountPoint))
+		assert.Equal(t, float64(0), testutil.ToFloat64(OrphanQgroupsGauge))
+	})
+
+	t.Run("quota_disabled", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+
+		report, err := s.CheckFilesystemConsistency(ctx, true)
+		require.NoError(t, err)
+		assert.Empty(t, report.Issues)
+		assert.Empty(t, runner.Calls)
+	})
+}
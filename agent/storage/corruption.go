@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// csumEvent is a checksum error read from the kernel log.
+type csumEvent struct {
+	btrfs.CsumError
+	Time time.Time
+}
+
+// fileLocation is where a corrupted file lives. Snapshot is empty for files
+// of the volume itself.
+type fileLocation struct {
+	Tenant   string
+	Volume   string
+	Snapshot string
+	// File is relative to the data directory.
+	File string
+}
+
+// StartCorruptionScanner follows the kernel log for data checksum errors,
+// raised on read or by a scrub, and records the affected files in the
+// metadata of their volume. Needs read access to /dev/kmsg.
+func (s *Storage) StartCorruptionScanner(ctx context.Context, interval time.Duration) {
+	r, err := openKmsg(kmsgPath)
+	if err != nil {
+		log.Warn().Err(err).Msg("corruption scanner: kernel log not readable, checksum errors are not mapped to files")
+		return
+	}
+	go func() {
+		defer func() { _ = r.Close() }()
+		s.scanKernelLog(ctx, r)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.scanKernelLog(ctx, r)
+			}
+		}
+	}()
+}
+
+func (s *Storage) scanKernelLog(ctx context.Context, r *kmsgReader) {
+	recs, err := r.Read()
+	if err != nil {
+		log.Warn().Err(err).Msg("corruption scanner: failed to read kernel log")
+	}
+	var events []csumEvent
+	for _, rec := range recs {
+		e, ok := btrfs.ParseCsumError(rec.Msg)
+		if !ok || !s.ownsDevice(e.Device) {
+			continue
+		}
+		events = append(events, csumEvent{CsumError: e, Time: rec.Time})
+	}
+	if len(events) > 0 {
+		s.recordCsumErrors(ctx, events)
+	}
+}
+
+// ownsDevice reports whether the kernel device name (e.g. "sda") belongs to
+// this filesystem. Other btrfs filesystems on the host log to the same buffer.
+func (s *Storage) ownsDevice(name string) bool {
+	devices := s.cachedDevices.Load()
+	if devices == nil {
+		return false
+	}
+	for _, d := range *devices {
+		if filepath.Base(d.Device) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Storage) recordCsumErrors(ctx context.Context, events []csumEvent) {
+	var subvols map[uint64]string
+	for _, ev := range events {
+		paths, err := s.resolveCsumError(ctx, ev.CsumError, &subvols)
+		if err != nil {
+			log.Warn().Err(err).Uint64("logical", ev.Logical).Uint64("root", ev.Root).Uint64("inode", ev.Inode).Msg("corruption scanner: failed to resolve checksum error")
+			continue
+		}
+		for _, p := range paths {
+			loc, ok := s.locateFile(p)
+			if !ok {
+				log.Warn().Str("path", p).Msg("corruption scanner: checksum error outside of any volume")
+				continue
+			}
+			if err := s.recordCorruptedFile(loc, ev); err != nil {
+				log.Error().Err(err).Str("tenant", loc.Tenant).Str("volume", loc.Volume).Str("file", loc.File).Msg("corruption scanner: failed to record corrupted file")
+			}
+		}
+	}
+}
+
+// resolveCsumError returns the absolute paths of the files referencing the
+// bad block. A logical address also finds snapshots sharing the block, read
+// errors only log the inode of the subvolume that was read. The subvolume
+// list is fetched once per scan and only if needed.
+func (s *Storage) resolveCsumError(ctx context.Context, e btrfs.CsumError, subvols *map[uint64]string) ([]string, error) {
+	if e.Logical != 0 {
+		return s.btrfs.LogicalResolve(ctx, e.Logical, s.mountPoint)
+	}
+	if *subvols == nil {
+		list, err := s.btrfs.SubvolumeListAll(ctx, s.mountPoint)
+		if err != nil {
+			return nil, fmt.Errorf("subvolume list: %w", err)
+		}
+		*subvols = map[uint64]string{fsTreeID: s.mountPoint}
+		for _, sv := range list {
+			(*subvols)[sv.ID] = filepath.Join(s.mountPoint, sv.Path)
+		}
+	}
+	root, ok := (*subvols)[e.Root]
+	if !ok {
+		return nil, fmt.Errorf("subvolume %d not found", e.Root)
+	}
+	return s.btrfs.InodeResolve(ctx, e.Inode, root)
+}
+
+// locateFile maps an absolute path to its volume through the directory
+// layout <tenant>/<volume>/data/<file> and
+// <tenant>/snapshots/<snapshot>/data/<file>. Files in a snapshot are
+// accounted to the volume the snapshot was taken of.
+func (s *Storage) locateFile(path string) (fileLocation, bool) {
+	base, err := filepath.Abs(s.basePath)
+	if err != nil {
+		return fileLocation{}, false
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fileLocation{}, false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) < 3 || !slices.Contains(s.Tenants(), parts[0]) {
+		return fileLocation{}, false
+	}
+	tenant := parts[0]
+
+	if parts[1] != config.SnapshotsDir {
+		if parts[2] != config.DataDir {
+			return fileLocation{}, false
+		}
+		return fileLocation{Tenant: tenant, Volume: parts[1], File: filepath.Join(parts[3:]...)}, true
+	}
+
+	if len(parts) < 4 || parts[3] != config.DataDir {
+		return fileLocation{}, false
+	}
+	var snap SnapshotMetadata
+	if err := ReadMetadata(filepath.Join(base, tenant, config.SnapshotsDir, parts[2], config.MetadataFile), &snap); err != nil || snap.Volume == "" {
+		return fileLocation{}, false
+	}
+	return fileLocation{Tenant: tenant, Volume: snap.Volume, Snapshot: parts[2], File: filepath.Join(parts[4:]...)}, true
+}
+
+// recordCorruptedFile adds the file to the volume metadata or counts another
+// error on it. Events not newer than the last recorded one are skipped, so
+// re-reading the kernel log after a restart does not count errors twice.
+func (s *Storage) recordCorruptedFile(loc fileLocation, ev csumEvent) error {
+	metaPath := filepath.Join(s.basePath, loc.Tenant, loc.Volume, config.MetadataFile)
+	var count int
+	added := false
+	if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) {
+		defer func() { count = len(meta.CorruptedFiles) }()
+		if meta.CorruptionClearedAt != nil && !ev.Time.After(*meta.CorruptionClearedAt) {
+			return
+		}
+		for i := range meta.CorruptedFiles {
+			f := &meta.CorruptedFiles[i]
+			if f.Path != loc.File || f.Snapshot != loc.Snapshot {
+				continue
+			}
+			if ev.Time.After(f.LastSeenAt) {
+				f.Errors++
+				f.LastSeenAt = ev.Time
+				if ev.Logical != 0 {
+					f.Logical = ev.Logical
+				}
+			}
+			return
+		}
+		meta.CorruptedFiles = append(meta.CorruptedFiles, CorruptedFile{
+			Path:        loc.File,
+			Snapshot:    loc.Snapshot,
+			Logical:     ev.Logical,
+			Errors:      1,
+			FirstSeenAt: ev.Time,
+			LastSeenAt:  ev.Time,
+		})
+		added = true
+	}); err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	VolumeCorruptedFiles.WithLabelValues(loc.Tenant, loc.Volume).Set(float64(count))
+	if added {
+		log.Warn().Str("tenant", loc.Tenant).Str("volume", loc.Volume).Str("snapshot", loc.Snapshot).Str("file", loc.File).Uint64("logical", ev.Logical).Msg("corrupted file detected")
+	}
+	return nil
+}
+
+// VolumeCorruption returns the files of the volume and its snapshots with
+// checksum errors.
+func (s *Storage) VolumeCorruption(tenant, name string) ([]CorruptedFile, error) {
+	meta, err := s.GetVolume(tenant, name)
+	if err != nil {
+		return nil, err
+	}
+	if meta.CorruptedFiles == nil {
+		return []CorruptedFile{}, nil
+	}
+	return meta.CorruptedFiles, nil
+}
+
+// ClearVolumeCorruption forgets the corrupted files of a volume, e.g. after
+// they were restored. Errors logged before are not recorded again.
+func (s *Storage) ClearVolumeCorruption(tenant, name string) error {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return err
+	}
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	metaPath := filepath.Join(bp, name, config.MetadataFile)
+	now := time.Now().UTC()
+	if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) {
+		meta.CorruptedFiles = nil
+		meta.CorruptionClearedAt = &now
+	}); err != nil {
+		if os.IsNotExist(err) {
+			return &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("volume %q not found", name)}
+		}
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+	VolumeCorruptedFiles.WithLabelValues(tenant, name).Set(0)
+	log.Info().Str("tenant", tenant).Str("volume", name).Msg("corrupted files cleared")
+	return nil
+}
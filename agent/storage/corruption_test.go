@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKmsgRecord(t *testing.T) {
+	boot := time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	rec, ok := parseKmsgRecord("4,1234,5000000,-;BTRFS warning (device sda): csum failed root 5 ino 257 off 0\n SUBSYSTEM=block\n", boot)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1234), rec.Seq)
+	assert.Equal(t, boot.Add(5*time.Second), rec.Time)
+	assert.Equal(t, "BTRFS warning (device sda): csum failed root 5 ino 257 off 0", rec.Msg)
+
+	for _, in := range []string{"", "no prefix", "4,x,0,-;msg", "4,1;msg"} {
+		_, ok := parseKmsgRecord(in, boot)
+		assert.False(t, ok, in)
+	}
+}
+
+func TestOwnsDevice(t *testing.T) {
+	s, _, _, _ := newTestStorage(t)
+	assert.False(t, s.ownsDevice("sda"))
+
+	s.cachedDevices.Store(&[]DeviceState{{BTRFSDevice: btrfs.BTRFSDevice{Device: "/dev/sda"}}})
+	assert.True(t, s.ownsDevice("sda"))
+	assert.False(t, s.ownsDevice("sdb"))
+}
+
+func TestLocateFile(t *testing.T) {
+	s, bp, _, _ := newTestStorage(t)
+	setupUsageSnap(t, bp, "snap1", SnapshotMetadata{Name: "snap1", Volume: "vol1"})
+	setupUsageSnap(t, bp, "orphan", SnapshotMetadata{Name: "orphan"})
+
+	tests := []struct {
+		name string
+		path string
+		want fileLocation
+		ok   bool
+	}{
+		{"volume", filepath.Join(bp, "vol1", config.DataDir, "dir", "file"), fileLocation{Tenant: "test", Volume: "vol1", File: "dir/file"}, true},
+		{"snapshot", filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir, "file"), fileLocation{Tenant: "test", Volume: "vol1", Snapshot: "snap1", File: "file"}, true},
+		{"snapshot_without_volume", filepath.Join(bp, config.SnapshotsDir, "orphan", config.DataDir, "file"), fileLocation{}, false},
+		{"metadata", filepath.Join(bp, "vol1", config.MetadataFile), fileLocation{}, false},
+		{"unknown_tenant", filepath.Join(s.basePath, "other", "vol1", config.DataDir, "file"), fileLocation{}, false},
+		{"outside", "/etc/passwd", fileLocation{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := s.locateFile(tt.path)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRecordCsumErrors(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	setup := func(t *testing.T) (*Storage, string) {
+		s, bp, runner, _ := newTestStorage(t)
+		cleanupMetrics(t, "test", "vol1")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		setupUsageSnap(t, bp, "snap1", SnapshotMetadata{Name: "snap1", Volume: "vol1"})
+		volFile := filepath.Join(bp, "vol1", config.DataDir, "file")
+		snapFile := filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir, "file")
+		runner.RunFn = func(args []string) (string, error) {
+			switch {
+			case args[0] == "inspect-internal" && args[1] == "logical-resolve":
+				return volFile + "\n" + snapFile + "\n", nil
+			case args[0] == "inspect-internal" && args[1] == "inode-resolve":
+				return volFile + "\n", nil
+			case args[0] == "subvolume" && args[1] == "list":
+				return "ID 256 gen 10 top level 5 path test/vol1\n", nil
+			}
+			return "", nil
+		}
+		return s, bp
+	}
+
+	t.Run("logical_includes_snapshots", func(t *testing.T) {
+		s, bp := setup(t)
+
+		s.recordCsumErrors(ctx, []csumEvent{{CsumError: btrfs.CsumError{Logical: 4096}, Time: t0}})
+
+		meta := readVolumeMeta(t, filepath.Join(bp, "vol1"))
+		require.Len(t, meta.CorruptedFiles, 2)
+		assert.Equal(t, CorruptedFile{Path: "file", Logical: 4096, Errors: 1, FirstSeenAt: t0, LastSeenAt: t0}, meta.CorruptedFiles[0])
+		assert.Equal(t, "snap1", meta.CorruptedFiles[1].Snapshot)
+		assert.Equal(t, float64(2), testutil.ToFloat64(VolumeCorruptedFiles.WithLabelValues("test", "vol1")))
+	})
+
+	t.Run("inode_in_subvolume", func(t *testing.T) {
+		s, bp := setup(t)
+
+		s.recordCsumErrors(ctx, []csumEvent{{CsumError: btrfs.CsumError{Root: 256, Inode: 257}, Time: t0}})
+
+		meta := readVolumeMeta(t, filepath.Join(bp, "vol1"))
+		require.Len(t, meta.CorruptedFiles, 1)
+		assert.Equal(t, "file", meta.CorruptedFiles[0].Path)
+		assert.Empty(t, meta.CorruptedFiles[0].Snapshot)
+	})
+
+	t.Run("unknown_root", func(t *testing.T) {
+		s, bp := setup(t)
+
+		s.recordCsumErrors(ctx, []csumEvent{{CsumError: btrfs.CsumError{Root: 999, Inode: 257}, Time: t0}})
+
+		assert.Empty(t, readVolumeMeta(t, filepath.Join(bp, "vol1")).CorruptedFiles)
+	})
+
+	t.Run("dedupe_and_count", func(t *testing.T) {
+		s, bp := setup(t)
+		ev := csumEvent{CsumError: btrfs.CsumError{Root: 256, Inode: 257}, Time: t0}
+
+		s.recordCsumErrors(ctx, []csumEvent{ev})
+		// kernel log re-read after a restart
+		s.recordCsumErrors(ctx, []csumEvent{ev})
+		ev.Time = t0.Add(time.Minute)
+		s.recordCsumErrors(ctx, []csumEvent{ev})
+
+		files := readVolumeMeta(t, filepath.Join(bp, "vol1")).CorruptedFiles
+		require.Len(t, files, 1)
+		assert.Equal(t, 2, files[0].Errors)
+		assert.Equal(t, t0, files[0].FirstSeenAt)
+		assert.Equal(t, t0.Add(time.Minute), files[0].LastSeenAt)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		s, bp := setup(t)
+		ev := csumEvent{CsumError: btrfs.CsumError{Logical: 4096}, Time: time.Now().Add(-time.Minute)}
+		s.recordCsumErrors(ctx, []csumEvent{ev})
+
+		require.NoError(t, s.ClearVolumeCorruption("test", "vol1"))
+		files, err := s.VolumeCorruption("test", "vol1")
+		require.NoError(t, err)
+		assert.Empty(t, files)
+		assert.Equal(t, float64(0), testutil.ToFloat64(VolumeCorruptedFiles.WithLabelValues("test", "vol1")))
+
+		// errors logged before the clear are not recorded again
+		s.recordCsumErrors(ctx, []csumEvent{ev})
+		assert.Empty(t, readVolumeMeta(t, filepath.Join(bp, "vol1")).CorruptedFiles)
+	})
+
+	t.Run("clear_not_found", func(t *testing.T) {
+		s, _ := setup(t)
+		requireStorageError(t, s.ClearVolumeCorruption("test", "missing"), ErrNotFound)
+	})
+}
@@ -0,0 +1,607 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// dedupeStateFile is stored in the tenant directory.
+	dedupeStateFile = ".dedupe.json"
+	// dedupeMinFileSize skips small files, sharing their few extents saves
+	// little and costs a full hash and compare each.
+	dedupeMinFileSize = 128 << 10
+	// dedupeChunkSize is the granularity files are hashed and matched in.
+	// Chunks are aligned to it, identical data at offsets that differ by
+	// less is not found.
+	dedupeChunkSize = 1 << 20
+	// dedupeHashSize is the length of the chunk hashes kept. The kernel
+	// compares the data before sharing it, a collision only costs a compare.
+	dedupeHashSize = 16
+	// dedupeSaveInterval is how often a running job persists its progress.
+	dedupeSaveInterval = 30 * time.Second
+)
+
+// dedupeRange and fileExtents are btrfs.DedupeRange and btrfs.FileExtents,
+// replaced in tests since FIDEDUPERANGE and FIEMAP need a btrfs filesystem.
+var (
+	dedupeRange = btrfs.DedupeRange
+	fileExtents = btrfs.FileExtents
+)
+
+// errExtentsShared is returned by dedupeFileRange if both ranges already
+// use the same extents.
+var errExtentsShared = errors.New("extents already shared")
+
+type dedupeJob = backgroundJob[DedupeJob]
+
+// dedupeFile is the state of one file, valid as long as size and mtime match.
+type dedupeFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Chunks are the hashes of the dedupeChunkSize chunks of the file.
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// dedupeState is persisted so an interrupted or repeated job does not hash
+// unchanged files again, ranges already shared are found with FIEMAP. Paths are relative to the tenant directory.
+type dedupeState struct {
+	Files   map[string]dedupeFile `json:"files"`
+	LastJob *DedupeJob            `json:"last_job,omitempty"`
+}
+
+// dedupeChunk is the first chunk with a hash, index counts from the start
+// of the file.
+type dedupeChunk struct {
+	file  string
+	index int
+}
+
+// dedupeExtent is a range of a file identical to a range of src.
+type dedupeExtent struct {
+	src    string
+	srcOff uint64
+	dstOff uint64
+	length uint64
+}
+
+// diskRange is where a part of a file range is stored, offset is relative
+// to the start of the range. A part of a compressed extent is identified by
+// the start of the extent and its distance skip to it.
+type diskRange struct {
+	offset   uint64
+	physical uint64
+	skip     uint64
+	length   uint64
+	encoded  bool
+}
+
+// rateLimiter keeps the average throughput at or below rate bytes per second,
+// zero is unlimited.
+type rateLimiter struct {
+	rate  uint64
+	start time.Time
+	total uint64
+}
+
+func newRateLimiter(rate uint64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait accounts n bytes and sleeps until they are within the rate.
+func (l *rateLimiter) wait(ctx context.Context, n uint64) error {
+	if l.rate == 0 {
+		return ctx.Err()
+	}
+	l.total += n
+	due := l.start.Add(time.Duration(float64(l.total) / float64(l.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// SetDedupeRateLimit limits the bytes per second a dedupe job reads and
+// compares, see AGENT_DEDUPE_RATE_LIMIT.
+func (s *Storage) SetDedupeRateLimit(bytesPerSec uint64) { s.dedupeRateLimit = bytesPerSec }
+
+// StartDedupe scans the volumes of a tenant for identical data in the
+// background and shares its extents with FIDEDUPERANGE. Snapshots are
+// read-only and not touched, they already share extents with their volume.
+func (s *Storage) StartDedupe(tenant string) (*DedupeJob, error) {
+	s.dedupeMu.Lock()
+	if prev, ok := s.dedupeJobs[tenant]; ok && prev.snapshot().Status == JobRunning {
+		s.dedupeMu.Unlock()
+		return nil, &StorageError{Code: ErrBusy, Message: "dedupe is already running"}
+	}
+	// not bound to the request, the job outlives it
+	ctx, cancel := context.WithCancel(context.Background())
+	j := newBackgroundJob(DedupeJob{Status: JobRunning, StartedAt: time.Now().UTC()}, cancel)
+	if s.dedupeJobs == nil {
+		s.dedupeJobs = make(map[string]*dedupeJob)
+	}
+	s.dedupeJobs[tenant] = j
+	s.dedupeMu.Unlock()
+
+	job := j.snapshot()
+	go s.runDedupe(ctx, j, tenant)
+
+	log.Info().Str("tenant", tenant).Uint64("rate_limit", s.dedupeRateLimit).Msg("dedupe started")
+	return &job, nil
+}
+
+func (s *Storage) runDedupe(ctx context.Context, j *dedupeJob, tenant string) {
+	defer close(j.done)
+	defer j.cancel()
+
+	DedupeRunningGauge.WithLabelValues(tenant).Set(1)
+	defer DedupeRunningGauge.WithLabelValues(tenant).Set(0)
+
+	bp := filepath.Join(s.basePath, tenant)
+	statePath := filepath.Join(bp, dedupeStateFile)
+	var prev dedupeState
+	if err := ReadMetadata(statePath, &prev); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("tenant", tenant).Msg("dedupe: failed to read state, starting over")
+	}
+
+	before, measured := s.tenantReferenced(ctx, tenant)
+	state := &dedupeState{Files: make(map[string]dedupeFile)}
+	shared := make(map[string]uint64)
+	err := s.dedupeTenant(ctx, j, bp, prev, state, shared)
+	cancelled := ctx.Err() != nil
+	if !cancelled && err == nil {
+		setDedupedBytes(tenant, bp, shared)
+	}
+	saved := s.dedupeSavings(tenant, bp, j.snapshot().DedupedBytes, before, measured)
+
+	now := time.Now().UTC()
+	j.update(func(job *DedupeJob) {
+		job.FinishedAt = &now
+		job.DedupedBytes = saved
+		switch {
+		case cancelled:
+			job.Status = JobCancelled
+		case err != nil:
+			job.Status = JobFailed
+			job.Error = err.Error()
+		default:
+			job.Status = JobCompleted
+		}
+	})
+
+	job := j.snapshot()
+	if job.Status != JobCompleted {
+		// keep the state of files not scanned yet for the next run, a failed
+		// run must not lose the hashes of earlier ones either
+		for rel, f := range prev.Files {
+			if _, ok := state.Files[rel]; !ok {
+				state.Files[rel] = f
+			}
+		}
+	}
+	state.LastJob = &job
+	if err := writeMetadataAtomic(statePath, state); err != nil {
+		log.Warn().Err(err).Str("tenant", tenant).Msg("dedupe: failed to save state")
+	}
+	if saved > 0 {
+		DedupeReclaimedBytesTotal.WithLabelValues(tenant).Add(float64(saved))
+	}
+
+	l := log.Info()
+	if job.Status == JobFailed {
+		l = log.Error().Err(err)
+	}
+	l.Str("tenant", tenant).Str("status", job.Status).Int("files", job.ScannedFiles).Int("duplicates", job.DuplicateFiles).
+		Uint64("deduped_bytes", job.DedupedBytes).Dur("duration", now.Sub(job.StartedAt)).Msg("dedupe finished")
+}
+
+// dedupeTenant hashes the files of the tenant in chunks and dedupes every
+// run of chunks already seen in an earlier file, by path, against its first
+// copy. Runs already sharing the extents of the copy are skipped. The bytes
+// of each volume that share extents with their copy afterwards are added to
+// shared, DedupedBytes of the job only counts bytes deduped in this run.
+func (s *Storage) dedupeTenant(ctx context.Context, j *dedupeJob, bp string, prev dedupeState, state *dedupeState, shared map[string]uint64) error {
+	files, err := scanDedupeFiles(ctx, j, bp, prev, state)
+	if err != nil {
+		return err
+	}
+
+	limiter := newRateLimiter(s.dedupeRateLimit)
+	lastSave := time.Now()
+	index := make(map[string]dedupeChunk)
+	for _, rel := range files {
+		f := state.Files[rel]
+		if f.Chunks == nil {
+			chunks, err := hashChunks(ctx, filepath.Join(bp, rel), limiter)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				log.Debug().Err(err).Str("file", rel).Msg("dedupe: failed to hash file, skipping")
+				delete(state.Files, rel)
+				continue
+			}
+			f.Chunks = chunks
+			state.Files[rel] = f
+			j.update(func(job *DedupeJob) { job.HashedBytes += uint64(f.Size) })
+		}
+
+		if extents := matchChunks(state.Files, index, rel); len(extents) > 0 {
+			already, deduped := dedupeExtents(ctx, bp, rel, extents, limiter)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			vol, _, _ := strings.Cut(rel, string(filepath.Separator))
+			shared[vol] += already + deduped
+			if deduped > 0 {
+				j.update(func(job *DedupeJob) {
+					job.DuplicateFiles++
+					job.DedupedBytes += deduped
+				})
+			}
+		}
+		for i, h := range f.Chunks {
+			if _, ok := index[h]; !ok {
+				index[h] = dedupeChunk{file: rel, index: i}
+			}
+		}
+
+		if time.Since(lastSave) >= dedupeSaveInterval {
+			if err := writeMetadataAtomic(filepath.Join(bp, dedupeStateFile), state); err != nil {
+				log.Warn().Err(err).Msg("dedupe: failed to save state")
+			}
+			lastSave = time.Now()
+		}
+	}
+	return nil
+}
+
+// matchChunks returns the ranges of file rel whose chunks are in index,
+// merging chunks that follow each other in both files. Chunks only found
+// in rel itself are not matched.
+func matchChunks(files map[string]dedupeFile, index map[string]dedupeChunk, rel string) []dedupeExtent {
+	f := files[rel]
+	var out []dedupeExtent
+	for i := 0; i < len(f.Chunks); {
+		ref, ok := index[f.Chunks[i]]
+		if !ok || ref.file == rel {
+			i++
+			continue
+		}
+		src := files[ref.file].Chunks
+		n := 1
+		for i+n < len(f.Chunks) && ref.index+n < len(src) && f.Chunks[i+n] == src[ref.index+n] {
+			n++
+		}
+		// only the last chunk can be short, equal hashes mean equal lengths
+		dstOff := uint64(i) * dedupeChunkSize
+		out = append(out, dedupeExtent{
+			src:    ref.file,
+			srcOff: uint64(ref.index) * dedupeChunkSize,
+			dstOff: dstOff,
+			length: min(uint64(n)*dedupeChunkSize, uint64(f.Size)-dstOff),
+		})
+		i += n
+	}
+	return out
+}
+
+// scanDedupeFiles records all candidate files of the tenant's volumes in
+// state, keeping the chunk hashes of files unchanged since prev.
+// Returns the files sorted by path.
+func scanDedupeFiles(ctx context.Context, j *dedupeJob, bp string, prev dedupeState, state *dedupeState) ([]string, error) {
+	entries, err := os.ReadDir(bp)
+	if err != nil {
+		return nil, fmt.Errorf("read tenant dir: %w", err)
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == config.SnapshotsDir || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		dataDir := filepath.Join(bp, e.Name(), config.DataDir)
+		err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil // removed meanwhile
+				}
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.Size() < dedupeMinFileSize {
+				return nil
+			}
+
+			rel, _ := filepath.Rel(bp, path)
+			f := dedupeFile{Size: info.Size(), ModTime: info.ModTime().UTC()}
+			if p, ok := prev.Files[rel]; ok && p.Size == f.Size && p.ModTime.Equal(f.ModTime) {
+				f.Chunks = p.Chunks
+			}
+			state.Files[rel] = f
+			files = append(files, rel)
+			j.update(func(job *DedupeJob) { job.ScannedFiles++ })
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan volume %s: %w", e.Name(), err)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// hashChunks returns the hashes of the dedupeChunkSize chunks of a file.
+func hashChunks(ctx context.Context, path string, limiter *rateLimiter) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	chunks := []string{}
+	buf := make([]byte, dedupeChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			chunks = append(chunks, hex.EncodeToString(sum[:dedupeHashSize]))
+			if werr := limiter.wait(ctx, uint64(n)); werr != nil {
+				return nil, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dedupeExtents dedupes the extents of file rel, skipping those that fail:
+// they changed meanwhile, are nocow, or were removed. Returns the bytes
+// that already shared extents and the bytes deduped.
+func dedupeExtents(ctx context.Context, bp, rel string, extents []dedupeExtent, limiter *rateLimiter) (already, deduped uint64) {
+	for _, e := range extents {
+		n, err := dedupeFileRange(ctx, filepath.Join(bp, e.src), e.srcOff, filepath.Join(bp, rel), e.dstOff, e.length, limiter)
+		deduped += n
+		switch {
+		case ctx.Err() != nil:
+			return already, deduped
+		case errors.Is(err, errExtentsShared):
+			already += e.length
+		case err != nil:
+			log.Debug().Err(err).Str("src", e.src).Str("dst", rel).Msg("dedupe: failed to dedupe range, skipping")
+		}
+	}
+	return already, deduped
+}
+
+// dedupeFileRange dedupes length bytes of dst at dstOff against src at
+// srcOff in pieces of btrfs.DedupeMaxLength. The kernel reads both ranges
+// to compare them, so every piece counts twice against the rate limit.
+// Ranges already sharing their extents are not passed to the kernel, it
+// would compare them again and count them as deduped.
+func dedupeFileRange(ctx context.Context, src string, srcOff uint64, dst string, dstOff, length uint64, limiter *rateLimiter) (uint64, error) {
+	sf, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = sf.Close() }()
+	// FIDEDUPERANGE only needs the destination open for reading as its owner
+	df, err := os.Open(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = df.Close() }()
+
+	if extentsShared(sf, srcOff, df, dstOff, length) {
+		return 0, errExtentsShared
+	}
+	var total uint64
+	for total < length {
+		n := min(length-total, btrfs.DedupeMaxLength)
+		if err := limiter.wait(ctx, 2*n); err != nil {
+			return total, err
+		}
+		n, err := dedupeRange(sf, srcOff+total, df, dstOff+total, n)
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// extentsShared reports whether length bytes of dst at dstOff are stored in
+// the same place on disk as src at srcOff. Ranges that cannot be compared
+// are not shared.
+func extentsShared(src *os.File, srcOff uint64, dst *os.File, dstOff, length uint64) bool {
+	a, err := diskRanges(src, srcOff, length)
+	if err != nil {
+		log.Debug().Err(err).Str("file", src.Name()).Msg("dedupe: failed to map extents")
+		return false
+	}
+	b, err := diskRanges(dst, dstOff, length)
+	if err != nil {
+		log.Debug().Err(err).Str("file", dst.Name()).Msg("dedupe: failed to map extents")
+		return false
+	}
+	return len(a) > 0 && slices.Equal(a, b)
+}
+
+// diskRanges maps length bytes of f at offset to disk, merging extents that
+// follow each other on disk.
+func diskRanges(f *os.File, offset, length uint64) ([]diskRange, error) {
+	extents, err := fileExtents(f, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	var out []diskRange
+	for _, e := range extents {
+		if e.Unmapped {
+			return nil, fmt.Errorf("extent at %d is not mapped", e.Logical)
+		}
+		start, end := max(e.Logical, offset), min(e.Logical+e.Length, offset+length)
+		if start >= end {
+			continue
+		}
+		r := diskRange{offset: start - offset, physical: e.Physical, length: end - start, encoded: e.Encoded}
+		if e.Encoded {
+			r.skip = start - e.Logical
+		} else {
+			r.physical += start - e.Logical
+		}
+		if n := len(out); n > 0 && !r.encoded && !out[n-1].encoded &&
+			out[n-1].offset+out[n-1].length == r.offset && out[n-1].physical+out[n-1].length == r.physical {
+			out[n-1].length += r.length
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// tenantReferenced returns the referenced bytes of the tenant qgroup after
+// a sync, false without quota or tenant qgroup.
+func (s *Storage) tenantReferenced(ctx context.Context, tenant string) (uint64, bool) {
+	if !s.quotaEnabled {
+		return 0, false
+	}
+	if err := s.btrfs.FilesystemSync(ctx, s.mountPoint); err != nil {
+		log.Warn().Err(err).Str("tenant", tenant).Msg("dedupe: filesystem sync failed")
+		return 0, false
+	}
+	usage, err := s.TenantUsage(ctx, tenant)
+	if err != nil {
+		log.Warn().Err(err).Str("tenant", tenant).Msg("dedupe: failed to read tenant usage")
+		return 0, false
+	}
+	if usage == nil {
+		return 0, false
+	}
+	return usage.UsedBytes, true
+}
+
+// dedupeSavings returns the space a job saved: how much the referenced bytes
+// of the tenant qgroup dropped since before, if measured, otherwise the
+// bytes deduped. Writes during the job count against the savings. With
+// quota, volume usage and snapshot ExclusiveBytes are refreshed, so they
+// reflect the shared extents without waiting for the usage updater. The
+// job context may be cancelled by now.
+func (s *Storage) dedupeSavings(tenant, bp string, deduped, before uint64, measured bool) uint64 {
+	if deduped == 0 {
+		return 0
+	}
+	if !s.quotaEnabled {
+		return deduped
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	after, ok := s.tenantReferenced(ctx, tenant)
+	updateAll(ctx, s.btrfs, bp, tenant)
+	if !measured || !ok {
+		return deduped
+	}
+	if after >= before {
+		// other writes during the job may outweigh the savings
+		return 0
+	}
+	return before - after
+}
+
+// setDedupedBytes sets DedupedBytes of every volume to its bytes in shared.
+func setDedupedBytes(tenant, bp string, shared map[string]uint64) {
+	entries, err := os.ReadDir(bp)
+	if err != nil {
+		log.Warn().Err(err).Str("tenant", tenant).Msg("dedupe: failed to read tenant dir")
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == config.SnapshotsDir || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		metaPath := filepath.Join(bp, e.Name(), config.MetadataFile)
+		var meta VolumeMetadata
+		if err := ReadMetadata(metaPath, &meta); err != nil || meta.DedupedBytes == shared[e.Name()] {
+			continue
+		}
+		if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) {
+			meta.DedupedBytes = shared[e.Name()]
+		}); err != nil {
+			log.Warn().Err(err).Str("tenant", tenant).Str("volume", e.Name()).Msg("dedupe: failed to update volume metadata")
+		}
+	}
+}
+
+// DedupeStatus returns the current or last dedupe of a tenant.
+func (s *Storage) DedupeStatus(tenant string) (*DedupeJob, error) {
+	if j := s.dedupeJob(tenant); j != nil {
+		job := j.snapshot()
+		return &job, nil
+	}
+	var state dedupeState
+	if err := ReadMetadata(filepath.Join(s.basePath, tenant, dedupeStateFile), &state); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read dedupe state: %w", err)
+	}
+	if state.LastJob == nil {
+		return nil, &StorageError{Code: ErrNotFound, Message: "dedupe has not run yet"}
+	}
+	if state.LastJob.Status == JobRunning {
+		// the agent stopped while the job was running
+		state.LastJob.Status = JobCancelled
+	}
+	return state.LastJob, nil
+}
+
+// CancelDedupe stops the running dedupe and waits for it to exit. Progress is
+// saved, the next run continues with the files not deduped yet.
+func (s *Storage) CancelDedupe(tenant string) (*DedupeJob, error) {
+	j := s.dedupeJob(tenant)
+	if j == nil || j.snapshot().Status != JobRunning {
+		return nil, &StorageError{Code: ErrInvalid, Message: "dedupe is not running"}
+	}
+	j.cancel()
+	<-j.done
+	job := j.snapshot()
+	return &job, nil
+}
+
+func (s *Storage) dedupeJob(tenant string) *dedupeJob {
+	s.dedupeMu.Lock()
+	defer s.dedupeMu.Unlock()
+	return s.dedupeJobs[tenant]
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dedupeFn = func(src *os.File, srcOffset uint64, dst *os.File, dstOffset, length uint64) (uint64, error)
+
+// stubDedupeRange replaces FIDEDUPERANGE with fn and records the
+// destination of every call. FIEMAP is replaced too: every range queried
+// has an extent of its own until fn deduped it.
+func stubDedupeRange(t *testing.T, fn dedupeFn) *[]string {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []string
+	physical := make(map[string]uint64)
+	// a rewritten file gets new extents
+	key := func(f *os.File, offset uint64) string {
+		info, err := f.Stat()
+		require.NoError(t, err)
+		return fmt.Sprintf("%s@%d@%d", f.Name(), offset, info.ModTime().UnixNano())
+	}
+	extentOf := func(f *os.File, offset uint64) uint64 {
+		key := key(f, offset)
+		if _, ok := physical[key]; !ok {
+			physical[key] = uint64(len(physical)+1) << 32
+		}
+		return physical[key]
+	}
+
+	origDedupe, origExtents := dedupeRange, fileExtents
+	dedupeRange = func(src *os.File, srcOffset uint64, dst *os.File, dstOffset, length uint64) (uint64, error) {
+		n, err := fn(src, srcOffset, dst, dstOffset, length)
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, dst.Name())
+		if n > 0 {
+			physical[key(dst, dstOffset)] = extentOf(src, srcOffset)
+		}
+		return n, err
+	}
+	fileExtents = func(f *os.File, offset, length uint64) ([]btrfs.Extent, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []btrfs.Extent{{Logical: offset, Physical: extentOf(f, offset), Length: length}}, nil
+	}
+	t.Cleanup(func() { dedupeRange, fileExtents = origDedupe, origExtents })
+	return &calls
+}
+
+func dedupeOK(_ *os.File, _ uint64, _ *os.File, _, length uint64) (uint64, error) { return length, nil }
+
+// waitDedupe waits for the dedupe of the test tenant to exit.
+func waitDedupe(t *testing.T, s *Storage) DedupeJob {
+	t.Helper()
+	j := s.dedupeJob("test")
+	require.NotNil(t, j)
+	<-j.done
+	return j.snapshot()
+}
+
+func writeDedupeFile(t *testing.T, bp, vol, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(bp, vol, config.DataDir, name)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	return path
+}
+
+func TestDedupe(t *testing.T) {
+	const size = 256 << 10
+	same := bytes.Repeat([]byte("a"), size)
+
+	setup := func(t *testing.T) (*Storage, string) {
+		s, bp, _, _ := newTestStorage(t)
+		t.Cleanup(func() { DedupeReclaimedBytesTotal.DeleteLabelValues("test") })
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		setupUsageVol(t, bp, "vol2", VolumeMetadata{Name: "vol2"})
+		writeDedupeFile(t, bp, "vol1", "image", same)
+		writeDedupeFile(t, bp, "vol2", "image", same)
+		writeDedupeFile(t, bp, "vol2", "other", bytes.Repeat([]byte("b"), size))
+		writeDedupeFile(t, bp, "vol2", "small", same[:1024])
+		return s, bp
+	}
+
+	t.Run("dedupes_identical_files", func(t *testing.T) {
+		s, bp := setup(t)
+		calls := stubDedupeRange(t, dedupeOK)
+
+		job, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		assert.Equal(t, JobRunning, job.Status)
+
+		got := waitDedupe(t, s)
+		assert.Equal(t, JobCompleted, got.Status)
+		assert.Equal(t, 3, got.ScannedFiles)
+		assert.Equal(t, uint64(3*size), got.HashedBytes)
+		assert.Equal(t, 1, got.DuplicateFiles)
+		assert.Equal(t, uint64(size), got.DedupedBytes)
+		assert.Equal(t, []string{filepath.Join(bp, "vol2", config.DataDir, "image")}, *calls)
+
+		assert.Equal(t, uint64(size), readVolumeMeta(t, filepath.Join(bp, "vol2")).DedupedBytes)
+		assert.Zero(t, readVolumeMeta(t, filepath.Join(bp, "vol1")).DedupedBytes)
+		assert.Equal(t, float64(size), testutil.ToFloat64(DedupeReclaimedBytesTotal.WithLabelValues("test")))
+	})
+
+	t.Run("dedupes_matching_chunks", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		t.Cleanup(func() { DedupeReclaimedBytesTotal.DeleteLabelValues("test") })
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		setupUsageVol(t, bp, "vol2", VolumeMetadata{Name: "vol2"})
+		chunk := func(b byte) []byte { return bytes.Repeat([]byte{b}, dedupeChunkSize) }
+		tail := bytes.Repeat([]byte("t"), 1000)
+		// b holds chunks 1-2 and the tail of a one chunk later, c differs
+		writeDedupeFile(t, bp, "vol1", "a", slices.Concat(chunk('x'), chunk('y'), chunk('z'), tail))
+		writeDedupeFile(t, bp, "vol2", "b", slices.Concat(chunk('q'), chunk('r'), chunk('y'), chunk('z'), tail))
+		writeDedupeFile(t, bp, "vol2", "c", chunk('c'))
+
+		type call struct{ srcOff, dstOff, length uint64 }
+		var calls []call
+		stubDedupeRange(t, func(src *os.File, srcOff uint64, dst *os.File, dstOff, length uint64) (uint64, error) {
+			assert.Equal(t, filepath.Join(bp, "vol1", config.DataDir, "a"), src.Name())
+			assert.Equal(t, filepath.Join(bp, "vol2", config.DataDir, "b"), dst.Name())
+			calls = append(calls, call{srcOff, dstOff, length})
+			return length, nil
+		})
+
+		_, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		got := waitDedupe(t, s)
+		assert.Equal(t, JobCompleted, got.Status)
+		want := uint64(2*dedupeChunkSize + len(tail))
+		assert.Equal(t, []call{{dedupeChunkSize, 2 * dedupeChunkSize, want}}, calls)
+		assert.Equal(t, 1, got.DuplicateFiles)
+		assert.Equal(t, want, got.DedupedBytes)
+		assert.Equal(t, want, readVolumeMeta(t, filepath.Join(bp, "vol2")).DedupedBytes)
+	})
+
+	t.Run("resumes_unchanged_files", func(t *testing.T) {
+		s, bp := setup(t)
+		calls := stubDedupeRange(t, dedupeOK)
+
+		_, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		waitDedupe(t, s)
+
+		*calls = nil
+		_, err = s.StartDedupe("test")
+		require.NoError(t, err)
+		got := waitDedupe(t, s)
+		assert.Equal(t, JobCompleted, got.Status)
+		assert.Zero(t, got.HashedBytes)
+		assert.Zero(t, got.DuplicateFiles)
+		assert.Empty(t, *calls, "shared extents are not deduped again")
+		assert.Zero(t, got.DedupedBytes)
+		assert.Equal(t, uint64(size), readVolumeMeta(t, filepath.Join(bp, "vol2")).DedupedBytes, "shared bytes are not counted twice")
+		assert.Equal(t, float64(size), testutil.ToFloat64(DedupeReclaimedBytesTotal.WithLabelValues("test")))
+
+		// a changed file is hashed and deduped again
+		path := writeDedupeFile(t, bp, "vol2", "image", same)
+		require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Hour)))
+		_, err = s.StartDedupe("test")
+		require.NoError(t, err)
+		got = waitDedupe(t, s)
+		assert.Equal(t, uint64(size), got.HashedBytes)
+		assert.Equal(t, 1, got.DuplicateFiles)
+		assert.Len(t, *calls, 1)
+
+		// different data shares nothing anymore
+		path = writeDedupeFile(t, bp, "vol2", "image", bytes.Repeat([]byte("c"), size))
+		require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Hour)))
+		_, err = s.StartDedupe("test")
+		require.NoError(t, err)
+		waitDedupe(t, s)
+		assert.Zero(t, readVolumeMeta(t, filepath.Join(bp, "vol2")).DedupedBytes)
+	})
+
+	t.Run("savings_from_tenant_qgroup", func(t *testing.T) {
+		s, bp := setup(t)
+		// the tenant references 3 files before and 2 after, 4 KiB written
+		// meanwhile count against the savings
+		var shows int
+		runner := &utils.MockRunner{RunFn: func(args []string) (string, error) {
+			if args[0] == "qgroup" && args[1] == "show" {
+				shows++
+				if shows == 1 {
+					return fmt.Sprintf("1/1 %d %d 0 none\n", 3*size, 3*size), nil
+				}
+				return fmt.Sprintf("1/1 %d %d 0 none\n", 2*size+4096, 2*size+4096), nil
+			}
+			return "", nil
+		}}
+		s.btrfs = btrfs.NewManagerWithRunner("btrfs", runner)
+		s.quotaEnabled = true
+		s.tenantQgroups = map[string]string{"test": "1/1"}
+		cleanupMetrics(t, "test", "vol1", "vol2")
+		stubDedupeRange(t, dedupeOK)
+
+		_, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		got := waitDedupe(t, s)
+		assert.Equal(t, uint64(size-4096), got.DedupedBytes)
+		assert.Equal(t, float64(size-4096), testutil.ToFloat64(DedupeReclaimedBytesTotal.WithLabelValues("test")))
+		assert.Equal(t, uint64(size), readVolumeMeta(t, filepath.Join(bp, "vol2")).DedupedBytes)
+	})
+
+	t.Run("differs", func(t *testing.T) {
+		s, bp := setup(t)
+		stubDedupeRange(t, func(*os.File, uint64, *os.File, uint64, uint64) (uint64, error) { return 0, btrfs.ErrDedupeDiffers })
+
+		_, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		got := waitDedupe(t, s)
+		assert.Equal(t, JobCompleted, got.Status)
+		assert.Zero(t, got.DuplicateFiles)
+		assert.Zero(t, readVolumeMeta(t, filepath.Join(bp, "vol2")).DedupedBytes)
+	})
+
+	t.Run("busy_and_cancel", func(t *testing.T) {
+		s, _ := setup(t)
+		started, release := make(chan struct{}), make(chan struct{})
+		stubDedupeRange(t, func(*os.File, uint64, *os.File, uint64, uint64) (uint64, error) {
+			close(started)
+			<-release
+			return 0, context.Canceled
+		})
+
+		_, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		<-started
+
+		_, err = s.StartDedupe("test")
+		requireStorageError(t, err, ErrBusy)
+
+		s.dedupeJob("test").cancel()
+		close(release)
+		got := waitDedupe(t, s)
+		assert.Equal(t, JobCancelled, got.Status)
+
+		_, err = s.CancelDedupe("test")
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("failed_keeps_state", func(t *testing.T) {
+		s, bp := setup(t)
+		stubDedupeRange(t, dedupeOK)
+		_, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		waitDedupe(t, s)
+
+		// vol1 cannot be scanned anymore, the scan stops before vol2
+		mkdirTooDeep(t, filepath.Join(bp, "vol1", config.DataDir))
+		_, err = s.StartDedupe("test")
+		require.NoError(t, err)
+		got := waitDedupe(t, s)
+		require.Equal(t, JobFailed, got.Status)
+
+		var state dedupeState
+		require.NoError(t, ReadMetadata(filepath.Join(bp, dedupeStateFile), &state))
+		f := state.Files[filepath.Join("vol2", config.DataDir, "image")]
+		assert.Len(t, f.Chunks, 1)
+	})
+
+	t.Run("status_survives_restart", func(t *testing.T) {
+		s, _ := setup(t)
+		stubDedupeRange(t, dedupeOK)
+
+		_, err := s.DedupeStatus("test")
+		requireStorageError(t, err, ErrNotFound)
+
+		_, err = s.StartDedupe("test")
+		require.NoError(t, err)
+		want := waitDedupe(t, s)
+
+		s.dedupeJobs = nil
+		got, err := s.DedupeStatus("test")
+		require.NoError(t, err)
+		assert.Equal(t, want.Status, got.Status)
+		assert.Equal(t, want.DedupedBytes, got.DedupedBytes)
+	})
+
+	t.Run("refreshes_usage", func(t *testing.T) {
+		s, bp := setup(t)
+		writeTestMetadata(t, filepath.Join(bp, "vol2"), VolumeMetadata{Name: "vol2", QuotaBytes: 1 << 30})
+		runner := &utils.MockRunner{}
+		s.btrfs = btrfs.NewManagerWithRunner("btrfs", runner)
+		s.quotaEnabled = true
+		cleanupMetrics(t, "test", "vol1", "vol2")
+		stubDedupeRange(t, dedupeOK)
+
+		_, err := s.StartDedupe("test")
+		require.NoError(t, err)
+		waitDedupe(t, s)
+		assert.True(t, containsCall(runner.Calls, "filesystem", "sync", s.mountPoint))
+		// usage is read per qgroup id, resolved with subvolume show
+		assert.True(t, containsCall(runner.Calls, "subvolume", "show", filepath.Join(bp, "vol2", config.DataDir)))
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("unlimited", func(t *testing.T) {
+		l := newRateLimiter(0)
+		start := time.Now()
+		require.NoError(t, l.wait(ctx, 1<<40))
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("throttles", func(t *testing.T) {
+		l := newRateLimiter(1000)
+		start := time.Now()
+		require.NoError(t, l.wait(ctx, 50))
+		assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		l := newRateLimiter(1)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		assert.ErrorIs(t, l.wait(ctx, 1000), context.Canceled)
+	})
+}
+
+// mkdirTooDeep creates nested directories in dir whose path exceeds
+// PATH_MAX, so reading the deepest one fails with ENAMETOOLONG.
+func mkdirTooDeep(t *testing.T, dir string) {
+	t.Helper()
+	name := strings.Repeat("a", 255)
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	require.NoError(t, err)
+	for range 17 {
+		require.NoError(t, syscall.Mkdirat(fd, name, 0o755))
+		next, err := syscall.Openat(fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		require.NoError(t, err)
+		_ = syscall.Close(fd)
+		fd = next
+	}
+	_ = syscall.Close(fd)
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+type defragJob = backgroundJob[DefragmentJob]
+
+// lineCounter calls fn with the number of lines in every write.
+type lineCounter func(n int)
+
+func (fn lineCounter) Write(p []byte) (int, error) {
+	if n := bytes.Count(p, []byte{'\n'}); n > 0 {
+		fn(n)
+	}
+	return len(p), nil
+}
+
+// SetRecompressOnChange starts a defragment whenever UpdateVolume changes the
+// compression of a volume, see AGENT_RECOMPRESS_ON_CHANGE.
+func (s *Storage) SetRecompressOnChange(enabled bool) { s.recompressOnChange = enabled }
+
+// StartDefragment rewrites the data of a volume in the background. Changing
+// the compression property only affects new writes, the defragment applies
+// it to existing data.
+func (s *Storage) StartDefragment(tenant, name string, req DefragmentRequest) (*DefragmentJob, error) {
+	meta, err := s.GetVolume(tenant, name)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := meta.Compression
+	if req.Compression != nil {
+		compression = *req.Compression
+	}
+	if !utils.IsValidCompression(compression) {
+		return nil, &StorageError{Code: ErrInvalid, Message: "compression must be one of: zstd, lzo, zlib, none"}
+	}
+	if meta.NoCOW && compression != "" && compression != "none" {
+		return nil, &StorageError{Code: ErrInvalid, Message: "nocow and compression are mutually exclusive"}
+	}
+
+	key := tenant + "/" + name
+	s.defragMu.Lock()
+	if prev, ok := s.defragJobs[key]; ok && prev.snapshot().Status == JobRunning {
+		s.defragMu.Unlock()
+		return nil, &StorageError{Code: ErrBusy, Message: fmt.Sprintf("volume %q is already being defragmented", name)}
+	}
+	// not bound to the request, the job outlives it
+	ctx, cancel := context.WithCancel(context.Background())
+	j := newBackgroundJob(DefragmentJob{Volume: name, Compression: compression, Status: JobRunning, StartedAt: time.Now().UTC()}, cancel)
+	if s.defragJobs == nil {
+		s.defragJobs = make(map[string]*defragJob)
+	}
+	s.defragJobs[key] = j
+	s.defragMu.Unlock()
+
+	dataDir := filepath.Join(s.basePath, tenant, name, config.DataDir)
+	job := j.snapshot()
+	go s.runDefragment(ctx, j, tenant, dataDir)
+
+	log.Info().Str("tenant", tenant).Str("volume", name).Str("compression", compression).Msg("defragment started")
+	return &job, nil
+}
+
+func (s *Storage) runDefragment(ctx context.Context, j *defragJob, tenant, dataDir string) {
+	defer close(j.done)
+	defer j.cancel()
+
+	files, size, err := countFiles(dataDir)
+	if err != nil {
+		log.Warn().Err(err).Str("path", dataDir).Msg("defragment: failed to count files, progress unknown")
+	}
+	j.update(func(job *DefragmentJob) {
+		job.TotalFiles = files
+		job.TotalBytes = size
+	})
+
+	progress := lineCounter(func(n int) {
+		j.update(func(job *DefragmentJob) { job.ProcessedFiles += n })
+	})
+	err = s.btrfs.Defragment(ctx, dataDir, j.snapshot().Compression, progress)
+
+	now := time.Now().UTC()
+	j.update(func(job *DefragmentJob) {
+		job.FinishedAt = &now
+		switch {
+		case ctx.Err() != nil:
+			job.Status = JobCancelled
+		case err != nil:
+			job.Status = JobFailed
+			job.Error = err.Error()
+		default:
+			job.Status = JobCompleted
+		}
+	})
+
+	job := j.snapshot()
+	l := log.Info()
+	if job.Status == JobFailed {
+		l = log.Error().Err(err)
+	}
+	l.Str("tenant", tenant).Str("volume", job.Volume).Str("status", job.Status).Int("files", job.ProcessedFiles).Dur("duration", now.Sub(job.StartedAt)).Msg("defragment finished")
+}
+
+// DefragmentStatus returns the current or last defragment of a volume.
+func (s *Storage) DefragmentStatus(tenant, name string) (*DefragmentJob, error) {
+	if _, err := s.GetVolume(tenant, name); err != nil {
+		return nil, err
+	}
+	j := s.defragJob(tenant, name)
+	if j == nil {
+		return nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("volume %q was not defragmented", name)}
+	}
+	job := j.snapshot()
+	return &job, nil
+}
+
+// CancelDefragment stops the running defragment of a volume and waits for it
+// to exit. Files already rewritten keep their new compression.
+func (s *Storage) CancelDefragment(tenant, name string) (*DefragmentJob, error) {
+	if _, err := s.GetVolume(tenant, name); err != nil {
+		return nil, err
+	}
+	j := s.defragJob(tenant, name)
+	if j == nil || j.snapshot().Status != JobRunning {
+		return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("volume %q is not being defragmented", name)}
+	}
+	j.cancel()
+	<-j.done
+	job := j.snapshot()
+	return &job, nil
+}
+
+// stopDefragment cancels and forgets the defragment of a deleted volume.
+func (s *Storage) stopDefragment(tenant, name string) {
+	key := tenant + "/" + name
+	s.defragMu.Lock()
+	j, ok := s.defragJobs[key]
+	delete(s.defragJobs, key)
+	s.defragMu.Unlock()
+	if ok {
+		j.cancel()
+		<-j.done
+	}
+}
+
+func (s *Storage) defragJob(tenant, name string) *defragJob {
+	s.defragMu.Lock()
+	defer s.defragMu.Unlock()
+	return s.defragJobs[tenant+"/"+name]
+}
+
+// countFiles returns the number and total size of the regular files below
+// dir, which is what `btrfs filesystem defragment -r` processes.
+func countFiles(dir string) (int, uint64, error) {
+	var files int
+	var size uint64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed meanwhile
+		}
+		files++
+		size += uint64(info.Size())
+		return nil
+	})
+	return files, size, err
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitDefragment waits for the defragment of the volume to exit.
+func waitDefragment(t *testing.T, s *Storage, name string) DefragmentJob {
+	t.Helper()
+	j := s.defragJob("test", name)
+	require.NotNil(t, j)
+	<-j.done
+	return j.snapshot()
+}
+
+func TestDefragment(t *testing.T) {
+	setup := func(t *testing.T, meta VolumeMetadata) *Storage {
+		s, bp, runner, _ := newTestStorage(t)
+		volDir := setupUsageVol(t, bp, "vol1", meta)
+		dataDir := filepath.Join(volDir, config.DataDir)
+		for _, f := range []string{"a", "b", "c", "d"} {
+			require.NoError(t, os.WriteFile(filepath.Join(dataDir, f), []byte("data"), 0o644))
+		}
+		// every file defragmented so far is printed by -v
+		runner.Out = filepath.Join(dataDir, "a") + "\n" + filepath.Join(dataDir, "b") + "\n"
+		return s
+	}
+
+	t.Run("volume_compression", func(t *testing.T) {
+		s := setup(t, VolumeMetadata{Name: "vol1", Compression: "zstd"})
+
+		job, err := s.StartDefragment("test", "vol1", DefragmentRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, JobRunning, job.Status)
+		assert.Equal(t, "zstd", job.Compression)
+
+		job2 := waitDefragment(t, s, "vol1")
+		assert.Equal(t, JobCompleted, job2.Status)
+		assert.Equal(t, 4, job2.TotalFiles)
+		assert.Equal(t, uint64(16), job2.TotalBytes)
+		assert.Equal(t, 2, job2.ProcessedFiles)
+		assert.Equal(t, 1.0, job2.Progress())
+		require.NotNil(t, job2.FinishedAt)
+	})
+
+	t.Run("returns_initial_state", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		volDir := setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		require.NoError(t, os.WriteFile(filepath.Join(volDir, config.DataDir, "a"), []byte("data"), 0o644))
+		release := make(chan struct{})
+		runner.StreamFn = func(_ []string, _ io.Reader, _ io.Writer) error {
+			<-release
+			return nil
+		}
+
+		job, err := s.StartDefragment("test", "vol1", DefragmentRequest{})
+		require.NoError(t, err)
+		// the job counts files in the background, the response must not race it
+		assert.Equal(t, JobRunning, job.Status)
+		assert.Zero(t, job.TotalFiles)
+		assert.Zero(t, job.ProcessedFiles)
+		assert.Zero(t, job.Progress())
+
+		close(release)
+		waitDefragment(t, s, "vol1")
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		runner.Err = errors.New("total 1 failures")
+
+		_, err := s.StartDefragment("test", "vol1", DefragmentRequest{Compression: ptrString("lzo")})
+		require.NoError(t, err)
+
+		job := waitDefragment(t, s, "vol1")
+		assert.Equal(t, JobFailed, job.Status)
+		assert.Equal(t, "total 1 failures", job.Error)
+	})
+
+	t.Run("busy_and_cancel", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		started, release := make(chan struct{}), make(chan struct{})
+		runner.StreamFn = func(_ []string, _ io.Reader, _ io.Writer) error {
+			close(started)
+			<-release
+			return errors.New("signal: killed")
+		}
+
+		_, err := s.StartDefragment("test", "vol1", DefragmentRequest{})
+		require.NoError(t, err)
+		<-started
+
+		_, err = s.StartDefragment("test", "vol1", DefragmentRequest{})
+		requireStorageError(t, err, ErrBusy)
+
+		s.defragJob("test", "vol1").cancel()
+		close(release)
+		job := waitDefragment(t, s, "vol1")
+		assert.Equal(t, JobCancelled, job.Status)
+
+		_, err = s.CancelDefragment("test", "vol1")
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "nocow", VolumeMetadata{Name: "nocow", NoCOW: true})
+
+		_, err := s.StartDefragment("test", "nocow", DefragmentRequest{Compression: ptrString("zstd")})
+		requireStorageError(t, err, ErrInvalid)
+		_, err = s.StartDefragment("test", "nocow", DefragmentRequest{Compression: ptrString("brotli")})
+		requireStorageError(t, err, ErrInvalid)
+		_, err = s.StartDefragment("test", "missing", DefragmentRequest{})
+		requireStorageError(t, err, ErrNotFound)
+		_, err = s.DefragmentStatus("test", "nocow")
+		requireStorageError(t, err, ErrNotFound)
+	})
+
+	t.Run("recompress_on_change", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		s.SetRecompressOnChange(true)
+
+		_, err := s.UpdateVolume(t.Context(), "test", "vol1", VolumeUpdateRequest{Compression: ptrString("zstd:3")})
+		require.NoError(t, err)
+
+		job := waitDefragment(t, s, "vol1")
+		assert.Equal(t, "zstd:3", job.Compression)
+		assert.True(t, containsCall(runner.Calls, "filesystem", "defragment", "-v", "-r", "-czstd", filepath.Join(bp, "vol1", config.DataDir)))
+	})
+
+	t.Run("no_recompress_when_unchanged", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", Compression: "zstd"})
+		s.SetRecompressOnChange(true)
+
+		_, err := s.UpdateVolume(t.Context(), "test", "vol1", VolumeUpdateRequest{Compression: ptrString("zstd")})
+		require.NoError(t, err)
+		assert.Nil(t, s.defragJob("test", "vol1"))
+	})
+}
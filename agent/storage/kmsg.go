@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const kmsgPath = "/dev/kmsg"
+
+// kmsgRecord is one kernel log record, see Documentation/ABI/testing/dev-kmsg.
+type kmsgRecord struct {
+	Seq  uint64
+	Time time.Time
+	Msg  string
+}
+
+// kmsgReader follows the kernel log. The first read returns everything still
+// in the ring buffer, later reads only new records.
+type kmsgReader struct {
+	fd   int
+	boot time.Time
+	buf  []byte
+}
+
+func openKmsg(path string) (*kmsgReader, error) {
+	// O_NONBLOCK makes read return EAGAIN at the end instead of waiting. The
+	// raw fd keeps the Go runtime poller from waiting on our behalf.
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	boot, err := bootTime()
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return &kmsgReader{fd: fd, boot: boot, buf: make([]byte, 8192)}, nil
+}
+
+// Read returns all records available right now. Each read(2) on /dev/kmsg
+// returns exactly one record.
+func (r *kmsgReader) Read() ([]kmsgRecord, error) {
+	var recs []kmsgRecord
+	for {
+		n, err := unix.Read(r.fd, r.buf)
+		switch {
+		case errors.Is(err, unix.EAGAIN):
+			return recs, nil
+		case errors.Is(err, unix.EPIPE), errors.Is(err, unix.EINTR):
+			// EPIPE: records were overwritten before we read them
+			continue
+		case err != nil:
+			return recs, fmt.Errorf("read %s: %w", kmsgPath, err)
+		}
+		if rec, ok := parseKmsgRecord(string(r.buf[:n]), r.boot); ok {
+			recs = append(recs, rec)
+		}
+	}
+}
+
+func (r *kmsgReader) Close() error { return unix.Close(r.fd) }
+
+// parseKmsgRecord parses "prio,seq,usec,flags[,...];message\n" followed by
+// optional continuation lines. usec is the time since boot.
+func parseKmsgRecord(s string, boot time.Time) (kmsgRecord, bool) {
+	prefix, msg, ok := strings.Cut(s, ";")
+	if !ok {
+		return kmsgRecord{}, false
+	}
+	fields := strings.Split(prefix, ",")
+	if len(fields) < 3 {
+		return kmsgRecord{}, false
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return kmsgRecord{}, false
+	}
+	usec, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return kmsgRecord{}, false
+	}
+	msg, _, _ = strings.Cut(msg, "\n")
+	return kmsgRecord{Seq: seq, Time: boot.Add(time.Duration(usec) * time.Microsecond), Msg: msg}, true
+}
+
+// bootTime returns the boot time from the btime line of /proc/stat. It is
+// stable across agent restarts, unlike one derived from the uptime.
+func bootTime() (time.Time, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			sec, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("parse btime %q: %w", v, err)
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
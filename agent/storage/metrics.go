@@ -31,6 +31,42 @@ var (
 		Help:      "Volume used space in bytes.",
 	}, []string{"tenant", "volume"})
 
+	VolumeCorruptedFiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "volume_corrupted_files",
+		Help:      "Files of the volume and its snapshots with checksum errors.",
+	}, []string{"tenant", "volume"})
+
+	// Replication metrics
+	ReplicationLagSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "replication_lag_seconds",
+		Help:      "Seconds since the last successful replication of the volume to the peer.",
+	}, []string{"tenant", "volume"})
+
+	ReplicationFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "replication_failures_total",
+		Help:      "Total failed replication runs of the volume.",
+	}, []string{"tenant", "volume"})
+
+	ConsistencyIssuesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "consistency_issues",
+		Help:      "Unrepaired issues found by the last consistency check.",
+	}, []string{"tenant", "kind"})
+
+	OrphanQgroupsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "orphan_qgroups",
+		Help:      "Unrepaired qgroups without a subvolume found by the last filesystem consistency check.",
+	})
+
 	// Device IO metrics
 	DeviceReadBytesTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "btrfs_nfs_csi",
@@ -152,6 +188,116 @@ var (
 		Help:      "Total btrfs generation errors on the device.",
 	}, []string{"device"})
 
+	// Scrub metrics (labeled by mount path, a scrub covers all devices)
+	ScrubRunningGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "scrub_running",
+		Help:      "Whether a scrub is running (1) or not (0).",
+	}, []string{"path"})
+
+	ScrubProgressRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "scrub_progress_ratio",
+		Help:      "Progress of the current or last scrub (0-1).",
+	}, []string{"path"})
+
+	ScrubLastCompletedTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "scrub_last_completed_timestamp_seconds",
+		Help:      "Unix time the last scrub finished.",
+	}, []string{"path"})
+
+	ScrubErrorsFound = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "scrub_errors_found",
+		Help:      "Errors found by the current or last scrub.",
+	}, []string{"path"})
+
+	ScrubErrorsCorrected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "scrub_errors_corrected",
+		Help:      "Errors corrected by the current or last scrub.",
+	}, []string{"path"})
+
+	ScrubErrorsUncorrectable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "scrub_errors_uncorrectable",
+		Help:      "Uncorrectable errors found by the current or last scrub.",
+	}, []string{"path"})
+
+	// Balance metrics (labeled by mount path)
+	BalanceRunningGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "balance_running",
+		Help:      "Whether a balance is running (1) or not (0).",
+	}, []string{"path"})
+
+	BalanceProgressRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "balance_progress_ratio",
+		Help:      "Balanced fraction of the chunks of the running or paused balance.",
+	}, []string{"path"})
+
+	AutoBalanceTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "auto_balance_total",
+		Help:      "Balances started because unallocated space dropped below the threshold.",
+	}, []string{"path"})
+
+	// Dedupe metrics
+	DedupeRunningGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "dedupe_running",
+		Help:      "Whether a dedupe of the tenant is running (1) or not (0).",
+	}, []string{"tenant"})
+
+	DedupeReclaimedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "dedupe_reclaimed_bytes_total",
+		Help:      "Bytes reclaimed by dedupe jobs of the tenant, measured on the tenant qgroup if there is one.",
+	}, []string{"tenant"})
+
+	// Tenant metrics
+	TenantUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "tenant_used_bytes",
+		Help:      "Bytes referenced by the volumes and snapshots of the tenant, from its level 1 qgroup.",
+	}, []string{"tenant"})
+
+	TenantLimitBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "tenant_limit_bytes",
+		Help:      "Capacity limit of the tenant (0 = unlimited).",
+	}, []string{"tenant"})
+
+	// Trash metrics
+	TrashVolumesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "trash_volumes",
+		Help:      "Deleted volumes of the tenant waiting in the trash.",
+	}, []string{"tenant"})
+
+	TrashUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btrfs_nfs_csi",
+		Subsystem: "agent",
+		Name:      "trash_used_bytes",
+		Help:      "Used bytes of the deleted volumes in the trash of the tenant.",
+	}, []string{"tenant"})
+
 	// Filesystem allocation metrics (labeled by mount path, not device,
 	// because filesystem usage spans all devices in a multi-device setup)
 	FilesystemSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -203,6 +349,12 @@ func init() {
 		ExportsGauge,
 		VolumeSizeBytes,
 		VolumeUsedBytes,
+		VolumeCorruptedFiles,
+		// Replication
+		ReplicationLagSeconds,
+		ReplicationFailuresTotal,
+		ConsistencyIssuesGauge,
+		OrphanQgroupsGauge,
 		// Device IO
 		DeviceReadBytesTotal,
 		DeviceReadIOsTotal,
@@ -222,6 +374,26 @@ func init() {
 		DeviceFlushErrsTotal,
 		DeviceCorruptionErrsTotal,
 		DeviceGenerationErrsTotal,
+		// Scrub
+		ScrubRunningGauge,
+		ScrubProgressRatio,
+		ScrubLastCompletedTimestamp,
+		ScrubErrorsFound,
+		ScrubErrorsCorrected,
+		ScrubErrorsUncorrectable,
+		// Balance
+		BalanceRunningGauge,
+		BalanceProgressRatio,
+		AutoBalanceTotal,
+		// Dedupe
+		DedupeRunningGauge,
+		DedupeReclaimedBytesTotal,
+		// Tenant
+		TenantUsedBytes,
+		TenantLimitBytes,
+		// Trash
+		TrashVolumesGauge,
+		TrashUsedBytes,
 		// Filesystem allocation
 		FilesystemSizeBytes,
 		FilesystemUsedBytes,
@@ -5,20 +5,63 @@ import "time"
 // Persisted metadata types
 
 type VolumeMetadata struct {
-	Name         string     `json:"name"`
-	Path         string     `json:"path"`
-	SizeBytes    uint64     `json:"size_bytes"`
-	NoCOW        bool       `json:"nocow"`
-	Compression  string     `json:"compression"`
-	QuotaBytes   uint64     `json:"quota_bytes"`
-	UsedBytes    uint64     `json:"used_bytes"`
-	UID          int        `json:"uid"`
-	GID          int        `json:"gid"`
-	Mode         string     `json:"mode"`
-	Clients      []string   `json:"clients,omitempty"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
-	LastAttachAt *time.Time `json:"last_attach_at,omitempty"`
+	Name             string            `json:"name"`
+	Path             string            `json:"path"`
+	SizeBytes        uint64            `json:"size_bytes"`
+	NoCOW            bool              `json:"nocow"`
+	Compression      string            `json:"compression"`
+	QuotaBytes       uint64            `json:"quota_bytes"`
+	UsedBytes        uint64            `json:"used_bytes"`
+	UID              int               `json:"uid"`
+	GID              int               `json:"gid"`
+	Mode             string            `json:"mode"`
+	Clients          []string          `json:"clients,omitempty"`
+	SourceSnapshot   string            `json:"source_snapshot,omitempty"`
+	SourceVolume     string            `json:"source_volume,omitempty"`
+	ReceivedSnapshot string            `json:"received_snapshot,omitempty"`
+	Replicate        bool              `json:"replicate"`
+	SnapshotSchedule string            `json:"snapshot_schedule,omitempty"`
+	Replication      *ReplicationState `json:"replication,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at"`
+	LastAttachAt     *time.Time        `json:"last_attach_at,omitempty"`
+	// CorruptedFiles lists files of the volume and its snapshots with checksum
+	// errors. Errors logged before CorruptionClearedAt are ignored.
+	CorruptedFiles      []CorruptedFile `json:"corrupted_files,omitempty"`
+	CorruptionClearedAt *time.Time      `json:"corruption_cleared_at,omitempty"`
+	// DedupedBytes are the bytes of this volume's files that share extents
+	// with identical data elsewhere in the tenant, as found by the last
+	// completed dedupe. Later writes may unshare them, the next job lowers it.
+	DedupedBytes uint64 `json:"deduped_bytes,omitempty"`
+	// AdoptedFrom is the path the data was adopted from, see VolumeAdoptRequest.
+	AdoptedFrom string `json:"adopted_from,omitempty"`
+	// DeletedAt is set while the volume is in the trash, see AGENT_TRASH_RETENTION.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// GroupQgroup is the level 1 qgroup shared with the snapshots of the
+	// volume, set if snapshots count against the volume size.
+	GroupQgroup string `json:"group_qgroup,omitempty"`
+	// CombinedUsedBytes is the usage of GroupQgroup, data shared between the
+	// volume and its snapshots counts once.
+	CombinedUsedBytes uint64 `json:"combined_used_bytes,omitempty"`
+}
+
+// ReplicationState tracks the last snapshot successfully pushed to the peer.
+// It is the parent for the next incremental send.
+type ReplicationState struct {
+	LastSnapshot string    `json:"last_snapshot"`
+	LastSyncAt   time.Time `json:"last_sync_at"`
+}
+
+// CorruptedFile is a file with data checksum errors, found on read or by a scrub.
+type CorruptedFile struct {
+	// Path is relative to the data directory of the volume or snapshot.
+	Path     string `json:"path"`
+	Snapshot string `json:"snapshot,omitempty"`
+	// Logical is the logical address of the last bad block, if known.
+	Logical     uint64    `json:"logical,omitempty"`
+	Errors      int       `json:"errors"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
 }
 
 type SnapshotMetadata struct {
@@ -29,50 +72,258 @@ type SnapshotMetadata struct {
 	UsedBytes      uint64    `json:"used_bytes"`
 	ExclusiveBytes uint64    `json:"exclusive_bytes"`
 	ReadOnly       bool      `json:"readonly"`
+	Schedule       string    `json:"schedule,omitempty"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
 }
 
-type CloneMetadata struct {
-	Name           string    `json:"name"`
-	SourceSnapshot string    `json:"source_snapshot"`
-	Path           string    `json:"path"`
-	CreatedAt      time.Time `json:"created_at"`
-}
+// CloneMetadata was the metadata of a clone before clones became volumes.
+//
+// Deprecated: clones are volumes, use VolumeMetadata. It will be removed in
+// the next release.
+type CloneMetadata = VolumeMetadata
 
 // Request types
 
 type VolumeCreateRequest struct {
-	Name        string `json:"name"`
-	SizeBytes   uint64 `json:"size_bytes"`
-	NoCOW       bool   `json:"nocow"`
-	Compression string `json:"compression"`
-	QuotaBytes  uint64 `json:"quota_bytes"`
-	UID         int    `json:"uid"`
-	GID         int    `json:"gid"`
-	Mode        string `json:"mode"`
+	Name             string `json:"name"`
+	SizeBytes        uint64 `json:"size_bytes"`
+	NoCOW            bool   `json:"nocow"`
+	Compression      string `json:"compression"`
+	QuotaBytes       uint64 `json:"quota_bytes"`
+	UID              int    `json:"uid"`
+	GID              int    `json:"gid"`
+	Mode             string `json:"mode"`
+	Replicate        bool   `json:"replicate"`
+	SnapshotSchedule string `json:"snapshot_schedule"`
+	// IncludeSnapshots counts data kept by snapshots against the volume size.
+	IncludeSnapshots bool `json:"include_snapshots"`
 }
 
 type VolumeUpdateRequest struct {
-	SizeBytes   *uint64 `json:"size_bytes,omitempty"`
-	NoCOW       *bool   `json:"nocow,omitempty"`
+	SizeBytes        *uint64 `json:"size_bytes,omitempty"`
+	NoCOW            *bool   `json:"nocow,omitempty"`
+	Compression      *string `json:"compression,omitempty"`
+	UID              *int    `json:"uid,omitempty"`
+	GID              *int    `json:"gid,omitempty"`
+	Mode             *string `json:"mode,omitempty"`
+	Replicate        *bool   `json:"replicate,omitempty"`
+	SnapshotSchedule *string `json:"snapshot_schedule,omitempty"`
+	IncludeSnapshots *bool   `json:"include_snapshots,omitempty"`
+}
+
+// VolumeReceiveRequest is passed as query parameters, the request body
+// carries the send stream.
+type VolumeReceiveRequest struct {
+	Snapshot    string `query:"snapshot"`
+	SizeBytes   uint64 `query:"size_bytes"`
+	NoCOW       bool   `query:"nocow"`
+	Compression string `query:"compression"`
+}
+
+// VolumeAdoptRequest turns an existing subvolume or directory below the btrfs
+// mount point into a volume. A subvolume at Path is moved, a directory is
+// copied and only removed with RemoveSource.
+type VolumeAdoptRequest struct {
+	Path             string `json:"path"`
+	SizeBytes        uint64 `json:"size_bytes"`
+	Replicate        bool   `json:"replicate"`
+	SnapshotSchedule string `json:"snapshot_schedule"`
+	RemoveSource     bool   `json:"remove_source"`
+}
+
+// TrashRestoreRequest restores a deleted volume. Name defaults to the name the
+// volume had when it was deleted.
+type TrashRestoreRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+type VolumeRollbackRequest struct {
+	Snapshot string `json:"snapshot"`
+	Force    bool   `json:"force"`
+}
+
+// DefragmentRequest rewrites the data of a volume. Compression defaults to
+// the compression of the volume.
+type DefragmentRequest struct {
 	Compression *string `json:"compression,omitempty"`
-	UID         *int    `json:"uid,omitempty"`
-	GID         *int    `json:"gid,omitempty"`
-	Mode        *string `json:"mode,omitempty"`
+}
+
+// Background job states, shared by defragment and dedupe jobs.
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// DefragmentJob is the state of the current or last defragment of a volume.
+// Jobs are kept in memory only and lost on restart.
+type DefragmentJob struct {
+	Volume      string `json:"volume"`
+	Compression string `json:"compression,omitempty"`
+	Status      string `json:"status"`
+	// TotalFiles is counted before the defragment starts, files created
+	// meanwhile are not included.
+	TotalFiles     int        `json:"total_files"`
+	ProcessedFiles int        `json:"processed_files"`
+	TotalBytes     uint64     `json:"total_bytes"`
+	Error          string     `json:"error,omitempty"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// Progress returns the processed fraction of files between 0 and 1.
+func (j DefragmentJob) Progress() float64 {
+	if j.Status == JobCompleted {
+		return 1
+	}
+	if j.TotalFiles == 0 {
+		return 0
+	}
+	return min(float64(j.ProcessedFiles)/float64(j.TotalFiles), 1)
+}
+
+// DedupeJob is the state of the current or last dedupe of a tenant. The last
+// job is persisted with the dedupe state and survives restarts.
+type DedupeJob struct {
+	Status       string `json:"status"`
+	ScannedFiles int    `json:"scanned_files"`
+	// HashedBytes only counts files hashed in this run, unchanged files
+	// reuse the hashes of an earlier run.
+	HashedBytes uint64 `json:"hashed_bytes"`
+	// DuplicateFiles counts the files with ranges shared in this run.
+	DuplicateFiles int `json:"duplicate_files"`
+	// DedupedBytes counts the bytes shared in this run while it is running.
+	// Once stopped, with a tenant qgroup, it is the drop in the referenced
+	// bytes of the tenant instead.
+	DedupedBytes uint64     `json:"deduped_bytes"`
+	Error        string     `json:"error,omitempty"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// TrashEntry is a deleted volume in the trash of a tenant. ID names the entry,
+// the same volume name may be deleted more than once.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	SizeBytes uint64    `json:"size_bytes"`
+	UsedBytes uint64    `json:"used_bytes"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// PurgeAt is unset if the trash purger is disabled.
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// TenantUsage is the space used by all volumes, snapshots and trash entries
+// of a tenant, accounted in its level 1 qgroup. Extents shared between them
+// count once. LimitBytes is zero without a limit.
+type TenantUsage struct {
+	QgroupID   string `json:"qgroup_id"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	LimitBytes uint64 `json:"limit_bytes"`
+}
+
+// Token scopes, checked per route of the tenant API. ScopeTenantAdmin grants
+// all scopes within the tenant, a token without scopes has ScopeTenantAdmin.
+// It does not grant the admin API, which only accepts AGENT_ADMIN_TOKEN.
+// ScopeSnapshotsSend exports the full data and is not implied by
+// ScopeVolumesRead.
+const (
+	ScopeVolumesRead    = "volumes:read"
+	ScopeVolumesWrite   = "volumes:write"
+	ScopeSnapshotsWrite = "snapshots:write"
+	ScopeSnapshotsSend  = "snapshots:send"
+	ScopeExportsWrite   = "exports:write"
+	ScopeTenantAdmin    = "tenant:admin"
+	// Deprecated: ScopeAdmin is the former name of ScopeTenantAdmin, still
+	// accepted as an alias for tokens created with it.
+	ScopeAdmin = "admin"
+)
+
+// Tenant is a tenant of the agent with its API tokens, managed through the
+// admin API and persisted in the tenant store. Token secrets are only
+// returned when a token is created.
+type Tenant struct {
+	Name       string        `json:"name"`
+	Tokens     []TenantToken `json:"tokens"`
+	LimitBytes uint64        `json:"limit_bytes,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// TenantToken is one of the API tokens of a tenant. A tenant may have several
+// valid tokens, so a token can be rotated without downtime. Only Hash is
+// stored, Token is set in the response that creates it. Seed marks a token
+// from AGENT_TENANTS, it is replaced when the token there changes.
+type TenantToken struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	Seed      bool      `json:"seed,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TenantCreateRequest creates a tenant with one token. A random token is
+// generated if Token is empty, Token may also be a hash from HashToken.
+// Scopes restricts the token, all scopes if empty.
+type TenantCreateRequest struct {
+	Name       string   `json:"name"`
+	Token      string   `json:"token,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	LimitBytes uint64   `json:"limit_bytes,omitempty"`
+}
+
+// TenantTokenCreateRequest adds a token to a tenant. A random token is
+// generated if Token is empty, Token may also be a hash from HashToken.
+// Scopes restricts the token, all scopes if empty.
+type TenantTokenCreateRequest struct {
+	Token  string   `json:"token,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// BalanceRequest selects the chunks to balance by usage percentage (0-100).
+// At least one filter is required, a full balance is not supported.
+type BalanceRequest struct {
+	DataUsage     *int `json:"data_usage,omitempty"`
+	MetadataUsage *int `json:"metadata_usage,omitempty"`
 }
 
 type SnapshotCreateRequest struct {
 	Volume string `json:"volume"`
 	Name   string `json:"name"`
+	// Schedule is set by the snapshot scheduler only, it marks the snapshot
+	// for pruning under the volume's retention rules.
+	Schedule string `json:"-"`
 }
 
+// CloneCreateRequest clones either a snapshot or a live volume, exactly one
+// of Snapshot and Volume must be set. SizeBytes defaults to the source size.
 type CloneCreateRequest struct {
-	Snapshot string `json:"snapshot"`
-	Name     string `json:"name"`
+	Snapshot  string `json:"snapshot,omitempty"`
+	Volume    string `json:"volume,omitempty"`
+	Name      string `json:"name"`
+	SizeBytes uint64 `json:"size_bytes,omitempty"`
 }
 
 type ExportEntry struct {
 	Path   string `json:"path"`
 	Client string `json:"client"`
 }
+
+// ConsistencyIssue is one mismatch between the on-disk layout, metadata and
+// btrfs found by CheckConsistency.
+type ConsistencyIssue struct {
+	Kind       string `json:"kind"`
+	Path       string `json:"path"`
+	Message    string `json:"message"`
+	Repairable bool   `json:"repairable"`
+	Repaired   bool   `json:"repaired"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ConsistencyReport struct {
+	CheckedAt time.Time          `json:"checked_at"`
+	Repair    bool               `json:"repair"`
+	Issues    []ConsistencyIssue `json:"issues"`
+}
@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// receiveMinOverhead is the minimum room for metadata in a received stream,
+// see receiveOverhead.
+const receiveMinOverhead = 64 << 20
+
+// ReceiveVolume imports a btrfs send stream into volume name.
+//
+// The received read-only subvolume is kept as snapshot req.Snapshot, so later
+// incremental streams can reference it as their parent, and the volume data
+// is a writable snapshot of it. An existing volume is only replaced if it was
+// created by an earlier receive and is not exported.
+func (s *Storage) ReceiveVolume(ctx context.Context, tenant, name string, req VolumeReceiveRequest, r io.Reader) (*VolumeMetadata, error) {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	// validation
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if err := validateName(req.Snapshot); err != nil {
+		return nil, err
+	}
+	if req.NoCOW && req.Compression != "" && req.Compression != "none" {
+		return nil, &StorageError{Code: ErrInvalid, Message: "nocow and compression are mutually exclusive"}
+	}
+	if !utils.IsValidCompression(req.Compression) {
+		return nil, &StorageError{Code: ErrInvalid, Message: "compression must be one of: zstd, lzo, zlib, none"}
+	}
+
+	volDir := filepath.Join(bp, name)
+	metaPath := filepath.Join(volDir, config.MetadataFile)
+
+	var cur *VolumeMetadata
+	if _, err := os.Stat(volDir); err == nil {
+		var existing VolumeMetadata
+		if err := ReadMetadata(metaPath, &existing); err != nil {
+			return nil, fmt.Errorf("volume %q exists but metadata is corrupt: %w", name, err)
+		}
+		if existing.ReceivedSnapshot == "" {
+			return nil, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("volume %q already exists and was not created by receive", name)}
+		}
+		if len(existing.Clients) > 0 {
+			return nil, &StorageError{Code: ErrBusy, Message: fmt.Sprintf("volume %q still has active NFS exports", name)}
+		}
+		if req.SizeBytes != 0 && req.SizeBytes < existing.SizeBytes {
+			return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("size %d must not be smaller than current size %d", req.SizeBytes, existing.SizeBytes)}
+		}
+		if existing.NoCOW && req.Compression != "" && req.Compression != "none" {
+			return nil, &StorageError{Code: ErrInvalid, Message: "nocow and compression are mutually exclusive"}
+		}
+		cur = &existing
+	} else if req.SizeBytes == 0 {
+		return nil, &StorageError{Code: ErrInvalid, Message: "size_bytes is required"}
+	}
+
+	snapDir := filepath.Join(bp, config.SnapshotsDir, req.Snapshot)
+	if _, err := os.Stat(snapDir); err == nil {
+		return nil, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("snapshot %q already exists", req.Snapshot)}
+	}
+
+	size := req.SizeBytes
+	if size == 0 {
+		size = cur.SizeBytes
+	}
+	limit, err := s.receiveLimit(ctx, tenant, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// operations
+	if err := os.MkdirAll(snapDir, s.defaultDirMode); err != nil {
+		log.Error().Err(err).Msg("failed to create snapshot directory")
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	cleanupSnap := func() {
+		s.removeReceived(ctx, snapDir)
+	}
+
+	stream := &capReader{r: r, remaining: limit}
+	if err := s.btrfs.Receive(ctx, snapDir, stream); err != nil {
+		cleanupSnap()
+		if stream.exceeded {
+			return nil, &StorageError{Code: ErrQuotaExceeded, Message: fmt.Sprintf("stream exceeds %d bytes, the size of the volume plus overhead or the space left to the tenant", limit)}
+		}
+		if strings.Contains(err.Error(), "cannot find parent subvolume") {
+			return nil, &StorageError{Code: ErrNotFound, Message: "parent subvolume of the incremental stream not found"}
+		}
+		log.Error().Err(err).Str("snapshot", req.Snapshot).Msg("failed to receive stream")
+		return nil, fmt.Errorf("btrfs receive failed: %w", err)
+	}
+
+	snapData := filepath.Join(snapDir, config.DataDir)
+	if err := renameReceived(snapDir); err != nil {
+		cleanupSnap()
+		return nil, err
+	}
+	// the subvolume created by btrfs receive cannot join a qgroup on creation
+	if err := s.assignTenantQgroup(ctx, tenant, snapData); err != nil {
+		log.Error().Err(err).Str("path", snapData).Msg("failed to assign tenant qgroup")
+		cleanupSnap()
+		return nil, fmt.Errorf("qgroup assign failed: %w", err)
+	}
+	if err := s.checkReceivedUsage(ctx, tenant, snapData, size); err != nil {
+		cleanupSnap()
+		return nil, err
+	}
+
+	info, err := os.Stat(snapData)
+	if err != nil {
+		cleanupSnap()
+		return nil, fmt.Errorf("stat received subvolume: %w", err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		cleanupSnap()
+		return nil, fmt.Errorf("stat received subvolume: unsupported platform")
+	}
+
+	now := time.Now().UTC()
+	snapMeta := SnapshotMetadata{
+		Name:      req.Snapshot,
+		Volume:    name,
+		Path:      snapDir,
+		SizeBytes: size,
+		ReadOnly:  true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := writeMetadataAtomic(filepath.Join(snapDir, config.MetadataFile), snapMeta); err != nil {
+		log.Error().Err(err).Msg("failed to write snapshot metadata")
+		cleanupSnap()
+		return nil, fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	nocow := req.NoCOW
+	compression := req.Compression
+	if cur != nil {
+		nocow = nocow || cur.NoCOW
+		if compression == "" {
+			compression = cur.Compression
+		}
+	}
+
+	var meta VolumeMetadata
+	if cur == nil {
+		meta = VolumeMetadata{
+			Name:        name,
+			Path:        volDir,
+			SizeBytes:   size,
+			NoCOW:       nocow,
+			Compression: compression,
+			QuotaBytes:  size,
+			UID:         int(st.Uid),
+			GID:         int(st.Gid),
+			Mode:        fmt.Sprintf("%o", unixMode(info.Mode())),
+			CreatedAt:   now,
+		}
+		if err := os.MkdirAll(volDir, s.defaultDirMode); err != nil {
+			log.Error().Err(err).Str("path", volDir).Msg("failed to create volume directory")
+			cleanupSnap()
+			return nil, fmt.Errorf("create volume directory: %w", err)
+		}
+	} else {
+		meta = *cur
+		meta.SizeBytes = size
+		meta.QuotaBytes = size
+		meta.NoCOW = nocow
+		meta.Compression = compression
+		meta.UID = int(st.Uid)
+		meta.GID = int(st.Gid)
+		meta.Mode = fmt.Sprintf("%o", unixMode(info.Mode()))
+	}
+	meta.ReceivedSnapshot = req.Snapshot
+	meta.UpdatedAt = now
+
+	// build the writable copy next to the current data, so an existing volume
+	// keeps its data until the new one is fully set up
+	dataDir := filepath.Join(volDir, config.DataDir)
+	newData := dataDir + ".new"
+	cleanup := func() {
+		if err := s.btrfs.SubvolumeDelete(ctx, newData); err != nil {
+			log.Warn().Err(err).Str("path", newData).Msg("cleanup: failed to delete subvolume")
+		}
+		if cur == nil {
+			if err := os.RemoveAll(volDir); err != nil {
+				log.Warn().Err(err).Str("path", volDir).Msg("cleanup: failed to remove directory")
+			}
+		}
+		cleanupSnap()
+	}
+
+	if err := s.btrfs.SubvolumeSnapshot(ctx, snapData, newData, false, s.volumeInherit(tenant, cur)...); err != nil {
+		if cur == nil {
+			_ = os.RemoveAll(volDir)
+		}
+		cleanupSnap()
+		log.Error().Err(err).Str("path", newData).Msg("failed to create writable snapshot")
+		return nil, fmt.Errorf("btrfs snapshot failed: %w", err)
+	}
+
+	if nocow {
+		if err := s.btrfs.SetNoCOW(ctx, newData); err != nil {
+			log.Error().Err(err).Str("path", newData).Msg("failed to set nocow")
+			cleanup()
+			return nil, fmt.Errorf("chattr +C failed: %w", err)
+		}
+	}
+
+	if compression != "" && compression != "none" {
+		if err := s.btrfs.SetCompression(ctx, newData, compression); err != nil {
+			log.Error().Err(err).Str("path", newData).Str("algo", compression).Msg("failed to set compression")
+			cleanup()
+			return nil, fmt.Errorf("set compression failed: %w", err)
+		}
+	}
+
+	if s.quotaEnabled {
+		if err := s.btrfs.QgroupLimit(ctx, newData, size); err != nil {
+			log.Error().Err(err).Str("path", newData).Uint64("bytes", size).Msg("failed to set qgroup limit")
+			cleanup()
+			return nil, fmt.Errorf("qgroup limit failed: %w", err)
+		}
+		if cur != nil && cur.GroupQgroup != "" {
+			// the new data joined the volume qgroup on creation, the received
+			// snapshot has to be assigned
+			if err := s.assignVolumeGroup(ctx, cur, snapData); err != nil {
+				log.Error().Err(err).Str("path", snapData).Msg("failed to assign volume qgroup")
+				cleanup()
+				return nil, fmt.Errorf("qgroup assign failed: %w", err)
+			}
+			if err := s.btrfs.QgroupLimitGroup(ctx, cur.GroupQgroup, size, s.mountPoint); err != nil {
+				log.Error().Err(err).Str("qgroup", cur.GroupQgroup).Uint64("bytes", size).Msg("failed to update volume qgroup limit")
+				cleanup()
+				return nil, fmt.Errorf("qgroup limit failed: %w", err)
+			}
+		}
+	}
+
+	oldData := dataDir + ".old"
+	if cur != nil {
+		if err := os.Rename(dataDir, oldData); err != nil {
+			log.Error().Err(err).Str("path", dataDir).Msg("failed to move old data aside")
+			cleanup()
+			return nil, fmt.Errorf("failed to replace volume data: %w", err)
+		}
+	}
+	if err := os.Rename(newData, dataDir); err != nil {
+		log.Error().Err(err).Str("path", newData).Msg("failed to move received data in place")
+		if cur != nil {
+			if rbErr := os.Rename(oldData, dataDir); rbErr != nil {
+				log.Error().Err(rbErr).Str("path", oldData).Msg("failed to restore old data")
+			}
+		}
+		cleanup()
+		return nil, fmt.Errorf("failed to replace volume data: %w", err)
+	}
+
+	if err := writeMetadataAtomic(metaPath, meta); err != nil {
+		log.Error().Err(err).Msg("failed to write metadata")
+		if cur == nil {
+			if delErr := s.btrfs.SubvolumeDelete(ctx, dataDir); delErr != nil {
+				log.Warn().Err(delErr).Str("path", dataDir).Msg("cleanup: failed to delete subvolume")
+			}
+			_ = os.RemoveAll(volDir)
+			cleanupSnap()
+			return nil, fmt.Errorf("failed to write metadata: %w", err)
+		}
+		// swap the old data back, so data and metadata stay consistent
+		if rbErr := os.Rename(dataDir, newData); rbErr != nil {
+			log.Error().Err(rbErr).Str("path", dataDir).Msg("failed to move received data aside")
+			return nil, fmt.Errorf("failed to write metadata: %w", err)
+		}
+		if rbErr := os.Rename(oldData, dataDir); rbErr != nil {
+			log.Error().Err(rbErr).Str("path", oldData).Msg("failed to restore old data")
+			return nil, fmt.Errorf("failed to write metadata: %w", err)
+		}
+		cleanup()
+		return nil, fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	if cur != nil {
+		if err := s.btrfs.SubvolumeDelete(ctx, oldData); err != nil {
+			log.Warn().Err(err).Str("path", oldData).Msg("failed to delete replaced subvolume")
+		}
+	}
+
+	log.Info().Str("tenant", tenant).Str("name", name).Str("snapshot", req.Snapshot).Bool("replaced", cur != nil).Msg("volume received")
+	return &meta, nil
+}
+
+// receiveLimit returns how many bytes a stream for a volume of size may
+// have: size, or what is left of the tenant limit if that is less, plus
+// receiveOverhead for the metadata commands of the stream.
+func (s *Storage) receiveLimit(ctx context.Context, tenant string, size uint64) (int64, error) {
+	usage, err := s.TenantUsage(ctx, tenant)
+	if err != nil {
+		return 0, err
+	}
+	if usage != nil && usage.LimitBytes > 0 {
+		if usage.UsedBytes >= usage.LimitBytes {
+			return 0, &StorageError{Code: ErrQuotaExceeded, Message: fmt.Sprintf("tenant %q uses %d of %d bytes", tenant, usage.UsedBytes, usage.LimitBytes)}
+		}
+		size = min(size, usage.LimitBytes-usage.UsedBytes)
+	}
+	return int64(size + receiveOverhead(size)), nil
+}
+
+// receiveOverhead is the part of a send stream that is not file data, 10% of
+// the data but at least receiveMinOverhead.
+func receiveOverhead(size uint64) uint64 {
+	return max(size/10, receiveMinOverhead)
+}
+
+// checkReceivedUsage fails with ErrQuotaExceeded if the received subvolume
+// at path references more than size bytes, or its tenant is over its limit
+// now. Received extents are only accounted once committed, so the
+// filesystem is synced first.
+func (s *Storage) checkReceivedUsage(ctx context.Context, tenant, path string, size uint64) error {
+	if s.quotaEnabled {
+		if err := s.btrfs.FilesystemSync(ctx, s.mountPoint); err != nil {
+			return fmt.Errorf("filesystem sync failed: %w", err)
+		}
+	}
+	used, err := s.dataUsage(ctx, path, true)
+	if err != nil {
+		return err
+	}
+	if used > size {
+		return &StorageError{Code: ErrQuotaExceeded, Message: fmt.Sprintf("received data uses %d bytes, more than the volume size of %d bytes", used, size)}
+	}
+	usage, err := s.TenantUsage(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	if usage != nil && usage.LimitBytes > 0 && usage.UsedBytes > usage.LimitBytes {
+		return &StorageError{Code: ErrQuotaExceeded, Message: fmt.Sprintf("received data takes tenant %q to %d of %d bytes", tenant, usage.UsedBytes, usage.LimitBytes)}
+	}
+	return nil
+}
+
+// capReader fails once more than remaining bytes are read from r, so a
+// stream cannot write more than it may keep.
+type capReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		c.exceeded = true
+		return 0, errStreamTooLarge
+	}
+	return n, err
+}
+
+var errStreamTooLarge = errors.New("stream too large")
+
+// renameReceived moves the subvolume created by btrfs receive to data/.
+// The stream names the subvolume after the sender's source, which is data/
+// for streams sent by an agent but can be anything for external streams.
+func renameReceived(snapDir string) error {
+	entries, err := os.ReadDir(snapDir)
+	if err != nil {
+		return fmt.Errorf("read snapshot directory: %w", err)
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, e.Name())
+		}
+	}
+	if len(dirs) != 1 {
+		return &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("stream must contain exactly one subvolume, got %d", len(dirs))}
+	}
+	if dirs[0] == config.DataDir {
+		return nil
+	}
+	if err := os.Rename(filepath.Join(snapDir, dirs[0]), filepath.Join(snapDir, config.DataDir)); err != nil {
+		return fmt.Errorf("rename received subvolume: %w", err)
+	}
+	return nil
+}
+
+// removeReceived deletes every subvolume a (possibly failed) receive left in
+// snapDir, then the directory itself.
+func (s *Storage) removeReceived(ctx context.Context, snapDir string) {
+	entries, _ := os.ReadDir(snapDir)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		p := filepath.Join(snapDir, e.Name())
+		if err := s.btrfs.SubvolumeDelete(ctx, p); err != nil {
+			log.Warn().Err(err).Str("path", p).Msg("cleanup: failed to delete subvolume")
+		}
+	}
+	if err := os.RemoveAll(snapDir); err != nil {
+		log.Warn().Err(err).Str("path", snapDir).Msg("cleanup: failed to remove directory")
+	}
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveRunner fakes btrfs receive by creating subvol inside the target dir
+// and btrfs subvolume snapshot by creating the destination dir.
+func receiveRunner(t *testing.T, subvol string) *utils.MockRunner {
+	t.Helper()
+	return &utils.MockRunner{
+		StreamFn: func(args []string, _ io.Reader, _ io.Writer) error {
+			return os.MkdirAll(filepath.Join(args[len(args)-1], subvol), 0o750)
+		},
+		RunFn: func(args []string) (string, error) {
+			if len(args) >= 2 && args[0] == "subvolume" && args[1] == "snapshot" {
+				return "", os.MkdirAll(args[len(args)-1], 0o755)
+			}
+			if len(args) >= 2 && args[0] == "subvolume" && args[1] == "delete" {
+				return "", os.RemoveAll(args[len(args)-1])
+			}
+			return "", nil
+		},
+	}
+}
+
+// withQgroupShow makes the runner answer subvolume show and qgroup show,
+// the received subvolume gets ID 256.
+func withQgroupShow(runner *utils.MockRunner, show string) {
+	run := runner.RunFn
+	runner.RunFn = func(args []string) (string, error) {
+		switch {
+		case args[0] == "subvolume" && args[1] == "show":
+			return "Subvolume ID:\t\t\t256\n", nil
+		case args[0] == "qgroup" && args[1] == "show":
+			return show, nil
+		}
+		return run(args)
+	}
+}
+
+func TestReceiveVolume(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("validation", func(t *testing.T) {
+		tests := []struct {
+			name string
+			vol  string
+			req  VolumeReceiveRequest
+			code string
+		}{
+			{name: "invalid_name", vol: "bad!", req: VolumeReceiveRequest{Snapshot: "s", SizeBytes: 1}, code: ErrInvalid},
+			{name: "invalid_snapshot", vol: "vol", req: VolumeReceiveRequest{Snapshot: "", SizeBytes: 1}, code: ErrInvalid},
+			{name: "no_size", vol: "vol", req: VolumeReceiveRequest{Snapshot: "s"}, code: ErrInvalid},
+			{name: "bad_compression", vol: "vol", req: VolumeReceiveRequest{Snapshot: "s", SizeBytes: 1, Compression: "gzip"}, code: ErrInvalid},
+			{name: "nocow_compression", vol: "vol", req: VolumeReceiveRequest{Snapshot: "s", SizeBytes: 1, NoCOW: true, Compression: "zstd"}, code: ErrInvalid},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s, _, runner, _ := newTestStorage(t)
+				_, err := s.ReceiveVolume(ctx, "test", tt.vol, tt.req, strings.NewReader(""))
+				requireStorageError(t, err, tt.code)
+				assert.Empty(t, runner.Calls)
+			})
+		}
+	})
+
+	t.Run("new_volume", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		withQgroupShow(runner, "0/256 4096 4096\n")
+		s, bp := testStorageWithRunner(t, runner, nil)
+		s.quotaEnabled = true
+
+		meta, err := s.ReceiveVolume(ctx, "test", "restored", VolumeReceiveRequest{
+			Snapshot: "restored-base", SizeBytes: 1 << 30, Compression: "zstd",
+		}, strings.NewReader("stream"))
+		require.NoError(t, err)
+
+		volDir := filepath.Join(bp, "restored")
+		snapDir := filepath.Join(bp, config.SnapshotsDir, "restored-base")
+		assert.Equal(t, uint64(1<<30), meta.SizeBytes)
+		assert.Equal(t, uint64(1<<30), meta.QuotaBytes)
+		assert.Equal(t, "zstd", meta.Compression)
+		assert.Equal(t, "restored-base", meta.ReceivedSnapshot)
+		assert.Equal(t, "750", meta.Mode, "mode is taken from the received subvolume")
+		assert.Equal(t, os.Getuid(), meta.UID)
+
+		assert.DirExists(t, filepath.Join(volDir, config.DataDir))
+		assert.NoDirExists(t, filepath.Join(volDir, config.DataDir+".new"))
+		assert.Equal(t, meta.Name, readVolumeMeta(t, volDir).Name)
+
+		snap := readSnapMeta(t, snapDir)
+		assert.Equal(t, "restored", snap.Volume)
+		assert.True(t, snap.ReadOnly)
+
+		newData := filepath.Join(volDir, config.DataDir+".new")
+		assert.Equal(t, []string{"receive", "-e", "-C", snapDir}, runner.Calls[0])
+		assert.True(t, containsCall(runner.Calls, "subvolume", "snapshot", filepath.Join(snapDir, config.DataDir), newData))
+		assert.True(t, containsCall(runner.Calls, "property", "set", newData, "compression", "zstd"))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", fmt.Sprintf("%d", 1<<30), newData))
+		assert.True(t, containsCall(runner.Calls, "filesystem", "sync", s.mountPoint), "usage is only accounted after a sync")
+	})
+
+	t.Run("stream_too_large", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		runner.StreamFn = func(_ []string, r io.Reader, _ io.Writer) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		s, bp := testStorageWithRunner(t, runner, nil)
+
+		stream := strings.NewReader(strings.Repeat("x", receiveMinOverhead+1025))
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024}, stream)
+		requireStorageError(t, err, ErrQuotaExceeded)
+		assert.NoDirExists(t, filepath.Join(bp, config.SnapshotsDir, "s1"))
+		assert.NoDirExists(t, filepath.Join(bp, "vol"))
+	})
+
+	t.Run("usage_over_size", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		withQgroupShow(runner, "0/256 2048 2048\n")
+		s, bp := testStorageWithRunner(t, runner, nil)
+		s.quotaEnabled = true
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024}, strings.NewReader(""))
+		requireStorageError(t, err, ErrQuotaExceeded)
+		assert.NoDirExists(t, filepath.Join(bp, config.SnapshotsDir, "s1"))
+		assert.NoDirExists(t, filepath.Join(bp, "vol"))
+	})
+
+	t.Run("usage_over_tenant_limit", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		withQgroupShow(runner, "")
+		// the tenant has room before the receive and is over its limit after
+		show := "1/1 2048 2048 3072 none\n"
+		receive := runner.StreamFn
+		runner.StreamFn = func(args []string, r io.Reader, w io.Writer) error {
+			show = "0/256 1024 1024\n1/1 4096 4096 3072 none\n"
+			return receive(args, r, w)
+		}
+		run := runner.RunFn
+		runner.RunFn = func(args []string) (string, error) {
+			if args[0] == "qgroup" && args[1] == "show" {
+				return show, nil
+			}
+			return run(args)
+		}
+		s, bp := testStorageWithRunner(t, runner, nil)
+		s.quotaEnabled = true
+		s.tenantQgroups = map[string]string{"test": "1/1"}
+		s.tenantLimits = map[string]uint64{"test": 3072}
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024}, strings.NewReader(""))
+		requireStorageError(t, err, ErrQuotaExceeded)
+		assert.Contains(t, err.Error(), "4096 of 3072")
+		assert.NoDirExists(t, filepath.Join(bp, config.SnapshotsDir, "s1"))
+	})
+
+	t.Run("tenant_limit_used_up", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		withQgroupShow(runner, "1/1 3072 3072 3072 none\n")
+		s, _ := testStorageWithRunner(t, runner, nil)
+		s.quotaEnabled = true
+		s.tenantQgroups = map[string]string{"test": "1/1"}
+		s.tenantLimits = map[string]uint64{"test": 3072}
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024}, strings.NewReader(""))
+		requireStorageError(t, err, ErrQuotaExceeded)
+		assert.Empty(t, callsOf(runner.Calls, "receive"))
+	})
+
+	t.Run("renames_foreign_subvolume", func(t *testing.T) {
+		runner := receiveRunner(t, "mysubvol")
+		s, bp := testStorageWithRunner(t, runner, nil)
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "base", SizeBytes: 1024}, strings.NewReader(""))
+		require.NoError(t, err)
+
+		snapDir := filepath.Join(bp, config.SnapshotsDir, "base")
+		assert.DirExists(t, filepath.Join(snapDir, config.DataDir))
+		assert.NoDirExists(t, filepath.Join(snapDir, "mysubvol"))
+	})
+
+	t.Run("incremental_replaces_received_volume", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		s, bp := testStorageWithRunner(t, runner, nil)
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024, NoCOW: true}, strings.NewReader(""))
+		require.NoError(t, err)
+		marker := filepath.Join(bp, "vol", config.DataDir, "old")
+		require.NoError(t, os.WriteFile(marker, nil, 0o644))
+
+		meta, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s2"}, strings.NewReader(""))
+		require.NoError(t, err)
+		assert.Equal(t, "s2", meta.ReceivedSnapshot)
+		assert.Equal(t, uint64(1024), meta.SizeBytes, "size is kept if not given")
+		assert.True(t, meta.NoCOW, "nocow is kept")
+		assert.NoFileExists(t, marker, "old data should be replaced")
+		assert.NoDirExists(t, filepath.Join(bp, "vol", config.DataDir+".old"))
+		assert.DirExists(t, filepath.Join(bp, config.SnapshotsDir, "s1"), "previous base is kept")
+	})
+
+	t.Run("metadata_fails_restores_old_data", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		s, bp := testStorageWithRunner(t, runner, nil)
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024}, strings.NewReader(""))
+		require.NoError(t, err)
+		volDir := filepath.Join(bp, "vol")
+		marker := filepath.Join(volDir, config.DataDir, "old")
+		require.NoError(t, os.WriteFile(marker, nil, 0o644))
+		// a directory in place of the temp file makes the metadata write fail
+		require.NoError(t, os.MkdirAll(filepath.Join(volDir, config.MetadataFile+".tmp"), 0o755))
+
+		_, err = s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s2"}, strings.NewReader(""))
+		require.Error(t, err)
+		assert.FileExists(t, marker, "old data should be restored")
+		assert.NoDirExists(t, filepath.Join(volDir, config.DataDir+".old"))
+		assert.NoDirExists(t, filepath.Join(volDir, config.DataDir+".new"))
+		assert.NoDirExists(t, filepath.Join(bp, config.SnapshotsDir, "s2"))
+		assert.Equal(t, "s1", readVolumeMeta(t, volDir).ReceivedSnapshot)
+	})
+
+	t.Run("existing_not_received", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		volDir := filepath.Join(bp, "vol")
+		require.NoError(t, os.MkdirAll(volDir, 0o755))
+		writeTestMetadata(t, volDir, VolumeMetadata{Name: "vol", SizeBytes: 1024})
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1"}, strings.NewReader(""))
+		requireStorageError(t, err, ErrAlreadyExists)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("existing_busy", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		volDir := filepath.Join(bp, "vol")
+		require.NoError(t, os.MkdirAll(volDir, 0o755))
+		writeTestMetadata(t, volDir, VolumeMetadata{Name: "vol", SizeBytes: 1024, ReceivedSnapshot: "s1", Clients: []string{"10.0.0.1"}})
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s2"}, strings.NewReader(""))
+		requireStorageError(t, err, ErrBusy)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("snapshot_exists", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		require.NoError(t, os.MkdirAll(filepath.Join(bp, config.SnapshotsDir, "s1"), 0o755))
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024}, strings.NewReader(""))
+		requireStorageError(t, err, ErrAlreadyExists)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("missing_parent", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		runner.StreamFn = func([]string, io.Reader, io.Writer) error {
+			return fmt.Errorf("btrfs receive: exit status 1: ERROR: cannot find parent subvolume")
+		}
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s2", SizeBytes: 1024}, strings.NewReader(""))
+		requireStorageError(t, err, ErrNotFound)
+		assert.NoDirExists(t, filepath.Join(bp, config.SnapshotsDir, "s2"))
+		assert.NoDirExists(t, filepath.Join(bp, "vol"))
+	})
+
+	t.Run("receive_fails", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		runner.StreamFn = func([]string, io.Reader, io.Writer) error {
+			return fmt.Errorf("short read")
+		}
+
+		_, err := s.ReceiveVolume(ctx, "test", "vol", VolumeReceiveRequest{Snapshot: "s1", SizeBytes: 1024}, strings.NewReader(""))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "btrfs receive failed")
+		assert.NoDirExists(t, filepath.Join(bp, config.SnapshotsDir, "s1"))
+	})
+}
@@ -74,7 +74,7 @@ func (s *Storage) reconcileExports(ctx context.Context, basePath string, tenant
 	}
 
 	for _, e := range entries {
-		if !e.IsDir() || e.Name() == config.SnapshotsDir {
+		if !e.IsDir() || e.Name() == config.SnapshotsDir || e.Name() == config.TrashDir {
 			continue
 		}
 		volDir := filepath.Join(basePath, e.Name())
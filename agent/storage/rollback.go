@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RollbackVolume replaces the data of volume name with a writable snapshot of
+// req.Snapshot. The previous data is kept as a read-only safety snapshot,
+// which is returned alongside the updated volume. Exported volumes are only
+// rolled back with req.Force: the old subvolume is deleted underneath the
+// export, so clients get ESTALE on their file handles and have to remount.
+func (s *Storage) RollbackVolume(ctx context.Context, tenant, name string, req VolumeRollbackRequest) (*VolumeMetadata, *SnapshotMetadata, error) {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// validation
+	if err := validateName(name); err != nil {
+		return nil, nil, err
+	}
+	if err := validateName(req.Snapshot); err != nil {
+		return nil, nil, err
+	}
+
+	volDir := filepath.Join(bp, name)
+	metaPath := filepath.Join(volDir, config.MetadataFile)
+	var cur VolumeMetadata
+	if err := ReadMetadata(metaPath, &cur); err != nil {
+		return nil, nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("volume %q not found", name)}
+	}
+
+	snapDir := filepath.Join(bp, config.SnapshotsDir, req.Snapshot)
+	var snap SnapshotMetadata
+	if err := ReadMetadata(filepath.Join(snapDir, config.MetadataFile), &snap); err != nil {
+		return nil, nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("snapshot %q not found", req.Snapshot)}
+	}
+	if snap.Volume != name {
+		return nil, nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("snapshot %q belongs to volume %q, not %q", req.Snapshot, snap.Volume, name)}
+	}
+	if len(cur.Clients) > 0 && !req.Force {
+		return nil, nil, &StorageError{Code: ErrBusy, Message: fmt.Sprintf("volume %q still has active NFS exports", name)}
+	}
+	mode, err := strconv.ParseUint(cur.Mode, 8, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("volume %q has invalid mode %q: %w", name, cur.Mode, err)
+	}
+
+	// operations
+	now := time.Now().UTC()
+	// no budget check, a volume with a used up budget is the one to roll back
+	safety, err := s.createSnapshot(ctx, tenant, SnapshotCreateRequest{
+		Volume: name,
+		Name:   SnapshotName(name, "pre-rollback-"+now.Format("20060102150405")),
+	}, false)
+	if err != nil {
+		log.Error().Err(err).Str("volume", name).Msg("failed to create safety snapshot")
+		return nil, nil, fmt.Errorf("safety snapshot failed: %w", err)
+	}
+
+	dataDir := filepath.Join(volDir, config.DataDir)
+	newData := dataDir + ".new"
+	cleanup := func() {
+		if err := s.btrfs.SubvolumeDelete(ctx, newData); err != nil {
+			log.Warn().Err(err).Str("path", newData).Msg("cleanup: failed to delete subvolume")
+		}
+		if err := s.DeleteSnapshot(ctx, tenant, safety.Name); err != nil {
+			log.Warn().Err(err).Str("snapshot", safety.Name).Msg("cleanup: failed to delete safety snapshot")
+		}
+	}
+
+	if err := s.btrfs.SubvolumeSnapshot(ctx, filepath.Join(snapDir, config.DataDir), newData, false, s.volumeInherit(tenant, &cur)...); err != nil {
+		log.Error().Err(err).Str("path", newData).Msg("failed to create writable snapshot")
+		if delErr := s.DeleteSnapshot(ctx, tenant, safety.Name); delErr != nil {
+			log.Warn().Err(delErr).Str("snapshot", safety.Name).Msg("cleanup: failed to delete safety snapshot")
+		}
+		return nil, nil, fmt.Errorf("btrfs snapshot failed: %w", err)
+	}
+
+	if cur.NoCOW {
+		if err := s.btrfs.SetNoCOW(ctx, newData); err != nil {
+			log.Error().Err(err).Str("path", newData).Msg("failed to set nocow")
+			cleanup()
+			return nil, nil, fmt.Errorf("chattr +C failed: %w", err)
+		}
+	}
+
+	if cur.Compression != "" && cur.Compression != "none" {
+		if err := s.btrfs.SetCompression(ctx, newData, cur.Compression); err != nil {
+			log.Error().Err(err).Str("path", newData).Str("algo", cur.Compression).Msg("failed to set compression")
+			cleanup()
+			return nil, nil, fmt.Errorf("set compression failed: %w", err)
+		}
+	}
+
+	if s.quotaEnabled {
+		if err := s.btrfs.QgroupLimit(ctx, newData, cur.QuotaBytes); err != nil {
+			log.Error().Err(err).Str("path", newData).Uint64("bytes", cur.QuotaBytes).Msg("failed to set qgroup limit")
+			cleanup()
+			return nil, nil, fmt.Errorf("qgroup limit failed: %w", err)
+		}
+	}
+
+	// the snapshot root carries the ownership it had back then
+	if err := os.Chmod(newData, fileMode(mode)); err != nil {
+		log.Error().Err(err).Msg("failed to chmod")
+	}
+	if err := os.Chown(newData, cur.UID, cur.GID); err != nil {
+		log.Error().Err(err).Msg("failed to chown")
+	}
+
+	if err := exchangePaths(newData, dataDir); err != nil {
+		log.Error().Err(err).Str("path", dataDir).Msg("failed to swap volume data")
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to replace volume data: %w", err)
+	}
+
+	// newData now holds the previous data, preserved in the safety snapshot
+	if err := s.btrfs.SubvolumeDelete(ctx, newData); err != nil {
+		log.Warn().Err(err).Str("path", newData).Msg("failed to delete replaced subvolume")
+	}
+
+	var updated VolumeMetadata
+	if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) {
+		meta.UpdatedAt = now
+		updated = *meta
+	}); err != nil {
+		log.Error().Err(err).Msg("failed to update metadata")
+		return nil, nil, fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	log.Info().Str("tenant", tenant).Str("name", name).Str("snapshot", req.Snapshot).Str("safety_snapshot", safety.Name).Bool("forced", len(cur.Clients) > 0).Msg("volume rolled back")
+	return &updated, safety, nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollbackVolume(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T, bp string, vol VolumeMetadata) {
+		t.Helper()
+		volDir := setupUsageVol(t, bp, "vol", vol)
+		require.NoError(t, os.WriteFile(filepath.Join(volDir, config.DataDir, "current"), nil, 0o644))
+		setupUsageSnap(t, bp, "snap1", SnapshotMetadata{Name: "snap1", Volume: "vol", ReadOnly: true})
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		tests := []struct {
+			name string
+			vol  string
+			req  VolumeRollbackRequest
+			code string
+		}{
+			{name: "invalid_name", vol: "bad!", req: VolumeRollbackRequest{Snapshot: "snap1"}, code: ErrInvalid},
+			{name: "invalid_snapshot", vol: "vol", req: VolumeRollbackRequest{Snapshot: ""}, code: ErrInvalid},
+			{name: "volume_not_found", vol: "missing", req: VolumeRollbackRequest{Snapshot: "snap1"}, code: ErrNotFound},
+			{name: "snapshot_not_found", vol: "vol", req: VolumeRollbackRequest{Snapshot: "missing"}, code: ErrNotFound},
+			{name: "snapshot_other_volume", vol: "vol", req: VolumeRollbackRequest{Snapshot: "other"}, code: ErrInvalid},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s, bp, runner, _ := newTestStorage(t)
+				setup(t, bp, VolumeMetadata{Name: "vol", Mode: "2770"})
+				setupUsageSnap(t, bp, "other", SnapshotMetadata{Name: "other", Volume: "vol2", ReadOnly: true})
+
+				_, _, err := s.RollbackVolume(ctx, "test", tt.vol, tt.req)
+				requireStorageError(t, err, tt.code)
+				assert.Empty(t, runner.Calls)
+			})
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		s, bp := testStorageWithRunner(t, runner, nil)
+		s.quotaEnabled = true
+		setup(t, bp, VolumeMetadata{Name: "vol", SizeBytes: 1 << 30, QuotaBytes: 1 << 30, Compression: "zstd", Mode: "750", UID: os.Getuid(), GID: os.Getgid()})
+
+		meta, safety, err := s.RollbackVolume(ctx, "test", "vol", VolumeRollbackRequest{Snapshot: "snap1"})
+		require.NoError(t, err)
+
+		volDir := filepath.Join(bp, "vol")
+		dataDir := filepath.Join(volDir, config.DataDir)
+		newData := dataDir + ".new"
+		assert.Equal(t, "zstd", meta.Compression)
+		assert.Equal(t, uint64(1<<30), meta.QuotaBytes)
+		assert.NoFileExists(t, filepath.Join(dataDir, "current"), "data should be replaced")
+		assert.NoDirExists(t, newData)
+
+		info, err := os.Stat(dataDir)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(0o750), unixMode(info.Mode()), "mode is restored from metadata")
+
+		assert.True(t, strings.HasPrefix(safety.Name, "vol-pre-rollback-"))
+		assert.Equal(t, "vol", safety.Volume)
+		assert.True(t, readSnapMeta(t, filepath.Join(bp, config.SnapshotsDir, safety.Name)).ReadOnly)
+
+		assert.True(t, containsCall(runner.Calls, "subvolume", "snapshot", "-r", dataDir, filepath.Join(bp, config.SnapshotsDir, safety.Name, config.DataDir)))
+		assert.True(t, containsCall(runner.Calls, "subvolume", "snapshot", filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir), newData))
+		assert.True(t, containsCall(runner.Calls, "property", "set", newData, "compression", "zstd"))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", fmt.Sprintf("%d", 1<<30), newData))
+		assert.True(t, containsCall(runner.Calls, "subvolume", "delete", newData))
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setup(t, bp, VolumeMetadata{Name: "vol", Mode: "2770", Clients: []string{"10.0.0.1"}})
+
+		_, _, err := s.RollbackVolume(ctx, "test", "vol", VolumeRollbackRequest{Snapshot: "snap1"})
+		requireStorageError(t, err, ErrBusy)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("force_while_exported", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		s, bp := testStorageWithRunner(t, runner, nil)
+		setup(t, bp, VolumeMetadata{Name: "vol", Mode: "2770", NoCOW: true, Clients: []string{"10.0.0.1"}, UID: os.Getuid(), GID: os.Getgid()})
+
+		meta, _, err := s.RollbackVolume(ctx, "test", "vol", VolumeRollbackRequest{Snapshot: "snap1", Force: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1"}, meta.Clients, "exports are kept")
+		assert.True(t, containsCall(runner.Calls, "+C", filepath.Join(bp, "vol", config.DataDir+".new")))
+	})
+
+	t.Run("budget_used_up", func(t *testing.T) {
+		runner := receiveRunner(t, config.DataDir)
+		snapshot, qgroup := runner.RunFn, tenantQgroupRunFn("1/256 1048576 4096 1048576 none\n")
+		runner.RunFn = func(args []string) (string, error) {
+			if args[0] == "qgroup" && args[1] == "show" {
+				return qgroup(args)
+			}
+			return snapshot(args)
+		}
+		s, bp := testStorageWithRunner(t, runner, nil)
+		s.quotaEnabled = true
+		setup(t, bp, VolumeMetadata{Name: "vol", SizeBytes: 1 << 20, QuotaBytes: 1 << 20, GroupQgroup: "1/256", Mode: "2770", UID: os.Getuid(), GID: os.Getgid()})
+		_, err := s.CreateSnapshot(ctx, "test", SnapshotCreateRequest{Volume: "vol", Name: "snap2"})
+		requireStorageError(t, err, ErrQuotaExceeded)
+
+		// the safety snapshot is not held to the budget
+		_, safety, err := s.RollbackVolume(ctx, "test", "vol", VolumeRollbackRequest{Snapshot: "snap1"})
+		require.NoError(t, err)
+		assert.DirExists(t, filepath.Join(bp, config.SnapshotsDir, safety.Name))
+	})
+
+	t.Run("snapshot_fails", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setup(t, bp, VolumeMetadata{Name: "vol", Mode: "2770"})
+		runner.RunFn = func(args []string) (string, error) {
+			if args[0] == "subvolume" && args[1] == "snapshot" && args[2] != "-r" {
+				return "", fmt.Errorf("no space left")
+			}
+			if args[0] == "subvolume" && args[1] == "snapshot" {
+				return "", os.MkdirAll(args[len(args)-1], 0o755)
+			}
+			return "", nil
+		}
+
+		_, _, err := s.RollbackVolume(ctx, "test", "vol", VolumeRollbackRequest{Snapshot: "snap1"})
+		require.Error(t, err)
+		assert.FileExists(t, filepath.Join(bp, "vol", config.DataDir, "current"), "data should be untouched")
+		snaps, err := s.ListSnapshots("test", "vol")
+		require.NoError(t, err)
+		assert.Len(t, snaps, 1, "safety snapshot should be removed")
+	})
+}
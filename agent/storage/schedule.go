@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StartSnapshotScheduler periodically takes the snapshots due under each
+// volume's snapshot schedule and prunes the ones beyond its retention.
+func (s *Storage) StartSnapshotScheduler(ctx context.Context, interval time.Duration, tenant string) {
+	go func() {
+		s.runSnapshotSchedules(ctx, tenant, time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.runSnapshotSchedules(ctx, tenant, now)
+			}
+		}
+	}()
+}
+
+func (s *Storage) runSnapshotSchedules(ctx context.Context, tenant string, now time.Time) {
+	vols, err := s.ListVolumes(tenant)
+	if err != nil {
+		log.Error().Err(err).Str("tenant", tenant).Msg("snapshot scheduler: failed to list volumes")
+		return
+	}
+
+	var created, pruned, failed int
+	for _, vol := range vols {
+		// an empty schedule still prunes the snapshots taken under an earlier one
+		sched, err := utils.ParseSnapshotSchedule(vol.SnapshotSchedule)
+		if err != nil {
+			log.Warn().Err(err).Str("volume", vol.Name).Msg("snapshot scheduler: invalid schedule, skipping")
+			continue
+		}
+		snaps, err := s.ListSnapshots(tenant, vol.Name)
+		if err != nil {
+			log.Error().Err(err).Str("volume", vol.Name).Msg("snapshot scheduler: failed to list snapshots")
+			failed++
+			continue
+		}
+		c, p, f := s.applySnapshotSchedule(ctx, tenant, vol.Name, sched, snaps, now)
+		created += c
+		pruned += p
+		failed += f
+	}
+
+	if created > 0 || pruned > 0 || failed > 0 {
+		log.Info().Str("tenant", tenant).Int("created", created).Int("pruned", pruned).Int("failed", failed).Msg("snapshot scheduler: done")
+	}
+}
+
+// applySnapshotSchedule handles one volume. Only snapshots taken by the
+// scheduler are considered, manual and replication snapshots are never pruned.
+func (s *Storage) applySnapshotSchedule(ctx context.Context, tenant, volume string, sched utils.SnapshotSchedule, snaps []SnapshotMetadata, now time.Time) (created, pruned, failed int) {
+	byPeriod := map[string][]SnapshotMetadata{}
+	for _, snap := range snaps {
+		if snap.Schedule != "" {
+			byPeriod[snap.Schedule] = append(byPeriod[snap.Schedule], snap)
+		}
+	}
+
+	for _, period := range utils.SchedulePeriods {
+		keep := sched[period]
+		existing := byPeriod[period]
+		sort.Slice(existing, func(i, j int) bool { return existing[i].CreatedAt.After(existing[j].CreatedAt) })
+
+		if keep > 0 && (len(existing) == 0 || existing[0].CreatedAt.Before(utils.PeriodStart(period, now))) {
+			name := SnapshotName(volume, period+"-"+now.UTC().Format("20060102150405"))
+			meta, err := s.CreateSnapshot(ctx, tenant, SnapshotCreateRequest{Volume: volume, Name: name, Schedule: period})
+			if err != nil {
+				log.Error().Err(err).Str("volume", volume).Str("schedule", period).Msg("snapshot scheduler: failed to create snapshot")
+				failed++
+			} else {
+				existing = append([]SnapshotMetadata{*meta}, existing...)
+				created++
+			}
+		}
+
+		for i := keep; i < len(existing); i++ {
+			if err := s.DeleteSnapshot(ctx, tenant, existing[i].Name); err != nil {
+				log.Error().Err(err).Str("snapshot", existing[i].Name).Msg("snapshot scheduler: failed to prune snapshot")
+				failed++
+				continue
+			}
+			pruned++
+		}
+	}
+	return created, pruned, failed
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSnapshotSchedules(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 15, 13, 45, 0, 0, time.UTC)
+
+	scheduledSnaps := func(t *testing.T, s *Storage, volume, period string) []string {
+		t.Helper()
+		snaps, err := s.ListSnapshots("test", volume)
+		require.NoError(t, err)
+		var names []string
+		for _, snap := range snaps {
+			if snap.Schedule == period {
+				names = append(names, snap.Name)
+			}
+		}
+		return names
+	}
+
+	t.Run("creates_due_snapshots", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", Path: filepath.Join(bp, "vol1"), SnapshotSchedule: "hourly=2,daily=1"})
+
+		s.runSnapshotSchedules(ctx, "test", now)
+
+		assert.Equal(t, []string{"vol1-hourly-20260115134500"}, scheduledSnaps(t, s, "vol1", "hourly"))
+		assert.Equal(t, []string{"vol1-daily-20260115134500"}, scheduledSnaps(t, s, "vol1", "daily"))
+		assert.Empty(t, scheduledSnaps(t, s, "vol1", "weekly"))
+
+		snap := readSnapMeta(t, filepath.Join(bp, config.SnapshotsDir, "vol1-hourly-20260115134500"))
+		assert.Equal(t, "vol1", snap.Volume)
+		assert.True(t, snap.ReadOnly)
+	})
+
+	t.Run("not_due_within_period", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SnapshotSchedule: "hourly=2"})
+		setupUsageSnap(t, bp, "vol1-hourly-a", SnapshotMetadata{Name: "vol1-hourly-a", Volume: "vol1", Schedule: "hourly", CreatedAt: now.Add(-30 * time.Minute)})
+
+		s.runSnapshotSchedules(ctx, "test", now)
+
+		assert.Equal(t, []string{"vol1-hourly-a"}, scheduledSnaps(t, s, "vol1", "hourly"))
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("prunes_beyond_retention", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SnapshotSchedule: "hourly=2"})
+		for i, name := range []string{"vol1-hourly-a", "vol1-hourly-b", "vol1-hourly-c"} {
+			setupUsageSnap(t, bp, name, SnapshotMetadata{Name: name, Volume: "vol1", Schedule: "hourly", CreatedAt: now.Add(-time.Duration(i+1) * time.Hour)})
+		}
+		setupUsageSnap(t, bp, "manual", SnapshotMetadata{Name: "manual", Volume: "vol1", CreatedAt: now.Add(-48 * time.Hour)})
+
+		s.runSnapshotSchedules(ctx, "test", now)
+
+		assert.ElementsMatch(t, []string{"vol1-hourly-20260115134500", "vol1-hourly-a"}, scheduledSnaps(t, s, "vol1", "hourly"))
+		assert.Equal(t, []string{"manual"}, scheduledSnaps(t, s, "vol1", ""), "manual snapshots are never pruned")
+	})
+
+	t.Run("removed_period_is_pruned", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SnapshotSchedule: "daily=1"})
+		setupUsageSnap(t, bp, "vol1-hourly-a", SnapshotMetadata{Name: "vol1-hourly-a", Volume: "vol1", Schedule: "hourly", CreatedAt: now.Add(-time.Hour)})
+		setupUsageSnap(t, bp, "vol1-daily-a", SnapshotMetadata{Name: "vol1-daily-a", Volume: "vol1", Schedule: "daily", CreatedAt: now.Add(-time.Hour)})
+
+		s.runSnapshotSchedules(ctx, "test", now)
+
+		assert.Empty(t, scheduledSnaps(t, s, "vol1", "hourly"))
+		assert.Equal(t, []string{"vol1-daily-a"}, scheduledSnaps(t, s, "vol1", "daily"))
+	})
+
+	t.Run("cleared_schedule_is_pruned", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SnapshotSchedule: "hourly=2"})
+		setupUsageSnap(t, bp, "vol1-hourly-a", SnapshotMetadata{Name: "vol1-hourly-a", Volume: "vol1", Schedule: "hourly", CreatedAt: now.Add(-30 * time.Minute)})
+		setupUsageSnap(t, bp, "manual", SnapshotMetadata{Name: "manual", Volume: "vol1", CreatedAt: now.Add(-time.Hour)})
+
+		s.runSnapshotSchedules(ctx, "test", now)
+		assert.Equal(t, []string{"vol1-hourly-a"}, scheduledSnaps(t, s, "vol1", "hourly"))
+
+		_, err := s.UpdateVolume(ctx, "test", "vol1", VolumeUpdateRequest{SnapshotSchedule: ptrString("")})
+		require.NoError(t, err)
+		s.runSnapshotSchedules(ctx, "test", now)
+
+		assert.Empty(t, scheduledSnaps(t, s, "vol1", "hourly"))
+		assert.Equal(t, []string{"manual"}, scheduledSnaps(t, s, "vol1", ""), "manual snapshots are never pruned")
+		assert.False(t, containsCall(runner.Calls, "subvolume", "snapshot"), "no snapshot is taken without schedule")
+	})
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// scrubCheckInterval is how often the scrub scheduler checks whether a scrub is due.
+const scrubCheckInterval = 10 * time.Minute
+
+// ScrubStatus returns the state of the current or last scrub. A scrub always
+// covers the whole filesystem, not a single tenant.
+func (s *Storage) ScrubStatus(ctx context.Context) (*btrfs.ScrubStatus, error) {
+	st, err := s.btrfs.ScrubStatus(ctx, s.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("scrub status: %w", err)
+	}
+	s.setScrubStatus(st)
+	return &st, nil
+}
+
+// StartScrub starts a scrub of the filesystem in the background.
+func (s *Storage) StartScrub(ctx context.Context) (*btrfs.ScrubStatus, error) {
+	st, err := s.ScrubStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if st.Running() {
+		return nil, &StorageError{Code: ErrBusy, Message: "scrub is already running"}
+	}
+	if err := s.btrfs.ScrubStart(ctx, s.mountPoint); err != nil {
+		return nil, fmt.Errorf("scrub start: %w", err)
+	}
+	log.Info().Str("path", s.mountPoint).Msg("scrub started")
+	return s.ScrubStatus(ctx)
+}
+
+// CancelScrub cancels the running scrub.
+func (s *Storage) CancelScrub(ctx context.Context) (*btrfs.ScrubStatus, error) {
+	st, err := s.ScrubStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Running() {
+		return nil, &StorageError{Code: ErrInvalid, Message: "no scrub is running"}
+	}
+	if err := s.btrfs.ScrubCancel(ctx, s.mountPoint); err != nil {
+		return nil, fmt.Errorf("scrub cancel: %w", err)
+	}
+	log.Info().Str("path", s.mountPoint).Msg("scrub cancelled")
+	return s.ScrubStatus(ctx)
+}
+
+// StartScrubScheduler starts a scrub once per period (see utils.SchedulePeriods)
+// unless one already ran in the current period.
+func (s *Storage) StartScrubScheduler(ctx context.Context, period string) {
+	go func() {
+		s.runScrubSchedule(ctx, period, time.Now())
+		ticker := time.NewTicker(scrubCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.runScrubSchedule(ctx, period, now)
+			}
+		}
+	}()
+}
+
+func (s *Storage) runScrubSchedule(ctx context.Context, period string, now time.Time) {
+	st, err := s.ScrubStatus(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("scrub scheduler: failed to get scrub status")
+		return
+	}
+	if !scrubDue(*st, period, now) {
+		return
+	}
+	if _, err := s.StartScrub(ctx); err != nil {
+		log.Error().Err(err).Str("schedule", period).Msg("scrub scheduler: failed to start scrub")
+	}
+}
+
+// scrubDue reports whether no scrub ran in the period containing now. An
+// interrupted scrub (e.g. by a reboot) does not count, a cancelled one does.
+func scrubDue(st btrfs.ScrubStatus, period string, now time.Time) bool {
+	switch {
+	case st.Running():
+		return false
+	case st.StartedAt.IsZero(), st.Status == btrfs.ScrubInterrupted:
+		return true
+	}
+	return st.StartedAt.Before(utils.PeriodStart(period, now))
+}
+
+// setScrubStatus caches st for DeviceStats and updates the scrub metrics.
+func (s *Storage) setScrubStatus(st btrfs.ScrubStatus) {
+	s.cachedScrub.Store(&st)
+
+	running := 0.0
+	if st.Running() {
+		running = 1
+	}
+	ScrubRunningGauge.WithLabelValues(s.basePath).Set(running)
+	ScrubProgressRatio.WithLabelValues(s.basePath).Set(st.Progress())
+	ScrubErrorsFound.WithLabelValues(s.basePath).Set(float64(st.ErrorsFound))
+	ScrubErrorsCorrected.WithLabelValues(s.basePath).Set(float64(st.CorrectedErrors))
+	ScrubErrorsUncorrectable.WithLabelValues(s.basePath).Set(float64(st.UncorrectableErrors))
+	if t := st.CompletedAt(); !t.IsZero() {
+		ScrubLastCompletedTimestamp.WithLabelValues(s.basePath).Set(float64(t.Unix()))
+	}
+}
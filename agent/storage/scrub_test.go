@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrubRunner fakes `btrfs scrub status --raw` with the given status lines
+// and accepts scrub start and cancel.
+func scrubRunner(status string) func(args []string) (string, error) {
+	return func(args []string) (string, error) {
+		if args[0] == "scrub" && args[1] == "status" {
+			return status, nil
+		}
+		return "", nil
+	}
+}
+
+const (
+	scrubRunningOut  = "Scrub started:    Thu Jan 15 10:00:00 2026\nStatus:           running\nDuration:         0:10:00\nTotal to scrub:   1000\nBytes scrubbed:   250  (25.00%)\nError summary:    no errors found\n"
+	scrubFinishedOut = "Scrub started:    Thu Jan  1 10:00:00 2026\nStatus:           finished\nDuration:         1:00:00\nTotal to scrub:   1000\nError summary:    csum=3\n  Corrected:      2\n  Uncorrectable:  1\n"
+	scrubNeverOut    = "UUID:             2a8b4f1e-5c3d-4e6f-8a9b-0c1d2e3f4a5b\n\tno stats available\n"
+)
+
+func TestScrubDue(t *testing.T) {
+	now := time.Date(2026, 1, 15, 13, 45, 0, 0, time.UTC)
+	lastWeek := now.Add(-7 * 24 * time.Hour)
+	today := now.Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		st   btrfs.ScrubStatus
+		want bool
+	}{
+		{"never", btrfs.ScrubStatus{}, true},
+		{"running", btrfs.ScrubStatus{Status: btrfs.ScrubRunning, StartedAt: lastWeek}, false},
+		{"finished_last_week", btrfs.ScrubStatus{Status: btrfs.ScrubFinished, StartedAt: lastWeek}, true},
+		{"finished_this_week", btrfs.ScrubStatus{Status: btrfs.ScrubFinished, StartedAt: today}, false},
+		{"cancelled_this_week", btrfs.ScrubStatus{Status: btrfs.ScrubAborted, StartedAt: today}, false},
+		{"interrupted_this_week", btrfs.ScrubStatus{Status: btrfs.ScrubInterrupted, StartedAt: today}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, scrubDue(tt.st, "weekly", now))
+		})
+	}
+}
+
+func TestStartScrub(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("starts", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = scrubRunner(scrubFinishedOut)
+
+		_, err := s.StartScrub(ctx)
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "scrub", "start", s.mountPoint))
+	})
+
+	t.Run("already_running", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = scrubRunner(scrubRunningOut)
+
+		_, err := s.StartScrub(ctx)
+		requireStorageError(t, err, ErrBusy)
+		assert.False(t, containsCall(runner.Calls, "scrub", "start", s.mountPoint))
+	})
+
+	t.Run("cancel_not_running", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = scrubRunner(scrubFinishedOut)
+
+		_, err := s.CancelScrub(ctx)
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = scrubRunner(scrubRunningOut)
+
+		_, err := s.CancelScrub(ctx)
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "scrub", "cancel", s.mountPoint))
+	})
+}
+
+func TestRunScrubSchedule(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 15, 13, 45, 0, 0, time.UTC)
+
+	t.Run("due", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = scrubRunner(scrubNeverOut)
+
+		s.runScrubSchedule(ctx, "monthly", now)
+		assert.True(t, containsCall(runner.Calls, "scrub", "start", s.mountPoint))
+	})
+
+	t.Run("not_due", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		runner.RunFn = scrubRunner(scrubFinishedOut)
+
+		s.runScrubSchedule(ctx, "monthly", now)
+		assert.False(t, containsCall(runner.Calls, "scrub", "start", s.mountPoint))
+
+		assert.Equal(t, float64(3), testutil.ToFloat64(ScrubErrorsFound.WithLabelValues(s.basePath)))
+		assert.Equal(t, float64(2), testutil.ToFloat64(ScrubErrorsCorrected.WithLabelValues(s.basePath)))
+		assert.Equal(t, float64(1), testutil.ToFloat64(ScrubProgressRatio.WithLabelValues(s.basePath)))
+		completed := time.Date(2026, 1, 1, 11, 0, 0, 0, time.Local)
+		assert.Equal(t, float64(completed.Unix()), testutil.ToFloat64(ScrubLastCompletedTimestamp.WithLabelValues(s.basePath)))
+	})
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
@@ -13,6 +14,13 @@ import (
 )
 
 func (s *Storage) CreateSnapshot(ctx context.Context, tenant string, req SnapshotCreateRequest) (*SnapshotMetadata, error) {
+	return s.createSnapshot(ctx, tenant, req, true)
+}
+
+// createSnapshot creates a snapshot, checking the volume budget only with
+// checkBudget. Internal snapshots that must not fail on a full budget, like
+// the safety snapshot of a rollback, skip the check.
+func (s *Storage) createSnapshot(ctx context.Context, tenant string, req SnapshotCreateRequest, checkBudget bool) (*SnapshotMetadata, error) {
 	bp, err := s.tenantPath(tenant)
 	if err != nil {
 		return nil, err
@@ -39,6 +47,11 @@ func (s *Storage) CreateSnapshot(ctx context.Context, tenant string, req Snapsho
 	if _, err := os.Stat(snapDir); err == nil {
 		return nil, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("snapshot %q already exists", req.Name)}
 	}
+	if checkBudget {
+		if err := s.checkVolumeBudget(ctx, &volMeta); err != nil {
+			return nil, err
+		}
+	}
 
 	// operations
 	if err := os.MkdirAll(snapDir, s.defaultDirMode); err != nil {
@@ -47,7 +60,7 @@ func (s *Storage) CreateSnapshot(ctx context.Context, tenant string, req Snapsho
 	}
 
 	dstData := filepath.Join(snapDir, config.DataDir)
-	if err := s.btrfs.SubvolumeSnapshot(ctx, srcData, dstData, true); err != nil {
+	if err := s.btrfs.SubvolumeSnapshot(ctx, srcData, dstData, true, s.volumeInherit(tenant, &volMeta)...); err != nil {
 		_ = os.RemoveAll(snapDir)
 		log.Error().Err(err).Msg("failed to create snapshot")
 		return nil, fmt.Errorf("btrfs snapshot failed: %w", err)
@@ -60,6 +73,7 @@ func (s *Storage) CreateSnapshot(ctx context.Context, tenant string, req Snapsho
 		Path:      filepath.Join(filepath.Dir(volMeta.Path), config.SnapshotsDir, req.Name),
 		SizeBytes: volMeta.SizeBytes,
 		ReadOnly:  true,
+		Schedule:  req.Schedule,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -157,3 +171,60 @@ func (s *Storage) DeleteSnapshot(ctx context.Context, tenant, name string) error
 	log.Info().Str("tenant", tenant).Str("name", name).Msg("snapshot deleted")
 	return nil
 }
+
+// SendSnapshot streams a btrfs send stream of a read-only snapshot to w.
+// If parent is set, an incremental stream against that snapshot is sent;
+// both snapshots must belong to the same volume.
+// Nothing is written to w if validation fails.
+func (s *Storage) SendSnapshot(ctx context.Context, tenant, name, parent string, w io.Writer) error {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return err
+	}
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	meta, err := s.readSendableSnapshot(bp, name)
+	if err != nil {
+		return err
+	}
+
+	var parentData string
+	if parent != "" {
+		if err := validateName(parent); err != nil {
+			return err
+		}
+		if parent == name {
+			return &StorageError{Code: ErrInvalid, Message: "parent must differ from the sent snapshot"}
+		}
+		parentMeta, err := s.readSendableSnapshot(bp, parent)
+		if err != nil {
+			return err
+		}
+		if parentMeta.Volume != meta.Volume {
+			return &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("parent snapshot %q belongs to volume %q, not %q", parent, parentMeta.Volume, meta.Volume)}
+		}
+		parentData = filepath.Join(bp, config.SnapshotsDir, parent, config.DataDir)
+	}
+
+	dataDir := filepath.Join(bp, config.SnapshotsDir, name, config.DataDir)
+	if err := s.btrfs.Send(ctx, dataDir, parentData, w); err != nil {
+		log.Error().Err(err).Str("snapshot", name).Str("parent", parent).Msg("failed to send snapshot")
+		return fmt.Errorf("btrfs send failed: %w", err)
+	}
+
+	log.Info().Str("tenant", tenant).Str("name", name).Str("parent", parent).Msg("snapshot sent")
+	return nil
+}
+
+func (s *Storage) readSendableSnapshot(bp, name string) (*SnapshotMetadata, error) {
+	var meta SnapshotMetadata
+	if err := ReadMetadata(filepath.Join(bp, config.SnapshotsDir, name, config.MetadataFile), &meta); err != nil {
+		return nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("snapshot %q not found", name)}
+	}
+	if !meta.ReadOnly {
+		return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("snapshot %q is not read-only", name)}
+	}
+	return &meta, nil
+}
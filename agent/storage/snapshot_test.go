@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -256,3 +258,109 @@ func TestDeleteSnapshot(t *testing.T) {
 		assert.False(t, os.IsNotExist(statErr), "snapDir should still exist when subvol delete fails")
 	})
 }
+
+// --- TestSendSnapshot ---
+
+func TestSendSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	setupSnapOf := func(t *testing.T, bp, name, volume string, readonly bool) string {
+		t.Helper()
+		snapDir := filepath.Join(bp, config.SnapshotsDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Join(snapDir, config.DataDir), 0o755))
+		writeSnapshotMetadata(t, snapDir, SnapshotMetadata{Name: name, Volume: volume, ReadOnly: readonly})
+		return snapDir
+	}
+	setupSnap := func(t *testing.T, bp, name string, readonly bool) string {
+		t.Helper()
+		return setupSnapOf(t, bp, name, "srcvol", readonly)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		snapDir := setupSnap(t, bp, "snap1", true)
+		runner.Out = "btrfs-stream"
+
+		var buf bytes.Buffer
+		require.NoError(t, s.SendSnapshot(ctx, "test", "snap1", "", &buf))
+		assert.Equal(t, "btrfs-stream", buf.String())
+
+		require.Len(t, runner.Calls, 1)
+		assert.Equal(t, []string{"send", "-q", filepath.Join(snapDir, config.DataDir)}, runner.Calls[0])
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+
+		err := s.SendSnapshot(ctx, "test", "nope", "", io.Discard)
+		requireStorageError(t, err, ErrNotFound)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("not_readonly", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupSnap(t, bp, "rw", false)
+
+		err := s.SendSnapshot(ctx, "test", "rw", "", io.Discard)
+		requireStorageError(t, err, ErrInvalid)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("incremental", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		parentDir := setupSnap(t, bp, "snap1", true)
+		snapDir := setupSnap(t, bp, "snap2", true)
+
+		require.NoError(t, s.SendSnapshot(ctx, "test", "snap2", "snap1", io.Discard))
+		require.Len(t, runner.Calls, 1)
+		assert.Equal(t, []string{"send", "-q", "-p", filepath.Join(parentDir, config.DataDir), filepath.Join(snapDir, config.DataDir)}, runner.Calls[0])
+	})
+
+	t.Run("parent_not_found", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupSnap(t, bp, "snap2", true)
+
+		err := s.SendSnapshot(ctx, "test", "snap2", "nope", io.Discard)
+		requireStorageError(t, err, ErrNotFound)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("parent_other_volume", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupSnapOf(t, bp, "other", "othervol", true)
+		setupSnap(t, bp, "snap2", true)
+
+		err := s.SendSnapshot(ctx, "test", "snap2", "other", io.Discard)
+		requireStorageError(t, err, ErrInvalid)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("parent_not_readonly", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupSnap(t, bp, "rw", false)
+		setupSnap(t, bp, "snap2", true)
+
+		err := s.SendSnapshot(ctx, "test", "snap2", "rw", io.Discard)
+		requireStorageError(t, err, ErrInvalid)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("parent_is_self", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupSnap(t, bp, "snap1", true)
+
+		err := s.SendSnapshot(ctx, "test", "snap1", "snap1", io.Discard)
+		requireStorageError(t, err, ErrInvalid)
+		assert.Empty(t, runner.Calls)
+	})
+
+	t.Run("btrfs_fails", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupSnap(t, bp, "snap1", true)
+		runner.Err = fmt.Errorf("send error")
+
+		err := s.SendSnapshot(ctx, "test", "snap1", "", io.Discard)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "btrfs send failed")
+	})
+}
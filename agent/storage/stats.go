@@ -35,6 +35,8 @@ type DeviceState struct {
 type DeviceStats struct {
 	Devices    []DeviceState
 	Filesystem btrfs.FilesystemUsage
+	Scrub      btrfs.ScrubStatus
+	Balance    btrfs.BalanceStatus
 }
 
 // readDeviceIOStats reads /sys/block/<dev>/stat and returns IO counters.
@@ -196,7 +198,8 @@ func (s *Storage) updateDeviceIO(ctx context.Context) {
 	}
 }
 
-// StartDeviceStatsUpdater polls btrfs device errors and filesystem usage (default 1m).
+// StartDeviceStatsUpdater polls btrfs device errors, filesystem usage,
+// scrub and balance status (default 1m).
 func (s *Storage) StartDeviceStatsUpdater(ctx context.Context, interval time.Duration) {
 	go func() {
 		s.updateBtrfsStats(ctx)
@@ -217,6 +220,8 @@ func (s *Storage) updateBtrfsStats(ctx context.Context) {
 	// 1. fetch from kernel
 	errs, errErr := s.btrfs.DeviceErrors(ctx, s.basePath)
 	fu, fuErr := s.btrfs.FilesystemUsage(ctx, s.mountPoint)
+	scrub, scrubErr := s.btrfs.ScrubStatus(ctx, s.mountPoint)
+	balance, balanceErr := s.btrfs.BalanceStatus(ctx, s.mountPoint)
 
 	// 2. load cache, merge, store (only on success, preserve previous values on error)
 	if errErr == nil {
@@ -266,6 +271,18 @@ func (s *Storage) updateBtrfsStats(ctx context.Context) {
 		FilesystemDataRatio.WithLabelValues(s.basePath).Set(fu.DataRatio)
 	}
 
+	if scrubErr != nil {
+		log.Warn().Err(scrubErr).Msg("device stats updater: btrfs scrub status failed")
+	} else {
+		s.setScrubStatus(scrub)
+	}
+
+	if balanceErr != nil {
+		log.Warn().Err(balanceErr).Msg("device stats updater: btrfs balance status failed")
+	} else {
+		s.setBalanceStatus(balance)
+	}
+
 	log.Debug().Msg("device stats updater: metrics updated")
 }
 
@@ -286,8 +303,8 @@ func (s *Storage) IsDegraded() bool {
 	return false
 }
 
-// DeviceStats returns cached per-device IO/error stats and filesystem usage.
-// IO stats are updated by the IO poller (5s), errors and filesystem by the stats poller (1m).
+// DeviceStats returns cached per-device IO/error stats, filesystem usage, scrub and balance status.
+// IO stats are updated by the IO poller (5s), everything else by the stats poller (1m).
 func (s *Storage) DeviceStats(ctx context.Context) (*DeviceStats, error) {
 	devs := s.cachedDevices.Load()
 	if devs == nil {
@@ -297,5 +314,11 @@ func (s *Storage) DeviceStats(ctx context.Context) (*DeviceStats, error) {
 	if fu := s.cachedFilesystem.Load(); fu != nil {
 		ds.Filesystem = *fu
 	}
+	if scrub := s.cachedScrub.Load(); scrub != nil {
+		ds.Scrub = *scrub
+	}
+	if balance := s.cachedBalance.Load(); balance != nil {
+		ds.Balance = *balance
+	}
 	return ds, nil
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -18,6 +19,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// QuotaModeAuto uses whichever quota mode is enabled on the filesystem.
+const QuotaModeAuto = "auto"
+
 // Storage encapsulates all btrfs volume, snapshot, and clone operations.
 type Storage struct {
 	basePath        string
@@ -25,7 +29,6 @@ type Storage struct {
 	quotaEnabled    bool
 	btrfs           *btrfs.Manager
 	exporter        nfs.Exporter
-	tenants         []string
 	defaultDirMode  os.FileMode
 	defaultDataMode string
 
@@ -37,9 +40,42 @@ type Storage struct {
 	// (max 5s for IO, max 1m for errors).
 	cachedDevices    atomic.Pointer[[]DeviceState]
 	cachedFilesystem atomic.Pointer[btrfs.FilesystemUsage]
+	cachedScrub      atomic.Pointer[btrfs.ScrubStatus]
+	cachedBalance    atomic.Pointer[btrfs.BalanceStatus]
+
+	// lastAutoBalance is only used by the auto balancer goroutine.
+	lastAutoBalance time.Time
+
+	// defragJobs holds the current or last defragment per "tenant/volume".
+	defragMu           sync.Mutex
+	defragJobs         map[string]*defragJob
+	recompressOnChange bool
+
+	// dedupeJobs holds the current or last dedupe per tenant.
+	dedupeMu        sync.Mutex
+	dedupeJobs      map[string]*dedupeJob
+	dedupeRateLimit uint64
+
+	// trashRetention moves deleted volumes to the trash if set.
+	trashRetention time.Duration
+
+	// tenantsMu guards the tenants, their tokens, qgroups and workers, which
+	// change at runtime through the tenant API. tenantAdminMu serializes
+	// these changes and the writes of the tenant store.
+	tenantsMu     sync.RWMutex
+	tenantAdminMu sync.Mutex
+	tenants       []string
+	tenantRecords []Tenant
+	tenantCancel  map[string]context.CancelFunc
+	workers       *tenantWorkers
+
+	// tenantQgroups maps each tenant to its level 1 qgroup, set up with
+	// quota enabled. tenantLimits holds the non-zero limits.
+	tenantQgroups map[string]string
+	tenantLimits  map[string]uint64
 }
 
-func New(basePath string, quotaEnabled bool, exporter nfs.Exporter, tenants []string, dirMode, dataMode, btrfsBin string) *Storage {
+func New(basePath string, quotaEnabled bool, quotaMode string, exporter nfs.Exporter, seed []Tenant, dirMode, dataMode, btrfsBin, btrfsBackend string) *Storage {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -69,21 +105,51 @@ func New(basePath string, quotaEnabled bool, exporter nfs.Exporter, tenants []st
 	if !mgr.IsAvailable(ctx) {
 		log.Fatal().Msg("btrfs tools not found - is btrfs-progs installed?")
 	}
+	switch btrfsBackend {
+	case string(btrfs.BackendCLI):
+	case string(btrfs.BackendIoctl):
+		if err := btrfs.ProbeIoctl(basePath); err != nil {
+			log.Warn().Err(err).Str("path", basePath).Msg("btrfs ioctl backend unavailable, falling back to btrfs-progs")
+		} else {
+			mgr.SetBackend(btrfs.BackendIoctl)
+		}
+	default:
+		log.Fatal().Str("backend", btrfsBackend).Msg("invalid btrfs backend, must be one of: cli, ioctl")
+	}
+	log.Info().Str("backend", string(mgr.Backend())).Msg("btrfs backend selected")
 	if exporter == nil {
 		log.Fatal().Msg("exporter must not be nil")
 	}
 
 	if quotaEnabled {
-		if err := mgr.QuotaCheck(ctx, basePath); err != nil {
-			log.Fatal().Str("path", basePath).Msg("AGENT_FEATURE_QUOTA_ENABLED=true but btrfs quota is not enabled (run: btrfs quota enable " + basePath + ")")
+		enable := "btrfs quota enable "
+		switch quotaMode {
+		case QuotaModeAuto, string(btrfs.QuotaModeQgroup):
+		case string(btrfs.QuotaModeSimple):
+			enable = "btrfs quota enable --simple "
+		default:
+			log.Fatal().Str("mode", quotaMode).Msg("invalid quota mode, must be one of: auto, qgroup, simple")
 		}
+		detected, err := mgr.DetectQuotaMode(ctx, basePath)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", basePath).Msg("AGENT_FEATURE_QUOTA_ENABLED=true but btrfs quota is not enabled (run: " + enable + basePath + ")")
+		}
+		if quotaMode != QuotaModeAuto && quotaMode != string(detected) {
+			log.Fatal().Str("configured", quotaMode).Str("detected", string(detected)).Msg("AGENT_FEATURE_QUOTA_MODE does not match the quota mode enabled on the filesystem")
+		}
+		mgr.SetQuotaMode(detected)
+		log.Info().Str("mode", string(detected)).Msg("btrfs quota enabled")
 	}
 
-	for _, name := range tenants {
-		if err := validateName(name); err != nil {
-			log.Fatal().Str("tenant", name).Msg("invalid tenant name")
+	tenants, err := loadTenantStore(basePath, seed)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load tenant store")
+	}
+	for _, t := range tenants {
+		if err := validateName(t.Name); err != nil {
+			log.Fatal().Str("tenant", t.Name).Msg("invalid tenant name")
 		}
-		td := filepath.Join(basePath, name)
+		td := filepath.Join(basePath, t.Name)
 		if err := os.MkdirAll(td, os.FileMode(parsedDirMode)); err != nil {
 			log.Fatal().Err(err).Str("path", td).Msg("failed to create tenant directory")
 		}
@@ -109,29 +175,89 @@ func New(basePath string, quotaEnabled bool, exporter nfs.Exporter, tenants []st
 	for i, d := range devices {
 		initialStates[i] = DeviceState{BTRFSDevice: d}
 	}
-	s := &Storage{basePath: basePath, mountPoint: mountPoint, quotaEnabled: quotaEnabled, btrfs: mgr, exporter: exporter, tenants: tenants, defaultDirMode: os.FileMode(parsedDirMode), defaultDataMode: dataMode}
+	s := &Storage{basePath: basePath, mountPoint: mountPoint, quotaEnabled: quotaEnabled, btrfs: mgr, exporter: exporter, defaultDirMode: os.FileMode(parsedDirMode), defaultDataMode: dataMode}
 	s.cachedDevices.Store(&initialStates)
-	return s
-}
+	s.setTenantRecords(tenants)
 
-func (s *Storage) StartWorkers(ctx context.Context, usageInterval, reconcileInterval, deviceIOInterval, deviceStatsInterval time.Duration) {
-	for _, tenant := range s.tenants {
-		bp := filepath.Join(s.basePath, tenant)
-		if s.quotaEnabled {
-			StartUsageUpdater(ctx, s.btrfs, bp, usageInterval, tenant)
+	limits := make(map[string]uint64)
+	for _, t := range tenants {
+		if t.LimitBytes > 0 {
+			limits[t.Name] = t.LimitBytes
 		}
-		if reconcileInterval > 0 {
-			s.StartNFSReconciler(ctx, bp, reconcileInterval, tenant)
+	}
+	if quotaEnabled {
+		// assigning existing subvolumes may rescan the quota, no timeout
+		if err := s.setupTenantQgroups(context.Background(), limits); err != nil {
+			log.Fatal().Err(err).Msg("failed to set up tenant qgroups")
 		}
+	} else if len(limits) > 0 {
+		log.Warn().Msg("tenant limits require AGENT_FEATURE_QUOTA_ENABLED=true, ignored")
+	}
+	return s
+}
+
+// WorkerConfig configures the background workers started by StartWorkers.
+// Workers with a zero interval, schedule or threshold are not started,
+// except the usage and device updaters, which require a positive interval.
+type WorkerConfig struct {
+	UsageInterval          time.Duration
+	ReconcileInterval      time.Duration
+	DeviceIOInterval       time.Duration
+	DeviceStatsInterval    time.Duration
+	ScheduleInterval       time.Duration
+	ConsistencyInterval    time.Duration
+	CorruptionScanInterval time.Duration
+	ScrubSchedule          string
+	// AutoBalanceMinUnallocated starts a balance with AutoBalanceUsage once
+	// the unallocated space drops below it.
+	AutoBalanceMinUnallocated uint64
+	AutoBalanceUsage          int
+}
+
+func (s *Storage) StartWorkers(ctx context.Context, cfg WorkerConfig) {
+	s.tenantsMu.Lock()
+	s.workers = &tenantWorkers{
+		ctx:                 ctx,
+		usageInterval:       cfg.UsageInterval,
+		reconcileInterval:   cfg.ReconcileInterval,
+		scheduleInterval:    cfg.ScheduleInterval,
+		consistencyInterval: cfg.ConsistencyInterval,
+	}
+	s.tenantsMu.Unlock()
+	for _, tenant := range s.Tenants() {
+		s.startTenantWorkers(tenant)
+	}
+	s.StartDeviceIOUpdater(ctx, cfg.DeviceIOInterval)
+	s.StartDeviceStatsUpdater(ctx, cfg.DeviceStatsInterval)
+	if cfg.ScrubSchedule != "" {
+		s.StartScrubScheduler(ctx, cfg.ScrubSchedule)
+	}
+	if cfg.CorruptionScanInterval > 0 {
+		s.StartCorruptionScanner(ctx, cfg.CorruptionScanInterval)
+	}
+	if cfg.ConsistencyInterval > 0 && s.quotaEnabled {
+		s.StartFilesystemConsistencyChecker(ctx, cfg.ConsistencyInterval)
+	}
+	if cfg.AutoBalanceMinUnallocated > 0 {
+		s.StartAutoBalancer(ctx, cfg.AutoBalanceMinUnallocated, cfg.AutoBalanceUsage)
 	}
-	s.StartDeviceIOUpdater(ctx, deviceIOInterval)
-	s.StartDeviceStatsUpdater(ctx, deviceStatsInterval)
 }
 
 func (s *Storage) BasePath() string       { return s.basePath }
 func (s *Storage) QuotaEnabled() bool     { return s.quotaEnabled }
 func (s *Storage) Exporter() nfs.Exporter { return s.exporter }
 
+// QuotaMode returns the quota accounting mode in use, empty if quota is disabled.
+func (s *Storage) QuotaMode() btrfs.QuotaMode {
+	if !s.quotaEnabled {
+		return ""
+	}
+	return s.btrfs.QuotaMode()
+}
+
+// Backend returns the btrfs backend in use, see AGENT_BTRFS_BACKEND.
+func (s *Storage) Backend() btrfs.Backend { return s.btrfs.Backend() }
+
 func (s *Storage) tenantPath(tenant string) (string, error) {
 	if err := validateName(tenant); err != nil {
 		return "", err
@@ -149,6 +275,10 @@ type FsStats struct {
 	TotalBytes uint64
 	UsedBytes  uint64
 	FreeBytes  uint64
+	// TrashVolumes and TrashUsedBytes count the deleted volumes of the
+	// tenant still in the trash, their space is included in UsedBytes.
+	TrashVolumes   int
+	TrashUsedBytes uint64
 }
 
 func (s *Storage) Stats(tenant string) (*FsStats, error) {
@@ -165,9 +295,16 @@ func (s *Storage) Stats(tenant string) (*FsStats, error) {
 	total := st.Blocks * uint64(st.Bsize)
 	free := st.Bavail * uint64(st.Bsize)
 
+	trashVolumes, trashUsed, err := trashUsage(bp)
+	if err != nil {
+		return nil, err
+	}
+
 	return &FsStats{
-		TotalBytes: total,
-		UsedBytes:  total - free,
-		FreeBytes:  free,
+		TotalBytes:     total,
+		UsedBytes:      total - free,
+		FreeBytes:      free,
+		TrashVolumes:   trashVolumes,
+		TrashUsedBytes: trashUsed,
 	}, nil
 }
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// tenantStateFile records the level 1 qgroup of a tenant, so it keeps
+	// the same qgroup across restarts and changes of AGENT_TENANTS.
+	tenantStateFile = ".tenant.json"
+	// tenantQgroupMax is the highest level 1 qgroup ID handed to tenants.
+	// Subvolume IDs start at 256, qgroups named after a subvolume never
+	// collide with a tenant.
+	tenantQgroupMax = 255
+)
+
+type tenantState struct {
+	QgroupID string `json:"qgroup_id"`
+}
+
+// setupTenantQgroups creates the level 1 qgroup of every tenant and applies
+// its limit. Volumes and snapshots of a tenant whose qgroup is new, e.g.
+// after upgrading, are assigned to it.
+func (s *Storage) setupTenantQgroups(ctx context.Context, limits map[string]uint64) error {
+	existing, claimed, err := s.tenantQgroupsInUse(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tenant := range s.Tenants() {
+		if err := s.setupTenantQgroup(ctx, tenant, limits[tenant], existing, claimed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantQgroupsInUse returns the existing level 1 qgroups and those recorded
+// by a tenant directory.
+func (s *Storage) tenantQgroupsInUse(ctx context.Context) (map[uint64]bool, map[uint64]bool, error) {
+	ids, err := s.btrfs.QgroupGroupIDs(ctx, s.mountPoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list qgroups: %w", err)
+	}
+	existing := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		existing[id] = true
+	}
+	claimed, err := s.claimedTenantQgroups()
+	if err != nil {
+		return nil, nil, err
+	}
+	return existing, claimed, nil
+}
+
+func (s *Storage) setupTenantQgroup(ctx context.Context, tenant string, limit uint64, existing, claimed map[uint64]bool) error {
+	statePath := filepath.Join(s.basePath, tenant, tenantStateFile)
+	var state tenantState
+	if err := ReadMetadata(statePath, &state); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read %s: %w", statePath, err)
+	}
+
+	created := false
+	if state.QgroupID == "" {
+		id, ok := nextTenantQgroup(existing, claimed)
+		if !ok {
+			return fmt.Errorf("no free level 1 qgroup for tenant %q, all of 1/1-1/%d are in use", tenant, tenantQgroupMax)
+		}
+		state.QgroupID = fmt.Sprintf("1/%d", id)
+		claimed[id] = true
+		if err := writeMetadataAtomic(statePath, state); err != nil {
+			return fmt.Errorf("write %s: %w", statePath, err)
+		}
+	}
+	if id, ok := tenantQgroupNumber(state.QgroupID); !ok {
+		return fmt.Errorf("invalid qgroup_id %q in %s", state.QgroupID, statePath)
+	} else if !existing[id] {
+		if err := s.btrfs.QgroupCreate(ctx, state.QgroupID, s.mountPoint); err != nil {
+			return fmt.Errorf("create qgroup %s for tenant %q: %w", state.QgroupID, tenant, err)
+		}
+		existing[id] = true
+		created = true
+	}
+
+	if err := s.btrfs.QgroupLimitGroup(ctx, state.QgroupID, limit, s.mountPoint); err != nil {
+		return fmt.Errorf("limit qgroup %s for tenant %q: %w", state.QgroupID, tenant, err)
+	}
+	s.tenantsMu.Lock()
+	if s.tenantQgroups == nil {
+		s.tenantQgroups = make(map[string]string)
+		s.tenantLimits = make(map[string]uint64)
+	}
+	s.tenantQgroups[tenant] = state.QgroupID
+	if limit > 0 {
+		s.tenantLimits[tenant] = limit
+	} else {
+		delete(s.tenantLimits, tenant)
+	}
+	s.tenantsMu.Unlock()
+
+	if created {
+		s.assignTenantSubvolumes(ctx, tenant)
+	}
+	log.Info().Str("tenant", tenant).Str("qgroup", state.QgroupID).Uint64("limit", limit).Bool("created", created).Msg("tenant qgroup ready")
+	return nil
+}
+
+// claimedTenantQgroups returns the qgroups recorded by any tenant directory,
+// including tenants no longer configured, so their qgroup is not reused.
+func (s *Storage) claimedTenantQgroups() (map[uint64]bool, error) {
+	entries, err := os.ReadDir(s.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base path: %w", err)
+	}
+	claimed := make(map[uint64]bool)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		var state tenantState
+		if err := ReadMetadata(filepath.Join(s.basePath, e.Name(), tenantStateFile), &state); err != nil {
+			continue
+		}
+		if id, ok := tenantQgroupNumber(state.QgroupID); ok {
+			claimed[id] = true
+		}
+	}
+	return claimed, nil
+}
+
+func nextTenantQgroup(existing, claimed map[uint64]bool) (uint64, bool) {
+	for id := uint64(1); id <= tenantQgroupMax; id++ {
+		if !existing[id] && !claimed[id] {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// tenantQgroupNumber returns N of the level 1 qgroup 1/N.
+func tenantQgroupNumber(qgroupID string) (uint64, bool) {
+	raw, ok := strings.CutPrefix(qgroupID, "1/")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	return id, err == nil && id > 0
+}
+
+// assignTenantSubvolumes assigns the data subvolumes of all volumes,
+// snapshots and trash entries of tenant to its qgroup.
+func (s *Storage) assignTenantSubvolumes(ctx context.Context, tenant string) {
+	bp := filepath.Join(s.basePath, tenant)
+	var dirs []string
+	for _, parent := range []string{bp, filepath.Join(bp, config.SnapshotsDir), filepath.Join(bp, config.TrashDir)} {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() || (parent == bp && (e.Name() == config.SnapshotsDir || e.Name() == config.TrashDir)) {
+				continue
+			}
+			dirs = append(dirs, filepath.Join(parent, e.Name(), config.DataDir))
+		}
+	}
+
+	var assigned int
+	for _, dataDir := range dirs {
+		if !s.btrfs.SubvolumeExists(ctx, dataDir) {
+			continue
+		}
+		if err := s.assignTenantQgroup(ctx, tenant, dataDir); err != nil {
+			log.Warn().Err(err).Str("tenant", tenant).Str("path", dataDir).Msg("failed to assign subvolume to tenant qgroup")
+			continue
+		}
+		assigned++
+	}
+	log.Info().Str("tenant", tenant).Int("subvolumes", assigned).Msg("existing subvolumes assigned to tenant qgroup")
+}
+
+// assignTenantQgroup adds the existing subvolume at path to the qgroup of
+// tenant, so it counts against the tenant limit. No-op without quota. The
+// assign may cost a quota rescan, new subvolumes join with tenantInherit.
+func (s *Storage) assignTenantQgroup(ctx context.Context, tenant, path string) error {
+	qgroupID, ok := s.tenantQgroup(tenant)
+	if !s.quotaEnabled || !ok {
+		return nil
+	}
+	return s.btrfs.QgroupAssign(ctx, path, qgroupID)
+}
+
+// tenantInherit returns the qgroups a new subvolume of tenant joins on
+// creation, empty without quota.
+func (s *Storage) tenantInherit(tenant string) []string {
+	qgroupID, ok := s.tenantQgroup(tenant)
+	if !s.quotaEnabled || !ok {
+		return nil
+	}
+	return []string{qgroupID}
+}
+
+// TenantUsage returns the space used by the volumes and snapshots of a
+// tenant, nil if quota is disabled.
+func (s *Storage) TenantUsage(ctx context.Context, tenant string) (*TenantUsage, error) {
+	if _, err := s.tenantPath(tenant); err != nil {
+		return nil, err
+	}
+	qgroupID, ok := s.tenantQgroup(tenant)
+	if !s.quotaEnabled || !ok {
+		return nil, nil
+	}
+	info, found, err := s.btrfs.QgroupGroupUsage(ctx, qgroupID, s.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("qgroup usage failed: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("qgroup %s of tenant %q not found", qgroupID, tenant)
+	}
+	s.tenantsMu.RLock()
+	limit := s.tenantLimits[tenant]
+	s.tenantsMu.RUnlock()
+	return &TenantUsage{QgroupID: qgroupID, UsedBytes: info.Referenced, LimitBytes: limit}, nil
+}
+
+func (s *Storage) tenantQgroup(tenant string) (string, bool) {
+	s.tenantsMu.RLock()
+	defer s.tenantsMu.RUnlock()
+	qgroupID, ok := s.tenantQgroups[tenant]
+	return qgroupID, ok
+}
+
+// StartTenantUsageUpdater periodically exports the usage of the tenant qgroup.
+func (s *Storage) StartTenantUsageUpdater(ctx context.Context, interval time.Duration, tenant string) {
+	go func() {
+		s.updateTenantUsage(ctx, tenant)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.updateTenantUsage(ctx, tenant)
+			}
+		}
+	}()
+}
+
+func (s *Storage) updateTenantUsage(ctx context.Context, tenant string) {
+	usage, err := s.TenantUsage(ctx, tenant)
+	if err != nil {
+		log.Warn().Err(err).Str("tenant", tenant).Msg("tenant usage updater: failed to get usage")
+		return
+	}
+	if usage == nil {
+		return
+	}
+	TenantUsedBytes.WithLabelValues(tenant).Set(float64(usage.UsedBytes))
+	TenantLimitBytes.WithLabelValues(tenant).Set(float64(usage.LimitBytes))
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tenantQgroupRunFn fakes `qgroup show` with the given output and resolves
+// every subvolume to ID 256.
+func tenantQgroupRunFn(show string) func([]string) (string, error) {
+	return func(args []string) (string, error) {
+		switch {
+		case args[0] == "subvolume" && args[1] == "show":
+			return "Subvolume ID:\t\t\t256\n", nil
+		case args[0] == "qgroup" && args[1] == "show":
+			return show, nil
+		}
+		return "", nil
+	}
+}
+
+// callsOf returns the calls starting with args.
+func callsOf(calls [][]string, args ...string) [][]string {
+	var out [][]string
+	for _, c := range calls {
+		if len(c) >= len(args) && slices.Equal(c[:len(args)], args) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func TestTenantQgroups(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T, show string) (*Storage, string, *utils.MockRunner) {
+		s, bp, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		runner.RunFn = tenantQgroupRunFn(show)
+		return s, bp, runner
+	}
+
+	t.Run("creates_and_assigns_existing", func(t *testing.T) {
+		// 1/1 belongs to someone else
+		s, bp, runner := setup(t, "0/5 16384 16384\n1/1 0 0\n")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+		setupUsageSnap(t, bp, "snap1", SnapshotMetadata{Name: "snap1", Volume: "vol1"})
+
+		require.NoError(t, s.setupTenantQgroups(ctx, map[string]uint64{"test": 1 << 30}))
+		assert.Equal(t, "1/2", s.tenantQgroups["test"])
+		assert.True(t, containsCall(runner.Calls, "qgroup", "create", "1/2", s.mountPoint))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "1073741824", "1/2", s.mountPoint))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "assign", "0/256", "1/2", filepath.Join(bp, "vol1", config.DataDir)))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "assign", "0/256", "1/2", filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir)))
+
+		var state tenantState
+		require.NoError(t, ReadMetadata(filepath.Join(bp, tenantStateFile), &state))
+		assert.Equal(t, "1/2", state.QgroupID)
+	})
+
+	t.Run("keeps_existing_qgroup", func(t *testing.T) {
+		s, bp, runner := setup(t, "1/7 0 0\n")
+		require.NoError(t, writeMetadataAtomic(filepath.Join(bp, tenantStateFile), tenantState{QgroupID: "1/7"}))
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+
+		require.NoError(t, s.setupTenantQgroups(ctx, nil))
+		assert.Equal(t, "1/7", s.tenantQgroups["test"])
+		assert.Empty(t, callsOf(runner.Calls, "qgroup", "create"))
+		assert.Empty(t, callsOf(runner.Calls, "qgroup", "assign"))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "none", "1/7", s.mountPoint))
+	})
+
+	t.Run("recreates_missing_qgroup", func(t *testing.T) {
+		s, bp, runner := setup(t, "")
+		require.NoError(t, writeMetadataAtomic(filepath.Join(bp, tenantStateFile), tenantState{QgroupID: "1/7"}))
+
+		require.NoError(t, s.setupTenantQgroups(ctx, nil))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "create", "1/7", s.mountPoint))
+	})
+
+	t.Run("skips_qgroups_of_other_tenants", func(t *testing.T) {
+		s, _, _ := setup(t, "")
+		other := filepath.Join(s.basePath, "removed")
+		require.NoError(t, os.MkdirAll(other, 0o755))
+		require.NoError(t, writeMetadataAtomic(filepath.Join(other, tenantStateFile), tenantState{QgroupID: "1/1"}))
+
+		require.NoError(t, s.setupTenantQgroups(ctx, nil))
+		assert.Equal(t, "1/2", s.tenantQgroups["test"])
+	})
+
+	t.Run("new_subvolumes_join_on_creation", func(t *testing.T) {
+		s, bp, runner := setup(t, "")
+		require.NoError(t, s.setupTenantQgroups(ctx, nil))
+
+		_, err := s.CreateVolume(ctx, "test", VolumeCreateRequest{Name: "vol1", SizeBytes: 1 << 20})
+		require.NoError(t, err)
+		dataDir := filepath.Join(bp, "vol1", config.DataDir)
+		assert.True(t, containsCall(runner.Calls, "subvolume", "create", "-i", "1/1", dataDir))
+
+		require.NoError(t, os.MkdirAll(dataDir, 0o755)) // the mock creates no subvolume
+		_, err = s.CreateSnapshot(ctx, "test", SnapshotCreateRequest{Volume: "vol1", Name: "snap1"})
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "subvolume", "snapshot", "-r", "-i", "1/1", dataDir, filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir)))
+
+		_, err = s.CreateClone(ctx, "test", CloneCreateRequest{Volume: "vol1", Name: "clone1"})
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "subvolume", "snapshot", "-i", "1/1", dataDir, filepath.Join(bp, "clone1", config.DataDir)))
+
+		// joining on creation needs no assign and thus no quota rescan
+		assert.Empty(t, callsOf(runner.Calls, "qgroup", "assign"))
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		s, bp, _ := setup(t, "1/1 8192 4096 1073741824 none\n")
+		require.NoError(t, writeMetadataAtomic(filepath.Join(bp, tenantStateFile), tenantState{QgroupID: "1/1"}))
+		require.NoError(t, s.setupTenantQgroups(ctx, map[string]uint64{"test": 1 << 30}))
+
+		usage, err := s.TenantUsage(ctx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, &TenantUsage{QgroupID: "1/1", UsedBytes: 8192, LimitBytes: 1 << 30}, usage)
+
+		s.quotaEnabled = false
+		usage, err = s.TenantUsage(ctx, "test")
+		require.NoError(t, err)
+		assert.Nil(t, usage)
+	})
+}
@@ -0,0 +1,613 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// minTenantTokenLength is the shortest token accepted when the caller picks
+// the token instead of having one generated.
+const minTenantTokenLength = 16
+
+// tenantStore is the content of config.TenantsFile in the base path.
+type tenantStore struct {
+	Tenants []Tenant `json:"tenants"`
+}
+
+// tenantWorkers holds what StartWorkers needs to start the workers of a
+// tenant created later.
+type tenantWorkers struct {
+	ctx                 context.Context
+	usageInterval       time.Duration
+	reconcileInterval   time.Duration
+	scheduleInterval    time.Duration
+	consistencyInterval time.Duration
+}
+
+// loadTenantStore reads the tenant store and adds the tenants of seed it does
+// not know yet, e.g. from AGENT_TENANTS. For tenants already in the store the
+// limit is taken from seed, and a changed seed token replaces the stored token
+// it was seeded from. A seed token that is not in the store and replaces none
+// was revoked through the API or seeded by an older version, it is ignored
+// with a warning instead of being re-added. Tokens stored in clear by older
+// versions are replaced by their hash. The seeded tokens of a tenant no
+// longer in seed are dropped, it fails if that leaves the tenant without a
+// token. The store is written back if anything changed.
+func loadTenantStore(basePath string, seed []Tenant) ([]Tenant, error) {
+	path := filepath.Join(basePath, config.TenantsFile)
+	var store tenantStore
+	if err := ReadMetadata(path, &store); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	changed := false
+	for i := range store.Tenants {
+		for j := range store.Tenants[i].Tokens {
+			tok := &store.Tenants[i].Tokens[j]
+			if tok.Token == "" {
+				continue
+			}
+			if err := hashTenantToken(tok); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+	}
+	for _, t := range seed {
+		i := slices.IndexFunc(store.Tenants, func(cur Tenant) bool { return cur.Name == t.Name })
+		if i < 0 {
+			t.Tokens = slices.Clone(t.Tokens)
+			for j := range t.Tokens {
+				if err := hashTenantToken(&t.Tokens[j]); err != nil {
+					return nil, err
+				}
+				t.Tokens[j].Seed = true
+			}
+			store.Tenants = append(store.Tenants, t)
+			changed = true
+			log.Info().Str("tenant", t.Name).Msg("tenant added to tenant store")
+			continue
+		}
+		cur := &store.Tenants[i]
+		if cur.LimitBytes != t.LimitBytes {
+			cur.LimitBytes = t.LimitBytes
+			changed = true
+		}
+		tokensChanged, err := reseedTenantTokens(cur, t.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		changed = changed || tokensChanged
+	}
+	for i := range store.Tenants {
+		cur := &store.Tenants[i]
+		if slices.ContainsFunc(seed, func(t Tenant) bool { return t.Name == cur.Name }) {
+			continue
+		}
+		kept := slices.DeleteFunc(slices.Clone(cur.Tokens), func(tok TenantToken) bool { return tok.Seed })
+		if len(kept) == len(cur.Tokens) {
+			continue
+		}
+		if len(kept) == 0 {
+			return nil, fmt.Errorf("tenant %q was removed from AGENT_TENANTS but has no other token, delete it through the admin API or add it back", cur.Name)
+		}
+		log.Info().Str("tenant", cur.Name).Int("dropped", len(cur.Tokens)-len(kept)).Msg("tenant removed from AGENT_TENANTS, seeded tokens dropped")
+		cur.Tokens = kept
+		changed = true
+	}
+	if changed {
+		if err := writeTenantStore(basePath, store.Tenants); err != nil {
+			return nil, err
+		}
+	}
+	return store.Tenants, nil
+}
+
+// reseedTenantTokens applies the seed tokens to the stored tenant cur. Stored
+// tokens matching a seed token are marked as seeded, stored seeded tokens
+// that no longer match are replaced by the new seed tokens. New seed tokens
+// are ignored if no seeded token is left to replace. It reports whether cur
+// changed.
+func reseedTenantTokens(cur *Tenant, seed []TenantToken) (bool, error) {
+	changed := false
+	var added []TenantToken
+	for _, tok := range seed {
+		j := slices.IndexFunc(cur.Tokens, func(c TenantToken) bool { return sameTenantToken(c, tok) })
+		if j >= 0 {
+			if !cur.Tokens[j].Seed {
+				cur.Tokens[j].Seed = true
+				changed = true
+			}
+			continue
+		}
+		if err := hashTenantToken(&tok); err != nil {
+			return false, err
+		}
+		tok.Seed = true
+		added = append(added, tok)
+	}
+	if len(added) == 0 {
+		return changed, nil
+	}
+
+	kept := slices.DeleteFunc(slices.Clone(cur.Tokens), func(c TenantToken) bool {
+		return c.Seed && !slices.ContainsFunc(seed, func(tok TenantToken) bool { return sameTenantToken(c, tok) })
+	})
+	replaced := len(cur.Tokens) - len(kept)
+	if replaced == 0 {
+		// never fail the start on a token that was deliberately revoked
+		log.Warn().Str("tenant", cur.Name).Msg("token in AGENT_TENANTS is not in the tenant store and replaces no seeded token, it was revoked or rotated through the admin API and is ignored")
+		return changed, nil
+	}
+	cur.Tokens = append(kept, added...)
+	log.Info().Str("tenant", cur.Name).Int("replaced", replaced).Msg("token in AGENT_TENANTS changed, stored token replaced")
+	return true, nil
+}
+
+// writeTenantStore atomically replaces the tenant store. It only holds token
+// hashes, but is still only readable by the agent.
+func writeTenantStore(basePath string, tenants []Tenant) error {
+	path := filepath.Join(basePath, config.TenantsFile)
+	data, err := json.MarshalIndent(tenantStore{Tenants: tenants}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename %s: %w", tmp, err)
+	}
+	return nil
+}
+
+// NewTenantToken returns a token with a random ID for secret, which is
+// either a token or a hash from HashToken. A random token is generated if
+// secret is empty. Token is only set if secret is not a hash, Hash is
+// always set.
+func NewTenantToken(secret string) (TenantToken, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return TenantToken{}, err
+	}
+	tok := TenantToken{ID: hex.EncodeToString(id), CreatedAt: time.Now().UTC()}
+	if IsTokenHash(secret) {
+		tok.Hash = secret
+		return tok, nil
+	}
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return TenantToken{}, err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+	}
+	hash, err := HashToken(secret)
+	if err != nil {
+		return TenantToken{}, fmt.Errorf("hash token: %w", err)
+	}
+	tok.Token, tok.Hash = secret, hash
+	return tok, nil
+}
+
+// hashTenantToken drops Token, hashing it first unless Hash is set.
+func hashTenantToken(tok *TenantToken) error {
+	if tok.Hash == "" {
+		hash, err := HashToken(tok.Token)
+		if err != nil {
+			return fmt.Errorf("hash token: %w", err)
+		}
+		tok.Hash = hash
+	}
+	tok.Token = ""
+	return nil
+}
+
+// sameTenantToken reports whether the stored token cur is seed, which holds
+// either a token or a hash.
+func sameTenantToken(cur, seed TenantToken) bool {
+	if seed.Token != "" {
+		return VerifyToken(cur.Hash, seed.Token)
+	}
+	return cur.Hash == seed.Hash
+}
+
+// setTenantRecords replaces the tenants. Token secrets are not kept in
+// memory, only their hashes.
+func (s *Storage) setTenantRecords(tenants []Tenant) {
+	names := make([]string, 0, len(tenants))
+	records := make([]Tenant, 0, len(tenants))
+	for _, t := range tenants {
+		names = append(names, t.Name)
+		t.Tokens = slices.Clone(t.Tokens)
+		for i := range t.Tokens {
+			t.Tokens[i].Token = ""
+		}
+		records = append(records, t)
+	}
+	s.tenantsMu.Lock()
+	s.tenantRecords = records
+	s.tenants = names
+	s.tenantsMu.Unlock()
+}
+
+// Tenants returns the names of all tenants.
+func (s *Storage) Tenants() []string {
+	s.tenantsMu.RLock()
+	defer s.tenantsMu.RUnlock()
+	return s.tenants
+}
+
+// TenantByToken resolves an API token to its tenant and the scopes of the
+// token. The token is checked against every stored hash, the time taken does
+// not depend on which one matches.
+func (s *Storage) TenantByToken(token string) (string, []string, bool) {
+	s.tenantsMu.RLock()
+	defer s.tenantsMu.RUnlock()
+	var tenant string
+	var scopes []string
+	found := false
+	for _, t := range s.tenantRecords {
+		for _, tok := range t.Tokens {
+			if VerifyToken(tok.Hash, token) && !found {
+				tenant, scopes, found = t.Name, tok.Scopes, true
+			}
+		}
+	}
+	return tenant, scopes, found
+}
+
+// ListTenants returns all tenants without their token secrets.
+func (s *Storage) ListTenants() []Tenant {
+	s.tenantsMu.RLock()
+	defer s.tenantsMu.RUnlock()
+	out := make([]Tenant, 0, len(s.tenantRecords))
+	for _, t := range s.tenantRecords {
+		out = append(out, redactTenant(t))
+	}
+	return out
+}
+
+func redactTenant(t Tenant) Tenant {
+	tokens := make([]TenantToken, len(t.Tokens))
+	for i, tok := range t.Tokens {
+		tok.Token = ""
+		tok.Hash = ""
+		tokens[i] = tok
+	}
+	t.Tokens = tokens
+	return t
+}
+
+// CreateTenant creates a tenant with one token and starts its workers. The
+// returned tenant carries the token secret, it cannot be read again later.
+// No secret is returned if the request passed a hash.
+func (s *Storage) CreateTenant(ctx context.Context, req TenantCreateRequest) (*Tenant, error) {
+	if err := validateName(req.Name); err != nil {
+		return nil, err
+	}
+	if req.LimitBytes > 0 && !s.quotaEnabled {
+		return nil, &StorageError{Code: ErrInvalid, Message: "limit_bytes requires quota to be enabled"}
+	}
+
+	s.tenantAdminMu.Lock()
+	defer s.tenantAdminMu.Unlock()
+
+	if err := validateScopes(req.Scopes); err != nil {
+		return nil, err
+	}
+	if err := s.checkTenantToken(req.Token); err != nil {
+		return nil, err
+	}
+	if slices.Contains(s.Tenants(), req.Name) {
+		return nil, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("tenant %q already exists", req.Name)}
+	}
+	td := filepath.Join(s.basePath, req.Name)
+	if _, err := os.Stat(td); err == nil {
+		return nil, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("directory of tenant %q already exists", req.Name)}
+	}
+
+	tok, err := NewTenantToken(req.Token)
+	if err != nil {
+		return nil, fmt.Errorf("generate token: %w", err)
+	}
+	tok.Scopes = req.Scopes
+	stored := tok
+	stored.Token = ""
+	tenant := Tenant{Name: req.Name, Tokens: []TenantToken{stored}, LimitBytes: req.LimitBytes, CreatedAt: tok.CreatedAt}
+
+	if err := os.MkdirAll(td, s.defaultDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create tenant directory: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(td, config.SnapshotsDir), s.defaultDirMode); err != nil {
+		_ = os.RemoveAll(td)
+		return nil, fmt.Errorf("failed to create tenant snapshots directory: %w", err)
+	}
+	if s.quotaEnabled {
+		existing, claimed, err := s.tenantQgroupsInUse(ctx)
+		if err == nil {
+			err = s.setupTenantQgroup(ctx, req.Name, req.LimitBytes, existing, claimed)
+		}
+		if err != nil {
+			_ = os.RemoveAll(td)
+			return nil, err
+		}
+	}
+
+	tenants := append(slices.Clone(s.tenantList()), tenant)
+	if err := writeTenantStore(s.basePath, tenants); err != nil {
+		s.dropTenantQgroup(ctx, req.Name)
+		_ = os.RemoveAll(td)
+		return nil, err
+	}
+	s.setTenantRecords(tenants)
+	s.startTenantWorkers(req.Name)
+
+	log.Info().Str("tenant", req.Name).Uint64("limit", req.LimitBytes).Msg("tenant created")
+	tenant.Tokens = []TenantToken{{ID: tok.ID, Token: tok.Token, Scopes: tok.Scopes, CreatedAt: tok.CreatedAt}}
+	return &tenant, nil
+}
+
+// DeleteTenant deletes a tenant without volumes, snapshots or trash entries.
+// Its tokens stop working at once.
+func (s *Storage) DeleteTenant(ctx context.Context, name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	s.tenantAdminMu.Lock()
+	defer s.tenantAdminMu.Unlock()
+
+	tenants := s.tenantList()
+	i := slices.IndexFunc(tenants, func(t Tenant) bool { return t.Name == name })
+	if i < 0 {
+		return &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("tenant %q not found", name)}
+	}
+
+	td := filepath.Join(s.basePath, name)
+	if err := checkTenantEmpty(td); err != nil {
+		return err
+	}
+	s.dedupeMu.Lock()
+	job := s.dedupeJobs[name]
+	s.dedupeMu.Unlock()
+	if job != nil && job.snapshot().Status == JobRunning {
+		return &StorageError{Code: ErrBusy, Message: fmt.Sprintf("dedupe of tenant %q is running", name)}
+	}
+
+	tenants = slices.Delete(slices.Clone(tenants), i, i+1)
+	if err := writeTenantStore(s.basePath, tenants); err != nil {
+		return err
+	}
+	s.setTenantRecords(tenants)
+	s.stopTenantWorkers(name)
+	s.dropTenantQgroup(ctx, name)
+
+	if err := os.RemoveAll(td); err != nil {
+		log.Warn().Err(err).Str("path", td).Msg("failed to remove tenant directory")
+	}
+	s.dedupeMu.Lock()
+	delete(s.dedupeJobs, name)
+	s.dedupeMu.Unlock()
+	deleteTenantMetrics(name)
+
+	log.Info().Str("tenant", name).Msg("tenant deleted")
+	return nil
+}
+
+// checkTenantEmpty fails with ErrBusy if the tenant directory holds anything
+// but its state files and empty snapshots and trash directories.
+func checkTenantEmpty(td string) error {
+	entries, err := os.ReadDir(td)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read tenant directory: %w", err)
+	}
+	var busy []string
+	for _, e := range entries {
+		switch e.Name() {
+		case tenantStateFile, dedupeStateFile:
+			continue
+		case config.SnapshotsDir, config.TrashDir:
+			sub, err := os.ReadDir(filepath.Join(td, e.Name()))
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", e.Name(), err)
+			}
+			if len(sub) == 0 {
+				continue
+			}
+		}
+		busy = append(busy, e.Name())
+	}
+	if len(busy) > 0 {
+		return &StorageError{Code: ErrBusy, Message: fmt.Sprintf("tenant %q is not empty: %s", filepath.Base(td), strings.Join(busy, ", "))}
+	}
+	return nil
+}
+
+// CreateTenantToken adds a token to a tenant. The returned token carries
+// its secret, it cannot be read again later.
+func (s *Storage) CreateTenantToken(name string, req TenantTokenCreateRequest) (*TenantToken, error) {
+	s.tenantAdminMu.Lock()
+	defer s.tenantAdminMu.Unlock()
+
+	tenants := slices.Clone(s.tenantList())
+	i := slices.IndexFunc(tenants, func(t Tenant) bool { return t.Name == name })
+	if i < 0 {
+		return nil, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("tenant %q not found", name)}
+	}
+	if err := validateScopes(req.Scopes); err != nil {
+		return nil, err
+	}
+	if err := s.checkTenantToken(req.Token); err != nil {
+		return nil, err
+	}
+
+	tok, err := NewTenantToken(req.Token)
+	if err != nil {
+		return nil, fmt.Errorf("generate token: %w", err)
+	}
+	tok.Scopes = req.Scopes
+	stored := tok
+	stored.Token = ""
+	tenants[i].Tokens = append(slices.Clone(tenants[i].Tokens), stored)
+	if err := writeTenantStore(s.basePath, tenants); err != nil {
+		return nil, err
+	}
+	s.setTenantRecords(tenants)
+
+	log.Info().Str("tenant", name).Str("token", tok.ID).Msg("tenant token created")
+	tok.Hash = ""
+	return &tok, nil
+}
+
+// DeleteTenantToken revokes a token of a tenant. The last token cannot be
+// deleted, create its replacement first.
+func (s *Storage) DeleteTenantToken(name, id string) error {
+	s.tenantAdminMu.Lock()
+	defer s.tenantAdminMu.Unlock()
+
+	tenants := slices.Clone(s.tenantList())
+	i := slices.IndexFunc(tenants, func(t Tenant) bool { return t.Name == name })
+	if i < 0 {
+		return &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("tenant %q not found", name)}
+	}
+	j := slices.IndexFunc(tenants[i].Tokens, func(t TenantToken) bool { return t.ID == id })
+	if j < 0 {
+		return &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("token %q of tenant %q not found", id, name)}
+	}
+	if len(tenants[i].Tokens) == 1 {
+		return &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("token %q is the last token of tenant %q, create a new token first", id, name)}
+	}
+
+	tenants[i].Tokens = slices.Delete(slices.Clone(tenants[i].Tokens), j, j+1)
+	if err := writeTenantStore(s.basePath, tenants); err != nil {
+		return err
+	}
+	s.setTenantRecords(tenants)
+
+	log.Info().Str("tenant", name).Str("token", id).Msg("tenant token deleted")
+	return nil
+}
+
+// checkTenantToken validates a token or hash picked by the caller, an empty
+// token is generated later.
+func (s *Storage) checkTenantToken(token string) error {
+	if token == "" {
+		return nil
+	}
+	if IsTokenHash(token) {
+		for _, t := range s.tenantList() {
+			if slices.ContainsFunc(t.Tokens, func(c TenantToken) bool { return c.Hash == token }) {
+				return &StorageError{Code: ErrAlreadyExists, Message: "token is already in use"}
+			}
+		}
+		return nil
+	}
+	if len(token) < minTenantTokenLength {
+		return &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("token must be at least %d characters", minTenantTokenLength)}
+	}
+	if strings.ContainsAny(token, ":, \t\r\n") {
+		return &StorageError{Code: ErrInvalid, Message: "token must not contain ':', ',' or whitespace"}
+	}
+	if _, _, ok := s.TenantByToken(token); ok {
+		return &StorageError{Code: ErrAlreadyExists, Message: "token is already in use"}
+	}
+	return nil
+}
+
+func (s *Storage) tenantList() []Tenant {
+	s.tenantsMu.RLock()
+	defer s.tenantsMu.RUnlock()
+	return s.tenantRecords
+}
+
+// startTenantWorkers starts the background workers of a tenant, no-op
+// before StartWorkers.
+func (s *Storage) startTenantWorkers(tenant string) {
+	s.tenantsMu.Lock()
+	w := s.workers
+	if w == nil {
+		s.tenantsMu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(w.ctx)
+	if s.tenantCancel == nil {
+		s.tenantCancel = make(map[string]context.CancelFunc)
+	}
+	s.tenantCancel[tenant] = cancel
+	s.tenantsMu.Unlock()
+
+	bp := filepath.Join(s.basePath, tenant)
+	if s.quotaEnabled {
+		StartUsageUpdater(ctx, s.btrfs, bp, w.usageInterval, tenant)
+		s.StartTenantUsageUpdater(ctx, w.usageInterval, tenant)
+	}
+	if w.reconcileInterval > 0 {
+		s.StartNFSReconciler(ctx, bp, w.reconcileInterval, tenant)
+	}
+	if w.scheduleInterval > 0 {
+		s.StartSnapshotScheduler(ctx, w.scheduleInterval, tenant)
+	}
+	if w.consistencyInterval > 0 {
+		s.StartConsistencyChecker(ctx, w.consistencyInterval, tenant)
+	}
+	if s.trashRetention > 0 {
+		s.StartTrashPurger(ctx, tenant)
+	}
+}
+
+func (s *Storage) stopTenantWorkers(tenant string) {
+	s.tenantsMu.Lock()
+	cancel := s.tenantCancel[tenant]
+	delete(s.tenantCancel, tenant)
+	s.tenantsMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// dropTenantQgroup destroys the qgroup of a deleted tenant. Failures are only
+// logged, an empty qgroup limits nothing.
+func (s *Storage) dropTenantQgroup(ctx context.Context, tenant string) {
+	s.tenantsMu.Lock()
+	qgroupID, ok := s.tenantQgroups[tenant]
+	delete(s.tenantQgroups, tenant)
+	delete(s.tenantLimits, tenant)
+	s.tenantsMu.Unlock()
+	if !s.quotaEnabled || !ok {
+		return
+	}
+	if err := s.btrfs.QgroupGroupDestroy(ctx, qgroupID, s.mountPoint); err != nil {
+		log.Warn().Err(err).Str("tenant", tenant).Str("qgroup", qgroupID).Msg("failed to destroy tenant qgroup")
+	}
+}
+
+func deleteTenantMetrics(tenant string) {
+	labels := prometheus.Labels{"tenant": tenant}
+	for _, vec := range []*prometheus.MetricVec{
+		VolumesGauge.MetricVec, ExportsGauge.MetricVec, VolumeSizeBytes.MetricVec, VolumeUsedBytes.MetricVec,
+		VolumeCorruptedFiles.MetricVec, ReplicationLagSeconds.MetricVec, ReplicationFailuresTotal.MetricVec,
+		ConsistencyIssuesGauge.MetricVec, DedupeRunningGauge.MetricVec, DedupeReclaimedBytesTotal.MetricVec,
+		TenantUsedBytes.MetricVec, TenantLimitBytes.MetricVec, TrashVolumesGauge.MetricVec, TrashUsedBytes.MetricVec,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
+}
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantStore(t *testing.T) {
+	ctx := context.Background()
+
+	// setup registers the tenant "test" with the token "test-token-0000001"
+	setup := func(t *testing.T) *Storage {
+		s, _, _, _ := newTestStorage(t)
+		tok, err := NewTenantToken("test-token-0000001")
+		require.NoError(t, err)
+		s.setTenantRecords([]Tenant{{Name: "test", Tokens: []TenantToken{tok}}})
+		return s
+	}
+
+	readStore := func(t *testing.T, base string) []Tenant {
+		var store tenantStore
+		require.NoError(t, ReadMetadata(filepath.Join(base, config.TenantsFile), &store))
+		return store.Tenants
+	}
+
+	t.Run("seed", func(t *testing.T) {
+		base := t.TempDir()
+		tok, err := NewTenantToken("seed-token-0000001")
+		require.NoError(t, err)
+
+		tenants, err := loadTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{tok}, LimitBytes: 1 << 30}})
+		require.NoError(t, err)
+		require.Len(t, tenants, 1)
+		require.Len(t, tenants[0].Tokens, 1)
+		assert.Empty(t, tenants[0].Tokens[0].Token)
+		assert.True(t, VerifyToken(tenants[0].Tokens[0].Hash, "seed-token-0000001"))
+		info, err := os.Stat(filepath.Join(base, config.TenantsFile))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		data, err := os.ReadFile(filepath.Join(base, config.TenantsFile))
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "seed-token-0000001")
+
+		assert.True(t, tenants[0].Tokens[0].Seed)
+
+		// a token added through the API is kept when the env token changes
+		api, err := NewTenantToken("api-token-00000001")
+		require.NoError(t, err)
+		api.Token = ""
+		tenants[0].Tokens = append(tenants[0].Tokens, api)
+		require.NoError(t, writeTenantStore(base, tenants))
+
+		// a changed env token replaces the seeded one, the limit follows the env
+		rotated, err := NewTenantToken("seed-token-0000002")
+		require.NoError(t, err)
+		tenants, err = loadTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{rotated}}})
+		require.NoError(t, err)
+		require.Len(t, tenants, 1)
+		require.Len(t, tenants[0].Tokens, 2)
+		assert.Equal(t, api.ID, tenants[0].Tokens[0].ID)
+		assert.False(t, tenants[0].Tokens[0].Seed)
+		assert.Equal(t, rotated.ID, tenants[0].Tokens[1].ID)
+		assert.True(t, tenants[0].Tokens[1].Seed)
+		assert.True(t, VerifyToken(tenants[0].Tokens[1].Hash, "seed-token-0000002"))
+		assert.False(t, VerifyToken(tenants[0].Tokens[1].Hash, "seed-token-0000001"))
+		assert.Zero(t, tenants[0].LimitBytes)
+		assert.Len(t, readStore(t, base)[0].Tokens, 2)
+
+		// the same env token again changes nothing
+		again, err := NewTenantToken("seed-token-0000002")
+		require.NoError(t, err)
+		tenants, err = loadTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{again}}})
+		require.NoError(t, err)
+		assert.Equal(t, rotated.ID, tenants[0].Tokens[1].ID)
+	})
+
+	t.Run("seed_revoked", func(t *testing.T) {
+		base := t.TempDir()
+		// the seeded token was revoked through the API, only api is left
+		api, err := NewTenantToken("api-token-00000001")
+		require.NoError(t, err)
+		api.Token = ""
+		require.NoError(t, writeTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{api}}}))
+
+		tok, err := NewTenantToken("seed-token-0000001")
+		require.NoError(t, err)
+		tenants, err := loadTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{tok}}})
+		require.NoError(t, err, "a revoked seed token must not fail the start")
+		require.Len(t, tenants[0].Tokens, 1, "revoked token is not re-added")
+		assert.Equal(t, api.ID, tenants[0].Tokens[0].ID)
+		stored := readStore(t, base)[0].Tokens
+		require.Len(t, stored, 1, "store is left untouched")
+		assert.Equal(t, api.ID, stored[0].ID)
+	})
+
+	t.Run("seed_removed", func(t *testing.T) {
+		base := t.TempDir()
+		seeded, err := NewTenantToken("seed-token-0000001")
+		require.NoError(t, err)
+		seeded.Token, seeded.Seed = "", true
+		api, err := NewTenantToken("api-token-00000001")
+		require.NoError(t, err)
+		api.Token = ""
+		require.NoError(t, writeTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{seeded, api}}}))
+
+		// a is no longer seeded, its seeded token stops working
+		tenants, err := loadTenantStore(base, nil)
+		require.NoError(t, err)
+		require.Len(t, tenants, 1)
+		require.Len(t, tenants[0].Tokens, 1)
+		assert.Equal(t, api.ID, tenants[0].Tokens[0].ID)
+		require.Len(t, readStore(t, base)[0].Tokens, 1)
+	})
+
+	t.Run("seed_removed_last_token", func(t *testing.T) {
+		base := t.TempDir()
+		seeded, err := NewTenantToken("seed-token-0000001")
+		require.NoError(t, err)
+		seeded.Token, seeded.Seed = "", true
+		other, err := NewTenantToken("seed-token-0000002")
+		require.NoError(t, err)
+		require.NoError(t, writeTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{seeded}}}))
+
+		_, err = loadTenantStore(base, []Tenant{{Name: "b", Tokens: []TenantToken{other}}})
+		require.Error(t, err, "a tenant left without a token must be deleted explicitly")
+		assert.Contains(t, err.Error(), `tenant "a"`)
+		stored := readStore(t, base)
+		require.Len(t, stored, 1, "store is left untouched")
+		assert.Len(t, stored[0].Tokens, 1)
+	})
+
+	t.Run("seed_marks_existing", func(t *testing.T) {
+		base := t.TempDir()
+		// stored by an older version, which did not mark seeded tokens
+		tok, err := NewTenantToken("seed-token-0000001")
+		require.NoError(t, err)
+		stored := tok
+		stored.Token = ""
+		require.NoError(t, writeTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{stored}}}))
+
+		tenants, err := loadTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{tok}}})
+		require.NoError(t, err)
+		require.Len(t, tenants[0].Tokens, 1)
+		assert.Equal(t, tok.ID, tenants[0].Tokens[0].ID)
+		assert.True(t, readStore(t, base)[0].Tokens[0].Seed)
+	})
+
+	t.Run("seed_hash", func(t *testing.T) {
+		base := t.TempDir()
+		hash, err := HashToken("seed-token-0000001")
+		require.NoError(t, err)
+		tok, err := NewTenantToken(hash)
+		require.NoError(t, err)
+		assert.Empty(t, tok.Token)
+		assert.Equal(t, hash, tok.Hash)
+
+		tenants, err := loadTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{tok}}})
+		require.NoError(t, err)
+		assert.Equal(t, hash, tenants[0].Tokens[0].Hash)
+	})
+
+	t.Run("migrates_clear_tokens", func(t *testing.T) {
+		base := t.TempDir()
+		require.NoError(t, writeTenantStore(base, []Tenant{{Name: "a", Tokens: []TenantToken{{ID: "1", Token: "old-token-00000001"}}}}))
+
+		tenants, err := loadTenantStore(base, nil)
+		require.NoError(t, err)
+		assert.Empty(t, tenants[0].Tokens[0].Token)
+		assert.True(t, VerifyToken(tenants[0].Tokens[0].Hash, "old-token-00000001"))
+		data, err := os.ReadFile(filepath.Join(base, config.TenantsFile))
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "old-token-00000001")
+	})
+
+	t.Run("create", func(t *testing.T) {
+		s := setup(t)
+
+		tenant, err := s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b"})
+		require.NoError(t, err)
+		require.Len(t, tenant.Tokens, 1)
+		secret := tenant.Tokens[0].Token
+		assert.NotEmpty(t, secret)
+		assert.DirExists(t, filepath.Join(s.basePath, "team-b", config.SnapshotsDir))
+
+		got, _, ok := s.TenantByToken(secret)
+		assert.True(t, ok)
+		assert.Equal(t, "team-b", got)
+		assert.Equal(t, []string{"test", "team-b"}, s.Tenants())
+		assert.Len(t, readStore(t, s.basePath), 2)
+
+		assert.Empty(t, tenant.Tokens[0].Hash)
+		for _, stored := range readStore(t, s.basePath)[1].Tokens {
+			assert.Empty(t, stored.Token)
+			assert.True(t, VerifyToken(stored.Hash, secret))
+		}
+
+		listed := s.ListTenants()
+		require.Len(t, listed, 2)
+		assert.Empty(t, listed[1].Tokens[0].Token)
+		assert.Empty(t, listed[1].Tokens[0].Hash)
+		assert.Equal(t, tenant.Tokens[0].ID, listed[1].Tokens[0].ID)
+
+		_, err = s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b"})
+		requireStorageError(t, err, ErrAlreadyExists)
+	})
+
+	t.Run("create_invalid", func(t *testing.T) {
+		s := setup(t)
+
+		_, err := s.CreateTenant(ctx, TenantCreateRequest{Name: "../x"})
+		requireStorageError(t, err, ErrInvalid)
+		_, err = s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b", Token: "short"})
+		requireStorageError(t, err, ErrInvalid)
+		_, err = s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b", Token: "test-token-0000001"})
+		requireStorageError(t, err, ErrAlreadyExists)
+		_, err = s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b", LimitBytes: 1 << 30})
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("create_with_hash", func(t *testing.T) {
+		s := setup(t)
+		hash, err := HashToken("team-b-token-00001")
+		require.NoError(t, err)
+
+		tenant, err := s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b", Token: hash})
+		require.NoError(t, err)
+		assert.Empty(t, tenant.Tokens[0].Token)
+		got, _, ok := s.TenantByToken("team-b-token-00001")
+		assert.True(t, ok)
+		assert.Equal(t, "team-b", got)
+
+		_, err = s.CreateTenantToken("test", TenantTokenCreateRequest{Token: hash})
+		requireStorageError(t, err, ErrAlreadyExists)
+	})
+
+	t.Run("create_with_quota", func(t *testing.T) {
+		s, _, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		runner.RunFn = tenantQgroupRunFn("1/1 0 0\n")
+
+		_, err := s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b", LimitBytes: 1 << 30})
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "create", "1/2", s.mountPoint))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "1073741824", "1/2", s.mountPoint))
+		assert.Equal(t, uint64(1<<30), readStore(t, s.basePath)[0].LimitBytes)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := setup(t)
+		tenant, err := s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b"})
+		require.NoError(t, err)
+		td := filepath.Join(s.basePath, "team-b")
+		setupUsageVol(t, td, "vol1", VolumeMetadata{Name: "vol1"})
+
+		requireStorageError(t, s.DeleteTenant(ctx, "team-b"), ErrBusy)
+		require.NoError(t, os.RemoveAll(filepath.Join(td, "vol1")))
+
+		require.NoError(t, s.DeleteTenant(ctx, "team-b"))
+		assert.NoDirExists(t, td)
+		_, _, ok := s.TenantByToken(tenant.Tokens[0].Token)
+		assert.False(t, ok)
+		assert.Len(t, readStore(t, s.basePath), 1)
+
+		requireStorageError(t, s.DeleteTenant(ctx, "team-b"), ErrNotFound)
+	})
+
+	t.Run("rotate_token", func(t *testing.T) {
+		s := setup(t)
+		old := s.ListTenants()[0].Tokens[0]
+
+		tok, err := s.CreateTenantToken("test", TenantTokenCreateRequest{})
+		require.NoError(t, err)
+
+		// both tokens are valid until the old one is deleted
+		for _, secret := range []string{"test-token-0000001", tok.Token} {
+			got, _, ok := s.TenantByToken(secret)
+			assert.True(t, ok)
+			assert.Equal(t, "test", got)
+		}
+
+		require.NoError(t, s.DeleteTenantToken("test", old.ID))
+		_, _, ok := s.TenantByToken("test-token-0000001")
+		assert.False(t, ok)
+		_, _, ok = s.TenantByToken(tok.Token)
+		assert.True(t, ok)
+		require.Len(t, readStore(t, s.basePath)[0].Tokens, 1)
+
+		requireStorageError(t, s.DeleteTenantToken("test", tok.ID), ErrInvalid)
+		requireStorageError(t, s.DeleteTenantToken("test", old.ID), ErrNotFound)
+		_, err = s.CreateTenantToken("missing", TenantTokenCreateRequest{})
+		requireStorageError(t, err, ErrNotFound)
+	})
+
+	t.Run("scopes", func(t *testing.T) {
+		s := setup(t)
+
+		tok, err := s.CreateTenantToken("test", TenantTokenCreateRequest{Scopes: []string{ScopeVolumesRead}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{ScopeVolumesRead}, tok.Scopes)
+		_, scopes, ok := s.TenantByToken(tok.Token)
+		assert.True(t, ok)
+		assert.Equal(t, []string{ScopeVolumesRead}, scopes)
+		assert.Equal(t, []string{ScopeVolumesRead}, readStore(t, s.basePath)[0].Tokens[1].Scopes)
+
+		// tokens without scopes keep full access
+		_, scopes, ok = s.TenantByToken("test-token-0000001")
+		assert.True(t, ok)
+		assert.Empty(t, scopes)
+
+		// the former name of tenant:admin is still accepted
+		_, err = s.CreateTenantToken("test", TenantTokenCreateRequest{Scopes: []string{ScopeAdmin}})
+		require.NoError(t, err)
+
+		_, err = s.CreateTenantToken("test", TenantTokenCreateRequest{Scopes: []string{"volumes:delete"}})
+		requireStorageError(t, err, ErrInvalid)
+		_, err = s.CreateTenant(ctx, TenantCreateRequest{Name: "team-b", Scopes: []string{"everything"}})
+		requireStorageError(t, err, ErrInvalid)
+	})
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// tokenHashScheme prefixes a salted token hash:
+// "hmac-sha256.<salt>.<mac>" with the hex encoded 16 byte salt and
+// HMAC-SHA256 of the token keyed with the salt. The separator is neither ':'
+// nor ',', so a hash fits in place of a token in AGENT_TENANTS.
+const tokenHashScheme = "hmac-sha256"
+
+// HashToken returns a salted hash of token, see tokenHashScheme.
+func HashToken(token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s.%s", tokenHashScheme, hex.EncodeToString(salt), hex.EncodeToString(tokenMAC(salt, token))), nil
+}
+
+// IsTokenHash reports whether s is a token hash rather than a token.
+func IsTokenHash(s string) bool {
+	_, _, ok := parseTokenHash(s)
+	return ok
+}
+
+// VerifyToken reports whether token matches hash. The MACs are compared in
+// constant time.
+func VerifyToken(hash, token string) bool {
+	salt, mac, ok := parseTokenHash(hash)
+	if !ok {
+		return false
+	}
+	return hmac.Equal(mac, tokenMAC(salt, token))
+}
+
+func parseTokenHash(s string) ([]byte, []byte, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || parts[0] != tokenHashScheme {
+		return nil, nil, false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil || len(salt) == 0 {
+		return nil, nil, false
+	}
+	mac, err := hex.DecodeString(parts[2])
+	if err != nil || len(mac) != sha256.Size {
+		return nil, nil, false
+	}
+	return salt, mac, true
+}
+
+func tokenMAC(salt []byte, token string) []byte {
+	m := hmac.New(sha256.New, salt)
+	m.Write([]byte(token))
+	return m.Sum(nil)
+}
+
+// HasScope reports whether a token with scopes may act with scope.
+func HasScope(scopes []string, scope string) bool {
+	return len(scopes) == 0 || slices.Contains(scopes, ScopeTenantAdmin) || slices.Contains(scopes, ScopeAdmin) || slices.Contains(scopes, scope)
+}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeVolumesRead, ScopeVolumesWrite, ScopeSnapshotsWrite, ScopeSnapshotsSend, ScopeExportsWrite, ScopeTenantAdmin, ScopeAdmin:
+		default:
+			return &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("invalid scope %q (must be one of: %s, %s, %s, %s, %s, %s)", scope, ScopeVolumesRead, ScopeVolumesWrite, ScopeSnapshotsWrite, ScopeSnapshotsSend, ScopeExportsWrite, ScopeTenantAdmin)}
+		}
+	}
+	return nil
+}
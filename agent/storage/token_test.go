@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenHash(t *testing.T) {
+	hash, err := HashToken("secret-token-0001")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "hmac-sha256."))
+	assert.True(t, IsTokenHash(hash))
+	assert.NotContains(t, hash, ":")
+	assert.NotContains(t, hash, ",")
+
+	assert.True(t, VerifyToken(hash, "secret-token-0001"))
+	assert.False(t, VerifyToken(hash, "secret-token-0002"))
+	assert.False(t, VerifyToken(hash, ""))
+
+	// salted, the same token hashes differently
+	other, err := HashToken("secret-token-0001")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+	assert.True(t, VerifyToken(other, "secret-token-0001"))
+
+	for _, s := range []string{"", "secret-token-0001", "hmac-sha256.abc", "hmac-sha256.zz.00", "sha1." + hash[len("hmac-sha256."):], hash[:len(hash)-2]} {
+		assert.False(t, IsTokenHash(s), s)
+		assert.False(t, VerifyToken(s, "secret-token-0001"), s)
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	assert.True(t, HasScope(nil, ScopeVolumesWrite))
+	assert.True(t, HasScope([]string{ScopeTenantAdmin}, ScopeExportsWrite))
+	assert.True(t, HasScope([]string{ScopeAdmin}, ScopeTenantAdmin), "legacy alias")
+	assert.True(t, HasScope([]string{ScopeVolumesRead, ScopeSnapshotsWrite}, ScopeSnapshotsWrite))
+	assert.False(t, HasScope([]string{ScopeVolumesRead}, ScopeVolumesWrite))
+	assert.False(t, HasScope([]string{ScopeVolumesWrite}, ScopeTenantAdmin))
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxTrashPurgeInterval caps how long an expired entry stays in the trash.
+const maxTrashPurgeInterval = 10 * time.Minute
+
+// SetTrashRetention keeps deleted volumes in the trash for retention before
+// they are purged, see AGENT_TRASH_RETENTION. Zero deletes volumes immediately.
+func (s *Storage) SetTrashRetention(retention time.Duration) { s.trashRetention = retention }
+
+// moveToTrash moves the volume directory to <tenant>/.trash/<name>-<time>.
+// The name is free for a new volume as soon as this returns.
+func (s *Storage) moveToTrash(bp, tenant, name string) error {
+	trashDir := filepath.Join(bp, config.TrashDir)
+	if err := os.MkdirAll(trashDir, s.defaultDirMode); err != nil {
+		log.Error().Err(err).Str("path", trashDir).Msg("failed to create trash directory")
+		return fmt.Errorf("create trash directory: %w", err)
+	}
+
+	now := time.Now().UTC()
+	id := SnapshotName(name, now.Format("20060102150405"))
+	entryDir := filepath.Join(trashDir, id)
+	if _, err := os.Stat(entryDir); err == nil {
+		return &StorageError{Code: ErrBusy, Message: fmt.Sprintf("volume %q was already deleted within this second, retry", name)}
+	}
+
+	volDir := filepath.Join(bp, name)
+	metaPath := filepath.Join(volDir, config.MetadataFile)
+	if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) {
+		meta.DeletedAt = &now
+	}); err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	if err := os.Rename(volDir, entryDir); err != nil {
+		log.Error().Err(err).Str("path", volDir).Str("trash", entryDir).Msg("failed to move volume to trash")
+		if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) { meta.DeletedAt = nil }); err != nil {
+			log.Warn().Err(err).Str("path", metaPath).Msg("cleanup: failed to clear deleted_at")
+		}
+		return fmt.Errorf("move volume to trash: %w", err)
+	}
+
+	log.Info().Str("tenant", tenant).Str("name", name).Str("id", id).Msg("volume moved to trash")
+	return nil
+}
+
+// ListTrash returns the deleted volumes of a tenant, oldest first.
+func (s *Storage) ListTrash(tenant string) ([]TrashEntry, error) {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := readTrash(bp)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]TrashEntry, 0, len(metas))
+	for id, meta := range metas {
+		entries = append(entries, s.trashEntryFrom(id, meta))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].DeletedAt.Equal(entries[j].DeletedAt) {
+			return entries[i].DeletedAt.Before(entries[j].DeletedAt)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (s *Storage) trashEntryFrom(id string, meta VolumeMetadata) TrashEntry {
+	e := TrashEntry{ID: id, Name: meta.Name, SizeBytes: meta.SizeBytes, UsedBytes: meta.UsedBytes}
+	if meta.DeletedAt != nil {
+		e.DeletedAt = *meta.DeletedAt
+	}
+	if s.trashRetention > 0 {
+		purgeAt := e.DeletedAt.Add(s.trashRetention)
+		e.PurgeAt = &purgeAt
+	}
+	return e
+}
+
+// RestoreTrash moves a deleted volume back out of the trash, under its old
+// name unless req.Name is set. Exports are not restored.
+func (s *Storage) RestoreTrash(tenant, id string, req TrashRestoreRequest) (*VolumeMetadata, error) {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return nil, err
+	}
+	entryDir, meta, err := readTrashEntry(bp, id)
+	if err != nil {
+		return nil, err
+	}
+
+	name := meta.Name
+	if req.Name != "" {
+		name = req.Name
+	}
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	volDir := filepath.Join(bp, name)
+	if _, err := os.Stat(volDir); err == nil {
+		return nil, &StorageError{Code: ErrAlreadyExists, Message: fmt.Sprintf("volume %q already exists, restore under another name", name)}
+	}
+
+	metaPath := filepath.Join(entryDir, config.MetadataFile)
+	now := time.Now().UTC()
+	if err := UpdateMetadata(metaPath, func(m *VolumeMetadata) {
+		m.Name = name
+		m.Path = volDir
+		m.DeletedAt = nil
+		m.UpdatedAt = now
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	if err := os.Rename(entryDir, volDir); err != nil {
+		log.Error().Err(err).Str("trash", entryDir).Str("path", volDir).Msg("failed to restore volume from trash")
+		if err := writeMetadataAtomic(metaPath, meta); err != nil {
+			log.Warn().Err(err).Str("path", metaPath).Msg("cleanup: failed to revert metadata")
+		}
+		return nil, fmt.Errorf("restore volume from trash: %w", err)
+	}
+
+	var restored VolumeMetadata
+	if err := ReadMetadata(filepath.Join(volDir, config.MetadataFile), &restored); err != nil {
+		return nil, fmt.Errorf("failed to read volume metadata: %w", err)
+	}
+	log.Info().Str("tenant", tenant).Str("id", id).Str("name", name).Msg("volume restored from trash")
+	return &restored, nil
+}
+
+// PurgeTrash deletes a trash entry without waiting for the retention.
+func (s *Storage) PurgeTrash(ctx context.Context, tenant, id string) error {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return err
+	}
+	entryDir, meta, err := readTrashEntry(bp, id)
+	if err != nil {
+		return err
+	}
+	return s.purgeTrashEntry(ctx, tenant, entryDir, &meta)
+}
+
+func (s *Storage) purgeTrashEntry(ctx context.Context, tenant, entryDir string, meta *VolumeMetadata) error {
+	dataDir := filepath.Join(entryDir, config.DataDir)
+	s.dropVolumeGroup(ctx, tenant, meta, dataDir)
+	if err := s.btrfs.SubvolumeDelete(ctx, dataDir); err != nil {
+		log.Error().Err(err).Str("path", dataDir).Msg("failed to delete subvolume")
+		return fmt.Errorf("btrfs subvolume delete failed: %w", err)
+	}
+	if err := os.RemoveAll(entryDir); err != nil {
+		log.Error().Err(err).Str("path", entryDir).Msg("failed to remove trash entry")
+		return fmt.Errorf("failed to remove trash entry: %w", err)
+	}
+	log.Info().Str("tenant", tenant).Str("id", filepath.Base(entryDir)).Msg("trash entry purged")
+	return nil
+}
+
+// StartTrashPurger periodically deletes trash entries older than the retention.
+func (s *Storage) StartTrashPurger(ctx context.Context, tenant string) {
+	interval := min(s.trashRetention, maxTrashPurgeInterval)
+	go func() {
+		s.runTrashPurge(ctx, tenant, time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.runTrashPurge(ctx, tenant, time.Now())
+			}
+		}
+	}()
+}
+
+// runTrashPurge deletes the expired entries and refreshes the usage of the
+// others, the usage updater does not look into the trash.
+func (s *Storage) runTrashPurge(ctx context.Context, tenant string, now time.Time) {
+	bp := filepath.Join(s.basePath, tenant)
+	metas, err := readTrash(bp)
+	if err != nil {
+		log.Error().Err(err).Str("tenant", tenant).Msg("trash purger: failed to read trash")
+		return
+	}
+
+	var purged, count int
+	var used uint64
+	for id, meta := range metas {
+		entryDir := filepath.Join(bp, config.TrashDir, id)
+		if meta.DeletedAt == nil {
+			log.Warn().Str("tenant", tenant).Str("id", id).Msg("trash purger: entry has no deleted_at, skipping")
+		} else if !now.Before(meta.DeletedAt.Add(s.trashRetention)) {
+			if err := s.purgeTrashEntry(ctx, tenant, entryDir, &meta); err == nil {
+				purged++
+				continue
+			}
+		}
+
+		if s.quotaEnabled && meta.QuotaBytes > 0 {
+			if u, err := s.btrfs.QgroupUsage(ctx, filepath.Join(entryDir, config.DataDir)); err != nil {
+				log.Warn().Err(err).Str("tenant", tenant).Str("id", id).Msg("trash purger: failed to get usage")
+			} else if u != meta.UsedBytes {
+				meta.UsedBytes = u
+				if err := UpdateMetadata(filepath.Join(entryDir, config.MetadataFile), func(m *VolumeMetadata) { m.UsedBytes = u }); err != nil {
+					log.Warn().Err(err).Str("tenant", tenant).Str("id", id).Msg("trash purger: failed to update usage")
+				}
+			}
+		}
+		count++
+		used += meta.UsedBytes
+	}
+
+	TrashVolumesGauge.WithLabelValues(tenant).Set(float64(count))
+	TrashUsedBytes.WithLabelValues(tenant).Set(float64(used))
+	log.Debug().Str("tenant", tenant).Int("entries", count).Int("purged", purged).Msg("trash purger: scan complete")
+}
+
+// trashUsage returns the number and used bytes of the trash entries.
+func trashUsage(bp string) (int, uint64, error) {
+	metas, err := readTrash(bp)
+	if err != nil {
+		return 0, 0, err
+	}
+	var used uint64
+	for _, meta := range metas {
+		used += meta.UsedBytes
+	}
+	return len(metas), used, nil
+}
+
+// readTrash returns the metadata of all trash entries by id. A missing trash
+// directory is empty, entries without metadata are skipped.
+func readTrash(bp string) (map[string]VolumeMetadata, error) {
+	entries, err := os.ReadDir(filepath.Join(bp, config.TrashDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trash: %w", err)
+	}
+	metas := make(map[string]VolumeMetadata, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		var meta VolumeMetadata
+		if err := ReadMetadata(filepath.Join(bp, config.TrashDir, e.Name(), config.MetadataFile), &meta); err != nil {
+			continue
+		}
+		metas[e.Name()] = meta
+	}
+	return metas, nil
+}
+
+func readTrashEntry(bp, id string) (string, VolumeMetadata, error) {
+	var meta VolumeMetadata
+	if err := validateName(id); err != nil {
+		return "", meta, err
+	}
+	entryDir := filepath.Join(bp, config.TrashDir, id)
+	if err := ReadMetadata(filepath.Join(entryDir, config.MetadataFile), &meta); err != nil {
+		if os.IsNotExist(err) {
+			return "", meta, &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("trash entry %q not found", id)}
+		}
+		return "", meta, fmt.Errorf("failed to read trash metadata: %w", err)
+	}
+	return entryDir, meta, nil
+}
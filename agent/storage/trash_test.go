@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+
+	// setup creates vol1 and deletes it into the trash
+	setup := func(t *testing.T) (*Storage, string, *utils.MockRunner, TrashEntry) {
+		s, bp, runner, _ := newTestStorage(t)
+		s.SetTrashRetention(24 * time.Hour)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", Path: filepath.Join(bp, "vol1"), SizeBytes: 1 << 30, UsedBytes: 4096})
+		require.NoError(t, s.DeleteVolume(ctx, "test", "vol1"))
+
+		entries, err := s.ListTrash("test")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.False(t, containsCall(runner.Calls, "subvolume", "delete", filepath.Join(bp, "vol1", config.DataDir)))
+		return s, bp, runner, entries[0]
+	}
+
+	t.Run("delete_moves_to_trash", func(t *testing.T) {
+		s, bp, _, entry := setup(t)
+		assert.NoDirExists(t, filepath.Join(bp, "vol1"))
+		assert.Equal(t, "vol1", entry.Name)
+		assert.Equal(t, uint64(4096), entry.UsedBytes)
+		require.NotNil(t, entry.PurgeAt)
+		assert.Equal(t, entry.DeletedAt.Add(24*time.Hour), *entry.PurgeAt)
+
+		meta := readVolumeMeta(t, filepath.Join(bp, config.TrashDir, entry.ID))
+		require.NotNil(t, meta.DeletedAt)
+
+		// the name is free at once and the trash is not listed as a volume
+		vols, err := s.ListVolumes("test")
+		require.NoError(t, err)
+		assert.Empty(t, vols)
+		_, err = s.CreateVolume(ctx, "test", VolumeCreateRequest{Name: "vol1", SizeBytes: 1 << 20})
+		require.NoError(t, err)
+
+		st, err := s.Stats("test")
+		require.NoError(t, err)
+		assert.Equal(t, 1, st.TrashVolumes)
+		assert.Equal(t, uint64(4096), st.TrashUsedBytes)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		s, bp, _, entry := setup(t)
+
+		meta, err := s.RestoreTrash("test", entry.ID, TrashRestoreRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "vol1", meta.Name)
+		assert.Nil(t, meta.DeletedAt)
+		assert.Equal(t, *meta, readVolumeMeta(t, filepath.Join(bp, "vol1")))
+
+		entries, err := s.ListTrash("test")
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("restore_as", func(t *testing.T) {
+		s, bp, _, entry := setup(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+
+		_, err := s.RestoreTrash("test", entry.ID, TrashRestoreRequest{})
+		requireStorageError(t, err, ErrAlreadyExists)
+
+		meta, err := s.RestoreTrash("test", entry.ID, TrashRestoreRequest{Name: "vol1-restored"})
+		require.NoError(t, err)
+		assert.Equal(t, "vol1-restored", meta.Name)
+		assert.Equal(t, filepath.Join(bp, "vol1-restored"), meta.Path)
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		s, _, _, _ := newTestStorage(t)
+
+		_, err := s.RestoreTrash("test", "missing", TrashRestoreRequest{})
+		requireStorageError(t, err, ErrNotFound)
+		requireStorageError(t, s.PurgeTrash(ctx, "test", "missing"), ErrNotFound)
+		_, err = s.RestoreTrash("test", "../vol1", TrashRestoreRequest{})
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		s, bp, runner, entry := setup(t)
+		t.Cleanup(func() {
+			TrashVolumesGauge.DeleteLabelValues("test")
+			TrashUsedBytes.DeleteLabelValues("test")
+		})
+		entryDir := filepath.Join(bp, config.TrashDir, entry.ID)
+
+		s.runTrashPurge(ctx, "test", entry.DeletedAt.Add(time.Hour))
+		assert.DirExists(t, entryDir)
+		assert.Equal(t, float64(1), testutil.ToFloat64(TrashVolumesGauge.WithLabelValues("test")))
+		assert.Equal(t, float64(4096), testutil.ToFloat64(TrashUsedBytes.WithLabelValues("test")))
+
+		s.runTrashPurge(ctx, "test", entry.DeletedAt.Add(24*time.Hour))
+		assert.True(t, containsCall(runner.Calls, "subvolume", "delete", filepath.Join(entryDir, config.DataDir)))
+		assert.NoDirExists(t, entryDir)
+		assert.Zero(t, testutil.ToFloat64(TrashVolumesGauge.WithLabelValues("test")))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1"})
+
+		require.NoError(t, s.DeleteVolume(ctx, "test", "vol1"))
+		assert.True(t, containsCall(runner.Calls, "subvolume", "delete", filepath.Join(bp, "vol1", config.DataDir)))
+		_, err := os.Stat(filepath.Join(bp, config.TrashDir))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
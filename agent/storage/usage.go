@@ -44,7 +44,7 @@ func updateAll(ctx context.Context, mgr *btrfs.Manager, basePath string, tenant
 
 	var updated, failed, count int
 	for _, e := range entries {
-		if !e.IsDir() || e.Name() == config.SnapshotsDir {
+		if !e.IsDir() || e.Name() == config.SnapshotsDir || e.Name() == config.TrashDir {
 			continue
 		}
 
@@ -78,6 +78,7 @@ func updateAll(ctx context.Context, mgr *btrfs.Manager, basePath string, tenant
 
 		VolumeSizeBytes.WithLabelValues(tenant, e.Name()).Set(float64(meta.QuotaBytes))
 		VolumeUsedBytes.WithLabelValues(tenant, e.Name()).Set(float64(meta.UsedBytes))
+		VolumeCorruptedFiles.WithLabelValues(tenant, e.Name()).Set(float64(len(meta.CorruptedFiles)))
 
 		// detect usage drift
 		var used uint64
@@ -94,6 +95,23 @@ func updateAll(ctx context.Context, mgr *btrfs.Manager, basePath string, tenant
 			}
 		}
 
+		// usage of the volume together with its snapshots
+		combined := meta.CombinedUsedBytes
+		if meta.GroupQgroup != "" {
+			info, found, err := mgr.QgroupGroupUsage(ctx, meta.GroupQgroup, dataDir)
+			switch {
+			case err != nil:
+				log.Warn().Err(err).Str("volume", e.Name()).Str("qgroup", meta.GroupQgroup).Msg("usage updater: volume qgroup query failed")
+			case !found:
+				log.Warn().Str("volume", e.Name()).Str("qgroup", meta.GroupQgroup).Msg("usage updater: volume qgroup not found")
+			default:
+				combined = info.Referenced
+			}
+			if combined != meta.CombinedUsedBytes {
+				changed = true
+			}
+		}
+
 		if !changed {
 			continue
 		}
@@ -111,6 +129,9 @@ func updateAll(ctx context.Context, mgr *btrfs.Manager, basePath string, tenant
 		if used != meta.UsedBytes {
 			ev = ev.Uint64("oldUsedBytes", meta.UsedBytes).Uint64("newUsedBytes", used)
 		}
+		if combined != meta.CombinedUsedBytes {
+			ev = ev.Uint64("oldCombinedUsedBytes", meta.CombinedUsedBytes).Uint64("newCombinedUsedBytes", combined)
+		}
 		ev.Msg("usage updater: updating metadata")
 
 		if err := UpdateMetadata(metaPath, func(m *VolumeMetadata) {
@@ -118,6 +139,7 @@ func updateAll(ctx context.Context, mgr *btrfs.Manager, basePath string, tenant
 			m.GID = fsGID
 			m.Mode = fsMode
 			m.UsedBytes = used
+			m.CombinedUsedBytes = combined
 			m.UpdatedAt = time.Now().UTC()
 		}); err != nil {
 			log.Error().Err(err).Str("volume", e.Name()).Msg("usage updater: failed to write metadata")
@@ -130,6 +152,12 @@ func updateAll(ctx context.Context, mgr *btrfs.Manager, basePath string, tenant
 	VolumesGauge.WithLabelValues(tenant).Set(float64(count))
 	log.Info().Str("tenant", tenant).Int("volumes", count).Int("updated", updated).Int("failed", failed).Msg("usage updater: volume scan complete")
 
+	// simple quotas charge shared extents to the source volume, a snapshot
+	// only owns what was written to it after creation - nothing to track
+	if mgr.QuotaMode() == btrfs.QuotaModeSimple {
+		return
+	}
+
 	// update snapshot usage
 	snapDir := filepath.Join(basePath, config.SnapshotsDir)
 	snapEntries, err := os.ReadDir(snapDir)
@@ -71,6 +71,7 @@ func cleanupMetrics(t *testing.T, tenant string, volumes ...string) {
 		for _, vol := range volumes {
 			VolumeSizeBytes.DeleteLabelValues(tenant, vol)
 			VolumeUsedBytes.DeleteLabelValues(tenant, vol)
+			VolumeCorruptedFiles.DeleteLabelValues(tenant, vol)
 		}
 	})
 }
@@ -279,6 +280,25 @@ func TestUpdateAllSnapshots(t *testing.T) {
 	cleanupMetrics(t, tenant)
 }
 
+func TestUpdateAllSimpleQuotaSkipsSnapshots(t *testing.T) {
+	bp := t.TempDir()
+	tenant := "squota"
+	runner := &utils.MockRunner{RunFn: qgroupRunFn(2048, 2048)}
+	mgr := btrfs.NewManagerWithRunner("btrfs", runner)
+	mgr.SetQuotaMode(btrfs.QuotaModeSimple)
+
+	volDir := setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", QuotaBytes: 4096, UID: os.Getuid(), GID: os.Getgid(), Mode: "755"})
+	snapDir := setupUsageSnap(t, bp, "snap1", SnapshotMetadata{Name: "snap1", Volume: "vol1"})
+
+	updateAll(context.Background(), mgr, bp, tenant)
+
+	assert.Equal(t, uint64(2048), readVolumeMeta(t, volDir).UsedBytes, "volume usage is still tracked")
+	meta := readSnapMeta(t, snapDir)
+	assert.Zero(t, meta.UsedBytes, "snapshot usage is not tracked with simple quotas")
+	assert.Zero(t, meta.ExclusiveBytes)
+	cleanupMetrics(t, tenant, "vol1")
+}
+
 func TestUpdateAllSnapshotNoChanges(t *testing.T) {
 	bp := t.TempDir()
 	tenant := "snapnoch"
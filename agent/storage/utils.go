@@ -1,9 +1,13 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"regexp"
+	"sync"
+
+	"golang.org/x/sys/unix"
 )
 
 // --- Error types ---
@@ -13,6 +17,8 @@ const (
 	ErrNotFound      = "NOT_FOUND"
 	ErrAlreadyExists = "ALREADY_EXISTS"
 	ErrBusy          = "BUSY"
+	ErrQuotaExceeded = "QUOTA_EXCEEDED"
+	ErrForbidden     = "FORBIDDEN"
 )
 
 type StorageError struct {
@@ -33,6 +39,23 @@ func validateName(name string) error {
 	return nil
 }
 
+// SnapshotName builds a snapshot name for volume with the given suffix,
+// shortening the volume part so the result stays a valid name.
+func SnapshotName(volume, suffix string) string {
+	if max := 128 - len(suffix) - 1; len(volume) > max {
+		volume = volume[:max]
+	}
+	return volume + "-" + suffix
+}
+
+// exchangePaths atomically swaps two paths on the same filesystem.
+func exchangePaths(a, b string) error {
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE); err != nil {
+		return &os.LinkError{Op: "renameat2", Old: a, New: b, Err: err}
+	}
+	return nil
+}
+
 // --- File mode ---
 
 // fileMode converts a traditional Unix octal mode (e.g. 0o2750) to an os.FileMode.
@@ -66,3 +89,29 @@ func unixMode(m os.FileMode) uint64 {
 	}
 	return mode
 }
+
+// backgroundJob is the state of a job running in its own goroutine. The
+// goroutine closes done when it exits, cancel stops it.
+type backgroundJob[T any] struct {
+	mu     sync.Mutex
+	job    T
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newBackgroundJob[T any](job T, cancel context.CancelFunc) *backgroundJob[T] {
+	return &backgroundJob[T]{job: job, cancel: cancel, done: make(chan struct{})}
+}
+
+// snapshot returns a copy of the job state.
+func (j *backgroundJob[T]) snapshot() T {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.job
+}
+
+func (j *backgroundJob[T]) update(fn func(*T)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.job)
+}
@@ -132,6 +132,15 @@ func TestValidateName(t *testing.T) {
 	}
 }
 
+func TestSnapshotName(t *testing.T) {
+	assert.Equal(t, "vol-repl-1", SnapshotName("vol", "repl-1"))
+
+	long := SnapshotName(strings.Repeat("a", 128), "repl-20260102030405")
+	assert.Len(t, long, 128)
+	assert.True(t, strings.HasSuffix(long, "-repl-20260102030405"))
+	assert.NoError(t, validateName(long))
+}
+
 func TestFileMode(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage/btrfs"
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A volume with include_snapshots shares its size with its snapshots. The data
+// subvolume and the snapshots of the volume are members of the level 1 qgroup
+// 1/<data subvolume ID>, limited to the size of the volume. Subvolume IDs start
+// at 256, so these qgroups never collide with a tenant qgroup.
+
+// checkVolumeGroup returns an error if include_snapshots is not supported.
+func (s *Storage) checkVolumeGroup() error {
+	if !s.quotaEnabled {
+		return &StorageError{Code: ErrInvalid, Message: "include_snapshots requires quota to be enabled"}
+	}
+	if s.btrfs.QuotaMode() == btrfs.QuotaModeSimple {
+		return &StorageError{Code: ErrInvalid, Message: "include_snapshots requires the qgroup quota mode, simple quotas already charge data kept by snapshots to the volume"}
+	}
+	return nil
+}
+
+// createVolumeGroup creates the qgroup of the volume at dataDir, assigns the
+// data subvolume and the given snapshot subvolumes and limits it to size. The
+// qgroup ID is only known once the data subvolume exists, so it has to be
+// assigned; an empty new subvolume is accounted without a rescan, existing
+// snapshots share extents and cost one. Later snapshots join with volumeInherit.
+func (s *Storage) createVolumeGroup(ctx context.Context, dataDir string, snapshots []string, size uint64) (string, error) {
+	id, err := s.btrfs.SubvolumeID(ctx, dataDir)
+	if err != nil {
+		return "", fmt.Errorf("subvolume id failed: %w", err)
+	}
+	group := fmt.Sprintf("1/%d", id)
+	if err := s.btrfs.QgroupCreate(ctx, group, s.mountPoint); err != nil {
+		return "", fmt.Errorf("qgroup create failed: %w", err)
+	}
+
+	members := append([]string{dataDir}, snapshots...)
+	for i, path := range members {
+		if err := s.btrfs.QgroupAssign(ctx, path, group); err != nil {
+			log.Error().Err(err).Str("path", path).Str("qgroup", group).Msg("failed to assign volume qgroup")
+			s.destroyVolumeGroup(ctx, group, members[:i])
+			return "", fmt.Errorf("qgroup assign failed: %w", err)
+		}
+	}
+	if err := s.btrfs.QgroupLimitGroup(ctx, group, size, s.mountPoint); err != nil {
+		log.Error().Err(err).Str("qgroup", group).Uint64("bytes", size).Msg("failed to set volume qgroup limit")
+		s.destroyVolumeGroup(ctx, group, members)
+		return "", fmt.Errorf("qgroup limit failed: %w", err)
+	}
+	return group, nil
+}
+
+// destroyVolumeGroup removes members from group and destroys it. Failures are
+// only logged, a leftover qgroup without members limits nothing.
+func (s *Storage) destroyVolumeGroup(ctx context.Context, group string, members []string) {
+	for _, path := range members {
+		if err := s.btrfs.QgroupUnassign(ctx, path, group); err != nil {
+			log.Warn().Err(err).Str("path", path).Str("qgroup", group).Msg("failed to remove subvolume from volume qgroup")
+		}
+	}
+	if err := s.btrfs.QgroupGroupDestroy(ctx, group, s.mountPoint); err != nil {
+		log.Warn().Err(err).Str("qgroup", group).Msg("failed to destroy volume qgroup")
+	}
+}
+
+// volumeGroupMembers returns dataDir followed by the data subvolumes of the
+// snapshots of volume name.
+func (s *Storage) volumeGroupMembers(tenant, name, dataDir string) ([]string, error) {
+	snaps, err := s.ListSnapshots(tenant, name)
+	if err != nil {
+		return nil, err
+	}
+	members := []string{dataDir}
+	for _, snap := range snaps {
+		members = append(members, filepath.Join(s.basePath, tenant, config.SnapshotsDir, snap.Name, config.DataDir))
+	}
+	return members, nil
+}
+
+// dropVolumeGroup destroys the qgroup of a volume before its data subvolume
+// at dataDir is deleted.
+func (s *Storage) dropVolumeGroup(ctx context.Context, tenant string, meta *VolumeMetadata, dataDir string) {
+	if !s.quotaEnabled || meta.GroupQgroup == "" {
+		return
+	}
+	members, err := s.volumeGroupMembers(tenant, meta.Name, dataDir)
+	if err != nil {
+		log.Warn().Err(err).Str("qgroup", meta.GroupQgroup).Msg("failed to list snapshots in volume qgroup")
+		members = []string{dataDir}
+	}
+	s.destroyVolumeGroup(ctx, meta.GroupQgroup, members)
+}
+
+// assignVolumeGroup adds the existing subvolume at path to the qgroup of the
+// volume, no-op if the volume does not include its snapshots.
+func (s *Storage) assignVolumeGroup(ctx context.Context, meta *VolumeMetadata, path string) error {
+	if !s.quotaEnabled || meta.GroupQgroup == "" {
+		return nil
+	}
+	return s.btrfs.QgroupAssign(ctx, path, meta.GroupQgroup)
+}
+
+// volumeInherit returns the qgroups a new subvolume of the volume joins on
+// creation: the tenant qgroup and, if the volume includes its snapshots, the
+// volume qgroup. meta may be nil for a volume that does not exist yet.
+func (s *Storage) volumeInherit(tenant string, meta *VolumeMetadata) []string {
+	qgroups := s.tenantInherit(tenant)
+	if s.quotaEnabled && meta != nil && meta.GroupQgroup != "" {
+		qgroups = append(qgroups, meta.GroupQgroup)
+	}
+	return qgroups
+}
+
+// volumeGroupUsage returns the space used by the volume and its snapshots,
+// extents shared between them count once.
+func (s *Storage) volumeGroupUsage(ctx context.Context, meta *VolumeMetadata) (uint64, error) {
+	info, found, err := s.btrfs.QgroupGroupUsage(ctx, meta.GroupQgroup, s.mountPoint)
+	if err != nil {
+		return 0, fmt.Errorf("qgroup usage failed: %w", err)
+	}
+	if !found {
+		return 0, fmt.Errorf("qgroup %s of volume %q not found", meta.GroupQgroup, meta.Name)
+	}
+	return info.Referenced, nil
+}
+
+// checkVolumeBudget fails with ErrQuotaExceeded once the volume and its
+// snapshots use the whole size of the volume.
+func (s *Storage) checkVolumeBudget(ctx context.Context, meta *VolumeMetadata) error {
+	if !s.quotaEnabled || meta.GroupQgroup == "" {
+		return nil
+	}
+	used, err := s.volumeGroupUsage(ctx, meta)
+	if err != nil {
+		return err
+	}
+	if used >= meta.SizeBytes {
+		return &StorageError{Code: ErrQuotaExceeded, Message: fmt.Sprintf("volume %q and its snapshots use %d of %d bytes, delete snapshots or expand the volume", meta.Name, used, meta.SizeBytes)}
+	}
+	return nil
+}
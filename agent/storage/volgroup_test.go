@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/erikmagkekse/btrfs-nfs-csi/config"
+	"github.com/erikmagkekse/btrfs-nfs-csi/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumeGroup(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T, show string) (*Storage, string, *utils.MockRunner) {
+		s, bp, runner, _ := newTestStorage(t)
+		s.quotaEnabled = true
+		runner.RunFn = tenantQgroupRunFn(show)
+		return s, bp, runner
+	}
+
+	t.Run("requires_quota", func(t *testing.T) {
+		s, _, _, _ := newTestStorage(t)
+
+		_, err := s.CreateVolume(ctx, "test", VolumeCreateRequest{Name: "vol1", SizeBytes: 1 << 20, IncludeSnapshots: true})
+		requireStorageError(t, err, ErrInvalid)
+	})
+
+	t.Run("create", func(t *testing.T) {
+		s, bp, runner := setup(t, "")
+
+		meta, err := s.CreateVolume(ctx, "test", VolumeCreateRequest{Name: "vol1", SizeBytes: 1 << 20, IncludeSnapshots: true})
+		require.NoError(t, err)
+		dataDir := filepath.Join(bp, "vol1", config.DataDir)
+		assert.Equal(t, "1/256", meta.GroupQgroup)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "create", "1/256", s.mountPoint))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "assign", "0/256", "1/256", dataDir))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "1048576", "1/256", s.mountPoint))
+	})
+
+	t.Run("snapshot_within_budget", func(t *testing.T) {
+		s, bp, runner := setup(t, "0/256 4096 4096\n1/256 8192 8192 1048576 none\n")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 1 << 20, GroupQgroup: "1/256"})
+
+		require.NoError(t, s.setupTenantQgroups(ctx, nil))
+		runner.Calls = nil
+
+		_, err := s.CreateSnapshot(ctx, "test", SnapshotCreateRequest{Volume: "vol1", Name: "snap1"})
+		require.NoError(t, err)
+		// the snapshot joins the tenant and the volume qgroup on creation
+		assert.True(t, containsCall(runner.Calls, "subvolume", "snapshot", "-r", "-i", "1/1", "-i", "1/256",
+			filepath.Join(bp, "vol1", config.DataDir), filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir)))
+		assert.Empty(t, callsOf(runner.Calls, "qgroup", "assign"))
+	})
+
+	t.Run("snapshot_over_budget", func(t *testing.T) {
+		s, bp, runner := setup(t, "1/256 1048576 4096 1048576 none\n")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 1 << 20, GroupQgroup: "1/256"})
+
+		_, err := s.CreateSnapshot(ctx, "test", SnapshotCreateRequest{Volume: "vol1", Name: "snap1"})
+		requireStorageError(t, err, ErrQuotaExceeded)
+		assert.Contains(t, err.Error(), "use 1048576 of 1048576 bytes")
+		assert.Empty(t, callsOf(runner.Calls, "subvolume", "snapshot"))
+		assert.NoDirExists(t, filepath.Join(bp, config.SnapshotsDir, "snap1"))
+	})
+
+	t.Run("enable_assigns_snapshots", func(t *testing.T) {
+		s, bp, runner := setup(t, "")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 1 << 20})
+		setupUsageSnap(t, bp, "snap1", SnapshotMetadata{Name: "snap1", Volume: "vol1"})
+		setupUsageSnap(t, bp, "other", SnapshotMetadata{Name: "other", Volume: "vol2"})
+
+		meta, err := s.UpdateVolume(ctx, "test", "vol1", VolumeUpdateRequest{IncludeSnapshots: ptrBool(true)})
+		require.NoError(t, err)
+		assert.Equal(t, "1/256", meta.GroupQgroup)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "assign", "0/256", "1/256", filepath.Join(bp, "vol1", config.DataDir)))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "assign", "0/256", "1/256", filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir)))
+		assert.Len(t, callsOf(runner.Calls, "qgroup", "assign"), 2)
+
+		// enabling again is a no-op
+		runner.Calls = nil
+		_, err = s.UpdateVolume(ctx, "test", "vol1", VolumeUpdateRequest{IncludeSnapshots: ptrBool(true)})
+		require.NoError(t, err)
+		assert.Empty(t, callsOf(runner.Calls, "qgroup"))
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		s, bp, runner := setup(t, "")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 1 << 20, GroupQgroup: "1/256", CombinedUsedBytes: 8192})
+		setupUsageSnap(t, bp, "snap1", SnapshotMetadata{Name: "snap1", Volume: "vol1"})
+
+		meta, err := s.UpdateVolume(ctx, "test", "vol1", VolumeUpdateRequest{IncludeSnapshots: ptrBool(false)})
+		require.NoError(t, err)
+		assert.Empty(t, meta.GroupQgroup)
+		assert.Zero(t, meta.CombinedUsedBytes)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "none", "1/256", s.mountPoint))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "remove", "0/256", "1/256", filepath.Join(bp, config.SnapshotsDir, "snap1", config.DataDir)))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "destroy", "1/256", s.mountPoint))
+	})
+
+	t.Run("resize", func(t *testing.T) {
+		s, bp, runner := setup(t, "0/256 4096 4096\n1/256 8192 8192 2097152 none\n")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 2 << 20, GroupQgroup: "1/256"})
+
+		_, err := s.UpdateVolume(ctx, "test", "vol1", VolumeUpdateRequest{SizeBytes: ptrUint64(4 << 20)})
+		require.NoError(t, err)
+		assert.True(t, containsCall(runner.Calls, "qgroup", "limit", "4194304", "1/256", s.mountPoint))
+	})
+
+	t.Run("shrink_counts_snapshots", func(t *testing.T) {
+		s, bp, _ := setup(t, "0/256 4096 4096\n1/256 838860800 4096 1073741824 none\n")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 1 << 30, GroupQgroup: "1/256"})
+
+		_, err := s.UpdateVolume(ctx, "test", "vol1", VolumeUpdateRequest{SizeBytes: ptrUint64(512 << 20)})
+		requireStorageError(t, err, ErrInvalid)
+		assert.Contains(t, err.Error(), "838860800 bytes in use")
+	})
+
+	t.Run("delete_destroys_qgroup", func(t *testing.T) {
+		s, bp, runner := setup(t, "")
+		setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 1 << 20, GroupQgroup: "1/256"})
+
+		require.NoError(t, s.DeleteVolume(ctx, "test", "vol1"))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "remove", "0/256", "1/256", filepath.Join(bp, "vol1", config.DataDir)))
+		assert.True(t, containsCall(runner.Calls, "qgroup", "destroy", "1/256", s.mountPoint))
+	})
+
+	t.Run("usage_updater", func(t *testing.T) {
+		s, bp, _ := setup(t, "0/256 4096 4096\n1/256 12288 8192 1048576 none\n")
+		cleanupMetrics(t, "test", "vol1")
+		volDir := setupUsageVol(t, bp, "vol1", VolumeMetadata{Name: "vol1", SizeBytes: 1 << 20, QuotaBytes: 1 << 20, GroupQgroup: "1/256"})
+
+		updateAll(ctx, s.btrfs, bp, "test")
+		meta := readVolumeMeta(t, volDir)
+		assert.Equal(t, uint64(4096), meta.UsedBytes)
+		assert.Equal(t, uint64(12288), meta.CombinedUsedBytes)
+	})
+}
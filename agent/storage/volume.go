@@ -14,6 +14,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// shrinkMinMargin is the minimum free space kept when shrinking a volume.
+const shrinkMinMargin = 64 << 20
+
 func (s *Storage) CreateVolume(ctx context.Context, tenant string, req VolumeCreateRequest) (*VolumeMetadata, error) {
 	bp, err := s.tenantPath(tenant)
 	if err != nil {
@@ -43,6 +46,15 @@ func (s *Storage) CreateVolume(ctx context.Context, tenant string, req VolumeCre
 	if err != nil {
 		return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("invalid mode: %s", req.Mode)}
 	}
+	schedule, err := utils.ParseSnapshotSchedule(req.SnapshotSchedule)
+	if err != nil {
+		return nil, &StorageError{Code: ErrInvalid, Message: err.Error()}
+	}
+	if req.IncludeSnapshots {
+		if err := s.checkVolumeGroup(); err != nil {
+			return nil, err
+		}
+	}
 
 	// operations
 	volDir := filepath.Join(bp, req.Name)
@@ -61,7 +73,11 @@ func (s *Storage) CreateVolume(ctx context.Context, tenant string, req VolumeCre
 		return nil, fmt.Errorf("create volume directory: %w", err)
 	}
 
+	var group string
 	cleanup := func() {
+		if group != "" {
+			s.destroyVolumeGroup(ctx, group, []string{dataDir})
+		}
 		if err := s.btrfs.SubvolumeDelete(ctx, dataDir); err != nil {
 			log.Warn().Err(err).Str("path", dataDir).Msg("cleanup: failed to delete subvolume")
 		}
@@ -70,7 +86,7 @@ func (s *Storage) CreateVolume(ctx context.Context, tenant string, req VolumeCre
 		}
 	}
 
-	if err := s.btrfs.SubvolumeCreate(ctx, dataDir); err != nil {
+	if err := s.btrfs.SubvolumeCreate(ctx, dataDir, s.tenantInherit(tenant)...); err != nil {
 		_ = os.RemoveAll(volDir)
 		log.Error().Err(err).Str("path", dataDir).Msg("failed to create subvolume")
 		return nil, fmt.Errorf("btrfs subvolume create failed: %w", err)
@@ -98,6 +114,12 @@ func (s *Storage) CreateVolume(ctx context.Context, tenant string, req VolumeCre
 			cleanup()
 			return nil, fmt.Errorf("qgroup limit failed: %w", err)
 		}
+		if req.IncludeSnapshots {
+			if group, err = s.createVolumeGroup(ctx, dataDir, nil, req.SizeBytes); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
 	}
 
 	if err := os.Chmod(dataDir, fileMode(mode)); err != nil {
@@ -109,17 +131,20 @@ func (s *Storage) CreateVolume(ctx context.Context, tenant string, req VolumeCre
 
 	now := time.Now().UTC()
 	meta := VolumeMetadata{
-		Name:        req.Name,
-		Path:        volDir,
-		SizeBytes:   req.SizeBytes,
-		NoCOW:       req.NoCOW,
-		Compression: req.Compression,
-		QuotaBytes:  req.QuotaBytes,
-		UID:         req.UID,
-		GID:         req.GID,
-		Mode:        req.Mode,
-		CreatedAt:   now,
-		UpdatedAt:   now,
+		Name:             req.Name,
+		Path:             volDir,
+		SizeBytes:        req.SizeBytes,
+		NoCOW:            req.NoCOW,
+		Compression:      req.Compression,
+		QuotaBytes:       req.QuotaBytes,
+		UID:              req.UID,
+		GID:              req.GID,
+		Mode:             req.Mode,
+		Replicate:        req.Replicate,
+		SnapshotSchedule: schedule.String(),
+		GroupQgroup:      group,
+		CreatedAt:        now,
+		UpdatedAt:        now,
 	}
 
 	if err := writeMetadataAtomic(filepath.Join(volDir, config.MetadataFile), meta); err != nil {
@@ -146,7 +171,7 @@ func (s *Storage) ListVolumes(tenant string) ([]VolumeMetadata, error) {
 
 	var vols []VolumeMetadata
 	for _, e := range entries {
-		if !e.IsDir() || e.Name() == config.SnapshotsDir {
+		if !e.IsDir() || e.Name() == config.SnapshotsDir || e.Name() == config.TrashDir {
 			continue
 		}
 		metaPath := filepath.Join(bp, e.Name(), config.MetadataFile)
@@ -196,8 +221,18 @@ func (s *Storage) UpdateVolume(ctx context.Context, tenant, name string, req Vol
 	}
 
 	// validation
-	if req.SizeBytes != nil && *req.SizeBytes <= cur.SizeBytes {
-		return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("new size %d must be larger than current size %d", *req.SizeBytes, cur.SizeBytes)}
+	if req.SizeBytes != nil && *req.SizeBytes == cur.SizeBytes {
+		return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("new size %d equals current size", *req.SizeBytes)}
+	}
+	if req.SizeBytes != nil && *req.SizeBytes < cur.SizeBytes {
+		if err := s.checkShrink(ctx, &cur, dataDir, *req.SizeBytes); err != nil {
+			return nil, err
+		}
+	}
+	if req.IncludeSnapshots != nil && *req.IncludeSnapshots && cur.GroupQgroup == "" {
+		if err := s.checkVolumeGroup(); err != nil {
+			return nil, err
+		}
 	}
 	if req.Compression != nil {
 		if !utils.IsValidCompression(*req.Compression) {
@@ -215,6 +250,14 @@ func (s *Storage) UpdateVolume(ctx context.Context, tenant, name string, req Vol
 			return nil, &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("invalid mode: %s", *req.Mode)}
 		}
 	}
+	if req.SnapshotSchedule != nil {
+		schedule, err := utils.ParseSnapshotSchedule(*req.SnapshotSchedule)
+		if err != nil {
+			return nil, &StorageError{Code: ErrInvalid, Message: err.Error()}
+		}
+		canonical := schedule.String()
+		req.SnapshotSchedule = &canonical
+	}
 
 	// operations
 	if req.SizeBytes != nil && s.quotaEnabled {
@@ -263,6 +306,11 @@ func (s *Storage) UpdateVolume(ctx context.Context, tenant, name string, req Vol
 		}
 	}
 
+	group, err := s.updateVolumeGroup(ctx, tenant, dataDir, &cur, req)
+	if err != nil {
+		return nil, err
+	}
+
 	var updated VolumeMetadata
 	if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) {
 		if req.SizeBytes != nil {
@@ -284,6 +332,16 @@ func (s *Storage) UpdateVolume(ctx context.Context, tenant, name string, req Vol
 		if req.Mode != nil {
 			meta.Mode = *req.Mode
 		}
+		if req.Replicate != nil {
+			meta.Replicate = *req.Replicate
+		}
+		if req.SnapshotSchedule != nil {
+			meta.SnapshotSchedule = *req.SnapshotSchedule
+		}
+		meta.GroupQgroup = group
+		if group == "" {
+			meta.CombinedUsedBytes = 0
+		}
 		meta.UpdatedAt = time.Now().UTC()
 		updated = *meta
 	}); err != nil {
@@ -292,9 +350,107 @@ func (s *Storage) UpdateVolume(ctx context.Context, tenant, name string, req Vol
 	}
 
 	log.Info().Str("tenant", tenant).Str("name", name).Msg("volume updated")
+
+	if s.recompressOnChange && req.Compression != nil && *req.Compression != cur.Compression && *req.Compression != "" && *req.Compression != "none" {
+		if _, err := s.StartDefragment(tenant, name, DefragmentRequest{}); err != nil {
+			log.Warn().Err(err).Str("tenant", tenant).Str("name", name).Msg("failed to start recompression after compression change")
+		}
+	}
 	return &updated, nil
 }
 
+// updateVolumeGroup applies include_snapshots and resizes the volume qgroup.
+// It returns the qgroup the volume is in afterwards.
+func (s *Storage) updateVolumeGroup(ctx context.Context, tenant, dataDir string, cur *VolumeMetadata, req VolumeUpdateRequest) (string, error) {
+	size := cur.SizeBytes
+	if req.SizeBytes != nil {
+		size = *req.SizeBytes
+	}
+
+	switch {
+	case req.IncludeSnapshots != nil && *req.IncludeSnapshots && cur.GroupQgroup == "":
+		members, err := s.volumeGroupMembers(tenant, cur.Name, dataDir)
+		if err != nil {
+			return "", err
+		}
+		return s.createVolumeGroup(ctx, members[0], members[1:], size)
+
+	case req.IncludeSnapshots != nil && !*req.IncludeSnapshots && cur.GroupQgroup != "":
+		if !s.quotaEnabled {
+			return "", nil
+		}
+		members, err := s.volumeGroupMembers(tenant, cur.Name, dataDir)
+		if err != nil {
+			return "", err
+		}
+		if err := s.btrfs.QgroupLimitGroup(ctx, cur.GroupQgroup, 0, s.mountPoint); err != nil {
+			log.Error().Err(err).Str("qgroup", cur.GroupQgroup).Msg("failed to remove volume qgroup limit")
+			return "", fmt.Errorf("qgroup limit failed: %w", err)
+		}
+		s.destroyVolumeGroup(ctx, cur.GroupQgroup, members)
+		return "", nil
+
+	case req.SizeBytes != nil && cur.GroupQgroup != "" && s.quotaEnabled:
+		if err := s.btrfs.QgroupLimitGroup(ctx, cur.GroupQgroup, size, s.mountPoint); err != nil {
+			log.Error().Err(err).Str("qgroup", cur.GroupQgroup).Uint64("bytes", size).Msg("failed to update volume qgroup limit")
+			return "", fmt.Errorf("qgroup limit failed: %w", err)
+		}
+	}
+	return cur.GroupQgroup, nil
+}
+
+// checkShrink allows shrinking a volume to size only if its referenced usage
+// plus shrinkMargin fits. A volume including its snapshots counts their usage
+// too. Without quota the usage is unknown.
+func (s *Storage) checkShrink(ctx context.Context, cur *VolumeMetadata, dataDir string, size uint64) error {
+	if !s.quotaEnabled {
+		return &StorageError{Code: ErrInvalid, Message: "shrinking a volume requires quota to be enabled"}
+	}
+	used, err := s.btrfs.QgroupUsage(ctx, dataDir)
+	if err != nil {
+		return fmt.Errorf("qgroup usage failed: %w", err)
+	}
+	if cur.GroupQgroup != "" {
+		if used, err = s.volumeGroupUsage(ctx, cur); err != nil {
+			return err
+		}
+	}
+	margin := shrinkMargin(size)
+	if used+margin > size {
+		return &StorageError{Code: ErrInvalid, Message: fmt.Sprintf("cannot shrink to %d bytes: %d bytes in use, at least %d bytes required (%d bytes margin)", size, used, used+margin, margin)}
+	}
+	return nil
+}
+
+// shrinkMargin is the free space a volume must keep after a shrink, 10% of
+// the new size but at least shrinkMinMargin, so writers do not hit the limit
+// right away.
+func shrinkMargin(size uint64) uint64 {
+	return max(size/10, shrinkMinMargin)
+}
+
+// SetReplicationState records the last snapshot replicated to the peer.
+func (s *Storage) SetReplicationState(tenant, name string, state *ReplicationState) error {
+	bp, err := s.tenantPath(tenant)
+	if err != nil {
+		return err
+	}
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	metaPath := filepath.Join(bp, name, config.MetadataFile)
+	if err := UpdateMetadata(metaPath, func(meta *VolumeMetadata) {
+		meta.Replication = state
+	}); err != nil {
+		if os.IsNotExist(err) {
+			return &StorageError{Code: ErrNotFound, Message: fmt.Sprintf("volume %q not found", name)}
+		}
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+	return nil
+}
+
 func (s *Storage) DeleteVolume(ctx context.Context, tenant, name string) error {
 	bp, err := s.tenantPath(tenant)
 	if err != nil {
@@ -318,7 +474,14 @@ func (s *Storage) DeleteVolume(ctx context.Context, tenant, name string) error {
 		return &StorageError{Code: ErrBusy, Message: fmt.Sprintf("volume %q still has active NFS exports", name)}
 	}
 
+	s.stopDefragment(tenant, name)
+
+	if s.trashRetention > 0 {
+		return s.moveToTrash(bp, tenant, name)
+	}
+
 	dataDir := filepath.Join(volDir, config.DataDir)
+	s.dropVolumeGroup(ctx, tenant, &meta, dataDir)
 	if err := s.btrfs.SubvolumeDelete(ctx, dataDir); err != nil {
 		log.Error().Err(err).Msg("failed to delete subvolume")
 		return fmt.Errorf("btrfs subvolume delete failed: %w", err)
@@ -45,6 +45,9 @@ func TestCreateVolume(t *testing.T) {
 			{name: "invalid_mode", req: VolumeCreateRequest{
 				Name: "vol", SizeBytes: 1024, Mode: "nope",
 			}, code: ErrInvalid},
+			{name: "invalid_snapshot_schedule", req: VolumeCreateRequest{
+				Name: "vol", SizeBytes: 1024, SnapshotSchedule: "yearly=1",
+			}, code: ErrInvalid},
 		}
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
@@ -329,7 +332,7 @@ func TestUpdateVolume(t *testing.T) {
 				code: ErrInvalid,
 			},
 			{
-				name: "size_must_increase",
+				name: "shrink_without_quota",
 				vol:  "vol",
 				meta: VolumeMetadata{Name: "vol", SizeBytes: 1024},
 				req:  VolumeUpdateRequest{SizeBytes: ptrUint64(512)},
@@ -393,6 +396,44 @@ func TestUpdateVolume(t *testing.T) {
 		assert.Equal(t, []string{"qgroup", "limit", "2048", dataDir}, runner.Calls[0])
 	})
 
+	t.Run("shrink", func(t *testing.T) {
+		const mib = 1 << 20
+		tests := []struct {
+			name string
+			used uint64
+			size uint64
+			ok   bool
+		}{
+			{"fits", 500 * mib, 1024 * mib, true},
+			{"exact_margin", 100*mib - shrinkMinMargin, 100 * mib, true},
+			{"percent_margin", 950 * mib, 1024 * mib, false},
+			{"min_margin", 90 * mib, 100 * mib, false},
+			{"over_usage", 2048 * mib, 1024 * mib, false},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s, bp, runner, _ := newTestStorage(t)
+				s.quotaEnabled = true
+				runner.RunFn = qgroupRunFn(tt.used, tt.used)
+				setupVol(t, bp, "vol", VolumeMetadata{Name: "vol", SizeBytes: 4096 * mib, QuotaBytes: 4096 * mib})
+				dataDir := filepath.Join(bp, "vol", config.DataDir)
+
+				meta, err := s.UpdateVolume(ctx, "test", "vol", VolumeUpdateRequest{SizeBytes: ptrUint64(tt.size)})
+				if !tt.ok {
+					requireStorageError(t, err, ErrInvalid)
+					assert.Contains(t, err.Error(), fmt.Sprintf("%d bytes in use", tt.used))
+					assert.False(t, containsCall(runner.Calls, "qgroup", "limit", fmt.Sprint(tt.size), dataDir))
+					assert.Equal(t, uint64(4096*mib), readVolumeMeta(t, filepath.Join(bp, "vol")).SizeBytes)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tt.size, meta.SizeBytes)
+				assert.Equal(t, tt.size, meta.QuotaBytes)
+				assert.True(t, containsCall(runner.Calls, "qgroup", "limit", fmt.Sprint(tt.size), dataDir))
+			})
+		}
+	})
+
 	t.Run("update_compression", func(t *testing.T) {
 		s, bp, runner, _ := newTestStorage(t)
 		setupVol(t, bp, "vol", VolumeMetadata{Name: "vol", SizeBytes: 1024})
@@ -466,6 +507,41 @@ func TestUpdateVolume(t *testing.T) {
 		assert.Equal(t, os.FileMode(0o700), info.Mode().Perm(), "permissions should be updated")
 	})
 
+	t.Run("update_snapshot_schedule", func(t *testing.T) {
+		s, bp, _, _ := newTestStorage(t)
+		setupVol(t, bp, "vol", VolumeMetadata{Name: "vol", SizeBytes: 1024})
+
+		meta, err := s.UpdateVolume(ctx, "test", "vol", VolumeUpdateRequest{
+			SnapshotSchedule: ptrString("daily=7, hourly=24"),
+		})
+		require.NoError(t, err, "UpdateVolume")
+		assert.Equal(t, "hourly=24,daily=7", meta.SnapshotSchedule, "schedule is stored in canonical form")
+
+		_, err = s.UpdateVolume(ctx, "test", "vol", VolumeUpdateRequest{
+			SnapshotSchedule: ptrString("hourly=x"),
+		})
+		requireStorageError(t, err, ErrInvalid)
+
+		meta, err = s.UpdateVolume(ctx, "test", "vol", VolumeUpdateRequest{
+			SnapshotSchedule: ptrString(""),
+		})
+		require.NoError(t, err, "UpdateVolume")
+		assert.Empty(t, meta.SnapshotSchedule, "empty schedule disables snapshots")
+	})
+
+	t.Run("update_replicate", func(t *testing.T) {
+		s, bp, runner, _ := newTestStorage(t)
+		setupVol(t, bp, "vol", VolumeMetadata{Name: "vol", SizeBytes: 1024})
+
+		meta, err := s.UpdateVolume(ctx, "test", "vol", VolumeUpdateRequest{
+			Replicate: ptrBool(true),
+		})
+		require.NoError(t, err, "UpdateVolume")
+		assert.True(t, meta.Replicate)
+		assert.True(t, readVolumeMeta(t, filepath.Join(bp, "vol")).Replicate)
+		assert.Empty(t, runner.Calls)
+	})
+
 	t.Run("qgroup_limit_fails", func(t *testing.T) {
 		runner := &utils.MockRunner{Err: fmt.Errorf("qgroup error")}
 		exporter := &nfs.MockExporter{}
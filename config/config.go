@@ -20,6 +20,9 @@ const (
 	ParamGID         = "gid"
 	ParamMode        = "mode"
 
+	ParamSnapshotSchedule = "snapshot-schedule"
+	ParamIncludeSnapshots = "include-snapshots"
+
 	ParamNFSServer       = "nfsServer"
 	ParamNFSMountOptions = "nfsMountOptions"
 	ParamNFSSharePath    = "nfsSharePath"
@@ -33,27 +36,47 @@ const (
 	DataDir      = "data"
 	MetadataFile = "metadata.json"
 	SnapshotsDir = "snapshots"
+	// TrashDir holds deleted volumes until the trash purger removes them.
+	TrashDir = ".trash"
+	// TenantsFile in the base path persists the tenants and their tokens.
+	TenantsFile = ".tenants.json"
 )
 
 type AgentConfig struct {
-	BasePath             string        `env:"AGENT_BASE_PATH" envDefault:"./storage"`
-	ListenAddr           string        `env:"AGENT_LISTEN_ADDR" envDefault:":8080"`
-	MetricsAddr          string        `env:"AGENT_METRICS_ADDR" envDefault:"127.0.0.1:9090"`
-	Tenants              string        `env:"AGENT_TENANTS,required"`
-	TLSCert              string        `env:"AGENT_TLS_CERT"`
-	TLSKey               string        `env:"AGENT_TLS_KEY"`
-	QuotaEnabled         bool          `env:"AGENT_FEATURE_QUOTA_ENABLED" envDefault:"true"`
-	UsageInterval        time.Duration `env:"AGENT_FEATURE_QUOTA_UPDATE_INTERVAL" envDefault:"1m"`
-	NFSExporter          string        `env:"AGENT_NFS_EXPORTER" envDefault:"kernel"`
-	ExportfsBin          string        `env:"AGENT_EXPORTFS_BIN" envDefault:"exportfs"`
-	KernelExportOptions  string        `env:"AGENT_KERNEL_EXPORT_OPTIONS" envDefault:"rw,nohide,crossmnt,no_root_squash,no_subtree_check"`
-	BtrfsBin             string        `env:"AGENT_BTRFS_BIN" envDefault:"btrfs"`
-	NFSReconcileInterval time.Duration `env:"AGENT_NFS_RECONCILE_INTERVAL" envDefault:"10m"`
-	DeviceIOInterval     time.Duration `env:"AGENT_DEVICE_IO_INTERVAL" envDefault:"5s"`
-	DeviceStatsInterval  time.Duration `env:"AGENT_DEVICE_STATS_INTERVAL" envDefault:"1m"`
-	DashboardRefresh     int           `env:"AGENT_DASHBOARD_REFRESH_SECONDS" envDefault:"5"`
-	DefaultDirMode       string        `env:"AGENT_DEFAULT_DIR_MODE" envDefault:"0700"`
-	DefaultDataMode      string        `env:"AGENT_DEFAULT_DATA_MODE" envDefault:"2770"`
+	BasePath                 string        `env:"AGENT_BASE_PATH" envDefault:"./storage"`
+	ListenAddr               string        `env:"AGENT_LISTEN_ADDR" envDefault:":8080"`
+	MetricsAddr              string        `env:"AGENT_METRICS_ADDR" envDefault:"127.0.0.1:9090"`
+	Tenants                  string        `env:"AGENT_TENANTS"`
+	TenantsFile              string        `env:"AGENT_TENANTS_FILE"`
+	TLSCert                  string        `env:"AGENT_TLS_CERT"`
+	TLSKey                   string        `env:"AGENT_TLS_KEY"`
+	AdminToken               string        `env:"AGENT_ADMIN_TOKEN"`
+	QuotaEnabled             bool          `env:"AGENT_FEATURE_QUOTA_ENABLED" envDefault:"true"`
+	QuotaMode                string        `env:"AGENT_FEATURE_QUOTA_MODE" envDefault:"auto"`
+	UsageInterval            time.Duration `env:"AGENT_FEATURE_QUOTA_UPDATE_INTERVAL" envDefault:"1m"`
+	NFSExporter              string        `env:"AGENT_NFS_EXPORTER" envDefault:"kernel"`
+	ExportfsBin              string        `env:"AGENT_EXPORTFS_BIN" envDefault:"exportfs"`
+	KernelExportOptions      string        `env:"AGENT_KERNEL_EXPORT_OPTIONS" envDefault:"rw,nohide,crossmnt,no_root_squash,no_subtree_check"`
+	BtrfsBin                 string        `env:"AGENT_BTRFS_BIN" envDefault:"btrfs"`
+	BtrfsBackend             string        `env:"AGENT_BTRFS_BACKEND" envDefault:"cli"`
+	NFSReconcileInterval     time.Duration `env:"AGENT_NFS_RECONCILE_INTERVAL" envDefault:"10m"`
+	DeviceIOInterval         time.Duration `env:"AGENT_DEVICE_IO_INTERVAL" envDefault:"5s"`
+	DeviceStatsInterval      time.Duration `env:"AGENT_DEVICE_STATS_INTERVAL" envDefault:"1m"`
+	DashboardRefresh         int           `env:"AGENT_DASHBOARD_REFRESH_SECONDS" envDefault:"5"`
+	DefaultDirMode           string        `env:"AGENT_DEFAULT_DIR_MODE" envDefault:"0700"`
+	DefaultDataMode          string        `env:"AGENT_DEFAULT_DATA_MODE" envDefault:"2770"`
+	SnapshotScheduleInterval time.Duration `env:"AGENT_SNAPSHOT_SCHEDULE_INTERVAL" envDefault:"5m"`
+	ConsistencyInterval      time.Duration `env:"AGENT_CONSISTENCY_CHECK_INTERVAL" envDefault:"1h"`
+	ScrubSchedule            string        `env:"AGENT_SCRUB_SCHEDULE"`
+	CorruptionScanInterval   time.Duration `env:"AGENT_CORRUPTION_SCAN_INTERVAL" envDefault:"1m"`
+	AutoBalanceThreshold     uint64        `env:"AGENT_AUTO_BALANCE_MIN_UNALLOCATED_BYTES" envDefault:"0"`
+	AutoBalanceUsage         int           `env:"AGENT_AUTO_BALANCE_USAGE" envDefault:"20"`
+	RecompressOnChange       bool          `env:"AGENT_RECOMPRESS_ON_CHANGE" envDefault:"false"`
+	DedupeRateLimit          uint64        `env:"AGENT_DEDUPE_RATE_LIMIT" envDefault:"52428800"`
+	TrashRetention           time.Duration `env:"AGENT_TRASH_RETENTION" envDefault:"0"`
+	ReplicationPeerURL       string        `env:"AGENT_REPLICATION_PEER_URL"`
+	ReplicationPeerTokens    string        `env:"AGENT_REPLICATION_PEER_TOKENS"`
+	ReplicationInterval      time.Duration `env:"AGENT_REPLICATION_INTERVAL" envDefault:"0"`
 }
 
 type ControllerConfig struct {
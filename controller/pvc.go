@@ -14,21 +14,25 @@ import (
 )
 
 type volumeParams struct {
-	StorageClass string
-	NoCOW        string
-	Compression  string
-	UID          string
-	GID          string
-	Mode         string
+	StorageClass     string
+	NoCOW            string
+	Compression      string
+	UID              string
+	GID              string
+	Mode             string
+	SnapshotSchedule string
+	IncludeSnapshots string
 }
 
 func resolveVolumeParams(ctx context.Context, params map[string]string) volumeParams {
 	vp := volumeParams{
-		NoCOW:       params[config.ParamNoCOW],
-		Compression: params[config.ParamCompression],
-		UID:         params[config.ParamUID],
-		GID:         params[config.ParamGID],
-		Mode:        params[config.ParamMode],
+		NoCOW:            params[config.ParamNoCOW],
+		Compression:      params[config.ParamCompression],
+		UID:              params[config.ParamUID],
+		GID:              params[config.ParamGID],
+		Mode:             params[config.ParamMode],
+		SnapshotSchedule: params[config.ParamSnapshotSchedule],
+		IncludeSnapshots: params[config.ParamIncludeSnapshots],
 	}
 
 	pvcName := params[config.PvcNameKey]
@@ -71,6 +75,12 @@ func resolveVolumeParams(ctx context.Context, params map[string]string) volumePa
 	if v, ok := annos[config.AnnoPrefix+config.ParamMode]; ok {
 		vp.Mode = v
 	}
+	if v, ok := annos[config.AnnoPrefix+config.ParamSnapshotSchedule]; ok {
+		vp.SnapshotSchedule = v
+	}
+	if v, ok := annos[config.AnnoPrefix+config.ParamIncludeSnapshots]; ok {
+		vp.IncludeSnapshots = v
+	}
 
 	return vp
 }
@@ -97,6 +107,14 @@ func (vp *volumeParams) validate() error {
 			return fmt.Errorf("invalid mode %q: %v", vp.Mode, err)
 		}
 	}
+	if vp.SnapshotSchedule != "" {
+		if _, err := utils.ParseSnapshotSchedule(vp.SnapshotSchedule); err != nil {
+			return fmt.Errorf("invalid snapshot schedule %q: %v", vp.SnapshotSchedule, err)
+		}
+	}
+	if vp.IncludeSnapshots != "" && vp.IncludeSnapshots != "true" && vp.IncludeSnapshots != "false" {
+		return fmt.Errorf("invalid include-snapshots %q: must be \"true\" or \"false\"", vp.IncludeSnapshots)
+	}
 	return nil
 }
 
@@ -126,5 +144,14 @@ func (vp *volumeParams) toUpdateRequest() (agentAPI.VolumeUpdateRequest, bool) {
 		update.Compression = &vp.Compression
 		changed = true
 	}
+	if vp.SnapshotSchedule != "" {
+		update.SnapshotSchedule = &vp.SnapshotSchedule
+		changed = true
+	}
+	if vp.IncludeSnapshots != "" {
+		include := vp.IncludeSnapshots == "true"
+		update.IncludeSnapshots = &include
+		changed = true
+	}
 	return update, changed
 }
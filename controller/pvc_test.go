@@ -20,6 +20,10 @@ func TestVolumeParamsValidate(t *testing.T) {
 		{name: "invalid_uid", vp: volumeParams{UID: "abc"}, wantErr: true},
 		{name: "invalid_gid", vp: volumeParams{GID: "-1.5"}, wantErr: true},
 		{name: "invalid_mode_not_octal", vp: volumeParams{Mode: "999"}, wantErr: true},
+		{name: "valid_snapshot_schedule", vp: volumeParams{SnapshotSchedule: "hourly=24,daily=7"}},
+		{name: "invalid_snapshot_schedule", vp: volumeParams{SnapshotSchedule: "hourly=-1"}, wantErr: true},
+		{name: "valid_include_snapshots", vp: volumeParams{IncludeSnapshots: "true"}},
+		{name: "invalid_include_snapshots", vp: volumeParams{IncludeSnapshots: "yes"}, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -68,6 +72,22 @@ func TestToUpdateRequest(t *testing.T) {
 		assert.False(t, *req.NoCOW)
 	})
 
+	t.Run("snapshot_schedule", func(t *testing.T) {
+		vp := volumeParams{SnapshotSchedule: "daily=7"}
+		req, changed := vp.toUpdateRequest()
+		require.True(t, changed)
+		require.NotNil(t, req.SnapshotSchedule)
+		assert.Equal(t, "daily=7", *req.SnapshotSchedule)
+	})
+
+	t.Run("include_snapshots", func(t *testing.T) {
+		vp := volumeParams{IncludeSnapshots: "true"}
+		req, changed := vp.toUpdateRequest()
+		require.True(t, changed)
+		require.NotNil(t, req.IncludeSnapshots)
+		assert.True(t, *req.IncludeSnapshots)
+	})
+
 	t.Run("compression", func(t *testing.T) {
 		vp := volumeParams{Compression: "zstd"}
 		req, changed := vp.toUpdateRequest()
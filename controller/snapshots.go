@@ -130,6 +130,10 @@ func (s *Server) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 				},
 			}, nil
 		}
+		if agentAPI.IsQuotaExceeded(err) {
+			agentOpsTotal.WithLabelValues("create_snapshot", "quota_exceeded", sc).Inc()
+			return nil, status.Errorf(codes.ResourceExhausted, "create snapshot: %v", err)
+		}
 		agentOpsTotal.WithLabelValues("create_snapshot", "error", sc).Inc()
 		return nil, status.Errorf(codes.Internal, "create snapshot: %v", err)
 	}
@@ -76,14 +76,18 @@ func (s *Server) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.Internal, "failed to resolve StorageClass name from PVC")
 	}
 
-	var sizeBytes uint64 = 1 << 30 // 1 GiB default
+	var requestedBytes uint64
 	if req.CapacityRange != nil {
 		if req.CapacityRange.RequiredBytes > 0 {
-			sizeBytes = uint64(req.CapacityRange.RequiredBytes)
+			requestedBytes = uint64(req.CapacityRange.RequiredBytes)
 		} else if req.CapacityRange.LimitBytes > 0 {
-			sizeBytes = uint64(req.CapacityRange.LimitBytes)
+			requestedBytes = uint64(req.CapacityRange.LimitBytes)
 		}
 	}
+	sizeBytes := requestedBytes
+	if sizeBytes == 0 {
+		sizeBytes = 1 << 30 // 1 GiB default
+	}
 
 	volCtx := map[string]string{
 		config.ParamNFSServer: nfsServer,
@@ -99,22 +103,36 @@ func (s *Server) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		volCtx[config.PvcNamespaceKey] = ns
 	}
 
-	// Clone from snapshot
-	if req.VolumeContentSource != nil {
-		snap := req.VolumeContentSource.GetSnapshot()
-		if snap == nil {
-			return nil, status.Error(codes.InvalidArgument, "only snapshot content source is supported")
-		}
-		_, snapName, err := utils.ParseVolumeID(snap.SnapshotId)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot ID: %v", err)
+	// Clone from snapshot or volume
+	if src := req.VolumeContentSource; src != nil {
+		// without a requested capacity the clone gets the source size
+		cloneReq := agentAPI.CloneCreateRequest{Name: req.Name, SizeBytes: requestedBytes}
+		switch {
+		case src.GetSnapshot() != nil:
+			var srcSC string
+			srcSC, cloneReq.Snapshot, err = utils.ParseVolumeID(src.GetSnapshot().SnapshotId)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot ID: %v", err)
+			}
+			if srcSC != sc {
+				return nil, status.Errorf(codes.InvalidArgument, "source snapshot is on storage class %q, not %q", srcSC, sc)
+			}
+		case src.GetVolume() != nil:
+			var srcSC string
+			srcSC, cloneReq.Volume, err = utils.ParseVolumeID(src.GetVolume().VolumeId)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid source volume ID: %v", err)
+			}
+			// the agent resolves the source by name, so it must be on the same agent
+			if srcSC != sc {
+				return nil, status.Errorf(codes.InvalidArgument, "source volume is on storage class %q, not %q", srcSC, sc)
+			}
+		default:
+			return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
 		}
 
 		start := time.Now()
-		cloneResp, err := client.CreateClone(ctx, agentAPI.CloneCreateRequest{
-			Snapshot: snapName,
-			Name:     req.Name,
-		})
+		cloneResp, err := client.CreateClone(ctx, cloneReq)
 		agentDuration.WithLabelValues("create_clone", sc).Observe(time.Since(start).Seconds())
 		if err != nil {
 			if agentAPI.IsConflict(err) {
@@ -122,6 +140,9 @@ func (s *Server) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 				if cloneResp == nil {
 					return nil, status.Errorf(codes.Internal, "clone conflict but no metadata returned: %v", err)
 				}
+			} else if agentAPI.IsNotFound(err) {
+				agentOpsTotal.WithLabelValues("create_clone", "not_found", sc).Inc()
+				return nil, status.Errorf(codes.NotFound, "create clone: %v", err)
 			} else {
 				agentOpsTotal.WithLabelValues("create_clone", "error", sc).Inc()
 				return nil, status.Errorf(codes.Internal, "create clone: %v", err)
@@ -131,12 +152,12 @@ func (s *Server) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 		volCtx[config.ParamNFSSharePath] = cloneResp.Path
 
-		log.Info().Str("volume", req.Name).Str("snapshot", snapName).Msg("volume cloned from snapshot")
+		log.Info().Str("volume", req.Name).Str("snapshot", cloneReq.Snapshot).Str("source_volume", cloneReq.Volume).Uint64("size", cloneResp.SizeBytes).Msg("volume cloned")
 
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
 				VolumeId:      utils.MakeVolumeID(sc, req.Name),
-				CapacityBytes: int64(sizeBytes),
+				CapacityBytes: int64(cloneResp.SizeBytes),
 				VolumeContext: volCtx,
 				ContentSource: req.VolumeContentSource,
 			},
@@ -152,13 +173,15 @@ func (s *Server) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 	start := time.Now()
 	volResp, err := client.CreateVolume(ctx, agentAPI.VolumeCreateRequest{
-		Name:        req.Name,
-		SizeBytes:   sizeBytes,
-		NoCOW:       vp.NoCOW == "true",
-		Compression: vp.Compression,
-		UID:         uid,
-		GID:         gid,
-		Mode:        vp.Mode,
+		Name:             req.Name,
+		SizeBytes:        sizeBytes,
+		NoCOW:            vp.NoCOW == "true",
+		Compression:      vp.Compression,
+		UID:              uid,
+		GID:              gid,
+		Mode:             vp.Mode,
+		SnapshotSchedule: vp.SnapshotSchedule,
+		IncludeSnapshots: vp.IncludeSnapshots == "true",
 	})
 	agentDuration.WithLabelValues("create_volume", sc).Observe(time.Since(start).Seconds())
 	if err != nil {
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/erikmagkekse/btrfs-nfs-csi/agent"
+	"github.com/erikmagkekse/btrfs-nfs-csi/agent/storage"
 	"github.com/erikmagkekse/btrfs-nfs-csi/config"
 	"github.com/erikmagkekse/btrfs-nfs-csi/controller"
 	"github.com/erikmagkekse/btrfs-nfs-csi/driver"
@@ -48,6 +52,8 @@ func main() {
 		runController()
 	case "driver":
 		runDriver()
+	case "hash-token":
+		runHashToken()
 	default:
 		usage()
 		os.Exit(1)
@@ -61,6 +67,7 @@ Commands:
   agent        Start the btrfs-nfs-csi agent
   controller   Start the CSI controller
   driver       Start the CSI node driver
+  hash-token   Read a token from stdin and print its hash for AGENT_TENANTS
 `, os.Args[0])
 }
 
@@ -89,6 +96,23 @@ func runAgent() {
 	log.Info().Msg("shutting down")
 }
 
+func runHashToken() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal().Err(err).Msg("failed to read token from stdin")
+	}
+	token := strings.TrimSpace(line)
+	if token == "" {
+		log.Fatal().Msg("no token on stdin")
+	}
+
+	hash, err := storage.HashToken(token)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to hash token")
+	}
+	fmt.Println(hash)
+}
+
 func runController() {
 	log.Info().Str("version", version).Str("commit", commit).Msg("starting btrfs-nfs-csi controller")
 
@@ -1,15 +1,21 @@
 package utils
 
-import "context"
+import (
+	"context"
+	"io"
+)
 
 // MockRunner records calls and returns preconfigured responses.
 // Use this in tests to avoid real shell execution.
 // Set RunFn for dynamic per-call responses, otherwise Out/Err are returned.
+// Stream calls are recorded in Calls as well; StreamFn overrides the default
+// behaviour of writing Out to stdout and returning Err.
 type MockRunner struct {
-	Calls [][]string
-	Out   string
-	Err   error
-	RunFn func(args []string) (string, error)
+	Calls    [][]string
+	Out      string
+	Err      error
+	RunFn    func(args []string) (string, error)
+	StreamFn func(args []string, stdin io.Reader, stdout io.Writer) error
 }
 
 func (m *MockRunner) Run(_ context.Context, _ string, args ...string) (string, error) {
@@ -19,3 +25,16 @@ func (m *MockRunner) Run(_ context.Context, _ string, args ...string) (string, e
 	}
 	return m.Out, m.Err
 }
+
+func (m *MockRunner) Stream(_ context.Context, stdin io.Reader, stdout io.Writer, _ string, args ...string) error {
+	m.Calls = append(m.Calls, args)
+	if m.StreamFn != nil {
+		return m.StreamFn(args, stdin, stdout)
+	}
+	if stdout != nil && m.Out != "" {
+		if _, err := io.WriteString(stdout, m.Out); err != nil {
+			return err
+		}
+	}
+	return m.Err
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 )
@@ -11,6 +13,9 @@ import (
 // For easy mock testing, this is abstracted behind an interface.
 type Runner interface {
 	Run(ctx context.Context, bin string, args ...string) (string, error)
+	// Stream runs a command with stdin/stdout wired to the given reader/writer.
+	// Either may be nil. stderr is captured and included in the returned error.
+	Stream(ctx context.Context, stdin io.Reader, stdout io.Writer, bin string, args ...string) error
 }
 
 // ShellRunner implements Runner using os/exec.
@@ -24,3 +29,15 @@ func (r *ShellRunner) Run(ctx context.Context, bin string, args ...string) (stri
 	}
 	return string(out), nil
 }
+
+func (r *ShellRunner) Stream(ctx context.Context, stdin io.Reader, stdout io.Writer, bin string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", bin, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
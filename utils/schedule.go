@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot schedule periods, in the order they are rendered.
+const (
+	ScheduleHourly  = "hourly"
+	ScheduleDaily   = "daily"
+	ScheduleWeekly  = "weekly"
+	ScheduleMonthly = "monthly"
+)
+
+var SchedulePeriods = []string{ScheduleHourly, ScheduleDaily, ScheduleWeekly, ScheduleMonthly}
+
+// SnapshotSchedule maps a period to the number of snapshots kept for it.
+type SnapshotSchedule map[string]int
+
+// ParseSnapshotSchedule parses "hourly=24,daily=7,weekly=4,monthly=12".
+// Periods may be omitted, an empty string is an empty schedule.
+func ParseSnapshotSchedule(s string) (SnapshotSchedule, error) {
+	sched := SnapshotSchedule{}
+	if strings.TrimSpace(s) == "" {
+		return sched, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		period, count, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry %q: expected period=count", entry)
+		}
+		period = strings.TrimSpace(period)
+		if _, ok := periodStarts[period]; !ok {
+			return nil, fmt.Errorf("invalid schedule period %q: must be one of %s", period, strings.Join(SchedulePeriods, ", "))
+		}
+		if _, dup := sched[period]; dup {
+			return nil, fmt.Errorf("duplicate schedule period %q", period)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid schedule count %q for %s: must be a non-negative integer", count, period)
+		}
+		sched[period] = n
+	}
+	return sched, nil
+}
+
+// String renders the schedule in canonical order, skipping zero counts.
+func (s SnapshotSchedule) String() string {
+	var parts []string
+	for _, p := range SchedulePeriods {
+		if n := s[p]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", p, n))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+var periodStarts = map[string]func(time.Time) time.Time{
+	ScheduleHourly: func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+	ScheduleDaily: func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	},
+	ScheduleWeekly: func(t time.Time) time.Time {
+		// weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+	},
+	ScheduleMonthly: func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	},
+}
+
+// IsSchedulePeriod reports whether p is one of SchedulePeriods.
+func IsSchedulePeriod(p string) bool {
+	_, ok := periodStarts[p]
+	return ok
+}
+
+// PeriodStart returns the start of the period containing t, in UTC.
+func PeriodStart(period string, t time.Time) time.Time {
+	return periodStarts[period](t.UTC())
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSnapshotSchedule(t *testing.T) {
+	sched, err := ParseSnapshotSchedule(" hourly=24, daily=7,weekly=4,monthly=0")
+	require.NoError(t, err)
+	assert.Equal(t, SnapshotSchedule{ScheduleHourly: 24, ScheduleDaily: 7, ScheduleWeekly: 4, ScheduleMonthly: 0}, sched)
+	assert.Equal(t, "hourly=24,daily=7,weekly=4", sched.String())
+
+	empty, err := ParseSnapshotSchedule("")
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+
+	invalid := []string{"hourly", "yearly=1", "hourly=-1", "hourly=abc", "daily=1,daily=2", "hourly=1,"}
+	for _, s := range invalid {
+		_, err := ParseSnapshotSchedule(s)
+		assert.Error(t, err, "ParseSnapshotSchedule(%q) should fail", s)
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	// Thursday
+	ts := time.Date(2026, 1, 15, 13, 45, 10, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2026, 1, 15, 13, 0, 0, 0, time.UTC), PeriodStart(ScheduleHourly, ts))
+	assert.Equal(t, time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), PeriodStart(ScheduleDaily, ts))
+	assert.Equal(t, time.Date(2026, 1, 12, 0, 0, 0, 0, time.UTC), PeriodStart(ScheduleWeekly, ts))
+	assert.Equal(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), PeriodStart(ScheduleMonthly, ts))
+
+	// Sunday belongs to the week starting the Monday before
+	sunday := time.Date(2026, 1, 18, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2026, 1, 12, 0, 0, 0, 0, time.UTC), PeriodStart(ScheduleWeekly, sunday))
+}